@@ -0,0 +1,525 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxDisplayNameLen is the maximum length of a peer's display name
+	MaxDisplayNameLen = 64
+	// MaxColorLen is the maximum length of a peer's color
+	MaxColorLen = 32
+	// DefaultGzipMinSize is the size of the smallest gzipped response
+	DefaultGzipMinSize = 1024
+	// DefaultMaxBodySize is the default maximum size of a request's body
+	DefaultMaxBodySize = 1 << 20
+	// DefaultListLimit is the size of a list page with no limit and
+	// MaxListLimit the largest one
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// getUserFromAuth returns the user whose token is in the request's
+// Authorization header
+func getUserFromAuth(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", fmt.Errorf("Missing a bearer token")
+	}
+	user, err := db.GetToken(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil || user == "" {
+		return "", fmt.Errorf("Failed to get token: err: %w", err)
+	}
+	return normalizeUser(user), nil
+}
+
+// serveList serves the /list/<token> endpoints of the token's user - a GET
+// returns the user's peers, filtered by the optional q, group & online query
+// parameters, and a POST to /list/<token>/validate validates a new peer.
+// With a cursor or a limit, the peers are listed a page at a time.
+func serveList(w http.ResponseWriter, r *http.Request) {
+	log := reqLogger(r)
+	// tokens issued before they were url safe can have a "/", so the token
+	// is all the path but the validate suffix
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/list/")
+	validate := strings.HasSuffix(path, "/validate")
+	user, err := getUserFromToken(strings.TrimSuffix(path, "/validate"))
+	if err != nil {
+		log.Warnf("Refusing an unauthorized list request: %s", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if validate {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		validatePeer(w, r, user)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var (
+		peers *PeerList
+		next  string
+	)
+	query := r.URL.Query()
+	_, hasCursor := query["cursor"]
+	_, hasLimit := query["limit"]
+	if hasCursor || hasLimit {
+		limit := DefaultListLimit
+		if v := query.Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+				http.Error(w, fmt.Sprintf("Bad limit parameter %q", v),
+					http.StatusBadRequest)
+				return
+			}
+			if limit > MaxListLimit {
+				limit = MaxListLimit
+			}
+		}
+		peers, next, err = FindUsersPeersPage(user, query.Get("q"),
+			query.Get("cursor"), limit)
+	} else {
+		peers, err = FindUsersPeers(user, query.Get("q"))
+	}
+	var badCursor *BadCursor
+	if errors.As(err, &badCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get user peers: %s", err)
+		log.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	list := peers.InGroup(r.URL.Query().Get("group"))
+	if v := r.URL.Query().Get("online"); v != "" {
+		online, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad online parameter %q", v),
+				http.StatusBadRequest)
+			return
+		}
+		connected, err := hub.ConnectedOf(list.FPs())
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get the connected peers: %s", err)
+			log.Error(msg)
+			http.Error(w, internalErrorText, http.StatusInternalServerError)
+			return
+		}
+		list = list.Connected(connected, online)
+	}
+	list.Sort()
+	items := list.Items()
+	if isAdmin(r) {
+		for i, p := range list {
+			items[i].LastIP = p.LastIP
+		}
+	}
+	res := map[string]interface{}{"peers": items}
+	if next != "" {
+		res["next_cursor"] = next
+	}
+	m, err := json.Marshal(res)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal peers: %s", err)
+		log.Errorf(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	writeCompressed(w, r, m)
+}
+
+// acceptsGzip returns true if the request's Accept-Encoding has gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(e, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		// gzip;q=0 means the client doesn't want it
+		for _, p := range parts[1:] {
+			q := strings.TrimPrefix(strings.TrimSpace(p), "q=")
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// writeCompressed writes a json body, gzipped if the client accepts it and
+// the body is at least GzipMinSize
+func writeCompressed(w http.ResponseWriter, r *http.Request, m []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Encoding")
+	min := conf().GzipMinSize
+	if min <= 0 || len(m) < min || !acceptsGzip(r) {
+		w.Write(m)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(m); err != nil {
+		Logger.Warnf("Failed to write a gzipped response: %s", err)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		Logger.Warnf("Failed to write a gzipped response: %s", err)
+	}
+}
+
+// Validation is the result of validating a new peer. Action is "create"
+// for a new peer, "update" for a peer the user has and empty when invalid.
+type Validation struct {
+	Valid  bool     `json:"valid"`
+	Action string   `json:"action,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+	// Fields are the errors of the invalid fields, by field
+	Fields ValidationErrors `json:"fields,omitempty"`
+}
+
+// validatePeer runs the checks of adding a peer, without adding it
+func validatePeer(w http.ResponseWriter, r *http.Request, user string) {
+	log := reqLogger(r)
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadJSON(w, err)
+		return
+	}
+	fp := req["fp"]
+	var v Validation
+	if err := ValidatePeer(fp, req["name"], req["kind"]); err != nil {
+		v.Errors = append(v.Errors, err.Error())
+		v.Fields = ValidationErrors{}
+		v.Fields.add("fp", err)
+	} else if !conf().kindAllowed(req["kind"]) {
+		err = &UnknownKind{req["kind"]}
+		v.Errors = append(v.Errors, err.Error())
+		v.Fields = ValidationErrors{"kind": err.Error()}
+	} else {
+		peer, err := GetPeer(fp)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get peer: %s", err)
+			log.Errorf(msg)
+			http.Error(w, internalErrorText, http.StatusInternalServerError)
+			return
+		}
+		switch peer.User {
+		case user:
+			if err = checkName(user, fp, req["name"]); err != nil {
+				v.Errors = append(v.Errors, err.Error())
+			} else {
+				v.Action = "update"
+			}
+		case "":
+			u, err := db.GetUser(user)
+			if err != nil {
+				msg := fmt.Sprintf("Failed to get user peers: %s", err)
+				log.Errorf(msg)
+				http.Error(w, internalErrorText, http.StatusInternalServerError)
+				return
+			}
+			if max := conf().MaxPeers; max > 0 && len(*u) >= max {
+				v.Errors = append(v.Errors, (&TooManyPeers{user}).Error())
+			} else if err = checkPending(user); err != nil {
+				v.Errors = append(v.Errors, err.Error())
+			} else if err = checkName(user, fp, req["name"]); err != nil {
+				v.Errors = append(v.Errors, err.Error())
+			} else {
+				v.Action = "create"
+			}
+		default:
+			v.Errors = append(v.Errors,
+				"Fingerprint is associated to another user")
+		}
+	}
+	v.Valid = len(v.Errors) == 0
+	m, err := json.Marshal(v)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal validation: %s", err)
+		log.Errorf(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
+
+// servePeer handles the /peer/<fingerprint> requests of the token's user
+func servePeer(w http.ResponseWriter, r *http.Request) {
+	user, err := getUserFromAuth(r)
+	if err != nil {
+		Logger.Warnf("Refusing an unauthorized peer request: %s", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/peer/")
+	status := strings.HasSuffix(path, "/status")
+	fp, err := url.PathUnescape(strings.TrimSuffix(path, "/status"))
+	if err != nil || fp == "" {
+		http.Error(w, "Bad fingerprint", http.StatusBadRequest)
+		return
+	}
+	owner, err := PeerOwner(fp)
+	if err != nil {
+		http.Error(w, "DB read failure", http.StatusInternalServerError)
+		return
+	}
+	// other users' peers are not found, so their owners aren't disclosed
+	if owner != user {
+		if owner != "" {
+			Logger.Warnf("Refusing %s a peer of another user: %q", user, fp)
+		}
+		http.Error(w, (&PeerNotFound{fp}).Error(), http.StatusNotFound)
+		return
+	}
+	peer, err := GetPeer(fp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get peer: %s", err)
+		Logger.Errorf(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	if status {
+		servePeerStatus(w, r, peer)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		peer.Online = hub.IsConnected(peer.FP)
+		writePeer(w, peer)
+	case "PATCH":
+		patchPeer(w, r, peer)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveResend emails the token's user another verification link for a
+// pending peer
+func serveResend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := getUserFromAuth(r)
+	if err != nil {
+		Logger.Warnf("Refusing an unauthorized resend request: %s", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadJSON(w, err)
+		return
+	}
+	fp := req["fp"]
+	peer, err := GetPeer(fp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get peer: %s", err)
+		Logger.Errorf(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	// other users' peers are as unknown as verified ones
+	if peer == nil || peer.User != user || peer.Verified || peer.DeletedOn != 0 {
+		http.Error(w, fmt.Sprintf("Peer %q is not pending verification", fp),
+			http.StatusNotFound)
+		return
+	}
+	err = sendAuthEmail(user, peer.Name)
+	var throttled *EmailThrottled
+	if errors.As(err, &throttled) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to send the email: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"msg": "Verification email sent"}`))
+}
+
+// ImportedPeer is a peer in a bulk import request
+type ImportedPeer struct {
+	FP   string `json:"fp"`
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+// serveImport handles a POST of the token's user peers, registering them as
+// verified peers of the user. The peers are added all at once, or none of
+// them when they'd take the user past max_peers.
+func serveImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := getUserFromAuth(r)
+	if err != nil {
+		Logger.Warnf("Refusing an unauthorized import request: %s", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req []ImportedPeer
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadJSON(w, err)
+		return
+	}
+	peers := make([]*Peer, len(req))
+	seen := make(map[string]bool, len(req))
+	for i, ip := range req {
+		if err = ValidatePeer(ip.FP, ip.Name, ip.Kind); err == nil &&
+			!conf().kindAllowed(ip.Kind) {
+			err = &UnknownKind{ip.Kind}
+		} else if err == nil && seen[ip.FP] {
+			err = fmt.Errorf("Fingerprint is repeated")
+		}
+		seen[ip.FP] = true
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad peer %q: %s", ip.FP, err),
+				http.StatusBadRequest)
+			return
+		}
+		owner, err := PeerOwner(ip.FP)
+		if err != nil {
+			http.Error(w, "DB read failure", http.StatusInternalServerError)
+			return
+		}
+		if owner != "" {
+			http.Error(w, fmt.Sprintf("Peer %q is already registered", ip.FP),
+				http.StatusConflict)
+			return
+		}
+		peers[i] = NewPeer(ip.FP, ip.Name, user, ip.Kind)
+		peers[i].Verified = true
+		peers[i].VerifiedOn = peers[i].CreatedOn
+	}
+	if err = db.AddPeers(user, peers); err != nil {
+		addPeerError(w, err)
+		return
+	}
+	Logger.Infof("Imported %d peers of %s", len(peers), user)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"imported": %d}`, len(peers))
+}
+
+// patchPeer updates the peer's cosmetic fields - display_name & color - and
+// publishes the update. The fields used to identify the peer can't be
+// patched.
+func patchPeer(w http.ResponseWriter, r *http.Request, peer *Peer) {
+	var req map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadJSON(w, err)
+		return
+	}
+	for k, v := range req {
+		s, isString := v.(string)
+		switch k {
+		case "display_name", "color", "group":
+			if !isString {
+				http.Error(w, fmt.Sprintf("Field %q must be a string", k),
+					http.StatusBadRequest)
+				return
+			}
+		}
+		switch k {
+		case "display_name":
+			if len(s) > MaxDisplayNameLen {
+				http.Error(w, "Display name is too long", http.StatusBadRequest)
+				return
+			}
+			peer.DisplayName = s
+		case "color":
+			if len(s) > MaxColorLen {
+				http.Error(w, "Color is too long", http.StatusBadRequest)
+				return
+			}
+			peer.Color = s
+		case "group":
+			if len(s) > MaxNameLen {
+				http.Error(w, "Group is too long", http.StatusBadRequest)
+				return
+			}
+			peer.Group = s
+		case "pinned":
+			pinned, ok := v.(bool)
+			if !ok {
+				http.Error(w, `Field "pinned" must be a boolean`,
+					http.StatusBadRequest)
+				return
+			}
+			peer.Pinned = pinned
+		default:
+			http.Error(w, fmt.Sprintf("Field %q can not be patched", k),
+				http.StatusBadRequest)
+			return
+		}
+	}
+	for k, v := range req {
+		if err := db.SetPeerField(peer.FP, k, v); err != nil {
+			msg := fmt.Sprintf("Failed to update peer: %s", err)
+			Logger.Errorf(msg)
+			http.Error(w, internalErrorText, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := SendPeerUpdate(peer.User, peer.FP, NewPeerUpdate(peer)); err != nil {
+		Logger.Errorf("Failed to publish peer update: %s", err)
+	}
+	writePeer(w, peer)
+}
+
+// servePeerStatus serves a GET of /peer/<fp>/status, whether the peer is
+// verified or pending verification. It's polled by onboarding UIs waiting
+// for the user to confirm the email, the peer needn't be connected.
+func servePeerStatus(w http.ResponseWriter, r *http.Request, peer *Peer) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m, err := json.Marshal(map[string]bool{"verified": peer.Verified,
+		"pending": peer.pending(time.Now())})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal the status: %s", err)
+		Logger.Errorf(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
+
+// writePeer writes the peer as json
+func writePeer(w http.ResponseWriter, peer *Peer) {
+	m, err := json.Marshal(peer)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal peer: %s", err)
+		Logger.Errorf(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
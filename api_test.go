@@ -0,0 +1,702 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+// apiRequest sends a REST request with the user's token
+func apiRequest(t *testing.T, method string, path string, token string,
+	body interface{}) *http.Response {
+	var b bytes.Buffer
+	if body != nil {
+		require.Nil(t, json.NewEncoder(&b).Encode(body))
+	}
+	req, err := http.NewRequest(method, "http://127.0.0.1:17777"+path, &b)
+	require.Nil(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	return resp
+}
+func TestPatchDisplayName(t *testing.T) {
+	startTest(t)
+	redisDouble.Set("token:avalidtoken", "j")
+	redisDouble.SetAdd("user:j", "A", "B")
+	redisDouble.SetAdd("user:h", "C")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	redisDouble.HSet("peer:B", "fp", "B", "name", "bar", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	redisDouble.HSet("peer:C", "fp", "C", "name", "baz", "kind", "lay",
+		"user", "h", "verified", "1", "online", "0")
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=A&name=foo&kind=lay&email=j")
+	require.Nil(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws, 200)
+	resp := apiRequest(t, "PATCH", "/peer/B", "avalidtoken",
+		map[string]string{"display_name": "My Laptop", "color": "#ff0000"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "My Laptop", redisDouble.HGet("peer:B", "display_name"))
+	require.Equal(t, "#ff0000", redisDouble.HGet("peer:B", "color"))
+	require.Equal(t, "1", redisDouble.HGet("peer:B", "verified"))
+	// A gets the new display name in a peer update
+	for {
+		var m map[string]json.RawMessage
+		err = ws.ReadJSON(&m)
+		require.Nil(t, err)
+		if string(m["source_fp"]) != `"B"` {
+			continue
+		}
+		var u PeerUpdate
+		require.Nil(t, json.Unmarshal(m["peer_update"], &u))
+		require.Equal(t, "My Laptop", u.DisplayName)
+		require.True(t, u.Verified)
+		break
+	}
+	// changing the display name doesn't change the peer's authentication
+	resp = apiRequest(t, "PATCH", "/peer/A", "avalidtoken",
+		map[string]string{"display_name": "Desktop"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	ws2, err := openWS("ws://127.0.0.1:17777/ws?fp=A&name=foo&kind=lay&email=j")
+	require.Nil(t, err)
+	defer ws2.Close()
+	ws2.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws2, 200)
+	// the identity fields can't be patched
+	resp = apiRequest(t, "PATCH", "/peer/A", "avalidtoken",
+		map[string]string{"name": "changed"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "foo", redisDouble.HGet("peer:A", "name"))
+	// foreign, unknown & unauthorized requests
+	resp = apiRequest(t, "PATCH", "/peer/C", "avalidtoken",
+		map[string]string{"display_name": "mine"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Empty(t, redisDouble.HGet("peer:C", "display_name"))
+	resp = apiRequest(t, "PATCH", "/peer/D", "avalidtoken",
+		map[string]string{"display_name": "mine"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = apiRequest(t, "PATCH", "/peer/A", "",
+		map[string]string{"display_name": "mine"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+func TestListFilter(t *testing.T) {
+	startTest(t)
+	redisDouble.Set("token:alisttoken", "j")
+	for i := 0; i < 300; i++ {
+		fp := fmt.Sprintf("FP%03d", i)
+		name := fmt.Sprintf("desk%03d", i)
+		if i%100 == 0 {
+			name = fmt.Sprintf("lap%03d", i)
+		}
+		redisDouble.SetAdd("user:j", fp)
+		redisDouble.HSet("peer:"+fp, "fp", fp, "name", name, "kind", "lay",
+			"user", "j", "verified", "1")
+	}
+	list := func(q string) []string {
+		resp, err := http.Get("http://127.0.0.1:17777/list/alisttoken?q=" +
+			url.QueryEscape(q))
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var l struct {
+			Peers []Peer `json:"peers"`
+		}
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+		names := []string{}
+		for _, p := range l.Peers {
+			require.Equal(t, "FP"+p.Name[len(p.Name)-3:], p.FP)
+			names = append(names, p.Name)
+		}
+		return names
+	}
+	require.ElementsMatch(t, []string{"lap000", "lap100", "lap200"}, list("lap"))
+	require.ElementsMatch(t, []string{"desk101", "desk102", "desk103"},
+		list("desk10[1-3]"))
+	require.Empty(t, list("tab"))
+	require.Empty(t, list("FP"))
+	require.Len(t, list(""), 300)
+	resp, err := http.Get("http://127.0.0.1:17777/list/badtoken")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+func TestGetPeerEndpoint(t *testing.T) {
+	startTest(t)
+	redisDouble.Set("token:avalidtoken", "j")
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", false)
+	seedPeer("C", "baz", "h", true)
+	// a stale online flag is ignored, the hub knows who's connected
+	redisDouble.HSet("peer:A", "online", "1")
+	getPeer := func(fp string) (int, Peer) {
+		var p Peer
+		resp := apiRequest(t, "GET", "/peer/"+fp, "avalidtoken", nil)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			require.Nil(t, json.NewDecoder(resp.Body).Decode(&p))
+		}
+		return resp.StatusCode, p
+	}
+	code, p := getPeer("A")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, Peer{FP: "A", Name: "foo", User: "j", Kind: "lay",
+		Verified: true}, p)
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=B")
+	require.Nil(t, err)
+	defer ws.Close()
+	require.Eventually(t, func() bool {
+		code, p = getPeer("B")
+		return code == http.StatusOK && p.Online
+	}, time.Second, 20*time.Millisecond)
+	require.False(t, p.Verified)
+	// another user's peer is as unknown, its owner isn't disclosed
+	resp := apiRequest(t, "GET", "/peer/C", "avalidtoken", nil)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NotContains(t, string(body), `"h"`)
+	code, _ = getPeer("D")
+	require.Equal(t, http.StatusNotFound, code)
+	resp = apiRequest(t, "GET", "/peer/A", "", nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+func TestPresenceExpiry(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.OnlineTTL = 30 })
+	redisDouble.Set("token:alisttoken", "j")
+	seedPeer("A", "foo", "j", true)
+	online := func() bool {
+		resp, err := http.Get("http://127.0.0.1:17777/list/alisttoken")
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		var l struct {
+			Peers []Peer `json:"peers"`
+		}
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+		require.Len(t, l.Peers, 1)
+		return l.Peers[0].Online
+	}
+	c := &Conn{User: "j", FP: "A", Verified: true}
+	require.Nil(t, c.SetOnline(db, true))
+	require.True(t, online())
+	// the server crashed, so no unregister, and the presence expired
+	redisDouble.FastForward(31 * time.Second)
+	require.False(t, online())
+}
+func TestValidatePeer(t *testing.T) {
+	startTest(t)
+	redisDouble.Set("token:alisttoken", "j")
+	redisDouble.SAdd("user:j", "A")
+	redisDouble.SAdd("user:h", "C")
+	seedPeer("A", "foo", "j", true)
+	seedPeer("C", "baz", "h", true)
+	before := redisDouble.Keys()
+	validate := func(req map[string]string) Validation {
+		resp := apiRequest(t, "POST", "/list/alisttoken/validate", "", req)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var v Validation
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&v))
+		return v
+	}
+	v := validate(map[string]string{"fp": "B", "name": "bar", "kind": "lay"})
+	require.Equal(t, Validation{Valid: true, Action: "create"}, v)
+	v = validate(map[string]string{"fp": "A", "name": "foo", "kind": "lay"})
+	require.Equal(t, Validation{Valid: true, Action: "update"}, v)
+	v = validate(map[string]string{"fp": "C", "name": "baz", "kind": "lay"})
+	require.False(t, v.Valid)
+	require.Len(t, v.Errors, 1)
+	v = validate(map[string]string{"fp": "bad fp", "name": "bar", "kind": "lay"})
+	require.False(t, v.Valid)
+	require.Contains(t, v.Errors[0], "Fingerprint")
+	v = validate(map[string]string{"fp": "bad fp",
+		"name": strings.Repeat("n", MaxNameLen+1), "kind": "lay"})
+	require.False(t, v.Valid)
+	require.Equal(t, []string{"fp", "name"}, sortedKeys(v.Fields))
+	require.Equal(t, before, redisDouble.Keys())
+	require.False(t, redisDouble.Exists("peer:B"))
+	resp := apiRequest(t, "GET", "/list/alisttoken/validate", "", nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	// tokens issued in the std encoding can have slashes, escaped or not
+	redisDouble.Set("token:a/slashed+token==", "j")
+	for _, token := range []string{"a/slashed+token==", "a%2Fslashed+token=="} {
+		resp = apiRequest(t, "POST", "/list/"+token+"/validate", "",
+			map[string]string{"fp": "B", "name": "bar", "kind": "lay"})
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, token)
+		resp = apiRequest(t, "GET", "/list/"+token, "", nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, token)
+	}
+}
+func TestListGzip(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.GzipMinSize = 512 })
+	redisDouble.Set("token:agziptoken", "j")
+	for i := 0; i < 20; i++ {
+		fp := fmt.Sprintf("desk%03d", i)
+		redisDouble.SetAdd("user:j", fp)
+		redisDouble.HSet("peer:"+fp, "fp", fp, "name", fp, "kind", "lay",
+			"user", "j", "verified", "1")
+	}
+	get := func(encoding string) *http.Response {
+		req, err := http.NewRequest("GET",
+			"http://127.0.0.1:17777/list/agziptoken", nil)
+		require.Nil(t, err)
+		req.Header.Set("Accept-Encoding", encoding)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp
+	}
+	var l struct {
+		Peers []Peer `json:"peers"`
+	}
+	resp := get("deflate, gzip")
+	defer resp.Body.Close()
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	gz, err := gzip.NewReader(resp.Body)
+	require.Nil(t, err)
+	require.Nil(t, json.NewDecoder(gz).Decode(&l))
+	require.Len(t, l.Peers, 20)
+	resp = get("gzip;q=0")
+	defer resp.Body.Close()
+	require.Empty(t, resp.Header.Get("Content-Encoding"))
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+	require.Len(t, l.Peers, 20)
+	// small lists aren't worth compressing
+	setConfig(t, func(c *Config) { c.GzipMinSize = 1 << 20 })
+	resp = get("gzip")
+	defer resp.Body.Close()
+	require.Empty(t, resp.Header.Get("Content-Encoding"))
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+	require.Len(t, l.Peers, 20)
+}
+func TestResendVerification(t *testing.T) {
+	startTest(t)
+	redisDouble.Set("token:avalidtoken", "j")
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", false)
+	seedPeer("C", "baz", "h", false)
+	resend := func(fp string, token string) int {
+		resp := apiRequest(t, "POST", "/resend", token,
+			map[string]string{"fp": fp})
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	tokens := len(redisDouble.Keys())
+	require.Equal(t, http.StatusUnauthorized, resend("B", "badtoken"))
+	// verified, foreign & unknown peers aren't pending
+	require.Equal(t, http.StatusNotFound, resend("A", "avalidtoken"))
+	require.Equal(t, http.StatusNotFound, resend("C", "avalidtoken"))
+	require.Equal(t, http.StatusNotFound, resend("Z", "avalidtoken"))
+	require.False(t, redisDouble.Exists("dontsend:j"))
+	require.Equal(t, http.StatusOK, resend("B", "avalidtoken"))
+	require.True(t, redisDouble.Exists("dontsend:j"))
+	// a new token was issued and indexed
+	require.True(t, redisDouble.Exists("tokens:j"))
+	require.Equal(t, tokens+3, len(redisDouble.Keys()))
+	require.Equal(t, http.StatusTooManyRequests, resend("B", "avalidtoken"))
+	require.Equal(t, tokens+3, len(redisDouble.Keys()))
+}
+func TestListGroup(t *testing.T) {
+	startTest(t)
+	redisDouble.Set("token:agrouptoken", "j")
+	for fp, group := range map[string]string{"A": "home", "B": "office",
+		"C": "home", "D": ""} {
+		redisDouble.SetAdd("user:j", fp)
+		redisDouble.HSet("peer:"+fp, "fp", fp, "name", fp, "kind", "lay",
+			"user", "j", "verified", "1", "group", group)
+	}
+	list := func(q string) []string {
+		resp, err := http.Get("http://127.0.0.1:17777/list/agrouptoken" + q)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var l struct {
+			Peers []Peer `json:"peers"`
+		}
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+		var fps []string
+		for _, p := range l.Peers {
+			fps = append(fps, p.FP)
+		}
+		return fps
+	}
+	require.ElementsMatch(t, []string{"A", "C"}, list("?group=home"))
+	require.ElementsMatch(t, []string{"B"}, list("?group=office"))
+	require.Empty(t, list("?group=garage"))
+	require.ElementsMatch(t, []string{"A", "B", "C", "D"}, list(""))
+	// groups are set by PATCHing the peer
+	resp := apiRequest(t, "PATCH", "/peer/D", "agrouptoken",
+		map[string]string{"group": "office"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "office", redisDouble.HGet("peer:D", "group"))
+	require.ElementsMatch(t, []string{"B", "D"}, list("?group=office"))
+}
+func TestListOnline(t *testing.T) {
+	startTest(t)
+	redisDouble.Set("token:anonlinetoken", "j")
+	for _, fp := range []string{"A", "B", "C"} {
+		redisDouble.SetAdd("user:j", fp)
+		redisDouble.HSet("peer:"+fp, "fp", fp, "name", fp, "kind", "lay",
+			"user", "j", "verified", "1")
+	}
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=A")
+	require.Nil(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws, 200)
+	list := func(q string) (int, []string) {
+		resp, err := http.Get("http://127.0.0.1:17777/list/anonlinetoken" + q)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, nil
+		}
+		var l struct {
+			Peers []Peer `json:"peers"`
+		}
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+		var fps []string
+		for _, p := range l.Peers {
+			fps = append(fps, p.FP)
+		}
+		return resp.StatusCode, fps
+	}
+	_, fps := list("?online=true")
+	require.Equal(t, []string{"A"}, fps)
+	_, fps = list("?online=false")
+	require.ElementsMatch(t, []string{"B", "C"}, fps)
+	_, fps = list("")
+	require.ElementsMatch(t, []string{"A", "B", "C"}, fps)
+	code, _ := list("?online=maybe")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+func TestListSchema(t *testing.T) {
+	startTest(t)
+	redisDouble.Set("token:aschematoken", "j")
+	redisDouble.SetAdd("user:j", "A")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "created_on", "100",
+		"verified_on", "200", "last_connect", "300", "group", "home",
+		"capabilities", "file-transfer", "deleted_on", "0")
+	resp, err := http.Get("http://127.0.0.1:17777/list/aschematoken")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var l struct {
+		Peers []map[string]interface{} `json:"peers"`
+	}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+	require.Equal(t, []map[string]interface{}{{"fp": "A", "name": "foo",
+		"user": "j", "kind": "lay", "verified": true, "online": false,
+		"created_on": float64(100), "verified_on": float64(200),
+		"last_connect": float64(300), "group": "home",
+		"capabilities": []interface{}{"file-transfer"}}}, l.Peers)
+}
+func TestPinnedFirst(t *testing.T) {
+	startTest(t)
+	redisDouble.Set("token:apintoken", "j")
+	for fp, lastConnect := range map[string]string{"A": "100", "B": "300",
+		"C": "200", "D": "400"} {
+		redisDouble.SetAdd("user:j", fp)
+		redisDouble.HSet("peer:"+fp, "fp", fp, "name", fp, "kind", "lay",
+			"user", "j", "verified", "1", "last_connect", lastConnect)
+	}
+	list := func() []string {
+		resp, err := http.Get("http://127.0.0.1:17777/list/apintoken")
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var l struct {
+			Peers []Peer `json:"peers"`
+		}
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+		var fps []string
+		for _, p := range l.Peers {
+			fps = append(fps, p.FP)
+		}
+		return fps
+	}
+	require.Equal(t, []string{"D", "B", "C", "A"}, list())
+	pin := func(fp string, pinned interface{}) int {
+		resp := apiRequest(t, "PATCH", "/peer/"+fp, "apintoken",
+			map[string]interface{}{"pinned": pinned})
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, pin("A", true))
+	require.Equal(t, http.StatusOK, pin("C", true))
+	require.Equal(t, "1", redisDouble.HGet("peer:A", "pinned"))
+	require.Equal(t, []string{"C", "A", "D", "B"}, list())
+	require.Equal(t, http.StatusOK, pin("C", false))
+	require.Equal(t, []string{"A", "D", "B", "C"}, list())
+	// pinned is a boolean
+	require.Equal(t, http.StatusBadRequest, pin("B", "yes"))
+	resp := apiRequest(t, "PATCH", "/peer/B", "apintoken",
+		map[string]interface{}{"display_name": 1})
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+func TestRevokeTokens(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.AdminToken = "anadmintoken" })
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		token, err := db.CreateToken("j")
+		require.Nil(t, err)
+		tokens = append(tokens, token)
+	}
+	other, err := db.CreateToken("h")
+	require.Nil(t, err)
+	list := func(token string) int {
+		resp := apiRequest(t, "GET", "/list/"+url.PathEscape(token), "", nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, token := range tokens {
+		require.Equal(t, http.StatusOK, list(token))
+	}
+	// only admins can revoke
+	resp := apiRequest(t, "POST", "/admin/users/j/revoke-tokens", "", nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = apiRequest(t, "POST", "/admin/users/J/revoke-tokens",
+		"anadmintoken", nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var r struct {
+		User    string `json:"user"`
+		Revoked int    `json:"revoked"`
+	}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&r))
+	require.Equal(t, "j", r.User)
+	require.Equal(t, 3, r.Revoked)
+	for _, token := range tokens {
+		require.Equal(t, http.StatusUnauthorized, list(token))
+	}
+	require.Equal(t, http.StatusOK, list(other))
+}
+// sortedKeys returns the fields of validation errors, sorted
+func sortedKeys(errs ValidationErrors) []string {
+	var keys []string
+	for k := range errs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+func TestVerifyValidationErrors(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.EmailUsers = true })
+	long := strings.Repeat("x", MaxNameLen+1)
+	resp := apiRequest(t, "POST", "/verify", "", map[string]string{
+		"fp": "bad fp", "email": "not an email", "name": long, "kind": long})
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var r struct {
+		Errors ValidationErrors `json:"errors"`
+	}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&r))
+	require.Equal(t, []string{"email", "fp", "kind", "name"}, sortedKeys(r.Errors))
+	require.Contains(t, r.Errors["fp"], "Fingerprint")
+	require.Contains(t, r.Errors["name"], "Name is longer")
+	require.False(t, redisDouble.Exists("peer:bad fp"))
+}
+func TestListPagination(t *testing.T) {
+	startTest(t)
+	redisDouble.Set("token:apagetoken", "j")
+	const n = 250
+	for i := 0; i < n; i++ {
+		seedPeer(fmt.Sprintf("P%03d", i), fmt.Sprintf("peer%d", i), "j", true)
+	}
+	page := func(q string) (int, []PeerListItem, string) {
+		resp, err := http.Get("http://127.0.0.1:17777/list/apagetoken?" + q)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		var l struct {
+			Peers      []PeerListItem `json:"peers"`
+			NextCursor string         `json:"next_cursor"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+		}
+		return resp.StatusCode, l.Peers, l.NextCursor
+	}
+	seen := map[string]bool{}
+	cursor := ""
+	pages := 0
+	for {
+		code, peers, next := page("limit=40&cursor=" + url.QueryEscape(cursor))
+		require.Equal(t, http.StatusOK, code)
+		require.LessOrEqual(t, len(peers), 40)
+		for _, p := range peers {
+			require.False(t, seen[p.FP], "%s listed twice", p.FP)
+			seen[p.FP] = true
+		}
+		pages++
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	require.Len(t, seen, n)
+	require.Equal(t, 7, pages)
+	// the limit is bounded
+	code, peers, next := page("limit=100000")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, peers, n)
+	require.Empty(t, next)
+	code, _, _ = page("limit=0")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _, _ = page("cursor=nonsense")
+	require.Equal(t, http.StatusBadRequest, code)
+	// a search of the names is paged too
+	code, peers, next = page("q=peer24&limit=6")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, peers, 6)
+	code, more, next := page("q=peer24&limit=6&cursor=" + url.QueryEscape(next))
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, more, 5)
+	require.Empty(t, next)
+	for _, p := range append(peers, more...) {
+		require.True(t, strings.HasPrefix(p.Name, "peer24"), p.Name)
+	}
+}
+func TestPeerKinds(t *testing.T) {
+	startTest(t)
+	swapEmails(t, 1, 10, func(m *gomail.Message) error { return nil })
+	redisDouble.Set("token:alisttoken", "j")
+	verify := func(fp string, kind string) int {
+		resp := apiRequest(t, "POST", "/verify", "", map[string]string{
+			"fp": fp, "email": "j", "name": fp, "kind": kind})
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// any kind is allowed when there are no kinds
+	require.Equal(t, http.StatusOK, verify("A", "terminl"))
+	require.Equal(t, "terminl", redisDouble.HGet("peer:A", "kind"))
+	setConfig(t, func(c *Config) { c.Kinds = []string{"terminal", "webexec"} })
+	require.Equal(t, http.StatusOK, verify("B", "terminal"))
+	require.Equal(t, "terminal", redisDouble.HGet("peer:B", "kind"))
+	require.Equal(t, http.StatusBadRequest, verify("C", "terminl"))
+	require.False(t, redisDouble.Exists("peer:C"))
+	// known peers can't change to an unknown kind
+	require.Equal(t, http.StatusBadRequest, verify("B", "terminl"))
+	require.Equal(t, "terminal", redisDouble.HGet("peer:B", "kind"))
+	resp := apiRequest(t, "POST", "/list/alisttoken/validate", "",
+		map[string]string{"fp": "C", "name": "C", "kind": "terminl"})
+	defer resp.Body.Close()
+	var v Validation
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&v))
+	require.False(t, v.Valid)
+	require.Equal(t, `Unknown kind "terminl"`, v.Fields["kind"])
+}
+func TestBodyTooLarge(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.MaxBodySize = 1024 })
+	redisDouble.Set("token:avalidtoken", "j")
+	redisDouble.SetAdd("user:j", "A")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	big := map[string]string{"fp": "B", "email": "j", "kind": "lay",
+		"name": strings.Repeat("a", 64*1024)}
+	resp := apiRequest(t, "POST", "/verify", "", big)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	require.False(t, redisDouble.Exists("peer:B"))
+	resp = apiRequest(t, "PATCH", "/peer/A", "avalidtoken",
+		map[string]string{"display_name": strings.Repeat("a", 64*1024)})
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	// a body under the limit is still decoded
+	resp = apiRequest(t, "PATCH", "/peer/A", "avalidtoken",
+		map[string]string{"display_name": "Foo"})
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	// decoding stops at the limit, not at the end of an endless body
+	body := &limitedBody{ReadCloser: io.NopCloser(io.MultiReader(
+		strings.NewReader(`{"name": "`), endless{})), limit: 1024, left: 1024}
+	var req map[string]string
+	err := json.NewDecoder(body).Decode(&req)
+	var tooLarge *BodyTooLarge
+	require.True(t, errors.As(err, &tooLarge), "got %v", err)
+}
+
+// endless is a reader of an endless stream of a's
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
+func TestPeerStatus(t *testing.T) {
+	startTest(t)
+	redisDouble.Set("token:avalidtoken", "j")
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", false)
+	redisDouble.HSet("peer:B", "created_on",
+		strconv.FormatInt(time.Now().Unix(), 10))
+	// its verification token expired
+	seedPeer("C", "baz", "j", false)
+	redisDouble.HSet("peer:C", "created_on",
+		strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	seedPeer("D", "qux", "h", true)
+	status := func(fp string) (int, map[string]bool) {
+		resp := apiRequest(t, "GET", "/peer/"+fp+"/status", "avalidtoken", nil)
+		defer resp.Body.Close()
+		var s map[string]bool
+		if resp.StatusCode == http.StatusOK {
+			require.Nil(t, json.NewDecoder(resp.Body).Decode(&s))
+		}
+		return resp.StatusCode, s
+	}
+	for fp, expected := range map[string]map[string]bool{
+		"A": {"verified": true, "pending": false},
+		"B": {"verified": false, "pending": true},
+		"C": {"verified": false, "pending": false},
+	} {
+		code, s := status(fp)
+		require.Equal(t, http.StatusOK, code, fp)
+		require.Equal(t, expected, s, fp)
+	}
+	code, _ := status("Z")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = status("D")
+	require.Equal(t, http.StatusNotFound, code)
+	resp := apiRequest(t, "GET", "/peer/A/status", "", nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
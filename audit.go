@@ -0,0 +1,114 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultAuditSize is the number of audit events kept for the admins
+const DefaultAuditSize = 1000
+
+// The types of the audit events
+const (
+	AuditConnect = "connect"
+	AuditReject  = "reject"
+	AuditRoute   = "route"
+	AuditKick    = "kick"
+)
+
+// auditLog keeps the latest audit events, it's started by main and nil when
+// audit_size is 0
+var auditLog *AuditLog
+
+// AuditEvent is an event kept in the audit buffer. FP is the peer that
+// acted, Target the one it acted on.
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	FP     string    `json:"fp,omitempty"`
+	User   string    `json:"user,omitempty"`
+	Target string    `json:"target,omitempty"`
+	ConnID string    `json:"conn_id,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// AuditLog is a fixed size ring buffer of the latest audit events, once
+// it's full the oldest are overwritten
+type AuditLog struct {
+	sync.Mutex
+	events []AuditEvent
+	// next is the index of the next event and full is set once it wrapped
+	next int
+	full bool
+}
+
+// NewAuditLog returns a buffer of the last size events
+func NewAuditLog(size int) *AuditLog {
+	return &AuditLog{events: make([]AuditEvent, size)}
+}
+
+// Add adds an event, overwriting the oldest when the buffer is full
+func (l *AuditLog) Add(e AuditEvent) {
+	l.Lock()
+	defer l.Unlock()
+	l.events[l.next] = e
+	l.next++
+	if l.next == len(l.events) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// Events returns a copy of the buffered events, the oldest first
+func (l *AuditLog) Events() []AuditEvent {
+	l.Lock()
+	defer l.Unlock()
+	if !l.full {
+		return append([]AuditEvent{}, l.events[:l.next]...)
+	}
+	ret := make([]AuditEvent, 0, len(l.events))
+	ret = append(ret, l.events[l.next:]...)
+	return append(ret, l.events[:l.next]...)
+}
+
+// audit adds an event to the audit buffer, if there's one, stamped with the
+// current time
+func audit(e AuditEvent) {
+	if auditLog == nil {
+		return
+	}
+	e.Time = time.Now()
+	auditLog.Add(e)
+}
+
+// serveAudit returns the buffered audit events, the oldest first
+func serveAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	events := []AuditEvent{}
+	if auditLog != nil {
+		events = auditLog.Events()
+	}
+	m, err := json.Marshal(map[string]interface{}{
+		"instance": hub.instance,
+		"events":   events,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal the audit events: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	l := NewAuditLog(3)
+	require.Empty(t, l.Events())
+	l.Add(AuditEvent{Type: AuditConnect, FP: "A"})
+	l.Add(AuditEvent{Type: AuditConnect, FP: "B"})
+	require.Equal(t, []AuditEvent{{Type: AuditConnect, FP: "A"},
+		{Type: AuditConnect, FP: "B"}}, l.Events())
+	for i := 0; i < 5; i++ {
+		l.Add(AuditEvent{Type: AuditReject, FP: fmt.Sprint(i)})
+	}
+	// the oldest are evicted
+	require.Equal(t, []AuditEvent{{Type: AuditReject, FP: "2"},
+		{Type: AuditReject, FP: "3"}, {Type: AuditReject, FP: "4"}}, l.Events())
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.Add(AuditEvent{Type: AuditRoute})
+				l.Events()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Len(t, l.Events(), 3)
+}
+func TestAdminAudit(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = "anadmintoken"
+		c.AuditRouting = true
+	})
+	orig := auditLog
+	auditLog = NewAuditLog(3)
+	t.Cleanup(func() { auditLog = orig })
+	s := newTestServer(t)
+	for _, fp := range []string{"A", "B", "C", "D"} {
+		seedPeer(fp, "foo"+fp, "j", true)
+	}
+	wsA := connectPeer(t, s, "A")
+	connectPeer(t, s, "B")
+	connectPeer(t, s, "C")
+	connectPeer(t, s, "D")
+	u := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?name=Z"
+	_, _, err := cstDialer.Dial(u, nil)
+	require.NotNil(t, err)
+	require.Nil(t, wsA.WriteJSON(map[string]string{"offer": "an offer",
+		"target": "B"}))
+	events := func() []AuditEvent {
+		resp := apiRequest(t, "GET", "/admin/audit", "anadmintoken", nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var res struct {
+			Events []AuditEvent `json:"events"`
+		}
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+		return res.Events
+	}
+	require.Eventually(t, func() bool {
+		l := events()
+		return len(l) == 3 && l[2].Type == AuditRoute
+	}, time.Second, 10*time.Millisecond)
+	l := events()
+	require.Equal(t, AuditConnect, l[0].Type)
+	require.Equal(t, "D", l[0].FP)
+	require.Equal(t, "j", l[0].User)
+	require.Equal(t, AuditReject, l[1].Type)
+	require.Contains(t, l[1].Detail, "fp")
+	require.Equal(t, "A", l[2].FP)
+	require.Equal(t, "B", l[2].Target)
+	require.Equal(t, "offer delivered", l[2].Detail)
+	require.False(t, l[0].Time.After(l[1].Time))
+	require.False(t, l[1].Time.After(l[2].Time))
+	resp := apiRequest(t, "GET", "/admin/audit", "", nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
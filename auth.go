@@ -0,0 +1,215 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultJWTUserClaim is the claim holding the user of a JWT
+const DefaultJWTUserClaim = "email"
+
+// Identity is the user an authenticator established for a request
+type Identity struct {
+	User string
+	// Verified is set when the identity provider vouches for the user, so
+	// its peers need no email verification
+	Verified bool
+}
+
+// Authenticator establishes the user of a request verifying or connecting a
+// peer. claimed is the user the request claims, empty if none.
+type Authenticator interface {
+	Authenticate(r *http.Request, claimed string) (*Identity, error)
+}
+
+// AuthFailed is an error returned when a request's credentials are missing
+// or invalid
+type AuthFailed struct {
+	reason string
+}
+
+func (e *AuthFailed) Error() string {
+	return fmt.Sprintf("Authentication failed: %s", e.reason)
+}
+
+// EmailAuthenticator is the built-in authenticator, it takes the claimed
+// user on its word and verifies its peers by email
+type EmailAuthenticator struct{}
+
+// Authenticate returns the claimed user, unverified
+func (EmailAuthenticator) Authenticate(r *http.Request, claimed string) (*Identity, error) {
+	user := normalizeUser(claimed)
+	if user == "" {
+		return nil, &MissingParam{"email"}
+	}
+	return &Identity{User: user}, nil
+}
+
+// JWTAuthenticator authenticates requests with a bearer JWT issued by an
+// external identity provider and signed by one of its RS256 keys
+type JWTAuthenticator struct {
+	// keys are the provider's public keys by key ID
+	keys   map[string]*rsa.PublicKey
+	issuer string
+	// claim is the claim holding the user
+	claim string
+}
+
+// NewJWTAuthenticator returns an authenticator of the tokens issued by the
+// issuer and signed by a key of the JWKS file. The user is read from the
+// claim.
+func NewJWTAuthenticator(jwksPath string, issuer string, claim string) (*JWTAuthenticator, error) {
+	b, err := os.ReadFile(jwksPath)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return nil, err
+	}
+	if claim == "" {
+		claim = DefaultJWTUserClaim
+	}
+	return &JWTAuthenticator{keys, issuer, claim}, nil
+}
+
+// parseJWKS returns the RSA keys of a JWKS document by key ID
+func parseJWKS(b []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("Bad JWKS: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("Bad modulus of key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("Bad exponent of key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no RSA keys")
+	}
+	return keys, nil
+}
+
+// Authenticate returns the user of the request's valid token. A token of
+// another user than the claimed one is refused.
+func (a *JWTAuthenticator) Authenticate(r *http.Request, claimed string) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		// browsers can't set the headers of websocket requests
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return nil, &AuthFailed{"missing token"}
+	}
+	user, err := a.validate(token, time.Now())
+	if err != nil {
+		return nil, &AuthFailed{err.Error()}
+	}
+	if claimed != "" && normalizeUser(claimed) != user {
+		return nil, &AuthFailed{fmt.Sprintf("token is of another user than %q",
+			claimed)}
+	}
+	return &Identity{User: user, Verified: true}, nil
+}
+
+// validate checks the token's signature, issuer & validity period and
+// returns its user
+func (a *JWTAuthenticator) validate(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", fmt.Errorf("bad header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return "", fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	key, found := a.keys[header.Kid]
+	if !found {
+		return "", fmt.Errorf("unknown key %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("bad signature encoding: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return "", fmt.Errorf("bad signature")
+	}
+	var claims map[string]interface{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("bad claims: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != a.issuer {
+		return "", fmt.Errorf("unexpected issuer %q", iss)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", fmt.Errorf("token has no expiry")
+	}
+	if now.Unix() >= int64(exp) {
+		return "", fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Unix() < int64(nbf) {
+		return "", fmt.Errorf("token is not valid yet")
+	}
+	user, _ := claims[a.claim].(string)
+	if user = normalizeUser(user); user == "" {
+		return "", fmt.Errorf("token has no %q claim", a.claim)
+	}
+	return user, nil
+}
+
+// decodeSegment decodes a base64url encoded json segment of a token
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// bearerToken returns the request's bearer token, empty if it has none
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+const testIssuer = "https://idp.example.com"
+
+// newTestJWKS writes a JWKS file with the key's public part
+func newTestJWKS(t *testing.T, key *rsa.PrivateKey) string {
+	enc := base64.RawURLEncoding
+	b, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA", "kid": "k1", "alg": "RS256",
+		"n": enc.EncodeToString(key.N.Bytes()),
+		"e": enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	require.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.Nil(t, os.WriteFile(path, b, 0600))
+	return path
+}
+
+// signTestJWT returns an RS256 token with the claims, signed by the key
+func signTestJWT(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	enc := base64.RawURLEncoding
+	h, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1",
+		"typ": "JWT"})
+	require.Nil(t, err)
+	c, err := json.Marshal(claims)
+	require.Nil(t, err)
+	signed := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.Nil(t, err)
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	a, err := NewJWTAuthenticator(newTestJWKS(t, key), testIssuer, "")
+	require.Nil(t, err)
+	exp := time.Now().Add(time.Hour).Unix()
+	authenticate := func(token string, claimed string) (*Identity, error) {
+		r, err := http.NewRequest("POST", "/verify", nil)
+		require.Nil(t, err)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return a.Authenticate(r, claimed)
+	}
+	valid := signTestJWT(t, key, map[string]interface{}{"iss": testIssuer,
+		"email": "J@example.com", "exp": exp})
+	id, err := authenticate(valid, "")
+	require.Nil(t, err)
+	require.Equal(t, &Identity{User: "j@example.com", Verified: true}, id)
+	_, err = authenticate(valid, "j@example.com")
+	require.Nil(t, err)
+	for name, tc := range map[string]struct {
+		token   string
+		claimed string
+	}{
+		"missing": {"", ""},
+		"expired": {signTestJWT(t, key, map[string]interface{}{
+			"iss": testIssuer, "email": "j@example.com",
+			"exp": time.Now().Add(-time.Minute).Unix()}), ""},
+		"wrong issuer": {signTestJWT(t, key, map[string]interface{}{
+			"iss": "https://evil.example.com", "email": "j@example.com",
+			"exp": exp}), ""},
+		"wrong key": {signTestJWT(t, other, map[string]interface{}{
+			"iss": testIssuer, "email": "j@example.com", "exp": exp}), ""},
+		"no expiry": {signTestJWT(t, key, map[string]interface{}{
+			"iss": testIssuer, "email": "j@example.com"}), ""},
+		"no user": {signTestJWT(t, key, map[string]interface{}{
+			"iss": testIssuer, "exp": exp}), ""},
+		"another user": {valid, "h@example.com"},
+	} {
+		_, err := authenticate(tc.token, tc.claimed)
+		var failed *AuthFailed
+		require.True(t, errors.As(err, &failed), "%s: got %v", name, err)
+	}
+}
+func TestVerifyWithJWT(t *testing.T) {
+	startTest(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	a, err := NewJWTAuthenticator(newTestJWKS(t, key), testIssuer, "")
+	require.Nil(t, err)
+	setConfig(t, func(c *Config) { c.auth = a })
+	token := signTestJWT(t, key, map[string]interface{}{"iss": testIssuer,
+		"email": "j", "exp": time.Now().Add(time.Hour).Unix()})
+	verify := func(token string) int {
+		// the user comes from the token, not the request
+		m, err := json.Marshal(map[string]string{"fp": "A", "email": "h",
+			"name": "foo", "kind": "lay"})
+		require.Nil(t, err)
+		req, err := http.NewRequest("POST", "http://127.0.0.1:17777/verify",
+			bytes.NewBuffer(m))
+		require.Nil(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusUnauthorized, verify(""))
+	require.False(t, redisDouble.Exists("peer:A"))
+	require.Equal(t, http.StatusUnauthorized, verify(token))
+	token = signTestJWT(t, key, map[string]interface{}{"iss": testIssuer,
+		"email": "h", "exp": time.Now().Add(time.Hour).Unix()})
+	require.Equal(t, http.StatusOK, verify(token))
+	// the identity provider vouched for the user, there's no email
+	require.Equal(t, "1", redisDouble.HGet("peer:A", "verified"))
+	require.Equal(t, "h", redisDouble.HGet("peer:A", "user"))
+	// connecting requires the user's token, capabilities are kept only
+	// once it's authenticated
+	_, resp, err := websocket.DefaultDialer.Dial(
+		"ws://127.0.0.1:17777/ws?fp=A&caps=file-transfer", nil)
+	require.NotNil(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, "", redisDouble.HGet("peer:A", "capabilities"))
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=A&caps=file-transfer&token=" +
+		token)
+	require.Nil(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws, http.StatusOK)
+	require.Equal(t, "file-transfer", redisDouble.HGet("peer:A", "capabilities"))
+}
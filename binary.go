@@ -0,0 +1,72 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+)
+
+// BinarySubprotocol is the websocket subprotocol peers negotiate to send &
+// receive binary frames. A binary frame starts with a byte holding the
+// length of a fingerprint followed by the fingerprint & the payload. Peers
+// send frames with the target's fingerprint and receive them with the
+// source's.
+const BinarySubprotocol = "peerbook.binary"
+
+// binaryMarker prefixes binary frames on the pubsub channels & the send
+// queue, it can't start a json message
+const binaryMarker byte = 0
+
+// parseBinaryFrame returns the fingerprint & payload of a binary frame
+func parseBinaryFrame(frame []byte) (string, []byte, error) {
+	if len(frame) == 0 {
+		return "", nil, fmt.Errorf("Empty binary frame")
+	}
+	n := int(frame[0])
+	if n == 0 || len(frame) < n+1 {
+		return "", nil, fmt.Errorf("Bad fingerprint length %d", n)
+	}
+	return string(frame[1 : n+1]), frame[n+1:], nil
+}
+
+// newBinaryFrame returns a frame with the fingerprint & payload, prefixed by
+// the binary marker
+func newBinaryFrame(fp string, payload []byte) ([]byte, error) {
+	if len(fp) == 0 || len(fp) > 255 {
+		return nil, fmt.Errorf("Bad fingerprint length %d", len(fp))
+	}
+	f := make([]byte, 0, len(fp)+len(payload)+2)
+	f = append(f, binaryMarker, byte(len(fp)))
+	f = append(f, fp...)
+	return append(f, payload...), nil
+}
+
+// handleBinary routes a binary frame to its target, replacing the target's
+// fingerprint with the source's
+func (c *Conn) handleBinary(frame []byte) {
+	c.touch()
+	tfp, payload, err := parseBinaryFrame(frame)
+	if err != nil {
+		c.logger().Warnf("Ignoring a bad binary frame from %q: %s", c.FP, err)
+		c.auditRoute("", "binary", RouteDropped)
+		return
+	}
+	target := c.routeTarget(tfp, "binary")
+	if target == nil {
+		return
+	}
+	m, err := newBinaryFrame(c.FP, payload)
+	if err != nil {
+		c.logger().Errorf("Failed to frame a binary message: %s", err)
+		c.auditRoute(tfp, "binary", RouteDropped)
+		return
+	}
+	// the marker isn't sent
+	if !c.checkOutbound(tfp, "binary", len(m)-1) {
+		return
+	}
+	c.logger().Infof("Forwarding binary from %q to %q", c.FP, tfp)
+	c.relay(target, "binary", m)
+}
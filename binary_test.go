@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// connectBinaryPeer opens a websocket in binary mode and reads the status &
+// peer list sent on connect
+func connectBinaryPeer(t *testing.T, s *httptest.Server, fp string) *websocket.Conn {
+	d := cstDialer
+	d.Subprotocols = []string{BinarySubprotocol}
+	ws, _, err := d.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws?fp="+fp, nil)
+	require.Nil(t, err)
+	t.Cleanup(func() { ws.Close() })
+	require.Equal(t, BinarySubprotocol, ws.Subprotocol())
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws, 200)
+	readUntil(t, ws, "peers")
+	return ws
+}
+
+func TestParseBinaryFrame(t *testing.T) {
+	fp, payload, err := parseBinaryFrame([]byte("\x02ABpayload"))
+	require.Nil(t, err)
+	require.Equal(t, "AB", fp)
+	require.Equal(t, []byte("payload"), payload)
+	_, _, err = parseBinaryFrame([]byte("\x05AB"))
+	require.NotNil(t, err)
+	_, _, err = parseBinaryFrame([]byte{})
+	require.NotNil(t, err)
+	f, err := newBinaryFrame("AB", []byte("payload"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("\x00\x02ABpayload"), f)
+}
+func TestBinaryRelay(t *testing.T) {
+	startTest(t)
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	seedPeer("C", "baz", "j", true)
+	wsA := connectBinaryPeer(t, s, "A")
+	wsB := connectBinaryPeer(t, s, "B")
+	payload := []byte{0xca, 0xfe, 0x00, 0x7b}
+	require.Nil(t, wsA.WriteMessage(websocket.BinaryMessage,
+		append([]byte("\x01B"), payload...)))
+	for {
+		mt, m, err := wsB.ReadMessage()
+		require.Nil(t, err)
+		if mt == websocket.BinaryMessage {
+			require.Equal(t, append([]byte("\x01A"), payload...), m)
+			break
+		}
+	}
+	// json mode is the default and binary frames don't break it
+	wsC := connectPeer(t, s, "C")
+	require.Equal(t, "", wsC.Subprotocol())
+	require.Nil(t, wsC.WriteMessage(websocket.BinaryMessage,
+		append([]byte("\x01B"), payload...)))
+	require.Nil(t, wsC.WriteJSON(map[string]string{"offer": "an offer", "target": "B"}))
+	for {
+		mt, m, err := wsB.ReadMessage()
+		require.Nil(t, err)
+		require.Equal(t, websocket.TextMessage, mt, "got a binary message: %v", m)
+		if strings.Contains(string(m), "an offer") {
+			break
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DefaultPeerCacheTTL is the seconds a verified peer is kept in the cache
+const DefaultPeerCacheTTL = 300
+
+// cachedPeer is a peer in the cache and when it expires
+type cachedPeer struct {
+	peer    Peer
+	expires time.Time
+}
+
+// PeerCache is a bounded LRU cache of the verified peers that connected, so
+// they can connect while the store is briefly down
+type PeerCache struct {
+	sync.Mutex
+	size int
+	ttl  time.Duration
+	// order holds the cached peers, the most recently used first
+	order *list.List
+	peers map[string]*list.Element
+	now   func() time.Time
+}
+
+// NewPeerCache returns a cache of up to size peers, each kept for ttl
+func NewPeerCache(size int, ttl time.Duration) *PeerCache {
+	return &PeerCache{size: size, ttl: ttl, order: list.New(),
+		peers: make(map[string]*list.Element), now: time.Now}
+}
+
+// Put caches a copy of the peer, evicting the least recently used one when
+// the cache is full
+func (c *PeerCache) Put(p *Peer) {
+	c.Lock()
+	defer c.Unlock()
+	entry := &cachedPeer{*p, c.now().Add(c.ttl)}
+	if e, found := c.peers[p.FP]; found {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.peers[p.FP] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.peers, last.Value.(*cachedPeer).peer.FP)
+	}
+}
+
+// Get returns a copy of the cached peer, nil if it's not cached or expired
+func (c *PeerCache) Get(fp string) *Peer {
+	c.Lock()
+	defer c.Unlock()
+	e, found := c.peers[fp]
+	if !found {
+		return nil
+	}
+	entry := e.Value.(*cachedPeer)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(e)
+		delete(c.peers, fp)
+		return nil
+	}
+	c.order.MoveToFront(e)
+	p := entry.peer
+	return &p
+}
+
+// Remove drops the peer from the cache, e.g. when it's revoked
+func (c *PeerCache) Remove(fp string) {
+	c.Lock()
+	defer c.Unlock()
+	if e, found := c.peers[fp]; found {
+		c.order.Remove(e)
+		delete(c.peers, fp)
+	}
+}
+
+// uncachePeer drops a peer from the configured cache, if there's one
+func uncachePeer(fp string) {
+	if cache := conf().peerCache; cache != nil {
+		cache.Remove(fp)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerCache(t *testing.T) {
+	now := time.Now()
+	c := NewPeerCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+	c.Put(&Peer{FP: "A", User: "j", Verified: true})
+	c.Put(&Peer{FP: "B", User: "j", Verified: true})
+	require.Equal(t, "j", c.Get("A").User)
+	// B is the least recently used
+	c.Put(&Peer{FP: "C", User: "j", Verified: true})
+	require.Nil(t, c.Get("B"))
+	require.NotNil(t, c.Get("A"))
+	require.NotNil(t, c.Get("C"))
+	// the cached peers are copies
+	c.Get("A").User = "h"
+	require.Equal(t, "j", c.Get("A").User)
+	c.Remove("A")
+	require.Nil(t, c.Get("A"))
+	now = now.Add(time.Minute)
+	require.Nil(t, c.Get("C"))
+}
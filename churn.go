@@ -0,0 +1,132 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// ChurnWindow is the period a user's reconnects are counted in, once
+	// it passes the counters restart
+	ChurnWindow = time.Hour
+	// MaxChurnUsers is the number of users whose reconnects are tracked
+	MaxChurnUsers = 10000
+)
+
+// UserChurn is a user's reconnects and average session, in seconds, in the
+// current window
+type UserChurn struct {
+	User       string  `json:"user"`
+	Reconnects int     `json:"reconnects"`
+	AvgSession float64 `json:"avg_session"`
+}
+
+// userChurn holds a user's sessions in the window starting at since
+type userChurn struct {
+	since       time.Time
+	reconnects  int
+	sessions    int
+	sessionTime time.Duration
+	// seen holds the fingerprints connected in the window
+	seen map[string]bool
+}
+
+// churnTracker counts the users' reconnects & session times. It's only
+// accessed from the hub's run goroutine.
+type churnTracker struct {
+	users map[string]*userChurn
+	now   func() time.Time
+}
+
+func newChurnTracker() *churnTracker {
+	return &churnTracker{users: make(map[string]*userChurn), now: time.Now}
+}
+
+// get returns the user's counters in the current window, or nil when too
+// many users are tracked
+func (t *churnTracker) get(user string) *userChurn {
+	now := t.now()
+	u, found := t.users[user]
+	if found && now.Sub(u.since) < ChurnWindow {
+		return u
+	}
+	if !found && len(t.users) >= MaxChurnUsers {
+		t.prune()
+		if len(t.users) >= MaxChurnUsers {
+			return nil
+		}
+	}
+	u = &userChurn{since: now, seen: make(map[string]bool)}
+	t.users[user] = u
+	return u
+}
+
+// prune removes the users whose window has passed
+func (t *churnTracker) prune() {
+	now := t.now()
+	for user, u := range t.users {
+		if now.Sub(u.since) >= ChurnWindow {
+			delete(t.users, user)
+		}
+	}
+}
+
+// connected records a connection, a peer connected before in the window is
+// a reconnect
+func (t *churnTracker) connected(c *Conn) {
+	c.connectedAt = t.now()
+	if c.Pair != "" {
+		return
+	}
+	u := t.get(c.User)
+	if u == nil {
+		return
+	}
+	if u.seen[c.FP] {
+		u.reconnects++
+	}
+	u.seen[c.FP] = true
+}
+
+// disconnected records the end of a connection's session
+func (t *churnTracker) disconnected(c *Conn) {
+	if c.Pair != "" {
+		return
+	}
+	u := t.get(c.User)
+	if u == nil || c.connectedAt.IsZero() {
+		return
+	}
+	u.sessions++
+	u.sessionTime += t.now().Sub(c.connectedAt)
+}
+
+// top returns the users with the most reconnects
+func (t *churnTracker) top(n int) []UserChurn {
+	t.prune()
+	churn := make([]UserChurn, 0, len(t.users))
+	for user, u := range t.users {
+		if u.reconnects == 0 {
+			continue
+		}
+		var avg float64
+		if u.sessions > 0 {
+			avg = u.sessionTime.Seconds() / float64(u.sessions)
+		}
+		churn = append(churn, UserChurn{user, u.reconnects, avg})
+	}
+	sort.Slice(churn, func(i, j int) bool {
+		if churn[i].Reconnects == churn[j].Reconnects {
+			return churn[i].User < churn[j].User
+		}
+		return churn[i].Reconnects > churn[j].Reconnects
+	})
+	if len(churn) > n {
+		churn = churn[:n]
+	}
+	return churn
+}
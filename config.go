@@ -0,0 +1,837 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/rs/cors"
+	"go.uber.org/zap"
+)
+
+// config holds the current *Config, use conf() to read it
+var config atomic.Value
+
+// Config is peerbook's reloadable configuration. It's read from the json
+// file at PB_CONF, if set, and the environment variables override the file.
+// Values captured by a connection when it's established are kept until it's
+// closed.
+type Config struct {
+	// WSRate is the number of websocket connections per second an IP can
+	// open, zero means no limit
+	WSRate  float64 `json:"ws_rate"`
+	WSBurst int     `json:"ws_burst"`
+	// ReconnectMax is the number of times a fingerprint can connect in
+	// ReconnectWindow seconds, zero means no limit. A fingerprint exceeding it
+	// is refused for ReconnectCooldown seconds.
+	ReconnectMax      int `json:"reconnect_max"`
+	ReconnectWindow   int `json:"reconnect_window"`
+	ReconnectCooldown int `json:"reconnect_cooldown"`
+	// TrustProxy is set to trust any immediate peer as a proxy whose
+	// X-Forwarded-For holds the client's IP
+	TrustProxy bool `json:"trust_proxy"`
+	// TrustedProxies are the CIDRs of the proxies whose X-Forwarded-For &
+	// X-Real-IP headers are trusted
+	TrustedProxies []string `json:"trusted_proxies"`
+	// AllowedOrigins of the REST endpoints, empty means all
+	AllowedOrigins []string `json:"allowed_origins"`
+	AdminToken     string   `json:"admin_token"`
+	// DeleteGrace is the number of seconds deleted peers can be restored
+	DeleteGrace int `json:"delete_grace"`
+	// RenameGrace is the number of seconds a renamed peer verifying with its
+	// previous name keeps the new one, without a re-verification
+	RenameGrace int `json:"rename_grace"`
+	// TrimFields is set to trim padded string fields of inbound messages
+	TrimFields bool `json:"trim_fields"`
+	// AuditRouting is set to log every routed message at the debug level
+	AuditRouting bool `json:"audit_routing"`
+	// AuditSize is the number of audit events kept in memory for the
+	// admins, 0 for none. It's read when the server starts.
+	AuditSize int `json:"audit_size"`
+	// OutboundHistory is the number of messages to a peer whose metadata
+	// is kept with the connection for the admins, 0 for none
+	OutboundHistory int `json:"outbound_history"`
+	// MsgRate is the number of messages per second a peer can send, zero
+	// means no limit. Once exceeded, messages are dropped or, if
+	// MsgThrottleClose is set, the connection is closed.
+	MsgRate          float64 `json:"msg_rate"`
+	MsgBurst         int     `json:"msg_burst"`
+	MsgThrottleClose bool    `json:"msg_throttle_close"`
+	// MaxPeers is the number of peers a user can register, zero means no
+	// limit
+	MaxPeers int `json:"max_peers"`
+	// EmailUsers is set to refuse users that aren't email addresses
+	EmailUsers bool `json:"email_users"`
+	// UniqueNames is set to refuse a peer named as another of its user's
+	// peers
+	UniqueNames bool `json:"unique_names"`
+	// MaxPending is the number of peers a user can have pending
+	// verification, zero means no limit
+	MaxPending int `json:"max_pending"`
+	// MaxInbound is the maximum size of a message from a peer, a peer
+	// sending a bigger one is disconnected
+	MaxInbound int `json:"max_inbound"`
+	// MaxOutbound is the maximum size of a message relayed to a peer, zero
+	// means no limit
+	MaxOutbound int `json:"max_outbound"`
+	// OnlineTTL is the number of seconds a connected peer is kept online in
+	// the store between pings, zero means three ping periods
+	OnlineTTL int `json:"online_ttl"`
+	// OfflineQueue is the number of messages queued for an offline peer
+	// and forwarded when it connects, zero means no queuing. Queued
+	// messages are dropped after OfflineTTL seconds.
+	OfflineQueue int `json:"offline_queue"`
+	OfflineTTL   int `json:"offline_ttl"`
+	// Banner is a notice sent to peers when they connect, empty for none
+	Banner string `json:"banner"`
+	// ServerHeader is the value of the Server header of all responses,
+	// empty for no header
+	ServerHeader string `json:"server_header"`
+	// Maintenance refuses all but the admins' & liveness probe's requests,
+	// asking to retry after MaintenanceRetry seconds
+	Maintenance      bool `json:"maintenance"`
+	MaintenanceRetry int  `json:"maintenance_retry"`
+	// UnverifiedRetry is the seconds unverified peers are asked to wait
+	// before reconnecting, in their 401 status' retry_after. Zero means no
+	// hint.
+	UnverifiedRetry int `json:"unverified_retry"`
+	// Envelopes is set for peers to send & get enveloped messages, instead
+	// of the legacy ones
+	Envelopes bool `json:"envelopes"`
+	// Ephemeral is set to accept ephemeral peers, connecting with a pairing
+	// code and no records
+	Ephemeral bool `json:"ephemeral"`
+	// The HTTP server's timeouts in seconds, zero means no timeout. They're
+	// read when the server starts. Websockets clear the read & write
+	// timeouts once upgraded and use their own keepalive.
+	ReadHeaderTimeout int `json:"read_header_timeout"`
+	ReadTimeout       int `json:"read_timeout"`
+	WriteTimeout      int `json:"write_timeout"`
+	IdleTimeout       int `json:"idle_timeout"`
+	// SocketMode is the octal permissions of the unix socket the server
+	// listens on when its address is unix:<path>, read when it starts
+	SocketMode string `json:"socket_mode"`
+	// SlowRedisOp is the milliseconds a redis operation takes to be logged
+	// as slow, zero means no logging
+	SlowRedisOp int `json:"slow_redis_op"`
+	// RedisReplica is the address of a redis replica serving the reads of
+	// tokens, user lists & peers, read when the server starts. Empty
+	// means all reads are from the primary.
+	RedisReplica string `json:"redis_replica"`
+	// ReadPrimaryAfterWrite is the milliseconds after a write in which
+	// reads are from the primary, so they aren't behind the replica's lag
+	ReadPrimaryAfterWrite int `json:"read_primary_after_write"`
+	// HighRTT is the milliseconds a ping's round trip takes to be logged as
+	// high, zero means no logging
+	HighRTT int `json:"high_rtt"`
+	// WriteWait is the milliseconds a write to a peer can take before the
+	// connection's considered dead
+	WriteWait int `json:"write_wait"`
+	// PresenceWindow is the milliseconds in which the presence updates a
+	// peer gets are coalesced into one presence-batch message, zero means
+	// no coalescing
+	PresenceWindow int `json:"presence_window"`
+	// LogSample logs 1 in LogSample of the identical routine connection
+	// logs each second, zero or one logs them all. Refusals & errors are
+	// always logged.
+	LogSample int `json:"log_sample"`
+	// PeerCacheSize is the number of verified peers cached in memory, so
+	// they can connect while the store is briefly down. Zero means no
+	// cache. PeerCacheTTL is the seconds a peer is cached.
+	PeerCacheSize int `json:"peer_cache_size"`
+	PeerCacheTTL  int `json:"peer_cache_ttl"`
+	// IdleEvict is the seconds a peer can go without sending or getting
+	// application messages before it's disconnected, zero means never
+	IdleEvict int `json:"idle_evict"`
+	// MaxHops is the number of times a message bounced between peers is
+	// relayed before it's dropped as a routing loop, zero means no limit
+	MaxHops int `json:"max_hops"`
+	// MaxBodySize is the maximum size in bytes of a request's body, bigger
+	// ones get a 413. Zero means no limit.
+	MaxBodySize int `json:"max_body_size"`
+	// GzipMinSize is the size of the smallest REST response that's gzipped
+	// for clients accepting it, zero means no compression
+	GzipMinSize int `json:"gzip_min_size"`
+	// StaticRoot is the directory of the html templates, the home page's
+	// built-in one is served when it's missing there
+	StaticRoot string `json:"static_root"`
+	// AllowedUsersFile & DeniedUsersFile are the paths of files listing a
+	// user per line. When there's an allow list, only its users can verify &
+	// connect peers. Users on the deny list never can.
+	AllowedUsersFile string `json:"allowed_users_file"`
+	DeniedUsersFile  string `json:"denied_users_file"`
+	// JWKSFile is the path of an identity provider's JWKS. When set, users
+	// are authenticated by a bearer JWT issued by JWTIssuer, with the user
+	// in the JWTUserClaim claim, instead of by email.
+	JWKSFile     string `json:"jwks_file"`
+	JWTIssuer    string `json:"jwt_issuer"`
+	JWTUserClaim string `json:"jwt_user_claim"`
+	// DefaultName & DefaultKind are given to new peers verifying without a
+	// name or a kind. When empty, both are required.
+	DefaultName string `json:"default_name"`
+	DefaultKind string `json:"default_kind"`
+	// IdentityFields are the peer's fields, beside the user, whose change
+	// by a verify request requires verifying the peer again - "name" and
+	// or "kind". Other changes are updated in place.
+	IdentityFields []string `json:"identity_fields"`
+	// Kinds are the kinds peers can have, empty for any kind
+	Kinds []string `json:"kinds"`
+	// MinClientVersion is the oldest client version that can connect, read
+	// from the v query parameter. Clients with no version are refused when
+	// RequireClientVersion is set.
+	MinClientVersion     string `json:"min_client_version"`
+	RequireClientVersion bool   `json:"require_client_version"`
+	// EmailConcurrency is the number of emails sent at once and EmailQueue
+	// the number waiting to be sent, more are dropped. They're read when the
+	// server starts.
+	EmailConcurrency int `json:"email_concurrency"`
+	EmailQueue       int `json:"email_queue"`
+	// WebhookURL receives the peers' lifecycle events, signed with
+	// WebhookSecret when it's set. Empty disables the webhook.
+	// WebhookConcurrency is the number of events posted at once and
+	// WebhookQueue the number waiting, more are dropped. They're read when
+	// the server starts.
+	WebhookURL         string `json:"webhook_url"`
+	WebhookSecret      string `json:"webhook_secret"`
+	WebhookConcurrency int    `json:"webhook_concurrency"`
+	WebhookQueue       int    `json:"webhook_queue"`
+	// the paths of the auth email's html & text templates, empty for the
+	// built-in ones
+	EmailHTMLTemplate string `json:"email_html_template"`
+	EmailTextTemplate string `json:"email_text_template"`
+
+	limiter   *IPLimiter
+	flaps     *FlapGuard
+	cors      *cors.Cors
+	emailHTML *htmltemplate.Template
+	emailText *template.Template
+	// allowedUsers is nil when there's no allow list
+	allowedUsers map[string]bool
+	deniedUsers  map[string]bool
+	auth         Authenticator
+	// trustedProxies are the parsed TrustedProxies
+	trustedProxies []*net.IPNet
+	// connLog is the sampled logger of routine connection logs, nil
+	// before the logger's initialized
+	connLog *zap.SugaredLogger
+	// peerCache is nil when there's no cache
+	peerCache *PeerCache
+}
+
+// defaultConfig returns the configuration used when nothing's set
+func defaultConfig() Config {
+	return Config{WSBurst: DefaultWSBurst, MsgBurst: DefaultMsgBurst,
+		ReconnectWindow:   DefaultReconnectWindow,
+		ReconnectCooldown: DefaultReconnectCooldown,
+		MaxPeers:          MaxPeersPerUser, MaxInbound: maxMessageSize,
+		MaxOutbound: 2 * maxMessageSize, OfflineTTL: DefaultOfflineTTL,
+		ServerHeader: DefaultServerHeader, ReadHeaderTimeout: 10,
+		SocketMode:  DefaultSocketMode,
+		ReadTimeout: 30, WriteTimeout: 30, IdleTimeout: 120,
+		MaxBodySize: DefaultMaxBodySize, MaxHops: DefaultMaxHops,
+		GzipMinSize: DefaultGzipMinSize, SlowRedisOp: DefaultSlowRedisOp,
+		HighRTT: DefaultHighRTT, MaintenanceRetry: DefaultMaintenanceRetry,
+		UnverifiedRetry: DefaultUnverifiedRetry, PeerCacheTTL: DefaultPeerCacheTTL,
+		EmailConcurrency: DefaultEmailConcurrency, EmailQueue: DefaultEmailQueue,
+		WebhookConcurrency: DefaultWebhookConcurrency, WebhookQueue: DefaultWebhookQueue,
+		AuditSize: DefaultAuditSize, WriteWait: DefaultWriteWait,
+		ReadPrimaryAfterWrite: DefaultReadPrimaryAfterWrite}
+}
+
+func init() {
+	c := defaultConfig()
+	c.init()
+	config.Store(&c)
+}
+
+// conf returns the current configuration
+func conf() *Config {
+	return config.Load().(*Config)
+}
+
+// LoadConfig reads the configuration file, if any, and the environment
+func LoadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open config file: %w", err)
+		}
+		defer f.Close()
+		if err = json.NewDecoder(f).Decode(&c); err != nil {
+			return nil, fmt.Errorf("Failed to parse config file %q: %w", path, err)
+		}
+	}
+	if err := c.fromEnv(); err != nil {
+		return nil, err
+	}
+	if err := c.loadEmailTemplates(); err != nil {
+		return nil, err
+	}
+	if err := c.loadUserLists(); err != nil {
+		return nil, err
+	}
+	if err := c.loadAuthenticator(); err != nil {
+		return nil, err
+	}
+	for _, f := range c.IdentityFields {
+		if f != "user" && f != "name" && f != "kind" {
+			return nil, fmt.Errorf("Bad identity_fields: unknown field %q", f)
+		}
+	}
+	if c.MinClientVersion != "" {
+		if _, err := parseVersion(c.MinClientVersion); err != nil {
+			return nil, fmt.Errorf("Bad min_client_version: %w", err)
+		}
+	}
+	if c.DefaultKind != "" && !c.kindAllowed(c.DefaultKind) {
+		return nil, fmt.Errorf("default_kind %q is not one of the kinds",
+			c.DefaultKind)
+	}
+	var err error
+	if c.trustedProxies, err = parseCIDRs(c.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("Bad trusted_proxies: %w", err)
+	}
+	c.init()
+	return &c, nil
+}
+
+// fromEnv overrides the configuration with the environment variables
+func (c *Config) fromEnv() error {
+	var err error
+	if s := os.Getenv("PB_WS_RATE"); s != "" {
+		if c.WSRate, err = strconv.ParseFloat(s, 64); err != nil {
+			return fmt.Errorf("Bad PB_WS_RATE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_WS_BURST"); s != "" {
+		if c.WSBurst, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_WS_BURST %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_RECONNECT_MAX"); s != "" {
+		if c.ReconnectMax, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_RECONNECT_MAX %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_RECONNECT_WINDOW"); s != "" {
+		if c.ReconnectWindow, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_RECONNECT_WINDOW %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_RECONNECT_COOLDOWN"); s != "" {
+		if c.ReconnectCooldown, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_RECONNECT_COOLDOWN %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_TRUST_PROXY"); s != "" {
+		if c.TrustProxy, err = strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("Bad PB_TRUST_PROXY %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_TRUSTED_PROXIES"); s != "" {
+		c.TrustedProxies = strings.Split(s, ",")
+	}
+	if s := os.Getenv("PB_ALLOWED_ORIGINS"); s != "" {
+		c.AllowedOrigins = strings.Split(s, ",")
+	}
+	if s := os.Getenv("PB_STATIC_ROOT"); s != "" {
+		c.StaticRoot = s
+	}
+	if s := os.Getenv("PB_ALLOWED_USERS_FILE"); s != "" {
+		c.AllowedUsersFile = s
+	}
+	if s := os.Getenv("PB_DENIED_USERS_FILE"); s != "" {
+		c.DeniedUsersFile = s
+	}
+	if s := os.Getenv("PB_JWKS_FILE"); s != "" {
+		c.JWKSFile = s
+	}
+	if s := os.Getenv("PB_JWT_ISSUER"); s != "" {
+		c.JWTIssuer = s
+	}
+	if s := os.Getenv("PB_JWT_USER_CLAIM"); s != "" {
+		c.JWTUserClaim = s
+	}
+	if s := os.Getenv("PB_DEFAULT_NAME"); s != "" {
+		c.DefaultName = s
+	}
+	if s := os.Getenv("PB_DEFAULT_KIND"); s != "" {
+		c.DefaultKind = s
+	}
+	if s := os.Getenv("PB_IDENTITY_FIELDS"); s != "" {
+		c.IdentityFields = strings.Split(s, ",")
+	}
+	if s := os.Getenv("PB_KINDS"); s != "" {
+		c.Kinds = strings.Split(s, ",")
+	}
+	if s := os.Getenv("PB_MIN_CLIENT_VERSION"); s != "" {
+		c.MinClientVersion = s
+	}
+	if s := os.Getenv("PB_REQUIRE_CLIENT_VERSION"); s != "" {
+		if c.RequireClientVersion, err = strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("Bad PB_REQUIRE_CLIENT_VERSION %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_ADMIN_TOKEN"); s != "" {
+		c.AdminToken = s
+	}
+	if s := os.Getenv("PB_DELETE_GRACE"); s != "" {
+		if c.DeleteGrace, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_DELETE_GRACE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_RENAME_GRACE"); s != "" {
+		if c.RenameGrace, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_RENAME_GRACE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_TRIM_FIELDS"); s != "" {
+		if c.TrimFields, err = strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("Bad PB_TRIM_FIELDS %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_AUDIT_ROUTING"); s != "" {
+		if c.AuditRouting, err = strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("Bad PB_AUDIT_ROUTING %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_AUDIT_SIZE"); s != "" {
+		if c.AuditSize, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_AUDIT_SIZE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_OUTBOUND_HISTORY"); s != "" {
+		if c.OutboundHistory, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_OUTBOUND_HISTORY %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_MSG_RATE"); s != "" {
+		if c.MsgRate, err = strconv.ParseFloat(s, 64); err != nil {
+			return fmt.Errorf("Bad PB_MSG_RATE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_MSG_BURST"); s != "" {
+		if c.MsgBurst, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_MSG_BURST %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_MSG_THROTTLE_CLOSE"); s != "" {
+		if c.MsgThrottleClose, err = strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("Bad PB_MSG_THROTTLE_CLOSE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_MAX_PEERS"); s != "" {
+		if c.MaxPeers, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_MAX_PEERS %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_EMAIL_USERS"); s != "" {
+		if c.EmailUsers, err = strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("Bad PB_EMAIL_USERS %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_UNIQUE_NAMES"); s != "" {
+		if c.UniqueNames, err = strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("Bad PB_UNIQUE_NAMES %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_MAX_PENDING"); s != "" {
+		if c.MaxPending, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_MAX_PENDING %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_ONLINE_TTL"); s != "" {
+		if c.OnlineTTL, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_ONLINE_TTL %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_OFFLINE_QUEUE"); s != "" {
+		if c.OfflineQueue, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_OFFLINE_QUEUE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_OFFLINE_TTL"); s != "" {
+		if c.OfflineTTL, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_OFFLINE_TTL %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_ENVELOPES"); s != "" {
+		if c.Envelopes, err = strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("Bad PB_ENVELOPES %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_EPHEMERAL"); s != "" {
+		if c.Ephemeral, err = strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("Bad PB_EPHEMERAL %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_READ_HEADER_TIMEOUT"); s != "" {
+		if c.ReadHeaderTimeout, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_READ_HEADER_TIMEOUT %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_READ_TIMEOUT"); s != "" {
+		if c.ReadTimeout, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_READ_TIMEOUT %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_WRITE_TIMEOUT"); s != "" {
+		if c.WriteTimeout, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_WRITE_TIMEOUT %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_IDLE_TIMEOUT"); s != "" {
+		if c.IdleTimeout, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_IDLE_TIMEOUT %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_SOCKET_MODE"); s != "" {
+		c.SocketMode = s
+	}
+	if s := os.Getenv("PB_SLOW_REDIS_OP"); s != "" {
+		if c.SlowRedisOp, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_SLOW_REDIS_OP %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_REDIS_REPLICA"); s != "" {
+		c.RedisReplica = s
+	}
+	if s := os.Getenv("PB_READ_PRIMARY_AFTER_WRITE"); s != "" {
+		if c.ReadPrimaryAfterWrite, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_READ_PRIMARY_AFTER_WRITE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_HIGH_RTT"); s != "" {
+		if c.HighRTT, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_HIGH_RTT %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_WRITE_WAIT"); s != "" {
+		if c.WriteWait, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_WRITE_WAIT %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_PRESENCE_WINDOW"); s != "" {
+		if c.PresenceWindow, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_PRESENCE_WINDOW %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_LOG_SAMPLE"); s != "" {
+		if c.LogSample, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_LOG_SAMPLE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_PEER_CACHE_SIZE"); s != "" {
+		if c.PeerCacheSize, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_PEER_CACHE_SIZE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_PEER_CACHE_TTL"); s != "" {
+		if c.PeerCacheTTL, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_PEER_CACHE_TTL %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_IDLE_EVICT"); s != "" {
+		if c.IdleEvict, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_IDLE_EVICT %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_MAX_HOPS"); s != "" {
+		if c.MaxHops, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_MAX_HOPS %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_MAX_BODY_SIZE"); s != "" {
+		if c.MaxBodySize, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_MAX_BODY_SIZE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_GZIP_MIN_SIZE"); s != "" {
+		if c.GzipMinSize, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_GZIP_MIN_SIZE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_EMAIL_CONCURRENCY"); s != "" {
+		if c.EmailConcurrency, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_EMAIL_CONCURRENCY %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_EMAIL_QUEUE"); s != "" {
+		if c.EmailQueue, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_EMAIL_QUEUE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_WEBHOOK_URL"); s != "" {
+		c.WebhookURL = s
+	}
+	if s := os.Getenv("PB_WEBHOOK_SECRET"); s != "" {
+		c.WebhookSecret = s
+	}
+	if s := os.Getenv("PB_WEBHOOK_CONCURRENCY"); s != "" {
+		if c.WebhookConcurrency, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_WEBHOOK_CONCURRENCY %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_WEBHOOK_QUEUE"); s != "" {
+		if c.WebhookQueue, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_WEBHOOK_QUEUE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_EMAIL_HTML_TEMPLATE"); s != "" {
+		c.EmailHTMLTemplate = s
+	}
+	if s := os.Getenv("PB_EMAIL_TEXT_TEMPLATE"); s != "" {
+		c.EmailTextTemplate = s
+	}
+	if s := os.Getenv("PB_BANNER"); s != "" {
+		c.Banner = s
+	}
+	if s := os.Getenv("PB_MAINTENANCE"); s != "" {
+		if c.Maintenance, err = strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("Bad PB_MAINTENANCE %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_MAINTENANCE_RETRY"); s != "" {
+		if c.MaintenanceRetry, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_MAINTENANCE_RETRY %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_UNVERIFIED_RETRY"); s != "" {
+		if c.UnverifiedRetry, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_UNVERIFIED_RETRY %q: %w", s, err)
+		}
+	}
+	if s, found := os.LookupEnv("PB_SERVER_HEADER"); found {
+		c.ServerHeader = s
+	}
+	if s := os.Getenv("PB_MAX_INBOUND"); s != "" {
+		if c.MaxInbound, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_MAX_INBOUND %q: %w", s, err)
+		}
+	}
+	if s := os.Getenv("PB_MAX_OUTBOUND"); s != "" {
+		if c.MaxOutbound, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("Bad PB_MAX_OUTBOUND %q: %w", s, err)
+		}
+	}
+	return nil
+}
+
+// init creates the helpers derived from the configuration
+func (c *Config) init() {
+	c.limiter = NewIPLimiter(c.WSRate, c.WSBurst)
+	c.flaps = NewFlapGuard(c.ReconnectMax,
+		time.Duration(c.ReconnectWindow)*time.Second,
+		time.Duration(c.ReconnectCooldown)*time.Second)
+	c.cors = newCORS(c.AllowedOrigins)
+	if c.auth == nil {
+		c.auth = EmailAuthenticator{}
+	}
+	if Logger != nil {
+		c.connLog = sampledLogger(Logger, c.LogSample)
+	}
+	if c.PeerCacheSize > 0 {
+		c.peerCache = NewPeerCache(c.PeerCacheSize,
+			time.Duration(c.PeerCacheTTL)*time.Second)
+	}
+}
+
+// keepState carries the previous configuration's rate limiter, flap guard &
+// peer cache over, so a reload doesn't reset the throttling nor empty the
+// cache. Each is rebuilt only when its settings changed.
+func (c *Config) keepState(prev *Config) {
+	if c.WSRate == prev.WSRate && c.WSBurst == prev.WSBurst {
+		c.limiter = prev.limiter
+	}
+	if c.ReconnectMax == prev.ReconnectMax &&
+		c.ReconnectWindow == prev.ReconnectWindow &&
+		c.ReconnectCooldown == prev.ReconnectCooldown {
+		c.flaps = prev.flaps
+	}
+	if c.PeerCacheSize == prev.PeerCacheSize && c.PeerCacheTTL == prev.PeerCacheTTL {
+		c.peerCache = prev.peerCache
+	}
+}
+
+// connLogger returns the logger of routine connection logs
+func (c *Config) connLogger() *zap.SugaredLogger {
+	if c.connLog == nil {
+		return Logger
+	}
+	return c.connLog
+}
+
+// loadAuthenticator reads the identity provider's keys, if one's configured
+func (c *Config) loadAuthenticator() error {
+	if c.JWKSFile == "" {
+		return nil
+	}
+	if c.JWTIssuer == "" {
+		return fmt.Errorf("jwt_issuer is required with jwks_file")
+	}
+	auth, err := NewJWTAuthenticator(c.JWKSFile, c.JWTIssuer, c.JWTUserClaim)
+	if err != nil {
+		return fmt.Errorf("Failed to read the JWKS: %w", err)
+	}
+	c.auth = auth
+	return nil
+}
+
+// loadUserLists reads the configured allow & deny lists
+func (c *Config) loadUserLists() error {
+	var err error
+	if c.AllowedUsersFile != "" {
+		if c.allowedUsers, err = readUserList(c.AllowedUsersFile); err != nil {
+			return fmt.Errorf("Failed to read the allowed users: %w", err)
+		}
+	}
+	if c.DeniedUsersFile != "" {
+		if c.deniedUsers, err = readUserList(c.DeniedUsersFile); err != nil {
+			return fmt.Errorf("Failed to read the denied users: %w", err)
+		}
+	}
+	return nil
+}
+
+// readUserList returns the normalized users listed in the file, one per
+// line. Blank lines & lines starting with # are skipped.
+func readUserList(path string) (map[string]bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		if user := normalizeUser(line); user != "" && !strings.HasPrefix(user, "#") {
+			users[user] = true
+		}
+	}
+	return users, nil
+}
+
+// kindAllowed returns whether peers can be of the kind
+func (c *Config) kindAllowed(kind string) bool {
+	if len(c.Kinds) == 0 {
+		return true
+	}
+	for _, k := range c.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// userAllowed returns whether the user can verify & connect peers
+func (c *Config) userAllowed(user string) bool {
+	user = normalizeUser(user)
+	if c.deniedUsers[user] {
+		return false
+	}
+	return c.allowedUsers == nil || c.allowedUsers[user]
+}
+
+// trustsProxy returns whether the IP is of a trusted proxy
+func (c *Config) trustsProxy(ip string) bool {
+	if c.TrustProxy {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range c.trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteGrace returns the time a deleted peer can be restored
+func (c *Config) deleteGrace() time.Duration {
+	return time.Duration(c.DeleteGrace) * time.Second
+}
+
+// renameGrace returns the time a renamed peer can verify with its previous
+// name
+func (c *Config) renameGrace() time.Duration {
+	return time.Duration(c.RenameGrace) * time.Second
+}
+
+// slowRedisOp returns the time a redis operation takes to be logged as slow
+func (c *Config) slowRedisOp() time.Duration {
+	return time.Duration(c.SlowRedisOp) * time.Millisecond
+}
+
+// readPrimaryAfterWrite returns how long after a write reads are from the
+// primary
+func (c *Config) readPrimaryAfterWrite() time.Duration {
+	return time.Duration(c.ReadPrimaryAfterWrite) * time.Millisecond
+}
+
+// idleEvict returns how long a peer can be idle before it's evicted
+func (c *Config) idleEvict() time.Duration {
+	return time.Duration(c.IdleEvict) * time.Second
+}
+
+// presenceWindow returns the window in which presence updates are coalesced
+func (c *Config) presenceWindow() time.Duration {
+	return time.Duration(c.PresenceWindow) * time.Millisecond
+}
+
+// highRTT returns the round trip time of a ping that's logged as high
+func (c *Config) highRTT() time.Duration {
+	return time.Duration(c.HighRTT) * time.Millisecond
+}
+
+// writeWait returns the time a write to a peer can take
+func (c *Config) writeWait() time.Duration {
+	if c.WriteWait <= 0 {
+		return DefaultWriteWait * time.Millisecond
+	}
+	return time.Duration(c.WriteWait) * time.Millisecond
+}
+
+// offlineTTL returns the time a message is queued for an offline peer
+func (c *Config) offlineTTL() time.Duration {
+	return time.Duration(c.OfflineTTL) * time.Second
+}
+
+// onlineTTL returns the presence ttl of a peer with the ping period. It's
+// always longer than the period so pinged peers stay online.
+func (c *Config) onlineTTL(ping time.Duration) time.Duration {
+	if c.OnlineTTL == 0 {
+		return 3 * ping
+	}
+	ttl := time.Duration(c.OnlineTTL) * time.Second
+	if ttl <= ping {
+		return ping + time.Second
+	}
+	return ttl
+}
+
+// reloadConfig loads the configuration and swaps it with the current one.
+// On failure, the current configuration is kept.
+func reloadConfig() error {
+	c, err := LoadConfig(os.Getenv("PB_CONF"))
+	if err != nil {
+		return err
+	}
+	c.keepState(conf())
+	config.Store(c)
+	Logger.Infof("Configuration loaded")
+	return nil
+}
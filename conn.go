@@ -2,33 +2,371 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
-	"github.com/gomodule/redigo/redis"
 	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
 )
 
 const (
-	// Time allowed to write a message to the peer.
-	writeWait  = 10 * time.Second
-	pingPeriod = 5 * time.Second
+	// DefaultWriteWait is the milliseconds a write to the peer can take
+	DefaultWriteWait = 10000
+	pingPeriod       = 5 * time.Second
 	// Time allowed to read the next pong message from the peer.
 	pongWait = 6 * time.Second
-	// Maximum message size allowed from peer.
+	// Limits of the ping & pong periods peers can ask for
+	minPingPeriod = time.Second
+	maxPingPeriod = time.Minute
+	maxPongWait   = maxPingPeriod + 30*time.Second
+	// Default maximum size of messages from & to the peer.
 	maxMessageSize = 4096
 	SendBufSize    = 4096
+	// ControlBufSize is the size of the send buffer's priority lane
+	ControlBufSize = 256
+	// the send buffer is near full when it's that full, in percents
+	nearFullPercent = 90
+	// DefaultHighRTT is the milliseconds a ping's round trip takes to be
+	// logged as high
+	DefaultHighRTT = 1000
+	// DefaultUnverifiedRetry is the seconds unverified peers are asked to
+	// wait before reconnecting
+	DefaultUnverifiedRetry = 60
+	// DefaultMaxHops is the number of times a message can be relayed before
+	// it's dropped as looping
+	DefaultMaxHops = 4
 )
 
+// The close codes of the frames ending connections, telling clients whether
+// to reconnect
+const (
+	// CloseNormal ends a connection for no particular reason, clients can
+	// reconnect
+	CloseNormal = websocket.CloseNormalClosure
+	// CloseServerRestart is sent when the server shuts down, clients should
+	// reconnect right away
+	CloseServerRestart = websocket.CloseServiceRestart
+	// CloseRateLimited is sent to peers exceeding the message rate, clients
+	// should back off before reconnecting
+	CloseRateLimited = 4029
+	// CloseRevoked is sent when the peer's verification is revoked or the
+	// peer is deleted, clients should stop reconnecting
+	CloseRevoked = 4001
+	// CloseKicked is sent when another peer of the user disconnected the
+	// peer, clients should stop reconnecting
+	CloseKicked = 4003
+	// CloseIdle is sent to peers evicted for exchanging no messages,
+	// clients should reconnect when they have something to send
+	CloseIdle = 4008
+	// CloseOutdated is sent to clients older than min_client_version,
+	// clients should stop reconnecting till they're upgraded
+	CloseOutdated = 4026
+)
+
+// closeWait is the time allowed to write a close frame of a connection that
+// isn't waiting for its queued messages
+const closeWait = time.Second
+
+// closeMarker prefixes a request to close a peer's connections, published on
+// the peer's channel. Like binaryMarker, it can't start a json message.
+const closeMarker byte = 1
+
+// CloseReason is the code & reason of the close frame ending a connection
+type CloseReason struct {
+	Code   int
+	Reason string
+}
+
+// slowConsumerPeriod is how long a peer's send buffer can stay near full
+// before it's reported as a slow consumer
+var slowConsumerPeriod = 5 * time.Second
+
+// newTicker returns the channel used to time pings and a function stopping
+// it, tests replace it to control the clock
+var newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+// pingClock times the pings' round trips, tests replace it to control the
+// clock
+var pingClock = time.Now
+
+// throttledMessages counts the inbound messages dropped by the peers' rate
+// limiters, use atomic to access
+var throttledMessages uint64
+
+// writeTimeouts counts the connections closed as a write timed out, use
+// atomic to access
+var writeTimeouts uint64
+
+// connCounter is used to give each connection a unique ID
+var connCounter uint64
+
 type Conn struct {
 	WS       *websocket.Conn
 	FP       string
+	Name     string
+	Kind     string
 	Verified bool
-	send     chan []byte
-	User     string
+	send     chan outbound
+	// control is the send buffer's priority lane, for statuses, peer lists
+	// & presence updates. The pinger writes its messages before any relay.
+	control chan outbound
+	User    string
+	// Binary is set when the peer negotiated the binary subprotocol
+	Binary bool
+	// Instance is the ID of the server instance the peer is connected to
+	Instance string
+	// RemoteIP is the client's IP, for the admins' eyes only
+	RemoteIP string
+	// lastIP is the IP the peer last connected from, known is set when the
+	// peer has a record to keep it in
+	lastIP string
+	known  bool
+	// caps are the capabilities the peer advertised, nil when it didn't or
+	// when it's connecting from the peer cache
+	caps Capabilities
+	// envelopes is set when the peer sends & gets enveloped messages instead
+	// of the legacy ones
+	envelopes bool
+	// Pair is the pairing code of an ephemeral peer, empty for registered
+	// peers
+	Pair string
+	// connectedAt is when the hub registered the connection
+	connectedAt time.Time
+	// active is when the peer last sent or got an application message, in
+	// unix nanoseconds. Use atomic to access.
+	active int64
+	// ID is a unique ID for the connection, used in logs
+	ID string
+	// requestID is the ID of the upgraded request, included in the logs
+	requestID string
+	// sent & dropped are message counters, use atomic to access
+	sent      uint64
+	dropped   uint64
+	throttled uint64
+	// nearFullSince is when the send buffer became near full
+	nearFullSince time.Time
+	lastSlowWarn  time.Time
+	queueM        sync.Mutex
+	// presence holds the fingerprints of the peers whose presence updates
+	// are forwarded, nil means all. Guarded by presenceM.
+	presence  map[string]bool
+	presenceM sync.Mutex
+	// batch holds the presence updates coalesced in the presence window, the
+	// latest of each peer indexed by its fingerprint in batchFPs. batchTimer
+	// flushes it. Guarded by batchM.
+	batch      []json.RawMessage
+	batchFPs   map[string]int
+	batchTimer *time.Timer
+	batchM     sync.Mutex
+	// labels are set by the peer and included in its presence updates.
+	// Guarded by labelsM.
+	labels  map[string]string
+	labelsM sync.Mutex
+	// history keeps the metadata of the last messages to the peer, nil
+	// when outbound_history is 0
+	history *OutboundHistory
+	// pingPeriod & pongWait are the peer's keepalive timing, zero means
+	// the default
+	pingPeriod time.Duration
+	pongWait   time.Duration
+	// appPing is set when the peer asked for an application level
+	// heartbeat - {"type": "ping"} messages it answers with {"type": "pong"}
+	appPing bool
+	// pingSent is when the unanswered ping was sent, in unix nanoseconds,
+	// and rtt is the last ping's round trip time. Use atomic to access.
+	pingSent int64
+	rtt      int64
+	// pingNonce is the payload of the unanswered websocket ping, its pong
+	// must echo it. Guarded by nonceM.
+	pingNonce string
+	nonceM    sync.Mutex
+	// closing is the close frame's code & reason, nil for a normal closure.
+	// Guarded by closeM.
+	closing *CloseReason
+	closeM  sync.Mutex
+	// done is closed once the connection is disconnected, so no more
+	// messages are queued. doneOnce closes it.
+	done     chan struct{}
+	doneOnce sync.Once
+	// registered is closed once the hub sent the connect status & the peer
+	// list, the queued messages are forwarded after them
+	registered chan struct{}
+}
+
+// logger returns the connection's logger, with the ID of the request that
+// opened it
+func (c *Conn) logger() *zap.SugaredLogger {
+	if c.requestID == "" {
+		return Logger
+	}
+	return Logger.With("request_id", c.requestID)
+}
+
+// routineLogger returns the connection's logger of routine logs, sampled
+// by the log_sample configuration
+func (c *Conn) routineLogger() *zap.SugaredLogger {
+	l := conf().connLogger()
+	if c.requestID == "" {
+		return l
+	}
+	return l.With("request_id", c.requestID)
+}
+
+// newConnID returns a fresh connection ID
+func newConnID() string {
+	return fmt.Sprintf("c%d", atomic.AddUint64(&connCounter, 1))
+}
+
+// keepalive returns the connection's ping period & pong wait
+func (c *Conn) keepalive() (time.Duration, time.Duration) {
+	ping, pong := c.pingPeriod, c.pongWait
+	if ping == 0 {
+		ping = pingPeriod
+	}
+	if pong == 0 {
+		pong = pongWait
+	}
+	return ping, pong
+}
+
+// onlineTTL returns how long the peer is kept online in the store without a
+// refresh. It's refreshed on every ping so once the server is gone, the peer
+// goes offline.
+func (c *Conn) onlineTTL() time.Duration {
+	ping, _ := c.keepalive()
+	return conf().onlineTTL(ping)
+}
+
+// parseKeepalive reads the optional ping & pong query parameters, in
+// seconds, and clamps them to the server's limits. The pong wait is always
+// longer than the ping period.
+func parseKeepalive(q url.Values) (time.Duration, time.Duration) {
+	ping, pong := pingPeriod, pongWait
+	if s := q.Get("ping"); s != "" {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			ping = clampDuration(time.Duration(f*float64(time.Second)),
+				minPingPeriod, maxPingPeriod)
+			pong = ping + pongWait - pingPeriod
+		}
+	}
+	if s := q.Get("pong"); s != "" {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			pong = time.Duration(f * float64(time.Second))
+		}
+	}
+	return ping, clampDuration(pong, ping+minPingPeriod, maxPongWait)
+}
+
+func clampDuration(d time.Duration, min time.Duration, max time.Duration) time.Duration {
+	if d < min {
+		return min
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+// Sent returns the number of messages queued to the peer
+func (c *Conn) Sent() uint64 {
+	return atomic.LoadUint64(&c.sent)
+}
+
+// Throttled returns the number of inbound messages dropped by the
+// connection's rate limiter
+func (c *Conn) Throttled() uint64 {
+	return atomic.LoadUint64(&c.throttled)
+}
+
+// Dropped returns the number of messages dropped as the peer's send buffer
+// was full
+func (c *Conn) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// outbound is a queued message with the type, source & id of its history
+// record, set by the sender that already knows them
+type outbound struct {
+	m      []byte
+	record OutboundRecord
+}
+
+// queue adds a message to the peer's send buffer without blocking. When the
+// buffer is full the message is dropped. A peer whose buffer stays near full
+// for slowConsumerPeriod is reported as a slow consumer.
+func (c *Conn) queue(m []byte, r OutboundRecord) bool {
+	c.checkSlowConsumer()
+	return c.enqueue(c.send, outbound{m, r})
+}
+
+// queueControl adds a message to the priority lane, so it's written before
+// the relayed messages waiting in the send buffer
+func (c *Conn) queueControl(m []byte, r OutboundRecord) bool {
+	if c.control == nil {
+		return c.queue(m, r)
+	}
+	return c.enqueue(c.control, outbound{m, r})
+}
+
+func (c *Conn) enqueue(lane chan outbound, o outbound) bool {
+	// once disconnected, the writer may be gone so messages are dropped
+	select {
+	case <-c.done:
+		c.recordOutbound(o, OutboundDropped)
+		n := atomic.AddUint64(&c.dropped, 1)
+		c.logger().Infof("Dropped a message to %q (conn %s) as it's disconnected, %d dropped so far",
+			c.FP, c.ID, n)
+		return false
+	default:
+	}
+	select {
+	case lane <- o:
+		atomic.AddUint64(&c.sent, 1)
+		return true
+	default:
+		c.recordOutbound(o, OutboundDropped)
+		n := atomic.AddUint64(&c.dropped, 1)
+		c.logger().Warnf("Dropped a message to %q (conn %s), %d dropped so far",
+			c.FP, c.ID, n)
+		return false
+	}
+}
+
+func (c *Conn) checkSlowConsumer() {
+	c.queueM.Lock()
+	defer c.queueM.Unlock()
+	if len(c.send)*100 < cap(c.send)*nearFullPercent {
+		c.nearFullSince = time.Time{}
+		return
+	}
+	now := time.Now()
+	if c.nearFullSince.IsZero() {
+		c.nearFullSince = now
+		return
+	}
+	if now.Sub(c.nearFullSince) >= slowConsumerPeriod &&
+		now.Sub(c.lastSlowWarn) >= slowConsumerPeriod {
+		c.lastSlowWarn = now
+		c.logger().Warnf("Slow consumer %q (conn %s): send buffer near full for %s, %d dropped",
+			c.FP, c.ID, now.Sub(c.nearFullSince).Truncate(time.Millisecond),
+			c.Dropped())
+	}
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -37,294 +375,1310 @@ type Conn struct {
 // ensures that there is at most one reader on a connection by executing all
 // reads from this goroutine.
 func (c *Conn) readPump(onDone func()) {
+	defer c.recoverPanic("readPump")
 	defer func() {
-		hub.unregister <- c
+		onDone()
+		hub.Unregister(c)
 	}()
-	c.WS.SetReadLimit(maxMessageSize)
-	c.WS.SetReadDeadline(time.Now().Add(pongWait))
-	c.WS.SetPongHandler(func(string) error {
-		c.WS.SetReadDeadline(time.Now().Add(pongWait))
+	_, pong := c.keepalive()
+	cfg := conf()
+	var limiter *TokenBucket
+	if cfg.MsgRate > 0 {
+		limiter = NewTokenBucket(cfg.MsgRate, cfg.MsgBurst)
+	}
+	c.WS.SetReadLimit(int64(cfg.MaxInbound))
+	c.WS.SetReadDeadline(time.Now().Add(pong))
+	c.WS.SetPongHandler(func(data string) error {
+		nonce := c.takePingNonce()
+		if nonce == "" {
+			// an unsolicited pong proves nothing
+			return nil
+		}
+		if data != nonce {
+			c.logger().Warnf("Closing %q (conn %s), its pong doesn't echo the ping",
+				c.FP, c.ID)
+			return fmt.Errorf("Pong of %q doesn't echo the ping", c.FP)
+		}
+		c.WS.SetReadDeadline(time.Now().Add(pong))
+		c.gotPong()
 		return nil
 	})
 	for {
-		message := make(map[string]interface{})
-		err := c.WS.ReadJSON(&message)
+		mt, data, err := c.WS.ReadMessage()
 		if err != nil {
-			Logger.Errorf("ws error: %w", err)
+			c.logger().Errorf("ws error: %w", err)
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				Logger.Errorf("ws error: %w", err)
+				c.logger().Errorf("ws error: %w", err)
 			}
 			break
 		}
-		if !c.Verified {
+		if c.appPing && mt == websocket.TextMessage && isAppPong(data) {
+			c.WS.SetReadDeadline(time.Now().Add(pong))
+			c.gotPong()
+			continue
+		}
+		if limiter != nil && !limiter.Allow(time.Now()) {
+			n := atomic.AddUint64(&c.throttled, 1)
+			atomic.AddUint64(&throttledMessages, 1)
+			if cfg.MsgThrottleClose {
+				c.logger().Warnf("Closing %q (conn %s) for exceeding the message rate",
+					c.FP, c.ID)
+				c.closeNow(&CloseReason{CloseRateLimited, "message rate exceeded"})
+				break
+			}
+			c.logger().Warnf("Throttled a message from %q (conn %s), %d throttled so far",
+				c.FP, c.ID, n)
+			continue
+		}
+		if !c.Verified && c.Pair == "" {
 			e := &UnauthorizedPeer{c.FP}
-			Logger.Warn(e)
+			c.logger().Warn(e)
 			c.sendStatus(http.StatusUnauthorized, e)
 			continue
 		}
+		if mt == websocket.BinaryMessage {
+			if c.Binary {
+				c.handleBinary(data)
+			} else {
+				c.logger().Warnf("Ignoring a binary message from %q, not in binary mode",
+					c.FP)
+			}
+			continue
+		}
+		if c.envelopes {
+			var e MessageEnvelope
+			if err = json.Unmarshal(data, &e); err != nil {
+				c.logger().Errorf("ws error: %w", err)
+				break
+			}
+			if conf().TrimFields {
+				e.Type, e.To = trimField(e.Type), trimField(e.To)
+			}
+			e.From, e.FromName = c.FP, c.Name
+			c.handleEnvelope(&e)
+			continue
+		}
+		message := make(map[string]interface{})
+		if err = decodeJSON(data, &message); err != nil {
+			c.logger().Errorf("ws error: %w", err)
+			break
+		}
+		if conf().TrimFields {
+			normalizeMessage(message)
+		}
 		message["source_fp"] = c.FP
+		message["source_name"] = c.Name
 		// message["user"] = c.User
 		c.handleMessage(message)
 	}
-	onDone()
 }
 
-// pinger sends pings
-func (c *Conn) pinger() {
-	ticker := time.NewTicker(pingPeriod)
+// appPingMessage is the application level ping
+var appPingMessage = []byte(`{"type":"ping"}`)
+
+// isAppPong returns whether a message is an application level pong
+func isAppPong(data []byte) bool {
+	var m struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(data, &m) == nil && m.Type == TypePong
+}
+
+// newPingNonce returns a random payload for a websocket ping
+func newPingNonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// setPingNonce sets the payload of the ping being sent
+func (c *Conn) setPingNonce(nonce string) {
+	c.nonceM.Lock()
+	defer c.nonceM.Unlock()
+	c.pingNonce = nonce
+}
+
+// takePingNonce returns the unanswered ping's payload, if any, and clears it
+func (c *Conn) takePingNonce() string {
+	c.nonceM.Lock()
+	defer c.nonceM.Unlock()
+	nonce := c.pingNonce
+	c.pingNonce = ""
+	return nonce
+}
+
+// gotPong measures the round trip time of the ping the pong answers, logging
+// it when it's high
+func (c *Conn) gotPong() {
+	sent := atomic.SwapInt64(&c.pingSent, 0)
+	if sent == 0 {
+		// an unsolicited pong
+		return
+	}
+	rtt := pingClock().Sub(time.Unix(0, sent))
+	atomic.StoreInt64(&c.rtt, int64(rtt))
+	if high := conf().highRTT(); high > 0 && rtt >= high {
+		c.logger().Warnw("High ping round trip time", "fp", c.FP, "conn", c.ID,
+			"rtt", rtt.String())
+	}
+}
+
+// RTT returns the round trip time of the last answered ping, zero before
+// the first pong
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// recoverPanic logs a panic of one of the connection's goroutines with its
+// stack, the connection is closed by the goroutine's deferred cleanup. It
+// must be deferred by the goroutine.
+func (c *Conn) recoverPanic(goroutine string) {
+	if v := recover(); v != nil {
+		c.logger().Errorw("Recovered from a panic", "panic", fmt.Sprint(v),
+			"goroutine", goroutine, "fp", c.FP, "conn", c.ID,
+			"stack", string(debug.Stack()))
+	}
+}
+
+// normalizeMessage trims the whitespace & control characters clients pad
+// the message's string fields with
+func normalizeMessage(m map[string]interface{}) {
+	for k, v := range m {
+		if s, ok := v.(string); ok {
+			m[k] = trimField(s)
+		}
+	}
+}
+
+// trimField trims the whitespace & control characters padding a field
+func trimField(s string) string {
+	return strings.TrimFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	})
+}
+
+// pinger sends pings and writes the queued messages until the connection
+// fails or ctx is done, when the read pump ends
+func (c *Conn) pinger(ctx context.Context) {
+	ping, _ := c.keepalive()
+	tick, stopTicker := newTicker(ping)
+	defer c.recoverPanic("pinger")
 	defer func() {
-		ticker.Stop()
-		hub.unregister <- c
+		stopTicker()
+		hub.Unregister(c)
+		c.routineLogger().Info("out pinger")
 	}()
-	Logger.Infof("in pinger")
+	c.routineLogger().Info("in pinger")
 	for {
+		// the priority lane is drained before any relayed message is written
 		select {
-		case message, ok := <-c.send:
-			if !ok {
-				Logger.Errorf("Got a bad message to send")
+		case message, ok := <-c.control:
+			if !c.write(message, ok) {
 				return
 			}
-			c.WS.SetWriteDeadline(time.Now().Add(writeWait))
-			err := c.WS.WriteMessage(websocket.TextMessage, message)
-			if err != nil {
-				if websocket.IsUnexpectedCloseError(err,
-					websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					Logger.Warnf("Failed to send websocket message: %s", err)
-					return
-				}
-				continue
+			continue
+		default:
+		}
+		select {
+		case message, ok := <-c.control:
+			if !c.write(message, ok) {
+				return
 			}
-		case <-ticker.C:
+		case message, ok := <-c.send:
+			if !c.write(message, ok) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		case <-tick:
 			if c.WS == nil {
 				break
 			}
-			c.WS.SetWriteDeadline(time.Now().Add(writeWait))
-			err := c.WS.WriteMessage(websocket.PingMessage, nil)
+			c.WS.SetWriteDeadline(time.Now().Add(conf().writeWait()))
+			atomic.StoreInt64(&c.pingSent, pingClock().UnixNano())
+			var err error
+			if c.appPing {
+				err = c.WS.WriteMessage(websocket.TextMessage, appPingMessage)
+			} else {
+				nonce := newPingNonce()
+				c.setPingNonce(nonce)
+				err = c.WS.WriteMessage(websocket.PingMessage, []byte(nonce))
+			}
 			if err != nil {
-				if websocket.IsUnexpectedCloseError(err,
+				if isTimeout(err) {
+					c.writeTimedOut("ping")
+				} else if websocket.IsUnexpectedCloseError(err,
 					websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					Logger.Errorf("failed to send ping message: %s", err)
+					c.logger().Errorf("failed to send ping message: %s", err)
 				}
 				return
 			}
+			if c.Pair != "" {
+				break
+			}
+			if err = db.SetPeerOnline(c.FP, c.Instance, c.onlineTTL()); err != nil {
+				c.logger().Errorf("Failed to refresh %q presence: %s", c.FP, err)
+			}
 		}
 	}
-	Logger.Infof("out pinger")
 }
+
+// write writes a queued message to the websocket. It returns false when the
+// connection is done, as the message is the closing sentinel or the write
+// failed.
+func (c *Conn) write(o outbound, ok bool) bool {
+	if !ok {
+		c.logger().Errorf("Got a bad message to send")
+		return false
+	}
+	message := o.m
+	if message == nil {
+		// queued by disconnect, after the status
+		c.WS.WriteControl(websocket.CloseMessage, c.closeMessage(),
+			time.Now().Add(conf().writeWait()))
+		c.WS.Close()
+		return false
+	}
+	mt := websocket.TextMessage
+	if len(message) > 0 && message[0] == binaryMarker {
+		mt = websocket.BinaryMessage
+		message = message[1:]
+	} else if c.envelopes {
+		e, err := encodeEnvelope(message)
+		if err != nil {
+			c.logger().Warnf("Failed to envelope a message to %q: %s", c.FP, err)
+		} else {
+			message = e
+		}
+	}
+	c.WS.SetWriteDeadline(time.Now().Add(conf().writeWait()))
+	err := c.WS.WriteMessage(mt, message)
+	if err != nil {
+		c.recordOutbound(o, OutboundFailed)
+		// a failed write leaves the websocket broken, so we close it and
+		// let both pumps unregister the connection. A timed out write can't
+		// be retried either, as part of its frame may have been sent.
+		if isTimeout(err) {
+			c.writeTimedOut("message")
+		} else if websocket.IsUnexpectedCloseError(err,
+			websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			c.logger().Warnf("Failed to send websocket message: %s", err)
+		} else {
+			c.logger().Infof("Closing %q after a failed write: %s", c.FP, err)
+		}
+		c.WS.Close()
+		return false
+	}
+	c.recordOutbound(o, OutboundSent)
+	return true
+}
+
+// isTimeout returns whether err is a write that missed its deadline, rather
+// than a failed connection
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// writeTimedOut logs & counts a write that took longer than write_wait, as
+// the peer stopped reading or its link stalled
+func (c *Conn) writeTimedOut(what string) {
+	n := atomic.AddUint64(&writeTimeouts, 1)
+	c.logger().Warnf("Closing %q, writing a %s took more than %s, %d so far",
+		c.FP, what, conf().writeWait(), n)
+}
+
+// sendNotice sends the peer a notice for its user, like a scheduled downtime
+func (c *Conn) sendNotice(message string) error {
+	m, err := json.Marshal(map[string]string{"type": TypeNotice,
+		"message": message})
+	if err != nil {
+		return err
+	}
+	c.queueControl(m, OutboundRecord{Type: TypeNotice})
+	return nil
+}
+
 func (c *Conn) sendStatus(code int, e error) error {
-	Logger.Infof("Sending status %d %s", code, e)
-	m, err := json.Marshal(StatusMessage{code, e.Error()})
+	c.logger().Infof("Sending status %d %s", code, e)
+	m, err := json.Marshal(StatusMessage{Code: code, Text: e.Error()})
 	if err != nil {
 		return err
 	}
-	c.send <- m
+	c.queueControl(m, OutboundRecord{Type: TypeStatus})
 	return nil
 }
 
+// disconnect sends the peer a status and closes the connection once it's
+// sent, with a close frame of the reason. A nil reason is a normal closure.
+// If the status can't be queued, the connection is closed right away.
+func (c *Conn) disconnect(code int, e error, reason *CloseReason) {
+	select {
+	case <-c.done:
+		// already disconnected, its status & close frame are queued
+		return
+	default:
+	}
+	c.setClosing(reason)
+	defer c.markDone()
+	if err := c.sendStatus(code, e); err == nil && c.queueControl(nil, OutboundRecord{}) {
+		return
+	}
+	if c.WS != nil {
+		c.WS.Close()
+	}
+}
+
+// markDone marks the connection as disconnected, the messages queued from
+// now on are dropped
+func (c *Conn) markDone() {
+	if c.done != nil {
+		c.doneOnce.Do(func() { close(c.done) })
+	}
+}
+
+// refuse writes a status & the reason's close frame to a connection that
+// was never registered, and closes it
+func (c *Conn) refuse(code int, e error, reason *CloseReason) {
+	c.setClosing(reason)
+	c.logger().Infof("Sending status %d %s", code, e)
+	if m, err := json.Marshal(StatusMessage{Code: code, Text: e.Error()}); err == nil {
+		if !c.write(outbound{m, OutboundRecord{Type: TypeStatus}}, true) {
+			return
+		}
+	}
+	c.write(outbound{}, true)
+}
+
+// closeNow writes the reason's close frame, without waiting for the queued
+// messages, and closes the websocket
+func (c *Conn) closeNow(reason *CloseReason) {
+	if c.WS == nil {
+		return
+	}
+	c.setClosing(reason)
+	c.WS.WriteControl(websocket.CloseMessage, c.closeMessage(),
+		time.Now().Add(closeWait))
+	c.WS.Close()
+}
+
+// setClosing sets the reason the connection is closed for, unless it's
+// already closing for another one
+func (c *Conn) setClosing(reason *CloseReason) {
+	c.closeM.Lock()
+	defer c.closeM.Unlock()
+	if c.closing == nil {
+		c.closing = reason
+	}
+}
+
+// closeRequest asks a peer's connections to close with a status and a close
+// frame, it's published on the peer's channel so it reaches all instances
+type closeRequest struct {
+	Status int    `json:"status"`
+	Text   string `json:"text"`
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// ClosePeer closes the peer's connections on all the server instances,
+// sending them a status and the reason's close frame. It returns the number
+// of connections that got the request.
+func ClosePeer(fp string, status int, e error,
+	reason *CloseReason) (int, error) {
+	m, err := json.Marshal(closeRequest{status, e.Error(), reason.Code,
+		reason.Reason})
+	if err != nil {
+		return 0, err
+	}
+	return db.Publish(fmt.Sprintf("out:%s", fp),
+		append([]byte{closeMarker}, m...))
+}
+
+// closeMessage returns the payload of the close frame ending the connection
+func (c *Conn) closeMessage() []byte {
+	c.closeM.Lock()
+	defer c.closeM.Unlock()
+	if c.closing == nil {
+		return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	}
+	return websocket.FormatCloseMessage(c.closing.Code, c.closing.Reason)
+}
+
 // SendMessage sends a message as json
 func SendMessage(tfp string, msg interface{}) error {
-	Logger.Infof("publishing message to %q: %v", tfp, msg)
+	Logger.Infof("publishing message to %q", tfp)
 	m, err := json.Marshal(msg)
-	rc := db.pool.Get()
-	defer rc.Close()
-	key := fmt.Sprintf("out:%s", tfp)
-	if _, err = rc.Do("PUBLISH", key, m); err != nil {
+	if err != nil {
 		return err
 	}
-	return nil
+	key := fmt.Sprintf("out:%s", tfp)
+	_, err = db.Publish(key, m)
+	return err
 }
 
 // serveWs handles websocket requests from the peer.
 func serveWs(w http.ResponseWriter, r *http.Request) {
+	log := reqLogger(r)
+	cfg := conf()
+	ip := getClientIP(r, cfg)
+	log = log.With("remote_ip", ip)
+	if !cfg.limiter.Allow(ip) {
+		log.Warnf("Throttling connection requests from %s", ip)
+		audit(AuditEvent{Type: AuditReject, IP: ip, Detail: "too many requests"})
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
 	q := r.URL.Query()
-	Logger.Infof("Got a new peer request: %v", q)
+	// requests are routine, the sampled logger keeps them from flooding
+	acceptLog := cfg.connLogger().With("remote_ip", ip)
+	if id := requestID(r); id != "" {
+		acceptLog = acceptLog.With("request_id", id)
+	}
+	acceptLog.Infow("Got a new peer request", "query", redactQuery(q))
+	if fp := q.Get("fp"); fp != "" {
+		if wait := cfg.flaps.Allow(fp, time.Now()); wait > 0 {
+			log.Warnf("Refusing %q, it's flapping - more than %d connections in %ds",
+				fp, cfg.ReconnectMax, cfg.ReconnectWindow)
+			audit(AuditEvent{Type: AuditReject, FP: fp, IP: ip,
+				Detail: "too many reconnects"})
+			w.Header().Set("Retry-After",
+				strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			http.Error(w, "Too many reconnects", http.StatusTooManyRequests)
+			return
+		}
+	}
 	conn, err := ConnFromQ(q)
 	if err != nil {
-		Logger.Warnf("Refusing a bad request: %s", err)
+		audit(AuditEvent{Type: AuditReject, FP: q.Get("fp"), IP: ip,
+			Detail: err.Error()})
+	}
+	var unavailable *StoreUnavailable
+	if errors.As(err, &unavailable) {
+		log.Warnf("Refusing a request while the store is down: %s", err)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var corrupt *CorruptPeer
+	if errors.As(err, &corrupt) {
+		log.Errorf("Refusing a corrupt peer: %s", err)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	var notAllowed *UserNotAllowed
+	if errors.As(err, &notAllowed) {
+		log.Warnf("Refusing a connection: %s", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Warnf("Refusing a bad request: %s", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if conn.Pair == "" && conn.User != "" {
+		if _, err = cfg.auth.Authenticate(r, conn.User); err != nil {
+			log.Warnf("Refusing a connection: %s", err)
+			audit(AuditEvent{Type: AuditReject, FP: conn.FP, User: conn.User,
+				IP: ip, Detail: err.Error()})
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
 
 	conn.WS, err = upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
-		Logger.Errorf("Failed to upgrade socket: %w", err)
+		log.Errorf("Failed to upgrade socket: %s", err)
+		return
+	}
+	conn.Binary = conn.WS.Subprotocol() == BinarySubprotocol
+	conn.RemoteIP = ip
+	conn.requestID = requestID(r)
+	conn.envelopes = cfg.Envelopes
+	if err = cfg.checkClientVersion(q.Get("v")); err != nil {
+		log.Warnf("Refusing a connection: %s", err)
+		audit(AuditEvent{Type: AuditReject, FP: conn.FP, User: conn.User,
+			IP: ip, Detail: err.Error()})
+		conn.refuse(http.StatusUpgradeRequired, err,
+			&CloseReason{CloseOutdated, "client upgrade required"})
+		return
 	}
-	hub.register <- conn
-	go conn.pinger()
+	if err = conn.recordIP(); err != nil {
+		log.Errorf("Failed to record the peer's IP: %s", err)
+	}
+	if err = conn.recordCapabilities(); err != nil {
+		log.Errorf("Failed to record the peer's capabilities: %s", err)
+	}
+	// all three goroutines end with the read pump - it cancels ctx once the
+	// websocket fails, and the hub closes the websocket when any other ends
 	ctx, cancel := context.WithCancel(context.Background())
+	hub.Register(conn)
+	go conn.pinger(ctx)
 	go conn.subscribe(ctx)
-	go conn.readPump(func() {
-		cancel()
-	})
-	// if it's an unverified peer, keep the connection open and send a status message
-	if !conn.Verified {
-		err = conn.sendStatus(http.StatusUnauthorized, fmt.Errorf(
-			"Unverified peer, please check your inbox to verify"))
+	go conn.readPump(cancel)
+}
+
+// recordIP keeps the IP a known peer connected from, warning when it's
+// from another network than the last one
+func (c *Conn) recordIP() error {
+	if !c.known || c.Pair != "" || c.RemoteIP == c.lastIP {
+		return nil
+	}
+	if c.lastIP != "" && !sameNetwork(c.lastIP, c.RemoteIP) {
+		c.logger().Warnw("Peer connected from another network", "fp", c.FP,
+			"user", c.User, "last_ip", c.lastIP, "remote_ip", c.RemoteIP)
+	}
+	return db.SetPeerField(c.FP, "last_ip", c.RemoteIP)
+}
+
+// recordCapabilities keeps the capabilities a verified peer advertised,
+// unverified peers can't change what's listed for the user's peers
+func (c *Conn) recordCapabilities() error {
+	if !c.known || !c.Verified || c.Pair != "" || c.caps == nil {
+		return nil
+	}
+	return db.SetPeerField(c.FP, "capabilities", c.caps)
+}
+
+// sameNetwork returns true when both IPs are in the same /24 IPv4 or /64
+// IPv6 network
+func sameNetwork(a string, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	mask := net.CIDRMask(64, 128)
+	if ipA.To4() != nil {
+		if ipB.To4() == nil {
+			return false
+		}
+		ipA, ipB, mask = ipA.To4(), ipB.To4(), net.CIDRMask(24, 32)
+	}
+	return ipA.Mask(mask).Equal(ipB.Mask(mask))
+}
+
+// redactQuery returns the query for the logs, without the bearer token
+func redactQuery(q url.Values) url.Values {
+	if _, found := q["token"]; !found {
+		return q
+	}
+	r := make(url.Values, len(q))
+	for k, v := range q {
+		r[k] = v
+	}
+	r["token"] = []string{"REDACTED"}
+	return r
+}
+
+// sendConnectStatus lets a newly connected peer know whether it's verified
+// with a 200 status, or not with a 401. Unverified peers' connections are
+// kept open so they'll get a 200 once verified.
+func (c *Conn) sendConnectStatus() error {
+	if c.Pair != "" {
+		return c.sendStatus(http.StatusOK, fmt.Errorf("peer is ephemeral"))
+	}
+	if c.Verified {
+		m, err := json.Marshal(StatusMessage{Code: http.StatusOK,
+			Text: "peer is verified"})
 		if err != nil {
-			Logger.Errorf("Failed to send status message: %s", err)
+			return err
 		}
+		c.queueControl(m, OutboundRecord{Type: TypeStatus})
+		return nil
 	}
+	// clients retrying right away would hammer us & the user's inbox
+	s := StatusMessage{Code: http.StatusUnauthorized,
+		Text:       "Unverified peer, please check your inbox to verify",
+		RetryAfter: conf().UnverifiedRetry}
+	c.logger().Infof("Sending status %d %s", s.Code, s.Text)
+	m, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	c.queueControl(m, OutboundRecord{Type: TypeStatus})
+	return nil
+}
+
+// touch marks the connection as active, as it sent or got an application
+// message
+func (c *Conn) touch() {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
 }
 
-// SetOnline sets the related peer's online redis and notifies peers
-func (c *Conn) SetOnline(o bool) error {
-	key := fmt.Sprintf("peer:%s", c.FP)
-	rc := db.pool.Get()
-	defer rc.Close()
-	if _, err := rc.Do("HSET", key, "online", o); err != nil {
+// activeAt returns when the peer last sent or got an application message, or
+// when it connected if it didn't
+func (c *Conn) activeAt() time.Time {
+	if n := atomic.LoadInt64(&c.active); n != 0 {
+		return time.Unix(0, n)
+	}
+	return c.connectedAt
+}
+
+// SetOnline sets the related peer's online field in the store and notifies
+// peers
+func (c *Conn) SetOnline(s Store, o bool) error {
+	var ttl time.Duration
+	if o {
+		ttl = c.onlineTTL()
+	}
+	if err := s.SetPeerOnline(c.FP, c.Instance, ttl); err != nil {
 		return err
 	}
+	p, err := s.GetPeer(c.FP)
+	if err != nil {
+		return err
+	}
+	u := NewPeerUpdate(p)
+	u.Verified = c.Verified
+	u.Online = o
+	if o {
+		u.Labels = c.getLabels()
+	}
 	// publish the peer update
-	return SendPeerUpdate(rc, c.User, c.FP, c.Verified, o)
+	return publishPeerUpdate(s, c.User, c.FP, u)
 }
-func SendPeerUpdate(rc redis.Conn, user string, fp string, verified bool, online bool) error {
+
+// SendPeerUpdate publishes a peer's state on the user's channel
+func SendPeerUpdate(user string, fp string, update PeerUpdate) error {
+	return publishPeerUpdate(db, user, fp, update)
+}
+
+func publishPeerUpdate(s Store, user string, fp string, update PeerUpdate) error {
 	m, err := json.Marshal(map[string]interface{}{
 		"source_fp":   fp,
-		"peer_update": PeerUpdate{Verified: verified, Online: online},
+		"peer_update": update,
 	})
-	key := fmt.Sprintf("peers:%s", user)
-	if _, err = rc.Do("PUBLISH", key, m); err != nil {
+	if err != nil {
 		return err
 	}
-	return nil
+	key := fmt.Sprintf("peers:%s", user)
+	_, err = s.Publish(key, m)
+	return err
 }
 
-func (c *Conn) SendPeerList() error {
+// SendPeerList sends the user's peers in the group, all of them for an
+// empty group
+func (c *Conn) SendPeerList(group string) error {
 	ps, err := GetUsersPeers(c.User)
 	if err != nil {
 		return err
 	}
-	m, err := json.Marshal(map[string]interface{}{"peers": ps})
+	list := ps.InGroup(group)
+	list.Sort()
+	m, err := json.Marshal(map[string]interface{}{"peers": list})
 	if err != nil {
 		return err
 	}
-	c.send <- m
+	c.queueControl(m, OutboundRecord{Type: TypePeers})
 	return nil
 }
 
-// subscribe listens for messages on Redis pubsub channels. The
+// subscribe forwards the messages published on the peer's & user's channels
+// until ctx is done. A failed subscription, e.g. when redis restarts, is
+// retried with a backoff.
 func (c *Conn) subscribe(ctx context.Context) {
-	// A ping is set to the server with this period to test for the health of
-	// the connection and server.
-	const healthCheckPeriod = time.Minute
-	conn := db.pool.Get()
-	defer conn.Close()
-	psc := redis.PubSubConn{Conn: conn}
-	outK := fmt.Sprintf("out:%s", c.FP)
-	peersK := fmt.Sprintf("peers:%s", c.User)
-	if err := psc.Subscribe(outK, peersK); err != nil {
-		Logger.Errorf("Failed subscribint to our messages: %s", err)
-		return
-	}
-
-	done := make(chan bool, 1)
-
-	// Start a goroutine to receive notifications from the server.
-	go func() {
-		for {
-			switch n := psc.Receive().(type) {
-			case error:
-				Logger.Errorf("Receive error from redis: %v", n)
-				done <- true
-				return
-			case redis.Message:
-				Logger.Infof("%q got a message: %s", c.FP, n.Data)
-				verified, err := IsVerified(c.FP)
-				if err != nil {
-					Logger.Errorf("Got an error testing if perr verfied: %s", err)
-				}
-				if verified {
-					Logger.Infof("forwarding %q message: %s", c.FP, n.Data)
-					c.WS.SetWriteDeadline(time.Now().Add(writeWait))
-					c.send <- n.Data
-				} else {
-					Logger.Infof("ignoring %q message: %s", c.FP, n.Data)
-				}
+	defer c.recoverPanic("subscribe")
+	channels := []string{fmt.Sprintf("out:%s", c.FP),
+		fmt.Sprintf("peers:%s", c.User)}
+	if c.Pair != "" {
+		channels = []string{pairChannel(c.Pair, c.FP)}
+	}
+	// the messages queued while the peer was offline are forwarded once it's
+	// subscribed, so none are queued after the drain
+	var ready func()
+	if c.Pair == "" && c.Verified && c.registered != nil {
+		ready = func() {
+			select {
+			case <-c.registered:
+				c.drainQueue(db)
+			case <-ctx.Done():
 			}
 		}
-	}()
-
-	ticker := time.NewTicker(healthCheckPeriod)
-	defer ticker.Stop()
-loop:
+	}
+	delay := minDialBackoff
 	for {
+		err := db.Subscribe(ctx, c.forward, ready, channels...)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		c.logger().Errorf("Subscription to our messages failed, retrying in %s: %s",
+			delay, err)
 		select {
-		case <-ticker.C:
-			// Send ping to test health of connection and server. If
-			// corresponding pong is not received, then receive on the
-			// connection will timeout and the receive goroutine will exit.
-			if err := psc.Ping(""); err != nil {
-				break loop
-			}
+		case <-time.After(delay):
 		case <-ctx.Done():
-			break loop
-		case <-done:
-			break loop
+			return
+		}
+		if delay *= 2; delay > maxDialBackoff {
+			delay = maxDialBackoff
 		}
 	}
+}
 
-	// Signal the receiving goroutine to exit by unsubscribing from all channels.
-	if err := psc.Unsubscribe(); err != nil {
-		Logger.Errorf("Failed to unsubscribe: %s", err)
+// forward queues a message published on one of the peer's channels
+func (c *Conn) forward(channel string, data []byte) {
+	c.logger().Infof("%q got a %d bytes message on %q", c.FP, len(data), channel)
+	if len(data) > 0 && data[0] == closeMarker {
+		var r closeRequest
+		if err := json.Unmarshal(data[1:], &r); err != nil {
+			c.logger().Errorf("Got a bad close request: %s", err)
+			return
+		}
+		c.logger().Infof("Closing %q (conn %s): %s", c.FP, c.ID, r.Reason)
+		c.disconnect(r.Status, errors.New(r.Text),
+			&CloseReason{r.Code, r.Reason})
+		return
+	}
+	// ephemeral peers only get messages of their pair
+	verified := c.Pair != ""
+	if !verified {
+		var err error
+		verified, err = IsVerified(c.FP)
+		if err != nil {
+			c.logger().Errorf("Got an error testing if perr verfied: %s", err)
+		}
+	}
+	var source string
+	if strings.HasPrefix(channel, "peers:") {
+		var u struct {
+			SourceFP string `json:"source_fp"`
+		}
+		if err := json.Unmarshal(data, &u); err == nil && !c.wantsPresence(u.SourceFP) {
+			return
+		}
+		source = u.SourceFP
+	}
+	if len(data) > 0 && data[0] == binaryMarker && !c.Binary {
+		c.logger().Warnf("Dropping a binary message to %q, not in binary mode",
+			c.FP)
+		return
+	}
+	if verified {
+		c.logger().Infof("forwarding a %d bytes message to %q", len(data), c.FP)
+		if strings.HasPrefix(channel, "peers:") {
+			c.queuePresence(source, data)
+		} else {
+			c.touch()
+			var r OutboundRecord
+			if c.history != nil {
+				r = relayedRecord(data)
+			}
+			c.queue(data, r)
+		}
+	} else {
+		c.logger().Infof("ignoring %q message: %s", c.FP, data)
 	}
-	<-done
 }
 
 // ConnFromQ retruns a fresh Peer based on query paramets: fp, name, kind &
 // email
 func ConnFromQ(q url.Values) (*Conn, error) {
+	if code := q.Get("pair"); code != "" {
+		return ephemeralConn(q, code)
+	}
 	fp := q.Get("fp")
 	if fp == "" {
-		return nil, &PeerNotFound{}
+		return nil, &MissingParam{"fp"}
 	}
+	cache := conf().peerCache
 	peer, err := GetPeer(fp)
+	var unavailable *StoreUnavailable
+	cached := false
+	if errors.As(err, &unavailable) && cache != nil {
+		// verified peers can connect while the store is briefly down
+		if p := cache.Get(fp); p != nil {
+			Logger.Warnf("Store is down, connecting %q from the peer cache", fp)
+			peer, err, cached = p, nil, true
+		}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get peer: %w", err)
 	}
-	if peer == nil {
-		return nil, &PeerNotFound{}
+	// a deleted peer in its grace period is gone till it's restored
+	if peer == nil || peer.DeletedOn != 0 {
+		return nil, &PeerNotFound{fp}
+	}
+	if peer.User != "" && !conf().userAllowed(peer.User) {
+		return nil, &UserNotAllowed{peer.User}
 	}
+	if cache != nil && !cached {
+		if peer.Verified {
+			cache.Put(peer)
+		} else {
+			cache.Remove(fp)
+		}
+	}
+	// the advertised capabilities are kept once the peer is authenticated
+	var caps Capabilities
+	if s, found := q["caps"]; found && !cached {
+		caps = ParseCapabilities(strings.Join(s, ","))
+	}
+	ping, pong := parseKeepalive(q)
 	ret := Conn{FP: fp,
-		Verified: peer.Verified,
-		User:     peer.User,
-		send:     make(chan []byte, SendBufSize)}
+		ID:         newConnID(),
+		Instance:   instanceID,
+		pingPeriod: ping,
+		pongWait:   pong,
+		appPing:    q.Get("heartbeat") == "app",
+		Name:       peer.Name,
+		Kind:       peer.Kind,
+		Verified:   peer.Verified,
+		User:       peer.User,
+		lastIP:     peer.LastIP,
+		known:      peer.FP != "",
+		caps:       caps,
+		send:       make(chan outbound, SendBufSize),
+		control:    make(chan outbound, ControlBufSize),
+		done:       make(chan struct{}),
+		registered: make(chan struct{})}
+	if n := conf().OutboundHistory; n > 0 {
+		ret.history = NewOutboundHistory(n)
+	}
 	return &ret, nil
 }
 
+// handleMessage handles a message in the legacy format
 func (c *Conn) handleMessage(m map[string]interface{}) {
-	_, offer := m["offer"]
-	_, answer := m["answer"]
-	_, candidate := m["candidate"]
-	if offer || answer || candidate {
-		v, found := m["target"]
-		if !found {
-			Logger.Warnf("Ignoring an forwarding msg with no target")
+	e, err := envelopeFromLegacy(m)
+	if err != nil {
+		c.logger().Infof("Ignoring a message from %q: %s", c.FP, err)
+		return
+	}
+	e.legacy = m
+	c.handleEnvelope(e)
+}
+
+// handleEnvelope handles a peer's message - a command or signaling to relay
+func (c *Conn) handleEnvelope(e *MessageEnvelope) {
+	switch e.Type {
+	case TypeSubscribe:
+		var p struct {
+			Fingerprints interface{} `json:"fingerprints"`
+		}
+		if len(e.RawPayload) > 0 {
+			json.Unmarshal(e.RawPayload, &p)
+		}
+		c.subscribePresence(p.Fingerprints)
+	case TypeKick:
+		c.kick(e.To)
+	case TypeGetList:
+		if err := c.SendPeerList(groupOf(e)); err != nil {
+			c.logger().Errorf("Failed to send the peer list: %s", err)
+			c.sendStatus(http.StatusInternalServerError, err)
+		}
+	case TypeSetStatus:
+		c.setStatus(e)
+	case TypeBroadcast:
+		c.touch()
+		c.broadcast(e)
+	case TypeOffer, TypeAnswer, TypeCandidate:
+		c.touch()
+		c.relaySignaling(e)
+	}
+}
+
+// groupOf returns the group in a command's payload
+func groupOf(e *MessageEnvelope) string {
+	var p struct {
+		Group string `json:"group"`
+	}
+	if len(e.RawPayload) > 0 {
+		json.Unmarshal(e.RawPayload, &p)
+	}
+	return p.Group
+}
+
+// broadcast relays a message to the user's other verified peers, or only to
+// those in the group
+func (c *Conn) broadcast(e *MessageEnvelope) {
+	if c.Pair != "" {
+		c.logger().Warnf("Ignoring a broadcast from ephemeral peer %q", c.FP)
+		return
+	}
+	group := groupOf(e)
+	ps, err := GetUsersPeers(c.User)
+	if err != nil {
+		c.logger().Errorf("Failed to get the peers to broadcast to: %s", err)
+		c.sendStatus(http.StatusInternalServerError, err)
+		return
+	}
+	out := *e
+	out.To = ""
+	b, err := out.encodeRelayed()
+	if err != nil {
+		c.logger().Errorf("Failed to encode a broadcast: %s", err)
+		return
+	}
+	if !c.checkOutbound("", TypeBroadcast, len(b)) {
+		return
+	}
+	c.logger().Infof("Broadcasting from %q to group %q", c.FP, group)
+	for _, target := range ps.InGroup(group) {
+		if target.FP != c.FP && target.Verified {
+			c.relay(target, TypeBroadcast, b)
+		}
+	}
+}
+
+// relaySignaling relays an offer, an answer or a candidate to its target
+func (c *Conn) relaySignaling(e *MessageEnvelope) {
+	kind, tfp := e.Type, e.To
+	if tfp == "" {
+		c.logger().Warnf("Ignoring an forwarding msg with no target")
+		c.auditRoute("", kind, RouteDropped)
+		return
+	}
+	if tfp == c.FP {
+		c.logger().Warnf("Refusing a %s %q sent to itself", kind, c.FP)
+		c.sendStatus(http.StatusBadRequest,
+			fmt.Errorf("Can't send a message to yourself"))
+		c.auditRoute(tfp, kind, RouteDropped)
+		return
+	}
+	// a message bounced back & forth as is keeps counting its hops
+	if max := conf().MaxHops; max > 0 && e.Hops >= max {
+		c.logger().Warnf("Dropping a %s from %q to %q, a routing loop of %d hops",
+			kind, c.FP, tfp, e.Hops)
+		c.sendStatus(http.StatusLoopDetected,
+			fmt.Errorf("Message was relayed %d times, it's looping", e.Hops))
+		c.auditRoute(tfp, kind, RouteDropped)
+		return
+	}
+	var target *Peer
+	if c.Pair == "" {
+		if target = c.routeTarget(tfp, kind); target == nil {
 			return
 		}
-		tfp := v.(string)
-		// verify message is not across users
-		rc := db.pool.Get()
-		defer rc.Close()
-		key := fmt.Sprintf("peer:%s", tfp)
-		targetUser, err := redis.String(rc.Do("HGET", key, "user"))
-		if err != nil {
-			Logger.Errorf("Failed to encode a clients msg: %s", err)
+		c.logger().Infof("Forwarding %s from %q to %q", kind, c.FP, tfp)
+	}
+	out := *e
+	out.To = ""
+	out.Hops++
+	b, err := out.encodeRelayed()
+	if err != nil {
+		c.logger().Errorf("Failed to encode a clients msg: %s", err)
+		c.auditRoute(tfp, kind, RouteDropped)
+		return
+	}
+	if !c.checkOutbound(tfp, kind, len(b)) {
+		return
+	}
+	if c.Pair != "" {
+		c.relayPaired(tfp, kind, b)
+		return
+	}
+	c.relay(target, kind, b)
+}
+
+// relay publishes a message on the target's channel. The target's
+// connection, on this server instance or another one, subscribes to the
+// channel and forwards the message.
+func (c *Conn) relay(target *Peer, kind string, m []byte) {
+	tfp := target.FP
+	n, err := db.Publish(fmt.Sprintf("out:%s", tfp), m)
+	if err != nil {
+		c.logger().Errorf("Failed to publish a %s: %s", kind, err)
+		c.auditRoute(tfp, kind, RouteDropped)
+	} else if n == 0 {
+		if target.Online {
+			// the target disconnected since it was read from the store
+			c.logger().Warnf("Relaying a %s to %q, which has just left", kind, tfp)
+		}
+		if c.queueOffline(tfp, kind, m) {
+			c.auditRoute(tfp, kind, RouteQueued)
+		} else {
+			c.auditRoute(tfp, kind, RouteOffline)
+		}
+	} else if !conf().AuditRouting {
+		// locating the target is only needed for the audit
+		return
+	} else if c.connectedElsewhere(tfp) {
+		c.auditRoute(tfp, kind, RouteRemote)
+	} else {
+		c.auditRoute(tfp, kind, RouteDelivered)
+	}
+}
+
+// checkOutbound returns whether a relayed message of that size can be sent
+// to the target. Oversized messages are refused with a 413 status.
+func (c *Conn) checkOutbound(tfp string, kind string, size int) bool {
+	max := conf().MaxOutbound
+	if max == 0 || size <= max {
+		return true
+	}
+	c.logger().Warnf("Refusing to relay a %d bytes %s from %q to %q", size, kind,
+		c.FP, tfp)
+	c.sendStatus(http.StatusRequestEntityTooLarge, fmt.Errorf(
+		"Message is %d bytes, the maximum is %d", size, max))
+	c.auditRoute(tfp, kind, RouteDropped)
+	return false
+}
+
+// kick disconnects the connections of another peer of the user
+func (c *Conn) kick(tfp string) {
+	if !c.Verified {
+		c.sendStatus(http.StatusUnauthorized,
+			fmt.Errorf("Unverified peers can't disconnect peers"))
+		return
+	}
+	owner, err := PeerOwner(tfp)
+	if err != nil {
+		c.logger().Errorf("Failed to get the peer to kick: %s", err)
+		c.sendStatus(http.StatusInternalServerError, err)
+		return
+	}
+	if owner == "" {
+		c.sendStatus(http.StatusNotFound, &PeerNotFound{tfp})
+		return
+	}
+	if owner != c.User {
+		c.logger().Warnf("Refusing %q kicking a peer of another user: %q",
+			c.FP, tfp)
+		c.sendStatus(http.StatusForbidden,
+			fmt.Errorf("Can't disconnect a peer of another user"))
+		return
+	}
+	// the target may be connected to another instance, so it's closed
+	// through its channel rather than the local hub
+	n, err := ClosePeer(tfp, http.StatusGone,
+		fmt.Errorf("Disconnected by %q", c.FP),
+		&CloseReason{CloseKicked, "kicked by another device"})
+	if err != nil {
+		c.logger().Errorf("Failed to disconnect %q: %s", tfp, err)
+		c.sendStatus(http.StatusServiceUnavailable,
+			fmt.Errorf("Failed to disconnect %q", tfp))
+		return
+	}
+	if n == 0 {
+		c.sendStatus(http.StatusNotFound,
+			fmt.Errorf("Peer %q is not connected", tfp))
+		return
+	}
+	audit(AuditEvent{Type: AuditKick, FP: c.FP, User: c.User, Target: tfp,
+		ConnID: c.ID})
+	c.logger().Infof("%q disconnected %q", c.FP, tfp)
+	c.sendStatus(http.StatusOK, fmt.Errorf("Disconnected %q", tfp))
+}
+
+// subscribePresence limits the presence updates forwarded to the peer to
+// the peers with the fingerprints, an empty list restores all updates
+func (c *Conn) subscribePresence(v interface{}) {
+	fps, _ := v.([]interface{})
+	var presence map[string]bool
+	if len(fps) > 0 {
+		presence = make(map[string]bool, len(fps))
+		for _, fp := range fps {
+			if s, ok := fp.(string); ok {
+				presence[s] = true
+			}
+		}
+	}
+	c.presenceM.Lock()
+	c.presence = presence
+	c.presenceM.Unlock()
+	c.logger().Infof("%q subscribed to the presence of %v", c.FP, fps)
+}
+
+// The limits of a connection's labels
+const (
+	MaxLabels   = 8
+	MaxLabelLen = 64
+)
+
+// setStatus sets the connection's labels, e.g. {"battery": "low"}, and
+// publishes them in a presence update. No labels clears them.
+func (c *Conn) setStatus(e *MessageEnvelope) {
+	if c.Pair != "" {
+		c.logger().Warnf("Ignoring a status of ephemeral peer %q", c.FP)
+		return
+	}
+	var p struct {
+		Labels map[string]string `json:"labels"`
+	}
+	if len(e.RawPayload) > 0 {
+		if err := json.Unmarshal(e.RawPayload, &p); err != nil {
+			c.sendStatus(http.StatusBadRequest,
+				fmt.Errorf("Labels must be a map of strings"))
 			return
 		}
-		if c.User != targetUser {
-			Logger.Warnf("Refusing to forward across users: %s => %s  ",
-				c.User, targetUser)
-			c.sendStatus(http.StatusUnauthorized,
-				fmt.Errorf("Target peer belongs to user %q", targetUser))
+	}
+	if len(p.Labels) > MaxLabels {
+		c.sendStatus(http.StatusBadRequest,
+			fmt.Errorf("More than %d labels", MaxLabels))
+		return
+	}
+	for k, v := range p.Labels {
+		if k == "" || len(k) > MaxLabelLen || len(v) > MaxLabelLen {
+			c.sendStatus(http.StatusBadRequest, fmt.Errorf(
+				"Label %q must be 1-%d long, with a value of up to %d",
+				k, MaxLabelLen, MaxLabelLen))
 			return
 		}
+	}
+	if len(p.Labels) == 0 {
+		p.Labels = nil
+	}
+	c.labelsM.Lock()
+	c.labels = p.Labels
+	c.labelsM.Unlock()
+	if err := c.SetOnline(db, true); err != nil {
+		c.logger().Errorf("Failed to publish the labels of %q: %s", c.FP, err)
+	}
+}
 
-		Logger.Infof("Forwarding: %v", m)
-		delete(m, "target")
-		SendMessage(tfp, m)
-		if err != nil {
-			Logger.Errorf("Failed to encode a clients msg: %s", err)
+// getLabels returns the connection's labels
+func (c *Conn) getLabels() map[string]string {
+	c.labelsM.Lock()
+	defer c.labelsM.Unlock()
+	return c.labels
+}
+
+// queuePresence queues a presence update of the peer with the fingerprint.
+// With a presence window, the updates in it are coalesced into one
+// presence-batch message holding the latest update of each peer.
+func (c *Conn) queuePresence(fp string, m []byte) {
+	window := conf().presenceWindow()
+	if window <= 0 {
+		c.queueControl(m, OutboundRecord{Type: TypePeerUpdate, From: fp})
+		return
+	}
+	c.batchM.Lock()
+	defer c.batchM.Unlock()
+	if i, found := c.batchFPs[fp]; found {
+		c.batch[i] = m
+		return
+	}
+	if c.batchFPs == nil {
+		c.batchFPs = make(map[string]int)
+	}
+	c.batchFPs[fp] = len(c.batch)
+	c.batch = append(c.batch, m)
+	if c.batchTimer == nil {
+		c.batchTimer = time.AfterFunc(window, c.flushPresence)
+	}
+}
+
+// flushPresence queues the coalesced presence updates, a lone update is
+// queued as is
+func (c *Conn) flushPresence() {
+	c.batchM.Lock()
+	batch, fps := c.batch, c.batchFPs
+	c.batch, c.batchFPs, c.batchTimer = nil, nil, nil
+	c.batchM.Unlock()
+	if len(batch) == 1 {
+		r := OutboundRecord{Type: TypePeerUpdate}
+		for fp := range fps {
+			r.From = fp
 		}
+		c.queueControl(batch[0], r)
+		return
+	}
+	m, err := json.Marshal(map[string]interface{}{"type": TypePresenceBatch,
+		"changes": batch})
+	if err != nil {
+		c.logger().Errorf("Failed to marshal a presence batch: %s", err)
+		return
+	}
+	c.queueControl(m, OutboundRecord{Type: TypePresenceBatch})
+}
+
+// wantsPresence returns whether a presence update of the peer with the
+// fingerprint should be forwarded
+func (c *Conn) wantsPresence(fp string) bool {
+	c.presenceM.Lock()
+	defer c.presenceM.Unlock()
+	return c.presence == nil || c.presence[fp]
+}
+
+// routeTarget returns the target peer of a message, or nil if it's unknown
+// or belongs to another user
+func (c *Conn) routeTarget(tfp string, kind string) *Peer {
+	// verify message is not across users
+	target, err := db.GetPeer(tfp)
+	if err != nil {
+		c.logger().Errorf("Failed to get the target peer: %s", err)
+		c.auditRoute(tfp, kind, RouteDropped)
+		return nil
+	}
+	if target.User == "" {
+		target = nil
+	}
+	sender := &Peer{FP: c.FP, User: c.User, Verified: c.Verified}
+	outcome, err := routeCheck(sender, tfp, target)
+	switch outcome {
+	case "":
+		return target
+	case RouteForeign:
+		c.logger().Warnf("Refusing to forward across users: %s => %s  ",
+			c.User, target.User)
+		c.sendStatus(http.StatusUnauthorized, err)
+	default:
+		c.logger().Warnf("Ignoring a message from %q: %s", c.FP, err)
+	}
+	c.auditRoute(tfp, kind, outcome)
+	return nil
+}
+
+// routeCheck returns the outcome of routing a message from the sender to the
+// target and why, or an empty outcome when the message can be relayed.
+// target is nil when it's unknown, a deleted target in its grace period is
+// unknown too. It's pure, so the route tests can ask
+// what would happen without sending.
+func routeCheck(sender *Peer, tfp string, target *Peer) (string, error) {
+	if !sender.Verified {
+		return RoutePolicyBlocked, &UnauthorizedPeer{sender.FP}
+	}
+	if tfp == sender.FP {
+		return RoutePolicyBlocked, fmt.Errorf("Can't send a message to yourself")
+	}
+	if target == nil || target.DeletedOn != 0 {
+		return RouteDropped, fmt.Errorf("Unknown target peer %q", tfp)
+	}
+	if target.User != sender.User {
+		return RouteForeign, fmt.Errorf("Target peer belongs to user %q",
+			target.User)
+	}
+	// unverified peers ignore the messages they get
+	if !target.Verified {
+		return RoutePolicyBlocked, fmt.Errorf("Target peer %q is unverified", tfp)
+	}
+	return "", nil
+}
+
+// The outcomes of routing a message, as logged in the audit trail
+const (
+	RouteDelivered = "delivered"
+	RouteDropped   = "dropped"
+	RouteForeign   = "foreign"
+	RouteOffline   = "offline"
+	// RouteRemote is a message to a peer connected to another instance
+	RouteRemote = "remote"
+	// RouteQueued is a message queued for an offline peer
+	RouteQueued = "queued"
+	// RoutePolicyBlocked is a message refused by policy, e.g. from or to an
+	// unverified peer
+	RoutePolicyBlocked = "policy-blocked"
+)
+
+// connectedElsewhere returns whether the target is connected to another
+// server instance
+func (c *Conn) connectedElsewhere(tfp string) bool {
+	instance, err := hub.Locate(tfp)
+	if err != nil {
+		c.logger().Errorf("Failed to locate %q: %s", tfp, err)
+		return false
+	}
+	return instance != "" && instance != hub.instance
+}
+
+// auditRoute logs the metadata of a routed message and adds it to the audit
+// buffer when audit_routing is set. The message's payload is never logged.
+func (c *Conn) auditRoute(target string, kind string, outcome string) {
+	if !conf().AuditRouting {
+		return
 	}
+	c.logger().Debugw("routed message", "source_fp", c.FP, "target_fp", target,
+		"type", kind, "outcome", outcome)
+	audit(AuditEvent{Type: AuditRoute, FP: c.FP, User: c.User, Target: target,
+		ConnID: c.ID, Detail: kind + " " + outcome})
 }
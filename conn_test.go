@@ -0,0 +1,1005 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// observed holds the core of the test observing the logs, the global logger
+// is set once and writes to it too so goroutines of former tests never race
+// with a test replacing the logger
+var (
+	observed       atomic.Value
+	testLoggerOnce sync.Once
+)
+
+// observedCore writes the logs to the observing test's core, if any
+type observedCore struct {
+	fields []zapcore.Field
+}
+
+type observingCore struct {
+	core zapcore.Core
+}
+
+func (c *observedCore) current() zapcore.Core {
+	o, _ := observed.Load().(observingCore)
+	return o.core
+}
+
+func (c *observedCore) Enabled(level zapcore.Level) bool {
+	core := c.current()
+	return core != nil && core.Enabled(level)
+}
+
+func (c *observedCore) With(fields []zapcore.Field) zapcore.Core {
+	return &observedCore{append(c.fields[:len(c.fields):len(c.fields)], fields...)}
+}
+
+func (c *observedCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c *observedCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	core := c.current()
+	if core == nil {
+		return nil
+	}
+	return core.With(c.fields).Write(e, fields)
+}
+
+func (c *observedCore) Sync() error { return nil }
+
+// initTestLogger sets the global logger, once, to a development logger that
+// writes to the observing test's core too
+func initTestLogger() {
+	testLoggerOnce.Do(func() {
+		l, err := zap.NewDevelopment()
+		if err != nil {
+			panic(err)
+		}
+		Logger = zap.New(zapcore.NewTee(l.Core(), &observedCore{})).Sugar()
+	})
+}
+
+// observeLogs records the logs till the returned function is called
+func observeLogs(level zapcore.Level) (*observer.ObservedLogs, func()) {
+	initTestLogger()
+	core, logs := observer.New(level)
+	observed.Store(observingCore{core})
+	return logs, func() { observed.Store(observingCore{}) }
+}
+
+func TestSlowConsumer(t *testing.T) {
+	logs, restore := observeLogs(zap.WarnLevel)
+	defer restore()
+	period := slowConsumerPeriod
+	slowConsumerPeriod = 10 * time.Millisecond
+	defer func() { slowConsumerPeriod = period }()
+	// a peer that never reads its messages
+	c := &Conn{FP: "A", ID: newConnID(), send: make(chan outbound, 4)}
+	for i := 0; i < 4; i++ {
+		require.True(t, c.queue([]byte("hello"), OutboundRecord{}))
+	}
+	require.False(t, c.queue([]byte("hello"), OutboundRecord{}))
+	require.Equal(t, uint64(4), c.Sent())
+	require.Equal(t, uint64(1), c.Dropped())
+	time.Sleep(2 * slowConsumerPeriod)
+	require.False(t, c.queue([]byte("hello"), OutboundRecord{}))
+	require.Equal(t, uint64(2), c.Dropped())
+	slow := logs.FilterMessageSnippet("Slow consumer").All()
+	require.Len(t, slow, 1)
+	require.True(t, strings.Contains(slow[0].Message, c.ID),
+		"the warning should have the connection ID: %s", slow[0].Message)
+}
+
+func TestSendAfterDisconnect(t *testing.T) {
+	logs, restore := observeLogs(zap.InfoLevel)
+	defer restore()
+	c := &Conn{FP: "A", ID: newConnID(), send: make(chan outbound, 4),
+		control: make(chan outbound, 4), done: make(chan struct{})}
+	c.disconnect(http.StatusGone, fmt.Errorf("Peer was deleted"), nil)
+	// the status & the closing sentinel
+	require.Len(t, c.control, 2)
+	require.NotPanics(t, func() {
+		require.Nil(t, c.sendStatus(http.StatusGone, fmt.Errorf("Peer was deleted")))
+		require.False(t, c.queue([]byte("hello"), OutboundRecord{}))
+		c.disconnect(http.StatusGone, fmt.Errorf("Disconnected by \"B\""), nil)
+	})
+	require.Len(t, c.control, 2)
+	require.Len(t, c.send, 0)
+	require.Equal(t, uint64(2), c.Sent())
+	require.Equal(t, uint64(2), c.Dropped())
+	require.Len(t, logs.FilterMessageSnippet("as it's disconnected").All(), 2)
+}
+func TestNormalizeMessage(t *testing.T) {
+	m := map[string]interface{}{
+		"target":    " B\r\n",
+		"candidate": "\t\x00a candidate \n",
+		"count":     float64(3),
+		"nested":    map[string]interface{}{"a": " b "},
+	}
+	normalizeMessage(m)
+	require.Equal(t, "B", m["target"])
+	require.Equal(t, "a candidate", m["candidate"])
+	require.Equal(t, float64(3), m["count"])
+	require.Equal(t, " b ", m["nested"].(map[string]interface{})["a"])
+}
+func TestTrimFieldsRelay(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.TrimFields = true })
+	redisDouble.SetAdd("user:j", "A", "B")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	redisDouble.HSet("peer:B", "fp", "B", "name", "bar", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	wsA, err := openWS("ws://127.0.0.1:17777/ws?fp=A")
+	require.Nil(t, err)
+	defer wsA.Close()
+	wsB, err := openWS("ws://127.0.0.1:17777/ws?fp=B")
+	require.Nil(t, err)
+	defer wsB.Close()
+	wsB.SetReadDeadline(time.Now().Add(ReadTimeout))
+	time.Sleep(time.Second / 10)
+	err = wsA.WriteJSON(map[string]string{"offer": " an offer\n", "target": "B \n"})
+	require.Nil(t, err)
+	var m map[string]interface{}
+	for {
+		err = wsB.ReadJSON(&m)
+		require.Nil(t, err)
+		if _, found := m["offer"]; found {
+			break
+		}
+	}
+	require.Equal(t, "an offer", m["offer"])
+}
+func TestFailedWriteClosesConn(t *testing.T) {
+	startTest(t)
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "1")
+	conns := make(chan *websocket.Conn, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		require.Nil(t, err)
+		conns <- ws
+	}))
+	defer s.Close()
+	client, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.Nil(t, err)
+	defer client.Close()
+	ws := <-conns
+	// break the connection so every write fails
+	ws.UnderlyingConn().Close()
+	c := &Conn{WS: ws, FP: "A", User: "j", Verified: true, ID: newConnID(),
+		send: make(chan outbound, SendBufSize)}
+	done := make(chan struct{})
+	go func() {
+		c.pinger(context.Background())
+		close(done)
+	}()
+	c.queue([]byte(`{"hello": "world"}`), OutboundRecord{})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pinger didn't exit after a failed write")
+	}
+	require.Eventually(t, func() bool {
+		return redisDouble.HGet("peer:A", "online") == "0"
+	}, time.Second, 10*time.Millisecond, "peer wasn't unregistered")
+}
+func TestParseKeepalive(t *testing.T) {
+	for _, tc := range []struct {
+		q    string
+		ping time.Duration
+		pong time.Duration
+	}{
+		{"", pingPeriod, pongWait},
+		{"ping=30", 30 * time.Second, 31 * time.Second},
+		{"ping=30&pong=45", 30 * time.Second, 45 * time.Second},
+		{"ping=0.01", minPingPeriod, minPingPeriod + time.Second},
+		{"ping=3600&pong=7200", maxPingPeriod, maxPongWait},
+		{"ping=20&pong=1", 20 * time.Second, 21 * time.Second},
+		{"ping=bad", pingPeriod, pongWait},
+	} {
+		q, err := url.ParseQuery(tc.q)
+		require.Nil(t, err)
+		ping, pong := parseKeepalive(q)
+		require.Equal(t, tc.ping, ping, "ping of %q", tc.q)
+		require.Equal(t, tc.pong, pong, "pong of %q", tc.q)
+	}
+}
+func TestKeepaliveNegotiation(t *testing.T) {
+	startTest(t)
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	periods := make(chan time.Duration, 1)
+	ticks := make(chan time.Time)
+	orig := newTicker
+	newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+		periods <- d
+		return ticks, func() {}
+	}
+	defer func() { newTicker = orig }()
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=A&ping=30")
+	require.Nil(t, err)
+	defer ws.Close()
+	select {
+	case d := <-periods:
+		require.Equal(t, 30*time.Second, d)
+	case <-time.After(time.Second):
+		t.Fatal("pinger didn't start")
+	}
+	pings := make(chan struct{}, 2)
+	ws.SetPingHandler(func(string) error {
+		pings <- struct{}{}
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// every tick of the negotiated period sends a ping
+	for i := 0; i < 2; i++ {
+		ticks <- time.Now()
+		select {
+		case <-pings:
+		case <-time.After(time.Second):
+			t.Fatalf("no ping after tick %d", i)
+		}
+	}
+}
+func TestPingRTT(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.HighRTT = 200 })
+	logs, restore := observeLogs(zap.WarnLevel)
+	defer restore()
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	ticks := make(chan time.Time)
+	origTicker, origClock := newTicker, pingClock
+	newTicker = func(time.Duration) (<-chan time.Time, func()) {
+		return ticks, func() {}
+	}
+	// the clock only moves when the peer answers a ping
+	var elapsed, delay int64
+	start := time.Now()
+	pingClock = func() time.Time {
+		return start.Add(time.Duration(atomic.LoadInt64(&elapsed)))
+	}
+	defer func() { newTicker, pingClock = origTicker, origClock }()
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=A")
+	require.Nil(t, err)
+	defer ws.Close()
+	ws.SetPingHandler(func(data string) error {
+		atomic.AddInt64(&elapsed, atomic.LoadInt64(&delay))
+		return ws.WriteControl(websocket.PongMessage, []byte(data),
+			time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	rtt := func() float64 {
+		for _, c := range hub.Connections() {
+			if c.FP == "A" {
+				return c.RTT
+			}
+		}
+		return 0
+	}
+	highRTT := func() int {
+		return logs.FilterMessage("High ping round trip time").Len()
+	}
+	atomic.StoreInt64(&delay, int64(150*time.Millisecond))
+	ticks <- time.Now()
+	require.Eventually(t, func() bool { return rtt() == 150 }, time.Second,
+		10*time.Millisecond)
+	require.Zero(t, highRTT())
+	atomic.StoreInt64(&delay, int64(250*time.Millisecond))
+	ticks <- time.Now()
+	require.Eventually(t, func() bool { return rtt() == 250 }, time.Second,
+		10*time.Millisecond)
+	require.Equal(t, 1, highRTT())
+}
+func TestForgedPong(t *testing.T) {
+	startTest(t)
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	ticks := make(chan time.Time)
+	origTicker := newTicker
+	newTicker = func(time.Duration) (<-chan time.Time, func()) {
+		return ticks, func() {}
+	}
+	defer func() { newTicker = origTicker }()
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=A")
+	require.Nil(t, err)
+	defer ws.Close()
+	pings := make(chan string, 2)
+	var forge int32
+	ws.SetPingHandler(func(data string) error {
+		pings <- data
+		if atomic.LoadInt32(&forge) == 1 {
+			data = "forged"
+		}
+		return ws.WriteControl(websocket.PongMessage, []byte(data),
+			time.Now().Add(time.Second))
+	})
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// a pong echoing the ping keeps the connection
+	ticks <- time.Now()
+	first := <-pings
+	require.NotEmpty(t, first)
+	require.Eventually(t, func() bool {
+		for _, c := range hub.Connections() {
+			if c.FP == "A" && c.RTT > 0 {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+	// a pong with another payload is a dead connection
+	atomic.StoreInt32(&forge, 1)
+	ticks <- time.Now()
+	require.NotEqual(t, first, <-pings)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the connection with a forged pong wasn't closed")
+	}
+	require.Eventually(t, func() bool { return !hub.IsConnected("A") },
+		time.Second, 10*time.Millisecond)
+}
+func TestRoutingAudit(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.AuditRouting = true })
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "1")
+	redisDouble.HSet("peer:B", "fp", "B", "name", "bar", "kind", "lay",
+		"user", "j", "verified", "1", "online", "1")
+	redisDouble.Set("online:B", instanceID)
+	subscribeConn(t, &Conn{User: "j", FP: "B", Verified: true,
+		send: make(chan outbound, SendBufSize)})
+	logs, restore := observeLogs(zapcore.DebugLevel)
+	defer restore()
+	c := &Conn{User: "j", FP: "A", Verified: true, ID: newConnID(),
+		send: make(chan outbound, SendBufSize)}
+	c.handleMessage(map[string]interface{}{"offer": "SECRETSDP", "target": "B"})
+	c.handleMessage(map[string]interface{}{"candidate": "SECRETICE", "target": "Z"})
+	entries := logs.FilterMessage("routed message").All()
+	require.Len(t, entries, 2)
+	require.Equal(t, map[string]interface{}{"source_fp": "A", "target_fp": "B",
+		"type": "offer", "outcome": RouteDelivered}, entries[0].ContextMap())
+	require.Equal(t, map[string]interface{}{"source_fp": "A", "target_fp": "Z",
+		"type": "candidate", "outcome": RouteDropped}, entries[1].ContextMap())
+	require.Equal(t, zapcore.DebugLevel, entries[0].Level)
+	for _, e := range logs.All() {
+		require.NotContains(t, e.Message, "SECRET")
+	}
+	// the audit is off by default
+	setConfig(t, func(c *Config) { c.AuditRouting = false })
+	c.handleMessage(map[string]interface{}{"offer": "SECRETSDP", "target": "B"})
+	require.Len(t, logs.FilterMessage("routed message").All(), 2)
+}
+func TestAcceptLogSampling(t *testing.T) {
+	startTest(t)
+	logs, restore := observeLogs(zapcore.InfoLevel)
+	defer restore()
+	setConfig(t, func(c *Config) { c.LogSample = 5 })
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	for i := 0; i < 10; i++ {
+		ws, err := openWS("ws://127.0.0.1:17777/ws?fp=A")
+		require.Nil(t, err)
+		ws.Close()
+		// a bad request is refused & logged in full
+		_, _, err = websocket.DefaultDialer.Dial("ws://127.0.0.1:17777/ws", nil)
+		require.NotNil(t, err)
+	}
+	// each second, the first request and every 5th one after it are logged
+	accepted := logs.FilterMessage("Got a new peer request").Len()
+	require.GreaterOrEqual(t, accepted, 4)
+	require.Less(t, accepted, 10)
+	require.Equal(t, 10, logs.FilterMessageSnippet("Refusing a bad request").Len())
+}
+func TestLastIP(t *testing.T) {
+	startTest(t)
+	logs, restore := observeLogs(zapcore.WarnLevel)
+	defer restore()
+	setConfig(t, func(c *Config) {
+		c.TrustedProxies = []string{"127.0.0.1/32"}
+		c.trustedProxies, _ = parseCIDRs(c.TrustedProxies)
+		c.AdminToken = "anadmintoken"
+	})
+	redisDouble.Set("token:aniptoken", "j")
+	redisDouble.SetAdd("user:j", "A")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	connect := func(ip string) {
+		h := http.Header{}
+		h.Set("X-Forwarded-For", ip)
+		ws, _, err := cstDialer.Dial("ws://127.0.0.1:17777/ws?fp=A", h)
+		require.Nil(t, err)
+		ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+		requireStatus(t, ws, 200)
+		ws.Close()
+	}
+	changes := func() int {
+		return logs.FilterMessage("Peer connected from another network").Len()
+	}
+	connect("203.0.113.5")
+	require.Equal(t, "203.0.113.5", redisDouble.HGet("peer:A", "last_ip"))
+	// the first IP & one of the same network aren't a change
+	connect("203.0.113.9")
+	require.Equal(t, "203.0.113.9", redisDouble.HGet("peer:A", "last_ip"))
+	require.Zero(t, changes())
+	connect("198.51.100.7")
+	require.Equal(t, "198.51.100.7", redisDouble.HGet("peer:A", "last_ip"))
+	require.Equal(t, 1, changes())
+	// only admins see the last IP
+	list := func(token string) []map[string]interface{} {
+		resp := apiRequest(t, "GET", "/list/aniptoken", token, nil)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var l struct {
+			Peers []map[string]interface{} `json:"peers"`
+		}
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+		require.Len(t, l.Peers, 1)
+		return l.Peers
+	}
+	require.Equal(t, "198.51.100.7", list("anadmintoken")[0]["last_ip"])
+	require.NotContains(t, list("")[0], "last_ip")
+	require.True(t, sameNetwork("2001:db8::1", "2001:db8::2"))
+	require.False(t, sameNetwork("2001:db8::1", "2001:db8:1::1"))
+	require.False(t, sameNetwork("203.0.113.5", "2001:db8::1"))
+}
+func TestInboundThrottling(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) {
+		c.MsgRate = 0.001
+		c.MsgBurst = 3
+	})
+	redisDouble.SetAdd("user:j", "A", "B")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	redisDouble.HSet("peer:B", "fp", "B", "name", "bar", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	wsA, err := openWS("ws://127.0.0.1:17777/ws?fp=A")
+	require.Nil(t, err)
+	defer wsA.Close()
+	wsB, err := openWS("ws://127.0.0.1:17777/ws?fp=B")
+	require.Nil(t, err)
+	defer wsB.Close()
+	time.Sleep(time.Second / 10)
+	throttled := atomic.LoadUint64(&throttledMessages)
+	// countOffers reads the websocket until it's quiet and counts the offers
+	countOffers := func(ws *websocket.Conn) int {
+		n := 0
+		for {
+			var m map[string]interface{}
+			ws.SetReadDeadline(time.Now().Add(time.Second / 5))
+			if err := ws.ReadJSON(&m); err != nil {
+				return n
+			}
+			if _, found := m["offer"]; found {
+				n++
+			}
+		}
+	}
+	// A is noisy, B is well behaved
+	for i := 0; i < 10; i++ {
+		require.Nil(t, wsA.WriteJSON(map[string]string{"offer": "o", "target": "B"}))
+	}
+	require.Nil(t, wsB.WriteJSON(map[string]string{"offer": "o", "target": "A"}))
+	require.Nil(t, wsB.WriteJSON(map[string]string{"offer": "o", "target": "A"}))
+	require.Equal(t, 3, countOffers(wsB))
+	require.Equal(t, 2, countOffers(wsA))
+	require.Equal(t, throttled+7, atomic.LoadUint64(&throttledMessages))
+}
+func TestInboundThrottlingClose(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) {
+		c.MsgRate = 0.001
+		c.MsgBurst = 1
+		c.MsgThrottleClose = true
+	})
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=A")
+	require.Nil(t, err)
+	defer ws.Close()
+	for i := 0; i < 2; i++ {
+		require.Nil(t, ws.WriteJSON(map[string]string{"offer": "o", "target": "B"}))
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	requireCloseCode(t, ws, CloseRateLimited)
+}
+
+// requireCloseCode reads messages until the connection is closed and
+// requires the close frame's code
+func requireCloseCode(t *testing.T, ws *websocket.Conn, code int) {
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var ce *websocket.CloseError
+		require.True(t, errors.As(err, &ce), "connection wasn't closed: %s", err)
+		require.Equal(t, code, ce.Code, "got: %s", ce)
+		return
+	}
+}
+func TestCloseCodes(t *testing.T) {
+	startTest(t)
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	online := func(fp string) func() bool {
+		return func() bool { return redisDouble.Exists("online:" + fp) }
+	}
+	// a revoked peer gets a 401 and is told to stop reconnecting
+	wsA := connectPeer(t, s, "A")
+	require.Eventually(t, online("A"), time.Second, 10*time.Millisecond)
+	require.Nil(t, VerifyPeer("A", false))
+	requireStatusWith(t, wsA, http.StatusUnauthorized)
+	requireCloseCode(t, wsA, CloseRevoked)
+	// so is a deleted one, with a 410
+	wsB := connectPeer(t, s, "B")
+	require.Eventually(t, online("B"), time.Second, 10*time.Millisecond)
+	p, err := db.GetPeer("B")
+	require.Nil(t, err)
+	require.Nil(t, DeletePeer(p))
+	requireStatusWith(t, wsB, http.StatusGone)
+	requireCloseCode(t, wsB, CloseRevoked)
+}
+func TestShutdownCloseCode(t *testing.T) {
+	startTest(t)
+	seedPeer("A", "foo", "j", true)
+	// a hub of its own, as the global one serves the other tests
+	h := NewHub(db)
+	go h.run()
+	conns := make(chan *websocket.Conn, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		require.Nil(t, err)
+		conns <- ws
+	}))
+	defer s.Close()
+	ws, _, err := cstDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.Nil(t, err)
+	defer ws.Close()
+	h.Register(&Conn{WS: <-conns, FP: "A", User: "j", Verified: true,
+		ID: newConnID(), send: make(chan outbound, SendBufSize),
+		control: make(chan outbound, ControlBufSize)})
+	require.Eventually(t, func() bool { return h.Stats(0).Connected == 1 },
+		time.Second, 10*time.Millisecond)
+	h.Stop()
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	requireCloseCode(t, ws, CloseServerRestart)
+}
+func TestMessageSizeLimits(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) {
+		c.MaxInbound = 200
+		c.MaxOutbound = 100
+	})
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	wsA := connectPeer(t, s, "A")
+	wsB := connectPeer(t, s, "B")
+	// a relay that's too big for the target is refused
+	offer := strings.Repeat("o", 120)
+	require.Nil(t, wsA.WriteJSON(map[string]string{"offer": offer, "target": "B"}))
+	requireStatusWith(t, wsA, http.StatusRequestEntityTooLarge)
+	require.Nil(t, wsA.WriteJSON(map[string]string{"offer": "small", "target": "B"}))
+	m := readUntil(t, wsB, "offer")
+	require.Equal(t, "small", m["offer"])
+	// an inbound message that's too big closes the connection
+	require.Nil(t, wsA.WriteJSON(map[string]string{"offer": strings.Repeat("o", 300),
+		"target": "B"}))
+	for {
+		var m map[string]interface{}
+		if err := wsA.ReadJSON(&m); err != nil {
+			require.NotContains(t, err.Error(), "timeout")
+			break
+		}
+	}
+}
+func TestControlPriority(t *testing.T) {
+	startTest(t)
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "1")
+	conns := make(chan *websocket.Conn, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		require.Nil(t, err)
+		conns <- ws
+	}))
+	defer s.Close()
+	client, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.Nil(t, err)
+	defer client.Close()
+	c := &Conn{WS: <-conns, FP: "A", User: "j", Verified: true,
+		ID: newConnID(), send: make(chan outbound, SendBufSize),
+		control: make(chan outbound, ControlBufSize)}
+	for i := 0; i < 100; i++ {
+		c.forward("out:A", []byte(`{"offer": "an offer"}`))
+	}
+	c.forward("peers:j", []byte(`{"peer_update": {"fp": "B"}, "source_fp": "B"}`))
+	require.Nil(t, c.sendStatus(http.StatusOK, fmt.Errorf("a status")))
+	go c.pinger(context.Background())
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	var m map[string]interface{}
+	require.Nil(t, client.ReadJSON(&m))
+	require.Contains(t, m, "peer_update")
+	m = nil
+	require.Nil(t, client.ReadJSON(&m))
+	require.Contains(t, m, "code")
+	m = nil
+	require.Nil(t, client.ReadJSON(&m))
+	require.Equal(t, "an offer", m["offer"])
+}
+func TestWriteTimeout(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.WriteWait = 50 })
+	conns := make(chan *websocket.Conn, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		require.Nil(t, err)
+		conns <- ws
+	}))
+	defer s.Close()
+	// the client never reads, so the server's writes stall
+	client, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	require.Nil(t, err)
+	defer client.Close()
+	c := &Conn{WS: <-conns, FP: "A", ID: newConnID()}
+	before := atomic.LoadUint64(&writeTimeouts)
+	start := time.Now()
+	require.False(t, c.write(outbound{m: make([]byte, 64<<20)}, true))
+	require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	require.Equal(t, before+1, atomic.LoadUint64(&writeTimeouts))
+	require.False(t, isTimeout(websocket.ErrCloseSent))
+	require.False(t, isTimeout(nil))
+}
+
+// TestConnGoroutines checks a connection's goroutines all end with it, on
+// every path
+func TestConnGoroutines(t *testing.T) {
+	startTest(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", false)
+	s := newTestServer(t)
+	u := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	baseline := runtime.NumGoroutine()
+	for round := 0; round < 3; round++ {
+		// connect & disconnect
+		for i := 0; i < 10; i++ {
+			connectPeer(t, s, "A").Close()
+		}
+		// an unverified peer that leaves at once
+		ws, _, err := cstDialer.Dial(u+"?fp=B", nil)
+		require.Nil(t, err)
+		ws.Close()
+		// a missing fingerprint
+		_, resp, err := cstDialer.Dial(u, nil)
+		require.NotNil(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		// a failed upgrade
+		resp, err = client.Get(s.URL + "/ws?fp=A")
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		// disconnected by the server
+		require.Eventually(t, func() bool {
+			return hub.Stats(0).Connected == 0
+		}, time.Second, 10*time.Millisecond)
+		ws = connectPeer(t, s, "A")
+		n, err := hub.Kick("A", "test")
+		require.Nil(t, err)
+		require.Equal(t, 1, n)
+		for err == nil {
+			_, _, err = ws.ReadMessage()
+		}
+		ws.Close()
+	}
+	// the store's pool keeps up to MaxIdle connections, each served by a
+	// goroutine of the redis double
+	require.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= baseline+5
+	}, 2*time.Second, 10*time.Millisecond,
+		"goroutines leaked: %d, started with %d", runtime.NumGoroutine(), baseline)
+}
+func TestGroupBroadcast(t *testing.T) {
+	startTest(t)
+	for fp, group := range map[string]string{"A": "home", "B": "home",
+		"C": "office"} {
+		seedPeer(fp, fp, "j", true)
+		redisDouble.HSet("peer:"+fp, "group", group)
+	}
+	s := newTestServer(t)
+	a := connectPeer(t, s, "A")
+	b := connectPeer(t, s, "B")
+	c := connectPeer(t, s, "C")
+	for _, group := range []string{"home", "office"} {
+		require.Nil(t, a.WriteJSON(map[string]interface{}{
+			"command": "broadcast", "group": group,
+			"message": map[string]string{"hello": group}}))
+	}
+	m := readUntil(t, b, "message")
+	require.Equal(t, "home", m["group"])
+	require.Equal(t, "A", m["source_fp"])
+	require.Equal(t, map[string]interface{}{"hello": "home"}, m["message"])
+	// C's first broadcast is the office's one
+	m = readUntil(t, c, "message")
+	require.Equal(t, "office", m["group"])
+	// the list is scoped too
+	require.Nil(t, c.WriteJSON(map[string]interface{}{
+		"command": "get_list", "group": "home"}))
+	m = readUntil(t, c, "peers")
+	var fps []string
+	for _, p := range m["peers"].([]interface{}) {
+		fps = append(fps, p.(map[string]interface{})["fp"].(string))
+	}
+	require.ElementsMatch(t, []string{"A", "B"}, fps)
+}
+func TestAppHeartbeat(t *testing.T) {
+	startTest(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	s := newTestServer(t)
+	// neither client answers ping frames, as if a proxy strips them
+	open := func(q string) (*websocket.Conn, chan struct{}) {
+		ws, _, err := cstDialer.Dial(
+			"ws"+strings.TrimPrefix(s.URL, "http")+"/ws?"+q, nil)
+		require.Nil(t, err)
+		t.Cleanup(func() { ws.Close() })
+		ws.SetPingHandler(func(string) error { return nil })
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				var m map[string]interface{}
+				if err := ws.ReadJSON(&m); err != nil {
+					return
+				}
+				if m["type"] == TypePing {
+					ws.WriteJSON(map[string]string{"type": TypePong})
+				}
+			}
+		}()
+		return ws, closed
+	}
+	_, closedA := open("fp=A&ping=1&pong=2&heartbeat=app")
+	_, closedB := open("fp=B&ping=1&pong=2")
+	select {
+	case <-closedB:
+	case <-time.After(4 * time.Second):
+		t.Fatal("B's connection outlived its pong wait")
+	}
+	// A is kept past its own pong wait
+	select {
+	case <-closedA:
+		t.Fatal("A's connection closed despite its application pongs")
+	case <-time.After(1500 * time.Millisecond):
+	}
+	connected, err := hub.askConnected("A")
+	require.Nil(t, err)
+	require.True(t, connected)
+}
+func TestUnverifiedRetryAfter(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.UnverifiedRetry = 42 })
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", false)
+	u := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?fp=A"
+	ws, _, err := cstDialer.Dial(u, nil)
+	require.Nil(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	var status StatusMessage
+	require.Nil(t, ws.ReadJSON(&status))
+	require.Equal(t, http.StatusUnauthorized, status.Code)
+	require.Equal(t, 42, status.RetryAfter)
+	// verified peers get no hint
+	seedPeer("B", "bar", "j", true)
+	wsB, _, err := cstDialer.Dial(
+		"ws"+strings.TrimPrefix(s.URL, "http")+"/ws?fp=B", nil)
+	require.Nil(t, err)
+	defer wsB.Close()
+	wsB.SetReadDeadline(time.Now().Add(ReadTimeout))
+	var m map[string]interface{}
+	require.Nil(t, wsB.ReadJSON(&m))
+	require.Equal(t, float64(http.StatusOK), m["code"])
+	_, found := m["retry_after"]
+	require.False(t, found)
+}
+func TestRoutingLoop(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.MaxHops = 3 })
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	wsA := connectPeer(t, s, "A")
+	wsB := connectPeer(t, s, "B")
+	// a message to itself is refused
+	require.Nil(t, wsA.WriteJSON(map[string]interface{}{"offer": "SDP",
+		"target": "A"}))
+	requireStatusWith(t, wsA, http.StatusBadRequest)
+	// A & B bounce the offer back as is
+	require.Nil(t, wsA.WriteJSON(map[string]interface{}{"offer": "SDP",
+		"target": "B"}))
+	from, to := wsA, wsB
+	for hops := 1; hops < 3; hops++ {
+		m := readUntil(t, to, "offer")
+		require.Equal(t, float64(hops), m["hops"])
+		m["target"] = m["source_fp"]
+		require.Nil(t, to.WriteJSON(m))
+		from, to = to, from
+	}
+	// the third hop is a loop
+	m := readUntil(t, to, "offer")
+	require.Equal(t, float64(3), m["hops"])
+	m["target"] = m["source_fp"]
+	require.Nil(t, to.WriteJSON(m))
+	requireStatusWith(t, to, http.StatusLoopDetected)
+	from.SetReadDeadline(time.Now().Add(time.Second / 5))
+	for {
+		var m map[string]interface{}
+		if err := from.ReadJSON(&m); err != nil {
+			break
+		}
+		_, found := m["offer"]
+		require.False(t, found, "a looping offer was relayed: %v", m)
+	}
+}
+func TestIdleEviction(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.IdleEvict = 2 })
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	seedPeer("C", "baz", "j", true)
+	// A answers the pings every second but sends nothing
+	wsA, _, err := cstDialer.Dial(
+		"ws"+strings.TrimPrefix(s.URL, "http")+"/ws?ping=1&fp=A", nil)
+	require.Nil(t, err)
+	defer wsA.Close()
+	var pings int32
+	wsA.SetPingHandler(func(data string) error {
+		atomic.AddInt32(&pings, 1)
+		return wsA.WriteControl(websocket.PongMessage, []byte(data),
+			time.Now().Add(time.Second))
+	})
+	connected := time.Now()
+	// B keeps signaling C
+	wsB := connectPeer(t, s, "B")
+	connectPeer(t, s, "C")
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(300 * time.Millisecond):
+				wsB.WriteJSON(map[string]interface{}{"offer": "SDP",
+					"target": "C"})
+			}
+		}
+	}()
+	wsA.SetReadDeadline(time.Now().Add(6 * time.Second))
+	var status StatusMessage
+	for {
+		_, data, err := wsA.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			require.True(t, errors.As(err, &closeErr), "got %v", err)
+			require.Equal(t, CloseIdle, closeErr.Code)
+			break
+		}
+		json.Unmarshal(data, &status)
+	}
+	require.Equal(t, http.StatusRequestTimeout, status.Code)
+	require.True(t, time.Since(connected) >= 2*time.Second)
+	require.Greater(t, atomic.LoadInt32(&pings), int32(0))
+	require.True(t, hub.IsConnected("B"))
+	require.True(t, hub.IsConnected("C"))
+}
+func TestClientVersion(t *testing.T) {
+	startTest(t)
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	// connect returns the connection's first status and, for a refused
+	// connection, its close code
+	connect := func(v string) (int, int) {
+		u := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?fp=A"
+		if v != "" {
+			u += "&v=" + url.QueryEscape(v)
+		}
+		ws, _, err := cstDialer.Dial(u, nil)
+		require.Nil(t, err)
+		defer ws.Close()
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var status StatusMessage
+		require.Nil(t, ws.ReadJSON(&status))
+		if status.Code != http.StatusUpgradeRequired {
+			return status.Code, 0
+		}
+		_, _, err = ws.ReadMessage()
+		var closeErr *websocket.CloseError
+		require.True(t, errors.As(err, &closeErr), "got %v", err)
+		return status.Code, closeErr.Code
+	}
+	for _, tc := range []struct {
+		min      string
+		require  bool
+		version  string
+		accepted bool
+	}{
+		{"", false, "0.1", true},
+		{"", true, "", true},
+		{"1.2", false, "1.3", true},
+		{"1.2", false, "v1.2.0", true},
+		{"1.2", false, "1.1.9", false},
+		{"1.2", false, "", true},
+		{"1.2", false, "latest", false},
+		{"1.2", true, "1.10", true},
+		{"1.2", true, "0.9", false},
+		{"1.2", true, "", false},
+	} {
+		setConfig(t, func(c *Config) {
+			c.MinClientVersion = tc.min
+			c.RequireClientVersion = tc.require
+		})
+		code, closeCode := connect(tc.version)
+		if tc.accepted {
+			require.Equal(t, http.StatusOK, code,
+				"version %q with min %q refused", tc.version, tc.min)
+		} else {
+			require.Equal(t, CloseOutdated, closeCode,
+				"version %q with min %q accepted", tc.version, tc.min)
+		}
+		require.Eventually(t, func() bool { return !hub.IsConnected("A") },
+			time.Second, 10*time.Millisecond)
+	}
+}
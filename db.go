@@ -1,24 +1,111 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/gomodule/redigo/redis"
 )
 
-const TokenLen = 30      // in Bytes, four times that in base64 and urls
-const TokenTTL = 300     // in Seconds
-const EmailInterval = 60 // in Seconds
-const MaxPeersPerUser = 10
+const TokenLen = 30        // in Bytes, four times that in base64 and urls
+const TokenTTL = 300       // in Seconds
+const EmailInterval = 60   // in Seconds
+const MaxPeersPerUser = 10 // the default of max_peers
+const ScanCount = 100      // elements examined by each SSCAN call
 
-// DBType is the type that holds our db
+// Store is the interface of peerbook's storage backend. DBType is the redis
+// implementation and MemStore an in-memory one.
+type Store interface {
+	Connect(host string) error
+	Close() error
+	CreateToken(email string) (string, error)
+	GetToken(token string) (string, error)
+	// RevokeTokens deletes all the user's tokens and returns their number
+	RevokeTokens(email string) (int, error)
+	GetUser(email string) (*DBUser, error)
+	// ScanUser returns the user's peers whose name matches a glob pattern
+	ScanUser(email string, pattern string) (*DBUser, error)
+	// ScanUserPage returns up to count of the user's peers whose name
+	// matches a glob pattern, starting at the cursor, and the cursor of the
+	// next page. The cursor is empty after the last page.
+	ScanUserPage(email string, pattern string, cursor string, count int) (*DBUser, string, error)
+	DeleteUser(email string) error
+	GetPeer(fp string) (*Peer, error)
+	// FindPeer returns a peer, or a PeerNotFound error when it's not stored
+	FindPeer(fp string) (*Peer, error)
+	PeerExists(fp string) (bool, error)
+	AddPeer(peer *Peer) error
+	// AddPeers adds or updates the peers of a user all at once. When the new
+	// peers take the user past max_peers, none is added and it returns a
+	// TooManyPeers error.
+	AddPeers(user string, peers []*Peer) error
+	SetPeerField(fp string, field string, value interface{}) error
+	DeletePeer(fp string) error
+	// GetPeerOwner returns the user of a peer from the owners index, or an
+	// empty string when the peer isn't indexed
+	GetPeerOwner(fp string) (string, error)
+	// RepairOwners rebuilds the owners index from the peers and returns the
+	// number of entries it fixed
+	RepairOwners() (int, error)
+	// FindOrphans returns the fingerprints of the peers missing from their
+	// user's set and, with clean set, deletes them
+	FindOrphans(clean bool) ([]string, error)
+	// SetPeerTTL sets the time to live of a peer, a zero ttl persists it
+	SetPeerTTL(fp string, ttl time.Duration) error
+	// SetPeerOnline marks a peer as online at the server instance for the
+	// ttl, a zero ttl marks it offline. GetPeer reports peers as online
+	// until the ttl expires.
+	SetPeerOnline(fp string, instance string, ttl time.Duration) error
+	// GetPeerInstance returns the server instance an online peer is
+	// connected to, or an empty string when the peer is offline
+	GetPeerInstance(fp string) (string, error)
+	AddUserPeer(user string, fp string) error
+	RemoveUserPeer(user string, fp string) error
+	// CountPeers returns the number of registered peers
+	CountPeers() (int, error)
+	GetSecret(user string) (string, error)
+	SetSecret(user string, secret string) error
+	SetQRVerified(email string) error
+	IsQRVerified(email string) bool
+	canSendEmail(email string) bool
+	// Publish sends a message to all the subscribers of a channel and
+	// returns the number of subscribers that got it
+	Publish(channel string, msg []byte) (int, error)
+	// QueueMessage queues a message for an offline peer, for the ttl. Only
+	// the last max messages are kept.
+	QueueMessage(fp string, msg []byte, max int, ttl time.Duration) error
+	// DrainQueue returns the fresh messages queued for the peer, oldest
+	// first, and clears its queue
+	DrainQueue(fp string) ([][]byte, error)
+	// Subscribe calls handler with every message published on channels and
+	// ready, when not nil, once they're subscribed. It blocks until ctx is
+	// done or the subscription fails.
+	Subscribe(ctx context.Context, handler func(channel string, data []byte),
+		ready func(), channels ...string) error
+}
+
+// DBType is the type that holds our redis db
 type DBType struct {
 	pool *redis.Pool
+	// replica serves the reads that can lag, nil when there's no replica.
+	// writes holds the time the replicated keys were last written, for
+	// read_primary_after_write. swept is when the old ones were forgotten.
+	// All three are guarded by replicaM.
+	replica  *redis.Pool
+	writes   map[string]time.Time
+	swept    time.Time
+	replicaM sync.Mutex
 }
 
 // DBUser is the info we store about a user - a list of peers' fingerprint
@@ -36,11 +123,19 @@ func (d *DBType) CreateToken(email string) (string, error) {
 	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
-	token := base64.StdEncoding.EncodeToString(b)
+	// url safe, so the token is a single path segment
+	token := base64.URLEncoding.EncodeToString(b)
 	key := fmt.Sprintf("token:%s", token)
 	conn := d.pool.Get()
 	defer conn.Close()
-	_, err := conn.Do("SETEX", key, TokenTTL, email)
+	// the user's tokens are indexed so they can be revoked, the index
+	// outlives the newest token
+	tokensKey := fmt.Sprintf("tokens:%s", email)
+	conn.Send("MULTI")
+	conn.Send("SETEX", key, TokenTTL, email)
+	conn.Send("SADD", tokensKey, token)
+	conn.Send("EXPIRE", tokensKey, TokenTTL)
+	_, err := conn.Do("EXEC")
 	if err != nil {
 		Logger.Errorf("Failed to set token: %w", err)
 	}
@@ -51,18 +146,102 @@ func (d *DBType) Connect(host string) error {
 	if redisDouble != nil {
 		host = redisDouble.Addr()
 	}
-	d.pool = &redis.Pool{
+	dialer := &backoffDialer{host: host}
+	d.pool = newPool(func() (redis.Conn, error) {
+		c, err := dialer.dial()
+		if err != nil {
+			return nil, err
+		}
+		return &primaryConn{c, d}, nil
+	})
+	return nil
+}
+
+// newPool returns a pool of redis connections
+func newPool(dial func() (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
 		MaxIdle:     5,
 		IdleTimeout: 5 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", host) },
+		Dial:        dial,
+		// discard connections that died while idle, e.g. when redis restarts
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Duration(atomic.LoadInt64(&poolTestIdle)) {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
 	}
-	return nil
+}
+
+// poolTestIdle is how long a pooled connection can be idle before it's
+// tested with a PING, in nanoseconds. Tests zero it, use atomic to access.
+var poolTestIdle = int64(time.Second)
+
+const (
+	minDialBackoff = 100 * time.Millisecond
+	maxDialBackoff = 5 * time.Second
+)
+
+// StoreUnavailable is a transient error returned while redis can't be
+// reached
+type StoreUnavailable struct {
+	err error
+}
+
+func (e *StoreUnavailable) Error() string {
+	return fmt.Sprintf("Store is unavailable: %s", e.err)
+}
+
+func (e *StoreUnavailable) Unwrap() error {
+	return e.err
+}
+
+// backoffDialer dials redis, backing off after failures so an outage isn't
+// met with a storm of dials
+type backoffDialer struct {
+	sync.Mutex
+	host    string
+	delay   time.Duration
+	next    time.Time
+	lastErr error
+}
+
+func (b *backoffDialer) dial() (redis.Conn, error) {
+	b.Lock()
+	if time.Now().Before(b.next) {
+		err := b.lastErr
+		b.Unlock()
+		return nil, &StoreUnavailable{err}
+	}
+	b.Unlock()
+	c, err := redis.Dial("tcp", b.host)
+	b.Lock()
+	defer b.Unlock()
+	if err != nil {
+		b.delay *= 2
+		if b.delay < minDialBackoff {
+			b.delay = minDialBackoff
+		}
+		if b.delay > maxDialBackoff {
+			b.delay = maxDialBackoff
+		}
+		b.next = time.Now().Add(b.delay)
+		b.lastErr = err
+		Logger.Warnf("Failed to dial redis, retrying in %s: %s", b.delay, err)
+		return nil, &StoreUnavailable{err}
+	}
+	if b.delay > 0 {
+		Logger.Infof("Reconnected to redis")
+	}
+	b.delay = 0
+	return &timedConn{c}, nil
 }
 
 // GetToken reads the value of a token, usually an email address
 func (d *DBType) GetToken(token string) (string, error) {
 	key := fmt.Sprintf("token:%s", token)
-	conn := d.pool.Get()
+	conn, _ := d.readConn(key)
 	defer conn.Close()
 	value, err := redis.String(conn.Do("GET", key))
 	if err != nil {
@@ -71,11 +250,35 @@ func (d *DBType) GetToken(token string) (string, error) {
 	return value, nil
 }
 
+// RevokeTokens deletes the user's indexed tokens
+func (d *DBType) RevokeTokens(email string) (int, error) {
+	tokensKey := fmt.Sprintf("tokens:%s", email)
+	conn := d.pool.Get()
+	defer conn.Close()
+	tokens, err := redis.Strings(conn.Do("SMEMBERS", tokensKey))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read the user's tokens: %w", err)
+	}
+	keys := redis.Args{tokensKey}
+	for _, token := range tokens {
+		keys = keys.Add(fmt.Sprintf("token:%s", token))
+	}
+	n, err := redis.Int(conn.Do("DEL", keys...))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to delete the user's tokens: %w", err)
+	}
+	// the index is deleted too
+	if n > 0 {
+		n--
+	}
+	return n, nil
+}
+
 // GetUser gets a user from redis
 func (d *DBType) GetUser(email string) (*DBUser, error) {
 	var r DBUser
 	key := fmt.Sprintf("user:%s", email)
-	conn := d.pool.Get()
+	conn, _ := d.readConn(key)
 	defer conn.Close()
 	values, err := redis.Values(conn.Do("SMEMBERS", key))
 	if err != nil {
@@ -86,14 +289,252 @@ func (d *DBType) GetUser(email string) (*DBUser, error) {
 	}
 	return &r, nil
 }
-func (d *DBType) getDoc(key string, target interface{}) error {
+
+// ScanUser returns the fingerprints in the user's set of the peers whose
+// name matches the glob pattern. It iterates with SSCAN so redis isn't
+// blocked by large sets and reads only the names of each batch.
+func (d *DBType) ScanUser(email string, pattern string) (*DBUser, error) {
+	r := DBUser{}
+	key := fmt.Sprintf("user:%s", email)
+	conn, _ := d.readConn(key)
+	defer conn.Close()
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SSCAN", key, cursor,
+			"COUNT", ScanCount))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to scan user %q list: %w", email, err)
+		}
+		cursor, err = redis.Int(values[0], nil)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read scan cursor: %w", err)
+		}
+		fps, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read scan results: %w", err)
+		}
+		if fps, err = matchNames(conn, fps, pattern); err != nil {
+			return nil, err
+		}
+		r = append(r, fps...)
+		if cursor == 0 {
+			return &r, nil
+		}
+	}
+}
+
+// ScanUserPage scans a page of the user's set for the peers whose name
+// matches the glob pattern. Each SSCAN returns about count fingerprints, so
+// a page may end in the middle of one and the cursor holds both SSCAN's
+// cursor and the number of its matching fingerprints returned.
+func (d *DBType) ScanUserPage(email string, pattern string, cursor string,
+	count int) (*DBUser, string, error) {
+	r := DBUser{}
+	scan, skip, err := parseListCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	key := fmt.Sprintf("user:%s", email)
+	conn, _ := d.readConn(key)
+	defer conn.Close()
+	for {
+		values, err := redis.Values(conn.Do("SSCAN", key, scan,
+			"COUNT", count))
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to scan user %q list: %w", email, err)
+		}
+		next, err := redis.Int(values[0], nil)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to read scan cursor: %w", err)
+		}
+		fps, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to read scan results: %w", err)
+		}
+		if fps, err = matchNames(conn, fps, pattern); err != nil {
+			return nil, "", err
+		}
+		if skip < len(fps) {
+			fps = fps[skip:]
+		} else {
+			fps = nil
+		}
+		if room := count - len(r); len(fps) > room {
+			r = append(r, fps[:room]...)
+			return &r, listCursor(scan, skip+room), nil
+		}
+		r = append(r, fps...)
+		if next == 0 {
+			return &r, "", nil
+		}
+		if len(r) == count {
+			return &r, listCursor(next, 0), nil
+		}
+		scan, skip = next, 0
+	}
+}
+
+// matchNames returns the fingerprints of the peers whose name matches the
+// glob pattern, reading the names in one round trip. Like path.Match, a "*"
+// doesn't match a "/".
+func matchNames(conn redis.Conn, fps []string, pattern string) ([]string, error) {
+	if pattern == "*" || len(fps) == 0 {
+		return fps, nil
+	}
+	for _, fp := range fps {
+		conn.Send("HGET", fmt.Sprintf("peer:%s", fp), "name")
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("Failed to read peer names: %w", err)
+	}
+	var r []string
+	for _, fp := range fps {
+		name, err := redis.String(conn.Receive())
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read peer %q name: %w", fp, err)
+		}
+		found, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, fmt.Errorf("Bad pattern %q: %w", pattern, err)
+		}
+		if found {
+			r = append(r, fp)
+		}
+	}
+	return r, nil
+}
+
+// listCursor returns the cursor of a list page starting at SSCAN's cursor,
+// after skipping the fingerprints of that scan already listed
+func listCursor(scan int, skip int) string {
+	return fmt.Sprintf("%d.%d", scan, skip)
+}
+
+// parseListCursor parses a list page's cursor, an empty cursor is the first
+// page
+func parseListCursor(cursor string) (int, int, error) {
+	if cursor == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(cursor, ".", 2)
+	if len(parts) == 2 {
+		scan, err := strconv.Atoi(parts[0])
+		skip, err2 := strconv.Atoi(parts[1])
+		if err == nil && err2 == nil && scan >= 0 && skip >= 0 {
+			return scan, skip, nil
+		}
+	}
+	return 0, 0, &BadCursor{cursor}
+}
+
+// GetPeer reads a peer's hash. If the peer is not found an empty peer is
+// returned.
+func (d *DBType) GetPeer(fp string) (*Peer, error) {
+	pd, _, err := d.readPeer(fp)
+	return pd, err
+}
+
+// FindPeer reads a peer's hash, returning a PeerNotFound error when it's
+// empty
+func (d *DBType) FindPeer(fp string) (*Peer, error) {
+	pd, found, err := d.readPeer(fp)
+	if err == nil && !found {
+		return nil, &PeerNotFound{fp}
+	}
+	return pd, err
+}
+
+// readPeer reads a peer's hash & presence in a single round trip and returns
+// whether the hash was found
+func (d *DBType) readPeer(fp string) (*Peer, bool, error) {
+	var pd Peer
+	key := fmt.Sprintf("peer:%s", fp)
+	online := fmt.Sprintf("online:%s", fp)
+	conn, fromReplica := d.readConn(key)
+	defer conn.Close()
+	conn.Send("HGETALL", key)
+	if !fromReplica {
+		conn.Send("EXISTS", online)
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to read %q: %w", key, err)
+	}
+	if fromReplica {
+		// the presence changes too often to be read from a replica
+		primary := d.pool.Get()
+		defer primary.Close()
+		exists, err := primary.Do("EXISTS", online)
+		if err != nil {
+			return nil, false, fmt.Errorf("Failed to read peer %q presence: %w", fp, err)
+		}
+		replies = append(replies, exists)
+	}
+	values, err := redis.Values(replies[0], nil)
+	if err != nil {
+		var rerr redis.Error
+		if errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "WRONGTYPE") {
+			t, terr := redis.String(conn.Do("TYPE", key))
+			if terr != nil {
+				t = "unknown type"
+			}
+			e := &CorruptPeer{fp, t}
+			Logger.Errorf("%s: %s", e, err)
+			return nil, false, e
+		}
+		return nil, false, fmt.Errorf("Failed to read %q: %w", key, err)
+	}
+	if err = redis.ScanStruct(values, &pd); err != nil {
+		return nil, false, fmt.Errorf("Failed to scan peer %q: %w", key, err)
+	}
+	pd.Online, err = redis.Bool(replies[1], nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to read peer %q presence: %w", fp, err)
+	}
+	return &pd, len(values) > 0, nil
+}
+
+// SetPeerOnline sets the peer's online key to the instance with a ttl, or
+// deletes it when the ttl is zero. The online field of the peer's hash is
+// kept for older readers.
+func (d *DBType) SetPeerOnline(fp string, instance string, ttl time.Duration) error {
 	conn := d.pool.Get()
 	defer conn.Close()
-	values, err := redis.Values(conn.Do("HGETALL", key))
-	if err = redis.ScanStruct(values, target); err != nil {
-		return fmt.Errorf("Failed to scan peer %q: %w", key, err)
+	key := fmt.Sprintf("online:%s", fp)
+	var err error
+	if ttl == 0 {
+		_, err = conn.Do("DEL", key)
+	} else {
+		_, err = conn.Do("SET", key, instance, "PX", ttl.Milliseconds())
 	}
-	return nil
+	if err != nil {
+		return err
+	}
+	// a peer that was deleted while connected isn't recreated
+	key = fmt.Sprintf("peer:%s", fp)
+	exists, err := redis.Bool(conn.Do("EXISTS", key))
+	if err != nil || !exists {
+		return err
+	}
+	_, err = conn.Do("HSET", key, "online", ttl != 0)
+	return err
+}
+
+// GetPeerInstance returns the instance in the peer's online key
+func (d *DBType) GetPeerInstance(fp string) (string, error) {
+	conn := d.pool.Get()
+	defer conn.Close()
+	instance, err := redis.String(conn.Do("GET", fmt.Sprintf("online:%s", fp)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to read peer %q instance: %w", fp, err)
+	}
+	return instance, nil
 }
 func (d *DBType) PeerExists(fp string) (bool, error) {
 	key := fmt.Sprintf("peer:%s", fp)
@@ -106,84 +547,468 @@ func (d *DBType) Close() error {
 	// return d.conn.Close()
 }
 
-// AddPeer adds or updates a peer
+// addPeersScript stores the peers of a user, indexes their owner and adds
+// them to the user's set, all at once. KEYS are the user's set and each
+// peer's hash & owner key, ARGV max_peers, 0 for no limit, the user and each
+// peer's fingerprint, number of hash arguments & the arguments. Returns 0 &
+// adds nothing when the new peers would take the set past max_peers.
+var addPeersScript = redis.NewScript(-1, `
+local max = tonumber(ARGV[1])
+local fps, fields, i = {}, {}, 3
+for p = 1, (#KEYS - 1) / 2 do
+	fps[p] = ARGV[i]
+	local n = tonumber(ARGV[i + 1])
+	fields[p] = {unpack(ARGV, i + 2, i + 1 + n)}
+	i = i + 2 + n
+end
+if max > 0 then
+	local total = redis.call("SCARD", KEYS[1])
+	for p = 1, #fps do
+		if redis.call("SISMEMBER", KEYS[1], fps[p]) == 0 then
+			total = total + 1
+		end
+	end
+	if total > max then
+		return 0
+	end
+end
+for p = 1, #fps do
+	redis.call("HSET", KEYS[2 * p], unpack(fields[p]))
+	redis.call("SET", KEYS[2 * p + 1], ARGV[2])
+	redis.call("SADD", KEYS[1], fps[p])
+end
+return 1
+`)
+
+// AddPeer adds or updates a peer, a new peer of a user with max_peers is
+// refused with a TooManyPeers error
 func (d *DBType) AddPeer(peer *Peer) error {
+	return d.AddPeers(peer.User, []*Peer{peer})
+}
+
+// AddPeers adds or updates the peers of a user all at once, or none of them
+// when the new ones would take the user past max_peers
+func (d *DBType) AddPeers(user string, peers []*Peer) error {
 	conn := d.pool.Get()
 	defer conn.Close()
-	key := fmt.Sprintf("user:%s", peer.User)
-	values, err := redis.Values(conn.Do("SMEMBERS", key))
+	keys := redis.Args{}.Add(fmt.Sprintf("user:%s", user))
+	args := redis.Args{}.Add(conf().MaxPeers, user)
+	for _, peer := range peers {
+		keys = keys.Add(peer.Key(), ownerKey(peer.FP))
+		fields := redis.Args{}.AddFlat(peer)
+		args = args.Add(peer.FP, len(fields)).Add(fields...)
+	}
+	added, err := redis.Int(addPeersScript.Do(conn,
+		append(redis.Args{}.Add(len(keys)).Add(keys...), args...)...))
 	if err != nil {
-		return fmt.Errorf("Failed to read user %q list: %w", peer.User, err)
+		return fmt.Errorf("Failed to add %d peers of %q: %w", len(peers), user,
+			err)
+	}
+	if added == 0 {
+		return &TooManyPeers{user}
 	}
-	if len(values) == MaxPeersPerUser {
-		return fmt.Errorf("User has too many peers")
+	return nil
+}
+
+// ownerKey returns the key of the peer's entry in the owners index
+func ownerKey(fp string) string {
+	return fmt.Sprintf("owner:%s", fp)
+}
+
+// GetPeerOwner returns the user in the peer's owner key
+func (d *DBType) GetPeerOwner(fp string) (string, error) {
+	conn := d.pool.Get()
+	defer conn.Close()
+	user, err := redis.String(conn.Do("GET", ownerKey(fp)))
+	if err == redis.ErrNil {
+		return "", nil
 	}
-	_, err = conn.Do("HSET", redis.Args{}.Add(peer.Key()).AddFlat(peer)...)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("Failed to read peer %q owner: %w", fp, err)
 	}
-	conn.Do("SADD", key, peer.FP)
-	return nil
+	return user, nil
 }
 
-// IsVerfied tests the db to see if a peer is verfied
-func IsVerified(fp string) (bool, error) {
-	key := fmt.Sprintf("peer:%s", fp)
-	conn := db.pool.Get()
+// RepairOwners scans the peer hashes and sets their owner keys, with the
+// same ttl, then removes the owner keys of peers that are gone
+func (d *DBType) RepairOwners() (int, error) {
+	conn := d.pool.Get()
 	defer conn.Close()
-	return redis.Bool(conn.Do("HGET", key, "verified"))
+	fixed := 0
+	err := d.scanKeys(conn, "peer:*", func(key string) error {
+		fp := strings.TrimPrefix(key, "peer:")
+		user, err := redis.String(conn.Do("HGET", key, "user"))
+		if err == redis.ErrNil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read peer %q user: %w", fp, err)
+		}
+		ttl, err := redis.Int64(conn.Do("PTTL", key))
+		if err != nil {
+			return fmt.Errorf("Failed to read peer %q ttl: %w", fp, err)
+		}
+		owner, err := d.GetPeerOwner(fp)
+		if err != nil {
+			return err
+		}
+		if owner == user {
+			return nil
+		}
+		args := redis.Args{}.Add(ownerKey(fp), user)
+		if ttl > 0 {
+			args = args.Add("PX", ttl)
+		}
+		if _, err = conn.Do("SET", args...); err != nil {
+			return fmt.Errorf("Failed to index peer %q owner: %w", fp, err)
+		}
+		fixed++
+		return nil
+	})
+	if err != nil {
+		return fixed, err
+	}
+	err = d.scanKeys(conn, "owner:*", func(key string) error {
+		fp := strings.TrimPrefix(key, "owner:")
+		exists, err := d.PeerExists(fp)
+		if err != nil || exists {
+			return err
+		}
+		if _, err = conn.Do("DEL", key); err != nil {
+			return fmt.Errorf("Failed to remove peer %q owner: %w", fp, err)
+		}
+		fixed++
+		return nil
+	})
+	return fixed, err
 }
 
-// GetPeer gets a peer, using the hub as cache for connected peers
-func GetPeer(fp string) (*Peer, error) {
+// FindOrphans scans the peer hashes for peers that aren't in their user's
+// set, e.g. left by a failed delete, and deletes them when clean is set.
+// Deleted peers in their grace period aren't orphans.
+func (d *DBType) FindOrphans(clean bool) ([]string, error) {
+	conn := d.pool.Get()
+	defer conn.Close()
+	orphans := []string{}
+	err := d.scanKeys(conn, "peer:*", func(key string) error {
+		fp := strings.TrimPrefix(key, "peer:")
+		values, err := redis.Strings(conn.Do("HMGET", key, "user", "deleted_on"))
+		if err != nil {
+			return fmt.Errorf("Failed to read peer %q user: %w", fp, err)
+		}
+		user, deletedOn := values[0], values[1]
+		// deleted peers are kept out of the set until their grace is over
+		if deletedOn != "" && deletedOn != "0" {
+			return nil
+		}
+		member, err := redis.Bool(conn.Do("SISMEMBER",
+			fmt.Sprintf("user:%s", user), fp))
+		if err != nil {
+			return fmt.Errorf("Failed to check user %q peer %q: %w", user, fp, err)
+		}
+		if member {
+			return nil
+		}
+		orphans = append(orphans, fp)
+		if clean {
+			if err = d.DeletePeer(fp); err != nil {
+				return fmt.Errorf("Failed to delete orphan peer %q: %w", fp, err)
+			}
+		}
+		return nil
+	})
+	return orphans, err
+}
+
+// scanKeys calls f with every key matching the pattern, using SCAN so redis
+// is never blocked
+func (d *DBType) scanKeys(conn redis.Conn, pattern string, f func(string) error) error {
+	cursor := 0
+	for {
+		values, err := redis.Values(
+			conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return fmt.Errorf("Failed to scan %q: %w", pattern, err)
+		}
+		var keys []string
+		if _, err = redis.Scan(values, &cursor, &keys); err != nil {
+			return fmt.Errorf("Failed to scan %q: %w", pattern, err)
+		}
+		for _, key := range keys {
+			if err = f(key); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// SetPeerField sets a single field in the peer's hash
+func (d *DBType) SetPeerField(fp string, field string, value interface{}) error {
+	conn := d.pool.Get()
+	defer conn.Close()
 	key := fmt.Sprintf("peer:%s", fp)
-	var pd Peer
-	err := db.getDoc(key, &pd)
+	_, err := conn.Do("HSET", key, field, value)
+	return err
+}
+
+// DeletePeer removes a peer's hash and owner key
+func (d *DBType) DeletePeer(fp string) error {
+	conn := d.pool.Get()
+	defer conn.Close()
+	key := fmt.Sprintf("peer:%s", fp)
+	_, err := conn.Do("DEL", key, ownerKey(fp))
+	return err
+}
+
+// SetPeerTTL sets the time to live of a peer's hash & owner key, a zero ttl
+// persists them
+func (d *DBType) SetPeerTTL(fp string, ttl time.Duration) error {
+	conn := d.pool.Get()
+	defer conn.Close()
+	for _, key := range []string{fmt.Sprintf("peer:%s", fp), ownerKey(fp)} {
+		var err error
+		if ttl == 0 {
+			_, err = conn.Do("PERSIST", key)
+		} else {
+			_, err = conn.Do("EXPIRE", key, int64(ttl.Seconds()))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddUserPeer adds a peer to the user's list
+func (d *DBType) AddUserPeer(user string, fp string) error {
+	conn := d.pool.Get()
+	defer conn.Close()
+	key := fmt.Sprintf("user:%s", user)
+	_, err := conn.Do("SADD", key, fp)
+	return err
+}
+
+// RemoveUserPeer removes a peer from the user's list
+func (d *DBType) RemoveUserPeer(user string, fp string) error {
+	conn := d.pool.Get()
+	defer conn.Close()
+	key := fmt.Sprintf("user:%s", user)
+	_, err := conn.Do("SREM", key, fp)
+	return err
+}
+
+// CountPeers counts the peer hashes using SCAN so redis is never blocked
+func (d *DBType) CountPeers() (int, error) {
+	conn := d.pool.Get()
+	defer conn.Close()
+	count := 0
+	err := d.scanKeys(conn, "peer:*", func(string) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// DeleteUser removes a user's list of peers
+func (d *DBType) DeleteUser(email string) error {
+	conn := d.pool.Get()
+	defer conn.Close()
+	key := fmt.Sprintf("user:%s", email)
+	_, err := conn.Do("DEL", key)
+	return err
+}
+
+// GetSecret returns the user's OTP secret or an empty string if the user has
+// none
+func (d *DBType) GetSecret(user string) (string, error) {
+	conn := d.pool.Get()
+	defer conn.Close()
+	key := fmt.Sprintf("secret:%s", user)
+	secret, err := redis.String(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return secret, err
+}
+
+// SetSecret saves the user's OTP secret
+func (d *DBType) SetSecret(user string, secret string) error {
+	conn := d.pool.Get()
+	defer conn.Close()
+	key := fmt.Sprintf("secret:%s", user)
+	_, err := conn.Do("SET", key, secret)
+	return err
+}
+
+// Publish publishes a message on a redis channel
+func (d *DBType) Publish(channel string, msg []byte) (int, error) {
+	conn := d.pool.Get()
+	defer conn.Close()
+	return redis.Int(conn.Do("PUBLISH", channel, msg))
+}
+
+// QueueMessage pushes the message to the peer's queue list, trims it to the
+// last max messages and sets the list to expire with its newest message
+func (d *DBType) QueueMessage(fp string, msg []byte, max int,
+	ttl time.Duration) error {
+	conn := d.pool.Get()
+	defer conn.Close()
+	key := fmt.Sprintf("queue:%s", fp)
+	conn.Send("MULTI")
+	conn.Send("RPUSH", key, newQueueEntry(msg, ttl))
+	conn.Send("LTRIM", key, -max, -1)
+	conn.Send("PEXPIRE", key, ttl.Milliseconds())
+	if _, err := conn.Do("EXEC"); err != nil {
+		return fmt.Errorf("Failed to queue a message for %q: %w", fp, err)
+	}
+	return nil
+}
+
+// DrainQueue reads & deletes the peer's queue list in one transaction
+func (d *DBType) DrainQueue(fp string) ([][]byte, error) {
+	conn := d.pool.Get()
+	defer conn.Close()
+	key := fmt.Sprintf("queue:%s", fp)
+	conn.Send("MULTI")
+	conn.Send("LRANGE", key, 0, -1)
+	conn.Send("DEL", key)
+	r, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to drain %q queue: %w", fp, err)
+	}
+	entries, err := redis.ByteSlices(r[0], nil)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Failed to read %q queue: %w", fp, err)
 	}
-	return &pd, nil
+	return freshEntries(entries), nil
+}
+
+// Subscribe listens for messages on Redis pubsub channels.
+func (d *DBType) Subscribe(ctx context.Context,
+	handler func(channel string, data []byte), ready func(),
+	channels ...string) error {
+	// A ping is set to the server with this period to test for the health of
+	// the connection and server.
+	const healthCheckPeriod = time.Minute
+	conn := d.pool.Get()
+	defer conn.Close()
+	psc := redis.PubSubConn{Conn: conn}
+	args := make([]interface{}, len(channels))
+	for i, c := range channels {
+		args[i] = c
+	}
+	if err := psc.Subscribe(args...); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+
+	// Start a goroutine to receive notifications from the server.
+	go func() {
+		for {
+			switch n := psc.Receive().(type) {
+			case error:
+				done <- n
+				return
+			case redis.Message:
+				handler(n.Channel, n.Data)
+			case redis.Subscription:
+				if n.Count == 0 {
+					done <- nil
+					return
+				}
+				if n.Kind == "subscribe" && n.Count == len(channels) && ready != nil {
+					ready()
+				}
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(healthCheckPeriod)
+	defer ticker.Stop()
+	var err error
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			// Send ping to test health of connection and server. If
+			// corresponding pong is not received, then receive on the
+			// connection will timeout and the receive goroutine will exit.
+			if err = psc.Ping(""); err != nil {
+				break loop
+			}
+		case <-ctx.Done():
+			break loop
+		case err = <-done:
+			return err
+		}
+	}
+
+	// Signal the receiving goroutine to exit by unsubscribing from all channels.
+	if err := psc.Unsubscribe(); err != nil {
+		Logger.Errorf("Failed to unsubscribe: %s", err)
+	}
+	<-done
+	return err
+}
+
+// IsVerfied tests the db to see if a peer is verfied
+func IsVerified(fp string) (bool, error) {
+	peer, err := db.GetPeer(fp)
+	if err != nil {
+		return false, err
+	}
+	return peer.Verified, nil
+}
+
+// GetPeer gets a peer from the store
+func GetPeer(fp string) (*Peer, error) {
+	return db.GetPeer(fp)
 }
 
 // VerifyPeer is a function that sets the peers verification and publishes
 // it's new state to the user's channel
 func VerifyPeer(fp string, verified bool) error {
-	rc := db.pool.Get()
-	defer rc.Close()
-	key := fmt.Sprintf("peer:%s", fp)
-	online, err := redis.Bool(rc.Do("HGET", key, "online"))
+	peer, err := db.FindPeer(fp)
+	var notFound *PeerNotFound
+	if errors.As(err, &notFound) {
+		return err
+	}
 	if err != nil {
-		return fmt.Errorf("Failed to get online key: %s", err)
+		return fmt.Errorf("Failed to get peer %q: %s", fp, err)
 	}
+	online := peer.Online
 	if verified {
-		rc.Do("HSET", key, "verified", "1")
+		db.SetPeerField(fp, "verified", "1")
 		if online {
-			SendMessage(fp, StatusMessage{200, "peer is verified"})
+			SendMessage(fp, StatusMessage{Code: 200, Text: "peer is verified"})
 			Logger.Infof("Sent a 200 to %q - a newly verified peer", fp)
-			user, err := redis.String(rc.Do("HGET", key, "user"))
-			if err != nil {
-				return fmt.Errorf("Failed to get a peer's user: %w", err)
-			}
 			// send the peers
-			ps, err := GetUsersPeers(user)
+			ps, err := GetUsersPeers(peer.User)
 			if err != nil {
 				return err
 			}
 			return SendMessage(fp, map[string]interface{}{"peers": ps})
 		}
 	} else {
-		rc.Do("HSET", key, "verified", "0")
+		uncachePeer(fp)
+		db.SetPeerField(fp, "verified", "0")
 		if online {
-			SendMessage(fp, StatusMessage{http.StatusUnauthorized,
-				"peer's verification was revoked"})
+			ClosePeer(fp, http.StatusUnauthorized,
+				fmt.Errorf("peer's verification was revoked"),
+				&CloseReason{CloseRevoked, "verification revoked"})
 		}
 	}
-	user, err := redis.String(rc.Do("HGET", key, "user"))
-	if err != nil {
-		return fmt.Errorf("Failed to hget user from %s: %w", key, err)
-	}
 	// publish the peer's state
-	return SendPeerUpdate(rc, user, fp, verified, online)
+	u := NewPeerUpdate(peer)
+	u.Verified = verified
+	return SendPeerUpdate(peer.User, fp, u)
 }
 func (d *DBType) canSendEmail(email string) bool {
 	key := fmt.Sprintf("dontsend:%s", email)
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 )
 
 func TestGetPeer(t *testing.T) {
 	startTest(t)
 	redisDouble.HSet("peer:foo", "fp", "foo", "name", "fucked up")
-	conn := db.pool.Get()
+	conn := db.(*DBType).pool.Get()
 	defer conn.Close()
 	exists, err := redis.Bool(conn.Do("EXISTS", "peer:foo"))
 	require.Nil(t, err)
@@ -28,7 +37,7 @@ func TestAddPeer(t *testing.T) {
 		CreatedOn: time.Now().Unix()}
 	err := db.AddPeer(peer)
 	require.Nil(t, err)
-	conn := db.pool.Get()
+	conn := db.(*DBType).pool.Get()
 	defer conn.Close()
 	exists, err := redis.Bool(conn.Do("EXISTS", "peer:publickey"))
 	require.Nil(t, err)
@@ -79,3 +88,507 @@ func TestCanSendEmail(t *testing.T) {
 	can2 := db.canSendEmail("j")
 	require.False(t, can2)
 }
+
+// testStore runs the same suite against any Store
+func testStore(t *testing.T, s Store) {
+	// tokens
+	token, err := s.CreateToken("j")
+	require.Nil(t, err)
+	require.Equal(t, url.PathEscape(token), token)
+	email, err := s.GetToken(token)
+	require.Nil(t, err)
+	require.Equal(t, "j", email)
+	_, err = s.GetToken("nosuchtoken")
+	require.NotNil(t, err)
+	other, err := s.CreateToken("h")
+	require.Nil(t, err)
+	_, err = s.CreateToken("j")
+	require.Nil(t, err)
+	n, err := s.RevokeTokens("j")
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	_, err = s.GetToken(token)
+	require.NotNil(t, err)
+	n, err = s.RevokeTokens("j")
+	require.Nil(t, err)
+	require.Zero(t, n)
+	email, err = s.GetToken(other)
+	require.Nil(t, err)
+	require.Equal(t, "h", email)
+	// peers
+	exists, err := s.PeerExists("A")
+	require.Nil(t, err)
+	require.False(t, exists)
+	pd, err := s.GetPeer("A")
+	require.Nil(t, err)
+	require.Equal(t, "", pd.FP)
+	_, err = s.FindPeer("A")
+	var notFound *PeerNotFound
+	require.True(t, errors.As(err, &notFound), "got: %v", err)
+	err = s.AddPeer(NewPeer("A", "foo", "j", "lay"))
+	require.Nil(t, err)
+	err = s.AddPeer(NewPeer("B", "bar", "j", "lay"))
+	require.Nil(t, err)
+	exists, err = s.PeerExists("A")
+	require.Nil(t, err)
+	require.True(t, exists)
+	require.Nil(t, s.SetPeerField("A", "verified", true))
+	require.Nil(t, s.SetPeerField("A", "name", "foofoo"))
+	pd, err = s.GetPeer("A")
+	require.Nil(t, err)
+	require.Equal(t, "A", pd.FP)
+	require.Equal(t, "foofoo", pd.Name)
+	require.Equal(t, "lay", pd.Kind)
+	require.True(t, pd.Verified)
+	require.False(t, pd.Online)
+	require.Nil(t, s.SetPeerOnline("A", "i1", time.Minute))
+	pd, err = s.GetPeer("A")
+	require.Nil(t, err)
+	require.True(t, pd.Online)
+	pd, err = s.FindPeer("A")
+	require.Nil(t, err)
+	require.Equal(t, "foofoo", pd.Name)
+	require.True(t, pd.Online)
+	instance, err := s.GetPeerInstance("A")
+	require.Nil(t, err)
+	require.Equal(t, "i1", instance)
+	require.Nil(t, s.SetPeerOnline("A", "i1", 0))
+	pd, err = s.GetPeer("A")
+	require.Nil(t, err)
+	require.False(t, pd.Online)
+	instance, err = s.GetPeerInstance("A")
+	require.Nil(t, err)
+	require.Equal(t, "", instance)
+	u, err := s.GetUser("j")
+	require.Nil(t, err)
+	require.ElementsMatch(t, DBUser{"A", "B"}, *u)
+	u, err = s.ScanUser("j", "foo*")
+	require.Nil(t, err)
+	require.Equal(t, DBUser{"A"}, *u)
+	// the names are matched, not the fingerprints
+	u, err = s.ScanUser("j", "A*")
+	require.Nil(t, err)
+	require.Empty(t, *u)
+	u, next, err := s.ScanUserPage("j", "*", "", 1)
+	require.Nil(t, err)
+	require.Len(t, *u, 1)
+	require.NotEmpty(t, next)
+	page, next, err := s.ScanUserPage("j", "*", next, 1)
+	require.Nil(t, err)
+	require.Empty(t, next)
+	require.ElementsMatch(t, DBUser{"A", "B"}, append(*u, *page...))
+	_, _, err = s.ScanUserPage("j", "*", "bad", 1)
+	var badCursor *BadCursor
+	require.True(t, errors.As(err, &badCursor))
+	owner, err := s.GetPeerOwner("A")
+	require.Nil(t, err)
+	require.Equal(t, "j", owner)
+	require.Nil(t, s.DeletePeer("A"))
+	exists, err = s.PeerExists("A")
+	require.Nil(t, err)
+	require.False(t, exists)
+	owner, err = s.GetPeerOwner("A")
+	require.Nil(t, err)
+	require.Equal(t, "", owner)
+	require.Nil(t, s.DeleteUser("j"))
+	u, err = s.GetUser("j")
+	require.Nil(t, err)
+	require.Empty(t, *u)
+	// secrets and flags
+	secret, err := s.GetSecret("j")
+	require.Nil(t, err)
+	require.Equal(t, "", secret)
+	require.Nil(t, s.SetSecret("j", "AVERYSECRETTOKEN"))
+	secret, err = s.GetSecret("j")
+	require.Nil(t, err)
+	require.Equal(t, "AVERYSECRETTOKEN", secret)
+	require.False(t, s.IsQRVerified("j"))
+	require.Nil(t, s.SetQRVerified("j"))
+	require.True(t, s.IsQRVerified("j"))
+	require.True(t, s.canSendEmail("j"))
+	require.False(t, s.canSendEmail("j"))
+	// offline queues
+	require.Nil(t, s.QueueMessage("A", []byte("one"), 2, time.Minute))
+	require.Nil(t, s.QueueMessage("A", []byte("two"), 2, time.Minute))
+	require.Nil(t, s.QueueMessage("A", []byte("three"), 2, time.Minute))
+	msgs, err := s.DrainQueue("A")
+	require.Nil(t, err)
+	require.Equal(t, [][]byte{[]byte("two"), []byte("three")}, msgs)
+	msgs, err = s.DrainQueue("A")
+	require.Nil(t, err)
+	require.Empty(t, msgs)
+	// pubsub
+	got := make(chan string, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Subscribe(ctx, func(channel string, data []byte) {
+			got <- channel + " " + string(data)
+		}, nil, "out:A")
+	}()
+	require.Eventually(t, func() bool {
+		s.Publish("out:A", []byte("hello"))
+		select {
+		case m := <-got:
+			require.Equal(t, "out:A hello", m)
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe didn't return after cancel")
+	}
+}
+func TestRedisStore(t *testing.T) {
+	startTest(t)
+	testStore(t, db)
+}
+func TestMemStore(t *testing.T) {
+	testStore(t, NewMemStore())
+}
+func TestOwnersIndex(t *testing.T) {
+	startTest(t)
+	require.Nil(t, db.AddPeer(NewPeer("A", "foo", "j", "lay")))
+	require.Nil(t, db.AddPeer(NewPeer("B", "bar", "j", "lay")))
+	require.Nil(t, db.AddPeer(NewPeer("C", "baz", "k", "lay")))
+	require.Equal(t, "j", redisDouble.HGet("peer:A", "user"))
+	for fp, user := range map[string]string{"A": "j", "B": "j", "C": "k"} {
+		owner, err := db.GetPeerOwner(fp)
+		require.Nil(t, err)
+		require.Equal(t, user, owner)
+	}
+	// tombstones expire with their owner
+	setConfig(t, func(c *Config) { c.DeleteGrace = 60 })
+	b, err := GetPeer("B")
+	require.Nil(t, err)
+	require.Nil(t, DeletePeer(b))
+	require.Equal(t, time.Minute, redisDouble.TTL("owner:B"))
+	require.Nil(t, RestorePeer("B", "j"))
+	require.Equal(t, time.Duration(0), redisDouble.TTL("owner:B"))
+	require.Nil(t, db.DeletePeer("C"))
+	require.False(t, redisDouble.Exists("owner:C"))
+	// an up to date index needs no repair
+	n, err := db.RepairOwners()
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+	// a missing entry, a wrong one & a stale one
+	redisDouble.Del("owner:A")
+	redisDouble.Set("owner:B", "k")
+	redisDouble.Set("owner:Z", "j")
+	redisDouble.HSet("peer:D", "fp", "D", "user", "k")
+	redisDouble.SetTTL("peer:D", time.Hour)
+	n, err = db.RepairOwners()
+	require.Nil(t, err)
+	require.Equal(t, 4, n)
+	for fp, user := range map[string]string{"A": "j", "B": "j", "D": "k", "Z": ""} {
+		owner, err := db.GetPeerOwner(fp)
+		require.Nil(t, err)
+		require.Equal(t, user, owner, fp)
+	}
+	require.Equal(t, time.Hour, redisDouble.TTL("owner:D"))
+}
+func TestFindOrphans(t *testing.T) {
+	startTest(t)
+	for name, s := range map[string]Store{"redis": db, "memory": NewMemStore()} {
+		require.Nil(t, s.AddPeer(NewPeer("A", "foo", "j", "lay")), name)
+		require.Nil(t, s.AddPeer(NewPeer("B", "bar", "j", "lay")), name)
+		require.Nil(t, s.AddPeer(NewPeer("C", "baz", "k", "lay")), name)
+		// a deleted peer in its grace period isn't an orphan
+		require.Nil(t, s.AddPeer(NewPeer("D", "qux", "k", "lay")), name)
+		require.Nil(t, s.RemoveUserPeer("k", "D"), name)
+		require.Nil(t, s.SetPeerField("D", "deleted_on", time.Now().Unix()), name)
+		orphans, err := s.FindOrphans(false)
+		require.Nil(t, err, name)
+		require.Empty(t, orphans, name)
+		require.Nil(t, s.RemoveUserPeer("j", "B"), name)
+		orphans, err = s.FindOrphans(false)
+		require.Nil(t, err, name)
+		require.Equal(t, []string{"B"}, orphans, name)
+		exists, err := s.PeerExists("B")
+		require.Nil(t, err, name)
+		require.True(t, exists, name)
+		orphans, err = s.FindOrphans(true)
+		require.Nil(t, err, name)
+		require.Equal(t, []string{"B"}, orphans, name)
+		for fp, want := range map[string]bool{"A": true, "B": false, "C": true, "D": true} {
+			exists, err = s.PeerExists(fp)
+			require.Nil(t, err, name)
+			require.Equal(t, want, exists, "%s %s", name, fp)
+		}
+		owner, err := s.GetPeerOwner("B")
+		require.Nil(t, err, name)
+		require.Empty(t, owner, name)
+		orphans, err = s.FindOrphans(false)
+		require.Nil(t, err, name)
+		require.Empty(t, orphans, name)
+	}
+}
+func TestRedisReplica(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.ReadPrimaryAfterWrite = 0 })
+	replica, err := miniredis.Run()
+	require.Nil(t, err)
+	defer replica.Close()
+	d := &DBType{}
+	require.Nil(t, d.Connect(""))
+	require.Nil(t, d.ConnectReplica(replica.Addr()))
+	redisDouble.Set("token:atoken", "primary")
+	replica.Set("token:atoken", "replica")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "primary", "user", "j")
+	replica.HSet("peer:A", "fp", "A", "name", "replica", "user", "j")
+	redisDouble.SAdd("user:j", "A")
+	replica.SAdd("user:j", "A", "R")
+	replica.HSet("peer:R", "fp", "R", "name", "remote", "user", "j")
+	// reads hit the replica
+	email, err := d.GetToken("atoken")
+	require.Nil(t, err)
+	require.Equal(t, "replica", email)
+	p, err := d.GetPeer("A")
+	require.Nil(t, err)
+	require.Equal(t, "replica", p.Name)
+	// the presence is read from the primary
+	require.False(t, p.Online)
+	redisDouble.Set("online:A", "i1")
+	p, err = d.GetPeer("A")
+	require.Nil(t, err)
+	require.Equal(t, "replica", p.Name)
+	require.True(t, p.Online)
+	u, err := d.GetUser("j")
+	require.Nil(t, err)
+	require.ElementsMatch(t, DBUser{"A", "R"}, *u)
+	u, err = d.ScanUser("j", "rem*")
+	require.Nil(t, err)
+	require.Equal(t, DBUser{"R"}, *u)
+	// writes hit the primary
+	require.Nil(t, d.AddPeer(NewPeer("B", "bar", "j", "lay")))
+	require.True(t, redisDouble.Exists("peer:B"))
+	require.False(t, replica.Exists("peer:B"))
+	ok, err := redisDouble.SIsMember("user:j", "B")
+	require.Nil(t, err)
+	require.True(t, ok)
+	// reads of a key right after it's written are from the primary
+	setConfig(t, func(c *Config) { c.ReadPrimaryAfterWrite = 100 })
+	require.Nil(t, d.SetPeerField("B", "name", "baz"))
+	p, err = d.GetPeer("B")
+	require.Nil(t, err)
+	require.Equal(t, "baz", p.Name)
+	u, err = d.GetUser("j")
+	require.Nil(t, err)
+	require.ElementsMatch(t, DBUser{"A", "R"}, *u)
+	require.Nil(t, d.AddUserPeer("j", "C"))
+	u, err = d.GetUser("j")
+	require.Nil(t, err)
+	require.ElementsMatch(t, DBUser{"A", "B", "C"}, *u)
+	// other keys are still read from the replica
+	email, err = d.GetToken("atoken")
+	require.Nil(t, err)
+	require.Equal(t, "replica", email)
+	p, err = d.GetPeer("A")
+	require.Nil(t, err)
+	require.Equal(t, "replica", p.Name)
+	require.Eventually(t, func() bool {
+		p, err = d.GetPeer("B")
+		return err == nil && p.Name == ""
+	}, time.Second, 10*time.Millisecond)
+	// with no replica all reads are from the primary
+	primary := &DBType{}
+	require.Nil(t, primary.Connect(""))
+	email, err = primary.GetToken("atoken")
+	require.Nil(t, err)
+	require.Equal(t, "primary", email)
+}
+func TestRedisReconnect(t *testing.T) {
+	startTest(t)
+	orig := atomic.SwapInt64(&poolTestIdle, 0)
+	defer atomic.StoreInt64(&poolTestIdle, orig)
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	ws := connectPeer(t, s, "A")
+	got := make(chan map[string]interface{}, 16)
+	go func() {
+		for {
+			var m map[string]interface{}
+			ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+			if err := ws.ReadJSON(&m); err != nil {
+				return
+			}
+			got <- m
+		}
+	}()
+	redisDouble.Close()
+	_, err := db.GetPeer("A")
+	var unavailable *StoreUnavailable
+	require.True(t, errors.As(err, &unavailable), "got error: %v", err)
+	_, resp, err := cstDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws?fp=A", nil)
+	require.NotNil(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	// the store's error is logged, not sent
+	b, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "Service unavailable\n", string(b))
+	require.Nil(t, redisDouble.Restart())
+	require.Eventually(t, func() bool {
+		p, err := db.GetPeer("A")
+		return err == nil && p.FP == "A"
+	}, 2*time.Second, 50*time.Millisecond)
+	// the peer's subscription recovers too
+	require.Eventually(t, func() bool {
+		_, err := db.Publish("out:A", []byte(`{"after": "restart"}`))
+		require.Nil(t, err)
+		for {
+			select {
+			case m := <-got:
+				if _, found := m["after"]; found {
+					return true
+				}
+			default:
+				return false
+			}
+		}
+	}, 2*time.Second, 100*time.Millisecond)
+}
+func TestPeerCacheFallback(t *testing.T) {
+	startTest(t)
+	orig := atomic.SwapInt64(&poolTestIdle, 0)
+	defer atomic.StoreInt64(&poolTestIdle, orig)
+	setConfig(t, func(c *Config) { c.PeerCacheSize = 10 })
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	seedPeer("C", "baz", "j", false)
+	connectPeer(t, s, "A").Close()
+	// unverified peers aren't cached
+	ws, _, err := cstDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws?fp=C", nil)
+	require.Nil(t, err)
+	ws.Close()
+	redisDouble.Close()
+	dial := func(fp string) (*websocket.Conn, int) {
+		ws, resp, err := cstDialer.Dial(
+			"ws"+strings.TrimPrefix(s.URL, "http")+"/ws?fp="+fp, nil)
+		if err != nil {
+			return nil, resp.StatusCode
+		}
+		t.Cleanup(func() { ws.Close() })
+		return ws, resp.StatusCode
+	}
+	// the verified peer that connected before is accepted from the cache
+	ws, code := dial("A")
+	require.Equal(t, http.StatusSwitchingProtocols, code)
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws, http.StatusOK)
+	// the rest need the store
+	for _, fp := range []string{"B", "C", "Z"} {
+		_, code = dial(fp)
+		require.Equal(t, http.StatusServiceUnavailable, code, fp)
+	}
+	require.Nil(t, redisDouble.Restart())
+	require.Eventually(t, func() bool {
+		_, err := db.GetPeer("A")
+		return err == nil
+	}, 6*time.Second, 50*time.Millisecond)
+}
+func TestCorruptPeer(t *testing.T) {
+	startTest(t)
+	redisDouble.Set("peer:X", "not a hash")
+	_, err := ConnFromQ(url.Values{"fp": {"X"}})
+	var corrupt *CorruptPeer
+	require.True(t, errors.As(err, &corrupt), "got error: %v", err)
+	require.Contains(t, err.Error(), `Peer "X" is corrupt, its key is a string`)
+	_, resp, err := cstDialer.Dial("ws://127.0.0.1:17777/ws?fp=X", nil)
+	require.NotNil(t, err)
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+// countingConn counts the round trips to redis. The pool flushes a
+// connection when it's returned, which is only a round trip with pending
+// commands.
+type countingConn struct {
+	redis.Conn
+	trips   *int64
+	pending int
+}
+
+func (c *countingConn) Send(cmd string, args ...interface{}) error {
+	c.pending++
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *countingConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "" || c.pending > 0 {
+		atomic.AddInt64(c.trips, 1)
+	}
+	c.pending = 0
+	return c.Conn.Do(cmd, args...)
+}
+
+// newCountingDB returns a store on the redis double counting its round trips
+func newCountingDB(trips *int64) *DBType {
+	return &DBType{pool: &redis.Pool{MaxIdle: 1, Dial: func() (redis.Conn, error) {
+		c, err := redis.Dial("tcp", redisDouble.Addr())
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: c, trips: trips}, nil
+	}}}
+}
+func TestReadPeerRoundTrips(t *testing.T) {
+	startTest(t)
+	seedPeer("A", "foo", "j", true)
+	var trips int64
+	d := newCountingDB(&trips)
+	defer d.pool.Close()
+	pd, err := d.GetPeer("A")
+	require.Nil(t, err)
+	require.Equal(t, "foo", pd.Name)
+	require.EqualValues(t, 1, trips)
+	_, err = d.FindPeer("Z")
+	var notFound *PeerNotFound
+	require.True(t, errors.As(err, &notFound), "got: %v", err)
+	require.EqualValues(t, 2, trips)
+	// a hash of a corrupt peer is reported as such
+	redisDouble.Set("peer:C", "notahash")
+	_, err = d.FindPeer("C")
+	var corrupt *CorruptPeer
+	require.True(t, errors.As(err, &corrupt), "got: %v", err)
+}
+
+// BenchmarkReadPeer compares reading a peer with the existence check that
+// used to precede it to the single round trip read
+func BenchmarkReadPeer(b *testing.B) {
+	if redisDouble == nil {
+		var err error
+		redisDouble, err = miniredis.Run()
+		require.Nil(b, err)
+	}
+	seedPeer("A", "foo", "j", true)
+	var trips int64
+	d := newCountingDB(&trips)
+	defer d.pool.Close()
+	b.Run("exists-then-get", func(b *testing.B) {
+		atomic.StoreInt64(&trips, 0)
+		for i := 0; i < b.N; i++ {
+			if exists, err := d.PeerExists("A"); err != nil || !exists {
+				b.Fatalf("peer not found: %v", err)
+			}
+			if _, err := d.GetPeer("A"); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&trips))/float64(b.N),
+			"trips/op")
+	})
+	b.Run("find", func(b *testing.B) {
+		atomic.StoreInt64(&trips, 0)
+		for i := 0; i < b.N; i++ {
+			if _, err := d.FindPeer("A"); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&trips))/float64(b.N),
+			"trips/op")
+	})
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"sync"
+	"sync/atomic"
+	"text/template"
+
+	"gopkg.in/gomail.v2"
+)
+
+const (
+	// DefaultEmailConcurrency is the number of emails sent at once
+	DefaultEmailConcurrency = 4
+	// DefaultEmailQueue is the number of emails waiting to be sent
+	DefaultEmailQueue = 100
+)
+
+// droppedEmails counts the emails dropped as the queue was full, use atomic
+// to access
+var droppedEmails uint64
+
+// emails sends the auth emails, it's started by main
+var emails *EmailPool
+
+// deliverEmail sends an email over SMTP, tests replace it
+var deliverEmail = func(m *gomail.Message) error {
+	d := gomail.NewPlainDialer(os.Getenv("PB_SMTP_HOST"), 587,
+		os.Getenv("PB_SMTP_USER"), os.Getenv("PB_SMTP_PASS"))
+	return d.DialAndSend(m)
+}
+
+// EmailPool sends emails with a bounded number of workers, so a burst of
+// verifications doesn't exhaust the SMTP connections. Emails waiting for a
+// worker are queued and once the queue is full, new ones are dropped.
+type EmailPool struct {
+	queue chan *gomail.Message
+	wg    sync.WaitGroup
+}
+
+// NewEmailPool returns a pool of workers sending emails and a queue of the
+// emails waiting for them. Use Stop() to stop it.
+func NewEmailPool(workers int, queue int) *EmailPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &EmailPool{queue: make(chan *gomail.Message, queue)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Send queues an email without blocking, it returns false when the queue is
+// full and the email is dropped
+func (p *EmailPool) Send(m *gomail.Message) bool {
+	select {
+	case p.queue <- m:
+		return true
+	default:
+		n := atomic.AddUint64(&droppedEmails, 1)
+		Logger.Warnf("Dropped an email to %v as the queue is full, %d dropped so far",
+			m.GetHeader("To"), n)
+		return false
+	}
+}
+
+// Stop sends the queued emails and stops the workers
+func (p *EmailPool) Stop() {
+	close(p.queue)
+	p.wg.Wait()
+}
+
+func (p *EmailPool) work() {
+	defer p.wg.Done()
+	for m := range p.queue {
+		if err := deliverEmail(m); err != nil {
+			Logger.Errorf("Failed to send email: %s", err)
+		} else {
+			Logger.Infof("Send email to %v", m.GetHeader("To"))
+		}
+	}
+}
+
+// AuthEmail holds the variables of the auth email templates
+type AuthEmail struct {
+	// VerifyURL is the link to the page where the user verifies peers
+	VerifyURL string
+	// PeerName is the name of the peer waiting for verification, empty
+	// when the user asked for the link
+	PeerName string
+	User     string
+}
+
+var defaultEmailHTML = htmltemplate.Must(htmltemplate.New("email").Parse(
+	`<html lang=en> <head><meta charset=utf-8>
+<title>Peerbook updates for your approval</title>
+</head>
+{{if .PeerName}}{{.PeerName}} is waiting for your approval. {{end}}Please click <a href="{{.VerifyURL}}">here to review</a>.`))
+
+var defaultEmailText = template.Must(template.New("email").Parse(
+	`{{if .PeerName}}{{.PeerName}} is waiting for your approval. {{end}}Please click to review:
+{{.VerifyURL}}`))
+
+// loadEmailTemplates parses the configured auth email templates. Each is
+// rendered with sample variables, so a broken template fails the load rather
+// than the emails.
+func (c *Config) loadEmailTemplates() error {
+	sample := AuthEmail{"https://example.com/pb/token", "a peer", "user@example.com"}
+	if c.EmailHTMLTemplate != "" {
+		t, err := htmltemplate.ParseFiles(c.EmailHTMLTemplate)
+		if err != nil {
+			return fmt.Errorf("Failed to parse the html email template: %w", err)
+		}
+		if err = t.Execute(&bytes.Buffer{}, sample); err != nil {
+			return fmt.Errorf("Failed to render the html email template: %w", err)
+		}
+		c.emailHTML = t
+	}
+	if c.EmailTextTemplate != "" {
+		t, err := template.ParseFiles(c.EmailTextTemplate)
+		if err != nil {
+			return fmt.Errorf("Failed to parse the text email template: %w", err)
+		}
+		if err = t.Execute(&bytes.Buffer{}, sample); err != nil {
+			return fmt.Errorf("Failed to render the text email template: %w", err)
+		}
+		c.emailText = t
+	}
+	return nil
+}
+
+// renderAuthEmail returns the html & text bodies of an auth email, from the
+// configured templates or the built-in ones
+func renderAuthEmail(e AuthEmail) (string, string, error) {
+	c := conf()
+	h := c.emailHTML
+	if h == nil {
+		h = defaultEmailHTML
+	}
+	t := c.emailText
+	if t == nil {
+		t = defaultEmailText
+	}
+	var hb, tb bytes.Buffer
+	if err := h.Execute(&hb, e); err != nil {
+		return "", "", fmt.Errorf("Failed to render the html email: %w", err)
+	}
+	if err := t.Execute(&tb, e); err != nil {
+		return "", "", fmt.Errorf("Failed to render the text email: %w", err)
+	}
+	return hb.String(), tb.String(), nil
+}
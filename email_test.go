@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+)
+
+// swapEmails replaces the email pool & delivery for the duration of the test
+func swapEmails(t *testing.T, workers int, queue int,
+	deliver func(m *gomail.Message) error) *EmailPool {
+	origPool, origDeliver := emails, deliverEmail
+	deliverEmail = deliver
+	p := NewEmailPool(workers, queue)
+	emails = p
+	t.Cleanup(func() { emails, deliverEmail = origPool, origDeliver })
+	return p
+}
+
+func TestDefaultAuthEmail(t *testing.T) {
+	body, text, err := renderAuthEmail(AuthEmail{
+		"https://pb.example.com/pb/atoken", "<laptop>", "j@example.com"})
+	require.Nil(t, err)
+	require.Contains(t, body, `href="https://pb.example.com/pb/atoken"`)
+	// html is escaped in the html body only
+	require.Contains(t, body, "&lt;laptop&gt; is waiting")
+	require.Contains(t, text, "<laptop> is waiting")
+	require.Contains(t, text, "https://pb.example.com/pb/atoken")
+	_, text, err = renderAuthEmail(AuthEmail{"https://pb.example.com/pb/atoken",
+		"", "j@example.com"})
+	require.Nil(t, err)
+	require.NotContains(t, text, "waiting")
+}
+func TestCustomAuthEmail(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		p := filepath.Join(dir, name)
+		require.Nil(t, os.WriteFile(p, []byte(content), 0600))
+		return p
+	}
+	c := defaultConfig()
+	c.EmailHTMLTemplate = write("email.html",
+		`<p>Hi {{.User}}, <a href="{{.VerifyURL}}">approve {{.PeerName}}</a></p>`)
+	c.EmailTextTemplate = write("email.txt",
+		`Hi {{.User}}, approve {{.PeerName}} at {{.VerifyURL}}`)
+	require.Nil(t, c.loadEmailTemplates())
+	orig := conf()
+	config.Store(&c)
+	defer config.Store(orig)
+	body, text, err := renderAuthEmail(AuthEmail{
+		"https://pb.example.com/pb/atoken", "laptop", "j@example.com"})
+	require.Nil(t, err)
+	require.Equal(t,
+		`<p>Hi j@example.com, <a href="https://pb.example.com/pb/atoken">approve laptop</a></p>`,
+		body)
+	require.Equal(t,
+		"Hi j@example.com, approve laptop at https://pb.example.com/pb/atoken",
+		text)
+	// broken templates fail the load
+	c = defaultConfig()
+	c.EmailTextTemplate = write("broken.txt", `{{.VerifyURL`)
+	require.NotNil(t, c.loadEmailTemplates())
+	c = defaultConfig()
+	c.EmailHTMLTemplate = write("unknown.html", `{{.Unknown}}`)
+	require.NotNil(t, c.loadEmailTemplates())
+	c = defaultConfig()
+	c.EmailHTMLTemplate = filepath.Join(dir, "missing.html")
+	require.NotNil(t, c.loadEmailTemplates())
+}
+func TestEmailConcurrency(t *testing.T) {
+	startTest(t)
+	var inFlight, maxInFlight, delivered int32
+	p := swapEmails(t, 3, 100, func(m *gomail.Message) error {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		atomic.AddInt32(&delivered, 1)
+		return nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.Nil(t, sendAuthEmail(fmt.Sprintf("u%d@example.com", i), ""))
+		}(i)
+	}
+	wg.Wait()
+	p.Stop()
+	require.Equal(t, int32(20), delivered)
+	require.LessOrEqual(t, maxInFlight, int32(3))
+}
+func TestEmailQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	p := swapEmails(t, 1, 1, func(m *gomail.Message) error {
+		<-release
+		return nil
+	})
+	dropped := atomic.LoadUint64(&droppedEmails)
+	m := gomail.NewMessage()
+	m.SetHeader("To", "j@example.com")
+	require.True(t, p.Send(m))
+	// wait for the worker to take the first email
+	require.Eventually(t, func() bool { return len(p.queue) == 0 },
+		time.Second, time.Millisecond)
+	require.True(t, p.Send(m))
+	require.False(t, p.Send(m))
+	require.Equal(t, dropped+1, atomic.LoadUint64(&droppedEmails))
+	close(release)
+	p.Stop()
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+const (
+	// MinPairCodeLen is the minimum length of an ephemeral peer's pairing
+	// code
+	MinPairCodeLen = 4
+	// MaxPairCodeLen is the maximum length of a pairing code
+	MaxPairCodeLen = 64
+)
+
+// ephemeralConn returns the connection of an ephemeral peer - a peer with no
+// records in the store that can only reach the peers sharing its pairing
+// code. Ephemeral peers are only accepted when `ephemeral` is set.
+func ephemeralConn(q url.Values, code string) (*Conn, error) {
+	if !conf().Ephemeral {
+		return nil, fmt.Errorf("Ephemeral peers are disabled")
+	}
+	if len(code) < MinPairCodeLen || len(code) > MaxPairCodeLen {
+		return nil, fmt.Errorf("Pairing code length must be %d-%d",
+			MinPairCodeLen, MaxPairCodeLen)
+	}
+	fp := q.Get("fp")
+	if err := ValidateFingerprint(fp); err != nil {
+		return nil, err
+	}
+	ping, pong := parseKeepalive(q)
+	return &Conn{FP: fp,
+		ID:         newConnID(),
+		Instance:   instanceID,
+		Pair:       code,
+		pingPeriod: ping,
+		pongWait:   pong,
+		appPing:    q.Get("heartbeat") == "app",
+		Name:       q.Get("name"),
+		send:       make(chan outbound, SendBufSize),
+		control:    make(chan outbound, ControlBufSize)}, nil
+}
+
+// pairChannel returns the channel of an ephemeral peer's messages. It's
+// apart from the registered peers' `out:` channels so the two never meet.
+func pairChannel(code string, fp string) string {
+	return fmt.Sprintf("pair:%s:%s", code, fp)
+}
+
+// relayPaired relays a message of an ephemeral peer to the peer with the
+// same pairing code and the target fingerprint
+func (c *Conn) relayPaired(tfp string, kind string, b []byte) {
+	n, err := db.Publish(pairChannel(c.Pair, tfp), b)
+	if err != nil {
+		c.logger().Errorf("Failed to publish a %s: %s", kind, err)
+		c.auditRoute(tfp, kind, RouteDropped)
+	} else if n == 0 {
+		c.logger().Warnf("Ignoring a %s to %q, not paired with %q", kind, tfp, c.FP)
+		c.auditRoute(tfp, kind, RouteOffline)
+	} else {
+		c.auditRoute(tfp, kind, RouteDelivered)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// connectEphemeral connects an ephemeral peer with the pairing code
+func connectEphemeral(t *testing.T, fp string, code string) *websocket.Conn {
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=" + url.QueryEscape(fp) +
+		"&pair=" + url.QueryEscape(code))
+	require.Nil(t, err)
+	t.Cleanup(func() { ws.Close() })
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatusWith(t, ws, http.StatusOK)
+	return ws
+}
+
+// requireSilent fails if the websocket gets a message with the key
+func requireSilent(t *testing.T, ws *websocket.Conn, key string) {
+	ws.SetReadDeadline(time.Now().Add(time.Second / 10))
+	defer ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	for {
+		var m map[string]interface{}
+		if err := ws.ReadJSON(&m); err != nil {
+			return
+		}
+		_, found := m[key]
+		require.False(t, found, "got: %v", m)
+	}
+}
+
+func TestEphemeralDisabled(t *testing.T) {
+	startTest(t)
+	_, resp, err := cstDialer.Dial("ws://127.0.0.1:17777/ws?fp=E1&pair=abcd", nil)
+	require.NotNil(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Empty(t, redisDouble.Keys())
+}
+func TestEphemeralPairing(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.Ephemeral = true })
+	seedPeer("B", "bar", "j", true)
+	wsB, err := openWS("ws://127.0.0.1:17777/ws?fp=B")
+	require.Nil(t, err)
+	defer wsB.Close()
+	wsB.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatusWith(t, wsB, http.StatusOK)
+	ws1 := connectEphemeral(t, "E1", "abcd")
+	ws2 := connectEphemeral(t, "E2", "abcd")
+	ws3 := connectEphemeral(t, "E3", "wxyz")
+	time.Sleep(time.Second / 20)
+	require.Nil(t, ws1.WriteJSON(map[string]interface{}{
+		"offer": "an offer", "target": "E2"}))
+	m := readUntil(t, ws2, "offer")
+	require.Equal(t, "an offer", m["offer"])
+	require.Equal(t, "E1", m["source_fp"])
+	// other pairs & registered peers are out of reach
+	require.Nil(t, ws1.WriteJSON(map[string]interface{}{
+		"offer": "an offer", "target": "E3"}))
+	require.Nil(t, ws1.WriteJSON(map[string]interface{}{
+		"offer": "an offer", "target": "B"}))
+	requireSilent(t, ws3, "offer")
+	requireSilent(t, wsB, "offer")
+	// and can't reach ephemeral peers
+	require.Nil(t, wsB.WriteJSON(map[string]interface{}{
+		"offer": "an offer", "target": "E2"}))
+	requireSilent(t, ws2, "offer")
+	// no records are kept
+	for _, k := range redisDouble.Keys() {
+		require.False(t, strings.Contains(k, "E1"), "found key %q", k)
+	}
+}
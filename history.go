@@ -0,0 +1,161 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The results of the messages to a peer
+const (
+	OutboundSent    = "sent"
+	OutboundDropped = "dropped"
+	OutboundFailed  = "failed"
+)
+
+// OutboundRecord is the metadata of a message to a peer - written, dropped
+// as the send buffer was full or failed to write. Payloads aren't kept.
+type OutboundRecord struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	From   string    `json:"from,omitempty"`
+	ID     string    `json:"id,omitempty"`
+	Size   int       `json:"size"`
+	Result string    `json:"result"`
+}
+
+// OutboundHistory is a fixed size ring buffer of the latest messages to a
+// peer, once it's full the oldest are overwritten
+type OutboundHistory struct {
+	sync.Mutex
+	records []OutboundRecord
+	// next is the index of the next record and full is set once it wrapped
+	next int
+	full bool
+}
+
+// NewOutboundHistory returns a buffer of the last size messages
+func NewOutboundHistory(size int) *OutboundHistory {
+	return &OutboundHistory{records: make([]OutboundRecord, size)}
+}
+
+// Add adds a record, overwriting the oldest when the buffer is full
+func (h *OutboundHistory) Add(r OutboundRecord) {
+	h.Lock()
+	defer h.Unlock()
+	h.records[h.next] = r
+	h.next++
+	if h.next == len(h.records) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// Records returns a copy of the buffered records, the oldest first
+func (h *OutboundHistory) Records() []OutboundRecord {
+	h.Lock()
+	defer h.Unlock()
+	if !h.full {
+		return append([]OutboundRecord{}, h.records[:h.next]...)
+	}
+	ret := make([]OutboundRecord, 0, len(h.records))
+	ret = append(ret, h.records[h.next:]...)
+	return append(ret, h.records[:h.next]...)
+}
+
+// recordOutbound adds a queued message's metadata to the connection's
+// history, a no-op when outbound_history is 0
+func (c *Conn) recordOutbound(o outbound, result string) {
+	if c.history == nil || o.m == nil {
+		return
+	}
+	r := o.record
+	r.Time, r.Size, r.Result = time.Now(), len(o.m), result
+	if o.m[0] == binaryMarker {
+		r.Size--
+	}
+	c.history.Add(r)
+}
+
+// relayedRecord returns the type, source & id of a relayed message for its
+// history record, decoding only the header of a json message
+func relayedRecord(m []byte) OutboundRecord {
+	var r OutboundRecord
+	if len(m) > 0 && m[0] == binaryMarker {
+		r.Type = "binary"
+		r.From, _, _ = parseBinaryFrame(m[1:])
+		return r
+	}
+	var h map[string]json.RawMessage
+	if err := json.Unmarshal(m, &h); err != nil {
+		return r
+	}
+	json.Unmarshal(h["source_fp"], &r.From)
+	if id := h["id"]; id != nil && string(id) != "null" {
+		r.ID = idText(id)
+	}
+	if json.Unmarshal(h["type"], &r.Type); r.Type == "" {
+		json.Unmarshal(h["command"], &r.Type)
+	}
+	for _, kind := range legacyKinds {
+		if _, found := h[kind]; found && r.Type == "" {
+			r.Type = kind
+		}
+	}
+	return r
+}
+
+// serveConnectionHistory returns the history of the messages to a connection
+// of this instance, by the connection's ID, the oldest first
+func serveConnectionHistory(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/connections/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "history" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := parts[0]
+	var c *Conn
+	ok, err := hub.queryWithin(busyWait(), "get a connection's history",
+		func(conns map[string]*Conn) { c = conns[id] })
+	if err != nil || !ok {
+		if err == nil {
+			err = fmt.Errorf("The hub is stopped")
+		}
+		Logger.Warnf("Failed to get connection %q history: %s", id, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if c == nil {
+		http.Error(w, fmt.Sprintf("Connection %q not found", id),
+			http.StatusNotFound)
+		return
+	}
+	records := []OutboundRecord{}
+	if c.history != nil {
+		records = c.history.Records()
+	}
+	m, err := json.Marshal(map[string]interface{}{
+		"conn_id":  c.ID,
+		"fp":       c.FP,
+		"messages": records,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal the connection's history: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboundHistory(t *testing.T) {
+	h := NewOutboundHistory(2)
+	require.Empty(t, h.Records())
+	h.Add(OutboundRecord{Type: TypeOffer, ID: "1"})
+	require.Equal(t, []OutboundRecord{{Type: TypeOffer, ID: "1"}}, h.Records())
+	h.Add(OutboundRecord{Type: TypeOffer, ID: "2"})
+	h.Add(OutboundRecord{Type: TypeAnswer, ID: "3"})
+	// the oldest are evicted
+	require.Equal(t, []OutboundRecord{{Type: TypeOffer, ID: "2"},
+		{Type: TypeAnswer, ID: "3"}}, h.Records())
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h.Add(OutboundRecord{Type: TypeCandidate})
+				h.Records()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Len(t, h.Records(), 2)
+}
+
+func TestAdminConnectionHistory(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) {
+		c.AdminToken = "anadmintoken"
+		c.OutboundHistory = 3
+	})
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	a := connectPeer(t, s, "A")
+	connectPeer(t, s, "B")
+	var connID string
+	for _, c := range hub.Connections() {
+		if c.FP == "B" {
+			connID = c.ID
+		}
+	}
+	require.NotEmpty(t, connID)
+	history := func(id string) (int, []OutboundRecord) {
+		resp := apiRequest(t, "GET", "/admin/connections/"+id+"/history",
+			"anadmintoken", nil)
+		defer resp.Body.Close()
+		var res struct {
+			FP       string           `json:"fp"`
+			Messages []OutboundRecord `json:"messages"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			require.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+			require.Equal(t, "B", res.FP)
+		}
+		return resp.StatusCode, res.Messages
+	}
+	// it starts with the connect status & the peer list
+	code, l := history(connID)
+	require.Equal(t, http.StatusOK, code)
+	require.GreaterOrEqual(t, len(l), 2)
+	require.Equal(t, TypeStatus, l[0].Type)
+	require.Equal(t, TypePeers, l[1].Type)
+	for i := 1; i <= 4; i++ {
+		require.Nil(t, a.WriteJSON(map[string]string{"offer": "an offer",
+			"target": "B", "id": fmt.Sprint(i)}))
+	}
+	require.Eventually(t, func() bool {
+		_, l = history(connID)
+		return len(l) == 3 && l[2].ID == "4"
+	}, time.Second, 10*time.Millisecond)
+	for i, r := range l {
+		require.Equal(t, TypeOffer, r.Type)
+		require.Equal(t, "A", r.From)
+		require.Equal(t, fmt.Sprint(i+2), r.ID)
+		require.Equal(t, OutboundSent, r.Result)
+		require.NotZero(t, r.Size)
+	}
+	require.False(t, l[0].Time.After(l[2].Time))
+	// ids are kept as sent, numbers too
+	require.Nil(t, a.WriteJSON(map[string]interface{}{"answer": "an answer",
+		"target": "B", "id": json.Number("12345678901234567891")}))
+	require.Eventually(t, func() bool {
+		_, l = history(connID)
+		return len(l) == 3 && l[2].Type == TypeAnswer
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, "12345678901234567891", l[2].ID)
+	code, _ = history("nosuchconn")
+	require.Equal(t, http.StatusNotFound, code)
+	resp := apiRequest(t, "GET", "/admin/connections/"+connID+"/history", "", nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	// a busy hub is unavailable rather than not found
+	stallHub(t)
+	code, _ = history(connID)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+}
@@ -4,36 +4,395 @@
 
 package main
 
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HubStats holds the hub's counters of connected peers
+type HubStats struct {
+	Connected int         `json:"connected"`
+	Users     []UserCount `json:"users"`
+	// Churn holds the users with the most reconnects
+	Churn []UserChurn `json:"churn"`
+}
+
+// UserCount is the number of peers a user has connected
+type UserCount struct {
+	User      string `json:"user"`
+	Connected int    `json:"connected"`
+}
+
+// queryRequest asks the hub to run a function against its connections, done
+// is closed once it returns
+type queryRequest struct {
+	f    func(conns map[string]*Conn)
+	done chan struct{}
+}
+
+// hubWait is how long a request waits for the run loop to take it, in
+// nanoseconds, so a hub stuck on the store doesn't freeze the readers of all
+// the peers. Tests shorten it, use atomic to access.
+var hubWait = int64(2 * time.Second)
+
+// busyWait returns how long a request waits for the hub
+func busyWait() time.Duration {
+	return time.Duration(atomic.LoadInt64(&hubWait))
+}
+
+// idleSweepPeriod is the time between the sweeps evicting idle peers
+const idleSweepPeriod = time.Second
+
+// busyRequests counts the requests dropped as the hub was busy, use atomic to
+// access
+var busyRequests uint64
+
+// HubBusy is an error returned when the hub didn't take a request in hubWait
+type HubBusy struct {
+	request string
+}
+
+func (e *HubBusy) Error() string {
+	return fmt.Sprintf("Server is too busy to %s, please try again", e.request)
+}
+
+// busy counts a request the hub didn't take and returns its error
+func busy(request string) error {
+	n := atomic.AddUint64(&busyRequests, 1)
+	Logger.Warnf("Dropped a %s request as the hub is busy, %d dropped so far",
+		request, n)
+	return &HubBusy{request}
+}
+
+// ConnInfo describes a live connection, for admins
+type ConnInfo struct {
+	FP          string    `json:"fp"`
+	User        string    `json:"user"`
+	ID          string    `json:"id"`
+	ConnectedAt time.Time `json:"connected_at"`
+	RemoteIP    string    `json:"remote_ip"`
+	// RTT is the last ping's round trip time, in milliseconds
+	RTT float64 `json:"rtt_ms,omitempty"`
+}
+
 // Hub maintains the set of active peers and broadcasts messages to the
 // peers.
 type Hub struct {
-	// Inbound messages from the peers.
-	requests chan map[string]interface{}
-
 	// Register requests from the peers.
 	register chan *Conn
 
 	// Unregister requests from peers.
 	unregister chan *Conn
+
+	// Queries reading or acting on the connections
+	query chan queryRequest
+
+	// conns holds the connected peers by connection ID, it's only accessed
+	// from the run goroutine
+	conns map[string]*Conn
+
+	// store keeps the peers' online state
+	store Store
+
+	// instance is the ID of the server instance running the hub
+	instance string
+
+	// churn tracks the users' reconnects
+	churn *churnTracker
+
+	// done is closed to stop the run loop, stopped is closed when it returns
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// NewHub returns a hub keeping its peers' state in the store. Use go run()
+// to start it and Stop() to stop it.
+func NewHub(store Store) *Hub {
+	return &Hub{
+		register:   make(chan *Conn),
+		unregister: make(chan *Conn),
+		query:      make(chan queryRequest),
+		conns:      make(map[string]*Conn),
+		store:      store,
+		instance:   instanceID,
+		churn:      newChurnTracker(),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// Register adds a connection to the hub, it's a no-op once the hub is stopped
+func (h *Hub) Register(c *Conn) {
+	select {
+	case h.register <- c:
+	case <-h.done:
+	}
+}
+
+// Unregister removes a connection from the hub, it's a no-op once the hub is
+// stopped
+func (h *Hub) Unregister(c *Conn) {
+	select {
+	case h.unregister <- c:
+	case <-h.done:
+	}
+}
+
+// Stop stops the run loop, closing all the connections, and waits for it to
+// return
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() { close(h.done) })
+	<-h.stopped
+}
+
+// Query runs f against the hub's connections, by connection ID, in the run
+// loop and waits for it to return. It's the one safe way to access the
+// connections, f must not keep the map nor block. Once the hub is stopped,
+// f isn't run and Query returns false.
+func (h *Hub) Query(f func(conns map[string]*Conn)) bool {
+	ok, _ := h.queryWithin(0, "", f)
+	return ok
+}
+
+// queryWithin is Query giving up with a HubBusy error when the run loop
+// doesn't take the request in wait, zero means waiting forever
+func (h *Hub) queryWithin(wait time.Duration, request string,
+	f func(conns map[string]*Conn)) (bool, error) {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	q := queryRequest{f, make(chan struct{})}
+	select {
+	case h.query <- q:
+		<-q.done
+		return true, nil
+	case <-timeout:
+		return false, busy(request)
+	case <-h.done:
+		return false, nil
+	}
+}
+
+// Stats returns the number of connected peers and the top users with the
+// most connected peers. Once the hub is stopped, it returns nil.
+func (h *Hub) Stats(top int) *HubStats {
+	var stats *HubStats
+	h.Query(func(conns map[string]*Conn) { stats = h.getStats(conns, top) })
+	return stats
+}
+
+// IsConnected returns whether the peer has a connection to the hub. A busy
+// or stopped hub has no connected peers.
+func (h *Hub) IsConnected(fp string) bool {
+	connected, _ := h.askConnected(fp)
+	return connected
+}
+
+func (h *Hub) askConnected(fp string) (bool, error) {
+	var connected bool
+	_, err := h.queryWithin(busyWait(), "locate a peer",
+		func(conns map[string]*Conn) { connected = isConnected(conns, fp) })
+	return connected, err
+}
+
+// ConnectedOf returns the fingerprints of the peers that have a connection
+// to the hub, out of the given ones
+func (h *Hub) ConnectedOf(fps []string) (map[string]bool, error) {
+	connected := make(map[string]bool)
+	_, err := h.queryWithin(busyWait(), "list the connected peers",
+		func(conns map[string]*Conn) {
+			for _, fp := range fps {
+				if isConnected(conns, fp) {
+					connected[fp] = true
+				}
+			}
+		})
+	return connected, err
+}
+
+// Locate returns the ID of the server instance the peer is connected to -
+// the hub's own instance or, for peers connected elsewhere, the instance in
+// the store. An empty string means the peer is offline.
+func (h *Hub) Locate(fp string) (string, error) {
+	connected, err := h.askConnected(fp)
+	if err != nil {
+		return "", err
+	}
+	if connected {
+		return h.instance, nil
+	}
+	return h.store.GetPeerInstance(fp)
+}
+
+// Kick disconnects the peer's connections, notifying them they were
+// disconnected by another peer, and returns their number
+func (h *Hub) Kick(fp string, by string) (int, error) {
+	var n int
+	_, err := h.queryWithin(busyWait(), "disconnect a peer",
+		func(conns map[string]*Conn) { n = kickPeer(conns, fp, by) })
+	return n, err
+}
+
+// Connections returns a snapshot of the live connections, sorted by the time
+// they connected. Once the hub is stopped, it returns nil.
+func (h *Hub) Connections() []ConnInfo {
+	var snapshot []ConnInfo
+	h.Query(func(conns map[string]*Conn) { snapshot = takeSnapshot(conns) })
+	return snapshot
+}
+
+func takeSnapshot(conns map[string]*Conn) []ConnInfo {
+	snapshot := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		snapshot = append(snapshot, ConnInfo{c.FP, c.User, c.ID, c.connectedAt,
+			c.RemoteIP, float64(c.RTT()) / float64(time.Millisecond)})
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].ConnectedAt.Before(snapshot[j].ConnectedAt)
+	})
+	return snapshot
+}
+
+func kickPeer(conns map[string]*Conn, fp string, by string) int {
+	n := 0
+	for _, c := range conns {
+		if c.FP == fp && c.Pair == "" {
+			c.disconnect(http.StatusGone, fmt.Errorf("Disconnected by %q", by),
+				&CloseReason{CloseKicked, "kicked by another device"})
+			audit(AuditEvent{Type: AuditKick, FP: by, User: c.User, Target: fp,
+				ConnID: c.ID})
+			n++
+		}
+	}
+	return n
+}
+
+// evictIdle disconnects the peers that sent & got no application messages -
+// signaling, broadcasts or binary frames - in the idle_evict period. Pings,
+// presence & commands don't count.
+func evictIdle(conns map[string]*Conn, now time.Time) {
+	idle := conf().idleEvict()
+	if idle <= 0 {
+		return
+	}
+	for _, c := range conns {
+		since := now.Sub(c.activeAt())
+		if since < idle {
+			continue
+		}
+		c.logger().Infof("Evicting %q (conn %s), idle for %s", c.FP, c.ID,
+			since.Truncate(time.Second))
+		c.disconnect(http.StatusRequestTimeout,
+			fmt.Errorf("Disconnected after %s with no messages", idle),
+			&CloseReason{CloseIdle, "idle"})
+	}
+}
+
+func isConnected(conns map[string]*Conn, fp string) bool {
+	for _, c := range conns {
+		if c.FP == fp && c.Pair == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hub) getStats(conns map[string]*Conn, top int) *HubStats {
+	perUser := make(map[string]int)
+	for _, c := range conns {
+		perUser[c.User]++
+	}
+	users := make([]UserCount, 0, len(perUser))
+	for u, n := range perUser {
+		users = append(users, UserCount{u, n})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Connected == users[j].Connected {
+			return users[i].User < users[j].User
+		}
+		return users[i].Connected > users[j].Connected
+	})
+	if len(users) > top {
+		users = users[:top]
+	}
+	return &HubStats{Connected: len(conns), Users: users,
+		Churn: h.churn.top(top)}
 }
 
 func (h *Hub) run() {
+	defer close(h.stopped)
+	sweep := time.NewTicker(idleSweepPeriod)
+	defer sweep.Stop()
 	for {
 		select {
+		case <-h.done:
+			for id, c := range h.conns {
+				delete(h.conns, id)
+				c.closeNow(&CloseReason{CloseServerRestart, "server restarting"})
+				fireLifecycle(EventPeerDisconnected, c, time.Now())
+				if c.Pair != "" {
+					continue
+				}
+				if err := c.SetOnline(h.store, false); err != nil {
+					Logger.Errorf("Failed setting a peer as offline: %s", err)
+				}
+			}
+			return
 		case c := <-h.register:
-			c.SendPeerList()
-			if err := c.SetOnline(true); err != nil {
+			h.conns[c.ID] = c
+			h.churn.connected(c)
+			fireLifecycle(EventPeerConnected, c, time.Time{})
+			audit(AuditEvent{Type: AuditConnect, FP: c.FP, User: c.User,
+				ConnID: c.ID, IP: c.RemoteIP})
+			if err := c.sendConnectStatus(); err != nil {
+				Logger.Errorf("Failed to send status message: %s", err)
+			}
+			if banner := conf().Banner; banner != "" {
+				if err := c.sendNotice(banner); err != nil {
+					Logger.Errorf("Failed to send the banner: %s", err)
+				}
+			}
+			// ephemeral peers have no records
+			if c.Pair != "" {
+				continue
+			}
+			c.SendPeerList("")
+			if c.registered != nil {
+				close(c.registered)
+			}
+			if err := c.SetOnline(h.store, true); err != nil {
 				Logger.Errorf("Failed setting a peer as online: %s", err)
 				continue
 			}
 		case c := <-h.unregister:
+			if _, found := h.conns[c.ID]; found {
+				h.churn.disconnected(c)
+				fireLifecycle(EventPeerDisconnected, c, time.Now())
+			}
+			delete(h.conns, c.ID)
 			if c.WS != nil {
 				c.WS.Close()
 			}
-			if err := c.SetOnline(false); err != nil {
+			if c.Pair != "" {
+				continue
+			}
+			if err := c.SetOnline(h.store, false); err != nil {
 				Logger.Errorf("Failed setting a peer as offline: %s", err)
 				continue
 			}
+		case q := <-h.query:
+			q.f(h.conns)
+			close(q.done)
+		case now := <-sweep.C:
+			evictIdle(h.conns, now)
 		}
 	}
 }
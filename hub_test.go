@@ -1,20 +1,44 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
 )
 
+// stallHub blocks the hub's run loop till the test ends, standing for a hub
+// stuck in the store, and shortens the wait for it
+func stallHub(t *testing.T) {
+	wait := atomic.SwapInt64(&hubWait, int64(50*time.Millisecond))
+	taken, release := make(chan struct{}), make(chan struct{})
+	go hub.Query(func(conns map[string]*Conn) {
+		close(taken)
+		<-release
+	})
+	<-taken
+	t.Cleanup(func() {
+		close(release)
+		atomic.StoreInt64(&hubWait, wait)
+	})
+}
+
 func TestSetPeerOnline(t *testing.T) {
 	startTest(t)
 	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
 		"user", "j", "verified", "1", "online", "0")
 	c := &Conn{User: "j", FP: "A"}
-	c.SetOnline(true)
+	c.SetOnline(db, true)
 	require.Equal(t, "1", redisDouble.HGet("peer:A", "online"))
-	c.SetOnline(false)
+	c.SetOnline(db, false)
 	require.Equal(t, "0", redisDouble.HGet("peer:A", "online"))
 }
 func TestPeersNotifications(t *testing.T) {
@@ -32,6 +56,7 @@ func TestPeersNotifications(t *testing.T) {
 	if err := wsA.SetReadDeadline(time.Now().Add(time.Second / 100)); err != nil {
 		t.Fatalf("SetReadDeadline: %v", err)
 	}
+	requireStatus(t, wsA, 200)
 	var i map[string]interface{}
 	err = wsA.ReadJSON(&i)
 	require.Nil(t, err)
@@ -45,3 +70,617 @@ func TestPeersNotifications(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, 401, s.Code)
 }
+func TestStats(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.AdminToken = "anadmintoken" })
+	registered = registeredCache{}
+	redisDouble.SAdd("user:j", "A", "B", "D")
+	redisDouble.SAdd("user:h", "C")
+	for _, p := range [][]string{{"A", "j"}, {"B", "j"}, {"C", "h"}, {"D", "j"}} {
+		redisDouble.HSet("peer:"+p[0], "fp", p[0], "name", "foo", "kind", "lay",
+			"user", p[1], "verified", "1", "online", "0")
+	}
+	for _, fp := range []string{"A", "B", "C"} {
+		ws, err := openWS("ws://127.0.0.1:17777/ws?fp=" + fp)
+		require.Nil(t, err)
+		defer ws.Close()
+	}
+	resp, err := http.Get("http://127.0.0.1:17777/stats")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	var stats struct {
+		Hub        HubStats `json:"hub"`
+		Registered int      `json:"registered"`
+		Uptime     int64    `json:"uptime"`
+	}
+	require.Eventually(t, func() bool {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:17777/stats", nil)
+		require.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer anadmintoken")
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		err = json.NewDecoder(resp.Body).Decode(&stats)
+		require.Nil(t, err)
+		return stats.Hub.Connected == 3
+	}, time.Second, 20*time.Millisecond, "stats: %v", stats)
+	require.Equal(t, 4, stats.Registered)
+	require.Equal(t, []UserCount{{"j", 2}, {"h", 1}}, stats.Hub.Users)
+	require.GreaterOrEqual(t, stats.Uptime, int64(0))
+}
+func TestHubStop(t *testing.T) {
+	startTest(t)
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	redisDouble.HSet("peer:B", "fp", "B", "name", "bar", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	h := NewHub(db)
+	done := make(chan struct{})
+	go func() {
+		h.run()
+		close(done)
+	}()
+	a := &Conn{User: "j", FP: "A", ID: newConnID(), Verified: true,
+		send: make(chan outbound, SendBufSize)}
+	b := &Conn{User: "j", FP: "B", ID: newConnID(), Verified: true,
+		send: make(chan outbound, SendBufSize)}
+	h.Register(a)
+	h.Register(b)
+	require.Equal(t, 2, h.Stats(10).Connected)
+	require.Equal(t, "1", redisDouble.HGet("peer:A", "online"))
+	h.Unregister(a)
+	require.Equal(t, 1, h.Stats(10).Connected)
+	require.Equal(t, "0", redisDouble.HGet("peer:A", "online"))
+	h.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run didn't return after Stop")
+	}
+	require.Equal(t, "0", redisDouble.HGet("peer:B", "online"))
+	// a stopped hub doesn't block
+	h.Unregister(b)
+	require.Nil(t, h.Stats(10))
+	h.Stop()
+}
+func TestPresenceSubscription(t *testing.T) {
+	startTest(t)
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	seedPeer("C", "baz", "j", true)
+	wsA := connectPeer(t, s, "A")
+	require.Nil(t, wsA.WriteJSON(map[string]interface{}{
+		"type": "subscribe", "fingerprints": []string{"B"}}))
+	time.Sleep(time.Second / 20)
+	connectPeer(t, s, "C")
+	connectPeer(t, s, "B")
+	for {
+		m := readUntil(t, wsA, "peer_update")
+		require.NotEqual(t, "C", m["source_fp"], "got an unsubscribed update")
+		if m["source_fp"] == "B" {
+			break
+		}
+	}
+	// without a subscription, all updates are forwarded
+	require.Nil(t, wsA.WriteJSON(map[string]interface{}{
+		"type": "subscribe", "fingerprints": []string{}}))
+	time.Sleep(time.Second / 20)
+	require.Nil(t, (&Conn{User: "j", FP: "C", Verified: true}).SetOnline(db, false))
+	m := readUntil(t, wsA, "peer_update")
+	require.Equal(t, "C", m["source_fp"])
+}
+func TestPresenceBatch(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.PresenceWindow = 200 })
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	for _, fp := range []string{"B", "C", "D"} {
+		seedPeer(fp, "bar", "j", true)
+	}
+	wsA := connectPeer(t, s, "A")
+	// A's own update is alone in its window, it's sent as is
+	m := readUntil(t, wsA, "peer_update")
+	require.Equal(t, "A", m["source_fp"])
+	// a flap of B, C & D
+	for _, online := range []bool{true, false, true, false} {
+		for _, fp := range []string{"B", "C", "D"} {
+			c := &Conn{User: "j", FP: fp, Verified: true}
+			require.Nil(t, c.SetOnline(db, online))
+		}
+	}
+	var batches []map[string]interface{}
+	wsA.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var m map[string]interface{}
+		if err := wsA.ReadJSON(&m); err != nil {
+			break
+		}
+		_, found := m["peer_update"]
+		require.False(t, found, "got an update outside a batch: %v", m)
+		if m["type"] == TypePresenceBatch {
+			batches = append(batches, m)
+		}
+	}
+	require.Len(t, batches, 1)
+	changes := batches[0]["changes"].([]interface{})
+	require.Len(t, changes, 3)
+	for i, fp := range []string{"B", "C", "D"} {
+		change := changes[i].(map[string]interface{})
+		require.Equal(t, fp, change["source_fp"])
+		// the latest update of each peer
+		update := change["peer_update"].(map[string]interface{})
+		require.Equal(t, false, update["online"])
+	}
+}
+func TestPresenceLabels(t *testing.T) {
+	startTest(t)
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	wsA := connectPeer(t, s, "A")
+	wsB := connectPeer(t, s, "B")
+	labels := map[string]interface{}{"power": "battery", "app": "background"}
+	require.Nil(t, wsA.WriteJSON(map[string]interface{}{"type": TypeSetStatus,
+		"labels": labels}))
+	wsB.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		m := readUntil(t, wsB, "peer_update")
+		update := m["peer_update"].(map[string]interface{})
+		if m["source_fp"] != "A" || update["labels"] == nil {
+			continue
+		}
+		require.Equal(t, labels, update["labels"])
+		require.Equal(t, true, update["online"])
+		break
+	}
+	// too many labels are refused
+	many := map[string]string{}
+	for i := 0; i <= MaxLabels; i++ {
+		many[string(rune('a'+i))] = "x"
+	}
+	require.Nil(t, wsA.WriteJSON(map[string]interface{}{"type": TypeSetStatus,
+		"labels": many}))
+	wsA.SetReadDeadline(time.Now().Add(time.Second))
+	requireStatusWith(t, wsA, http.StatusBadRequest)
+}
+func TestCrossInstanceDetection(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) {
+		c.AuditRouting = true
+		c.AdminToken = "anadmintoken"
+	})
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	// a second instance sharing the store
+	other := NewHub(db)
+	other.instance = "other"
+	go other.run()
+	defer other.Stop()
+	b := &Conn{User: "j", FP: "B", ID: newConnID(), Verified: true,
+		Instance: other.instance, send: make(chan outbound, SendBufSize)}
+	other.Register(b)
+	subscribeConn(t, b)
+	require.Eventually(t, func() bool {
+		instance, err := hub.Locate("B")
+		require.Nil(t, err)
+		return instance == "other"
+	}, time.Second, 10*time.Millisecond)
+	instance, err := other.Locate("B")
+	require.Nil(t, err)
+	require.Equal(t, "other", instance)
+	req, err := http.NewRequest("GET", "http://127.0.0.1:17777/instance/B", nil)
+	require.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer anadmintoken")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var located map[string]interface{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&located))
+	require.Equal(t, map[string]interface{}{"fp": "B", "instance": "other",
+		"local": false}, located)
+	// a message to B is detected as crossing instances
+	logs, restore := observeLogs(zapcore.DebugLevel)
+	defer restore()
+	a := &Conn{User: "j", FP: "A", Verified: true, ID: newConnID(),
+		Instance: instanceID, send: make(chan outbound, SendBufSize)}
+	a.handleMessage(map[string]interface{}{"offer": "SDP", "target": "B"})
+	entries := logs.FilterMessage("routed message").All()
+	require.Len(t, entries, 1)
+	require.Equal(t, RouteRemote, entries[0].ContextMap()["outcome"])
+	// once B leaves, it's not found anywhere
+	other.Unregister(b)
+	require.Eventually(t, func() bool {
+		instance, err := hub.Locate("B")
+		require.Nil(t, err)
+		return instance == ""
+	}, time.Second, 10*time.Millisecond)
+}
+func TestCrossInstanceRelay(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.AuditRouting = true })
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	other := NewHub(db)
+	other.instance = "other"
+	go other.run()
+	defer other.Stop()
+	b := &Conn{User: "j", FP: "B", ID: newConnID(), Verified: true,
+		Instance: other.instance, send: make(chan outbound, SendBufSize)}
+	other.Register(b)
+	unsubscribe := subscribeConn(t, b)
+	wsA := connectPeer(t, s, "A")
+	require.Eventually(t, func() bool {
+		instance, err := hub.Locate("B")
+		require.Nil(t, err)
+		return instance == "other"
+	}, time.Second, 10*time.Millisecond)
+	logs, restore := observeLogs(zapcore.DebugLevel)
+	defer restore()
+	require.Nil(t, wsA.WriteJSON(map[string]interface{}{
+		"offer": "an offer", "target": "B"}))
+	timeout := time.After(time.Second)
+	for found := false; !found; {
+		select {
+		case m := <-b.send:
+			var o map[string]interface{}
+			require.Nil(t, json.Unmarshal(m.m, &o))
+			if o["offer"] != nil {
+				require.Equal(t, "an offer", o["offer"])
+				require.Equal(t, "A", o["source_fp"])
+				found = true
+			}
+		case <-timeout:
+			t.Fatal("B didn't get the offer")
+		}
+	}
+	// the route is audited once the offer is published
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("routed message").Len() == 1
+	}, time.Second, 10*time.Millisecond)
+	entries := logs.FilterMessage("routed message").All()
+	require.Equal(t, RouteRemote, entries[0].ContextMap()["outcome"])
+	// B disconnected after it was looked up, while it's still online in the
+	// store
+	unsubscribe()
+	require.Eventually(t, func() bool {
+		return redisDouble.PubSubNumSub("out:B")["out:B"] == 0
+	}, time.Second, 10*time.Millisecond)
+	a := &Conn{User: "j", FP: "A", Verified: true, ID: newConnID(),
+		Instance: instanceID, send: make(chan outbound, SendBufSize)}
+	a.relay(&Peer{FP: "B", User: "j", Online: true}, "offer", []byte("{}"))
+	entries = logs.FilterMessage("routed message").All()
+	require.Len(t, entries, 2)
+	require.Equal(t, RouteOffline, entries[1].ContextMap()["outcome"])
+}
+func TestRelayLocatesOnlyWhenAudited(t *testing.T) {
+	startTest(t)
+	seedPeer("B", "bar", "j", true)
+	b := &Conn{User: "j", FP: "B", ID: newConnID(), Verified: true,
+		send: make(chan outbound, SendBufSize)}
+	subscribeConn(t, b)
+	a := &Conn{User: "j", FP: "A", Verified: true, ID: newConnID(),
+		Instance: instanceID, send: make(chan outbound, SendBufSize)}
+	stallHub(t)
+	busy := atomic.LoadUint64(&busyRequests)
+	a.relay(&Peer{FP: "B", User: "j", Online: true}, "offer", []byte("{}"))
+	require.Equal(t, busy, atomic.LoadUint64(&busyRequests))
+	setConfig(t, func(c *Config) { c.AuditRouting = true })
+	a.relay(&Peer{FP: "B", User: "j", Online: true}, "offer", []byte("{}"))
+	require.Equal(t, busy+1, atomic.LoadUint64(&busyRequests))
+}
+func TestKick(t *testing.T) {
+	startTest(t)
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	seedPeer("C", "baz", "h", true)
+	wsA := connectPeer(t, s, "A")
+	wsB := connectPeer(t, s, "B")
+	wsC := connectPeer(t, s, "C")
+	// a cross-user kick is refused
+	require.Nil(t, wsC.WriteJSON(map[string]interface{}{
+		"type": "kick", "target": "A"}))
+	requireStatusWith(t, wsC, http.StatusForbidden)
+	require.True(t, hub.IsConnected("A"))
+	require.Eventually(t, func() bool {
+		return redisDouble.PubSubNumSub("out:B")["out:B"] == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Nil(t, wsA.WriteJSON(map[string]interface{}{
+		"type": "kick", "target": "B"}))
+	requireStatusWith(t, wsA, http.StatusOK)
+	m := readUntil(t, wsB, "code")
+	require.Equal(t, float64(http.StatusGone), m["code"])
+	require.Contains(t, m["text"], `"A"`)
+	for {
+		_, _, err := wsB.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			require.True(t, errors.As(err, &ce), "got: %s", err)
+			require.Equal(t, CloseKicked, ce.Code)
+			require.Equal(t, "kicked by another device", ce.Text)
+			break
+		}
+	}
+	require.Eventually(t, func() bool { return !hub.IsConnected("B") },
+		time.Second, 10*time.Millisecond)
+	require.True(t, hub.IsConnected("A"))
+}
+func TestKickOnAnotherInstance(t *testing.T) {
+	startTest(t)
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	other := NewHub(db)
+	other.instance = "other"
+	go other.run()
+	defer other.Stop()
+	b := &Conn{User: "j", FP: "B", ID: newConnID(), Verified: true,
+		Instance: other.instance, send: make(chan outbound, SendBufSize),
+		done: make(chan struct{})}
+	other.Register(b)
+	defer subscribeConn(t, b)()
+	wsA := connectPeer(t, s, "A")
+	require.False(t, hub.IsConnected("B"))
+	require.Nil(t, wsA.WriteJSON(map[string]interface{}{
+		"type": "kick", "target": "B"}))
+	requireStatusWith(t, wsA, http.StatusOK)
+	select {
+	case <-b.done:
+	case <-time.After(time.Second):
+		t.Fatal("B wasn't disconnected")
+	}
+	require.Equal(t, websocket.FormatCloseMessage(CloseKicked,
+		"kicked by another device"), b.closeMessage())
+}
+func TestReconnectChurn(t *testing.T) {
+	startTest(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	h := NewHub(db)
+	now := time.Now()
+	h.churn.now = func() time.Time { return now }
+	go h.run()
+	defer h.Stop()
+	connect := func(fp string, session time.Duration) {
+		c := &Conn{User: "j", FP: fp, ID: newConnID(), Verified: true,
+			send: make(chan outbound, SendBufSize)}
+		h.Register(c)
+		h.Stats(1)
+		now = now.Add(session)
+		h.Unregister(c)
+		// both pumps unregister, the session ends once
+		h.Unregister(c)
+	}
+	connect("A", 10*time.Second)
+	connect("A", 20*time.Second)
+	connect("A", 30*time.Second)
+	connect("B", 60*time.Second)
+	stats := h.Stats(10)
+	require.Equal(t, []UserChurn{{"j", 2, 30}}, stats.Churn)
+	// the counters restart with the window
+	now = now.Add(ChurnWindow)
+	require.Empty(t, h.Stats(10).Churn)
+}
+func TestConnections(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.AdminToken = "anadmintoken" })
+	for _, p := range [][]string{{"A", "j"}, {"B", "j"}, {"C", "h"}} {
+		redisDouble.HSet("peer:"+p[0], "fp", p[0], "name", "foo", "kind", "lay",
+			"user", p[1], "verified", "1", "online", "0")
+	}
+	before := time.Now()
+	for _, fp := range []string{"A", "B", "C"} {
+		ws, err := openWS("ws://127.0.0.1:17777/ws?fp=" + fp)
+		require.Nil(t, err)
+		defer ws.Close()
+	}
+	resp, err := http.Get("http://127.0.0.1:17777/admin/connections")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	var l struct {
+		Instance    string     `json:"instance"`
+		Connections []ConnInfo `json:"connections"`
+	}
+	require.Eventually(t, func() bool {
+		req, err := http.NewRequest("GET",
+			"http://127.0.0.1:17777/admin/connections", nil)
+		require.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer anadmintoken")
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+		return len(l.Connections) == 3
+	}, time.Second, 20*time.Millisecond, "connections: %v", l)
+	require.Equal(t, instanceID, l.Instance)
+	users := map[string]string{}
+	ids := map[string]bool{}
+	for _, c := range l.Connections {
+		users[c.FP] = c.User
+		ids[c.ID] = true
+		require.Equal(t, "127.0.0.1", c.RemoteIP)
+		require.False(t, c.ConnectedAt.Before(before.Truncate(time.Second)),
+			"connected at %s", c.ConnectedAt)
+	}
+	require.Equal(t, map[string]string{"A": "j", "B": "j", "C": "h"}, users)
+	require.Len(t, ids, 3)
+}
+func TestStalledHub(t *testing.T) {
+	startTest(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	s := newTestServer(t)
+	a := connectPeer(t, s, "A")
+	stallHub(t)
+	busy := atomic.LoadUint64(&busyRequests)
+	start := time.Now()
+	_, err := hub.Locate("B")
+	require.IsType(t, &HubBusy{}, err)
+	require.False(t, hub.IsConnected("B"))
+	n, err := hub.Kick("B", "A")
+	require.IsType(t, &HubBusy{}, err)
+	require.Zero(t, n)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+	// the reader of a connected peer keeps going
+	status := func() int {
+		for {
+			var m map[string]interface{}
+			require.Nil(t, a.ReadJSON(&m))
+			if code, found := m["code"]; found {
+				return int(code.(float64))
+			}
+		}
+	}
+	// kicks go through the store, not the hub
+	require.Nil(t, a.WriteJSON(map[string]string{"type": "kick",
+		"target": "B"}))
+	a.SetReadDeadline(time.Now().Add(time.Second))
+	require.Equal(t, http.StatusNotFound, status())
+	require.Nil(t, a.WriteJSON(map[string]string{"type": "kick",
+		"target": "Z"}))
+	require.Equal(t, http.StatusNotFound, status())
+	require.Equal(t, busy+3, atomic.LoadUint64(&busyRequests))
+}
+func TestBanner(t *testing.T) {
+	startTest(t)
+	seedPeer("A", "foo", "j", true)
+	s := newTestServer(t)
+	// no banner by default
+	connectPeer(t, s, "A")
+	setConfig(t, func(c *Config) { c.Banner = "Down for maintenance at 10:00" })
+	ws, _, err := cstDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+
+		"/ws?fp=A", nil)
+	require.Nil(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	requireStatus(t, ws, http.StatusOK)
+	var m map[string]interface{}
+	require.Nil(t, ws.ReadJSON(&m))
+	require.Equal(t, map[string]interface{}{"type": "notice",
+		"message": "Down for maintenance at 10:00"}, m)
+	m = nil
+	require.Nil(t, ws.ReadJSON(&m))
+	require.Contains(t, m, "peers")
+}
+func TestHubQuery(t *testing.T) {
+	startTest(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	h := NewHub(db)
+	go h.run()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(fp string) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c := &Conn{User: "j", FP: fp, ID: newConnID(), Verified: true,
+					send: make(chan outbound, SendBufSize)}
+				h.Register(c)
+				h.Unregister(c)
+			}
+		}([]string{"A", "B"}[i%2])
+	}
+	stop := make(chan struct{})
+	var queries sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		queries.Add(1)
+		go func() {
+			defer queries.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var n int
+				require.True(t, h.Query(func(conns map[string]*Conn) {
+					for _, c := range conns {
+						if c.User == "j" {
+							n++
+						}
+					}
+				}))
+				require.LessOrEqual(t, n, 4)
+				require.LessOrEqual(t, len(h.Connections()), 4)
+				h.IsConnected("A")
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	queries.Wait()
+	require.Zero(t, h.Stats(10).Connected)
+	h.Stop()
+	// a stopped hub runs no queries
+	require.False(t, h.Query(func(map[string]*Conn) {
+		t.Fatal("a stopped hub ran a query")
+	}))
+}
+func TestRouteTest(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.AdminToken = "anadmintoken" })
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	seedPeer("C", "baz", "j", true)
+	seedPeer("D", "qux", "h", true)
+	seedPeer("E", "quux", "j", false)
+	seedPeer("F", "corge", "j", true)
+	connectPeer(t, s, "B")
+	// F is connected to another instance
+	redisDouble.HSet("peer:F", "online", "1")
+	redisDouble.Set("online:F", "other")
+	routeTest := func(from string, to string) (int, map[string]string) {
+		resp := apiRequest(t, "POST", "/admin/route-test", "anadmintoken",
+			map[string]string{"from": from, "to": to})
+		defer resp.Body.Close()
+		var res map[string]string
+		if resp.StatusCode == http.StatusOK {
+			require.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+		}
+		return resp.StatusCode, res
+	}
+	for _, tc := range []struct {
+		from    string
+		to      string
+		outcome string
+	}{
+		{"A", "B", RouteDelivered},
+		{"A", "F", RouteRemote},
+		{"A", "C", RouteOffline},
+		{"A", "D", RouteForeign},
+		{"A", "Z", RouteDropped},
+		{"A", "A", RoutePolicyBlocked},
+		{"A", "E", RoutePolicyBlocked},
+		{"E", "A", RoutePolicyBlocked},
+	} {
+		code, res := routeTest(tc.from, tc.to)
+		require.Equal(t, http.StatusOK, code, "%s => %s", tc.from, tc.to)
+		require.Equal(t, tc.outcome, res["outcome"], "%s => %s: %v",
+			tc.from, tc.to, res)
+		// refusals come with a reason
+		switch tc.outcome {
+		case RouteForeign, RouteDropped, RoutePolicyBlocked:
+			require.NotEmpty(t, res["reason"], "%s => %s", tc.from, tc.to)
+		}
+	}
+	// with an offline queue, nothing is queued
+	setConfig(t, func(c *Config) { c.OfflineQueue = 10 })
+	_, res := routeTest("A", "C")
+	require.Equal(t, RouteQueued, res["outcome"])
+	require.False(t, redisDouble.Exists("queue:C"))
+	code, _ := routeTest("Z", "A")
+	require.Equal(t, http.StatusNotFound, code)
+	resp := apiRequest(t, "POST", "/admin/route-test", "",
+		map[string]string{"from": "A", "to": "B"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
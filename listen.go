@@ -0,0 +1,79 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultSocketMode is the permissions of the unix socket the server
+// listens on
+const DefaultSocketMode = "0660"
+
+// unixPrefix marks an address as the path of a unix socket
+const unixPrefix = "unix:"
+
+// listen returns a listener of the address - a TCP address or unix:<path>
+// for a unix socket with the given octal permissions. A stale socket at the
+// path is removed first. stop stops listening and removes the socket.
+func listen(addr string, mode string) (ln net.Listener, stop func() error, err error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ln, ln.Close, nil
+	}
+	path := strings.TrimPrefix(addr, unixPrefix)
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Bad socket mode %q: %w", mode, err)
+	}
+	if err = removeStaleSocket(path); err != nil {
+		return nil, nil, err
+	}
+	ln, err = net.Listen("unix", path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = os.Chmod(path, os.FileMode(perm)); err != nil {
+		ln.Close()
+		return nil, nil, fmt.Errorf("Failed to set the socket's mode: %w", err)
+	}
+	stop = func() error {
+		err := ln.Close()
+		if rmErr := os.Remove(path); rmErr != nil && !os.IsNotExist(rmErr) {
+			return rmErr
+		}
+		return err
+	}
+	return ln, stop, nil
+}
+
+// removeStaleSocket removes the socket a crashed server left at the path.
+// Other files & sockets a server listens on are kept and returned as an
+// error.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%q exists and isn't a socket", path)
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("%q is in use", path)
+	}
+	Logger.Warnf("Removing the stale socket at %q", path)
+	return os.Remove(path)
+}
@@ -0,0 +1,69 @@
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixSocket(t *testing.T) {
+	startTest(t)
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	path := filepath.Join(t.TempDir(), "pb.sock")
+	// a crashed server left its socket
+	stale, err := net.Listen("unix", path)
+	require.Nil(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, stop, err := listen("unix:"+path, DefaultSocketMode)
+	require.Nil(t, err)
+	srv := newHTTPServer("unix:"+path, http.DefaultServeMux)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.Serve(ln)
+		stop()
+	}()
+	defer func() {
+		srv.Shutdown(context.Background())
+		<-done
+		_, err := os.Stat(path)
+		require.True(t, os.IsNotExist(err), "the socket wasn't removed")
+	}()
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0660), fi.Mode().Perm())
+	dialer := websocket.Dialer{
+		NetDial: func(string, string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}
+	ws, resp, err := dialer.Dial("ws://peerbook/ws?fp=A", nil)
+	require.Nil(t, err)
+	defer ws.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws, 200)
+	// a socket in use isn't stale
+	_, _, err = listen("unix:"+path, DefaultSocketMode)
+	require.NotNil(t, err)
+}
+func TestListenNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pb.sock")
+	require.Nil(t, os.WriteFile(path, []byte("keep me"), 0600))
+	_, _, err := listen("unix:"+path, DefaultSocketMode)
+	require.NotNil(t, err)
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "keep me", string(b))
+}
@@ -7,24 +7,37 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"image/png"
+	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/gomodule/redigo/redis"
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 	"github.com/rs/cors"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"gopkg.in/gomail.v2" //go get gopkg.in/gomail.v2
 )
 
@@ -49,17 +62,60 @@ const (
 
 `
 	DefaultHomeUrl = "https://pb.terminal7.dev"
+	// DefaultStatsTop is the default number of users listed in /stats
+	DefaultStatsTop = 10
+	// RegisteredCacheTTL is the time the count of registered peers is cached
+	RegisteredCacheTTL = 10 * time.Second
+	// DefaultWSBurst is the number of websocket connections an IP can open
+	// in a burst, when rate limiting is on
+	DefaultWSBurst = 10
+	// DefaultReconnectWindow & DefaultReconnectCooldown are the seconds of
+	// the reconnect limit's window & cooldown, when it's on
+	DefaultReconnectWindow   = 60
+	DefaultReconnectCooldown = 60
+	// DefaultMsgBurst is the number of messages a peer can send in a burst,
+	// when inbound rate limiting is on
+	DefaultMsgBurst = 20
+	// DefaultServerHeader is the default value of the Server header
+	DefaultServerHeader = "peerbook"
 )
 
 // Logger is our global logger
 var (
-	Logger       *zap.SugaredLogger
-	stop         chan os.Signal
-	db           DBType
-	hub          Hub
-	baseTemplate string
+	Logger     *zap.SugaredLogger
+	stop       chan os.Signal
+	db         Store
+	hub        *Hub
+	startTime  time.Time
+	registered registeredCache
+	// instanceID identifies this server among the instances sharing the
+	// store
+	instanceID string
 )
 
+// registeredCache caches the count of registered peers so scraping /stats
+// doesn't hammer redis
+type registeredCache struct {
+	sync.Mutex
+	count int
+	at    time.Time
+}
+
+func (rc *registeredCache) get() (int, error) {
+	rc.Lock()
+	defer rc.Unlock()
+	if !rc.at.IsZero() && time.Since(rc.at) < RegisteredCacheTTL {
+		return rc.count, nil
+	}
+	count, err := db.CountPeers()
+	if err != nil {
+		return 0, err
+	}
+	rc.count = count
+	rc.at = time.Now()
+	return count, nil
+}
+
 // PeerIsForeign is an error for the time when a peer asks to connect to a peer
 // belonging to another user
 type PeerIsForeign struct {
@@ -97,11 +153,114 @@ func (p *PeerNotFound) Error() string {
 	return fmt.Sprintf("Peer not found: %s", p.fp)
 }
 
-// PeerChanged is an error
-type PeerChanged struct{}
+// UnknownKind is an error returned for a peer kind that's not in the
+// configured kinds
+type UnknownKind struct {
+	kind string
+}
+
+func (e *UnknownKind) Error() string {
+	return fmt.Sprintf("Unknown kind %q", e.kind)
+}
+
+// BadCursor is an error returned for a list cursor that wasn't returned by
+// a list request
+type BadCursor struct {
+	cursor string
+}
+
+func (e *BadCursor) Error() string {
+	return fmt.Sprintf("Bad cursor %q", e.cursor)
+}
+
+// TooManyPeers is an error returned when a user reached the maximum number
+// of peers
+type TooManyPeers struct {
+	user string
+}
+
+func (e *TooManyPeers) Error() string {
+	return fmt.Sprintf("User %q has too many peers", e.user)
+}
+
+// TooManyPending is an error returned when a user has the maximum number of
+// peers pending verification
+type TooManyPending struct {
+	user string
+}
+
+func (e *TooManyPending) Error() string {
+	return fmt.Sprintf("User %q has too many peers pending verification", e.user)
+}
+
+// BodyTooLarge is an error returned when a request's body is larger than
+// MaxBodySize
+type BodyTooLarge struct {
+	limit int64
+}
+
+func (e *BodyTooLarge) Error() string {
+	return fmt.Sprintf("Request body is larger than %d bytes", e.limit)
+}
+
+// NameTaken is an error returned when a user already has a peer named so
+type NameTaken struct {
+	name string
+}
+
+func (e *NameTaken) Error() string {
+	return fmt.Sprintf("Another peer is named %q", e.name)
+}
+
+// EmailThrottled is an error returned when a user can't get another email
+// yet
+type EmailThrottled struct {
+	email string
+}
+
+func (e *EmailThrottled) Error() string {
+	return fmt.Sprintf("An email was sent to %q too recently", e.email)
+}
+
+// CorruptPeer is an error returned when a peer's key isn't a hash
+type CorruptPeer struct {
+	fp      string
+	keyType string
+}
+
+func (e *CorruptPeer) Error() string {
+	return fmt.Sprintf("Peer %q is corrupt, its key is a %s instead of a hash",
+		e.fp, e.keyType)
+}
+
+// MissingParam is an error for requests lacking a required parameter
+type MissingParam struct {
+	name string
+}
+
+func (e *MissingParam) Error() string {
+	return fmt.Sprintf("Missing required parameter: %s", e.name)
+}
+
+// UserNotAllowed is an error for users off the allow list or on the deny
+// list
+type UserNotAllowed struct {
+	user string
+}
+
+func (e *UserNotAllowed) Error() string {
+	return fmt.Sprintf("User %q is not allowed", e.user)
+}
+
+// PeerChanged is an error for a verify request changing the identity
+// fields of a verified peer
+type PeerChanged struct {
+	fields []string
+}
 
 func (p *PeerChanged) Error() string {
-	return "Peer exists with different properties"
+	return fmt.Sprintf("Peer exists with a different %s",
+		strings.Join(p.fields, " & "))
 }
 
 // NoSecret is an error
@@ -115,7 +274,11 @@ func (e *NewSecret) Error() string {
 // url part
 func getUserFromRequest(r *http.Request) (string, error) {
 	i := strings.IndexRune(r.URL.Path[1:], '/')
-	t := r.URL.Path[i+2:]
+	return getUserFromToken(r.URL.Path[i+2:])
+}
+
+// getUserFromToken returns the user of an escaped token
+func getUserFromToken(t string) (string, error) {
 	token, err := url.PathUnescape(t)
 	if err != nil {
 		return " ", fmt.Errorf("Failed to unescape token: err: %w", err)
@@ -125,7 +288,7 @@ func getUserFromRequest(r *http.Request) (string, error) {
 	if err != nil || user == "" {
 		return " ", fmt.Errorf("Failed to get token: err: %w", err)
 	}
-	return user, nil
+	return normalizeUser(user), nil
 }
 
 func serveAuthPage(w http.ResponseWriter, r *http.Request) {
@@ -133,14 +296,14 @@ func serveAuthPage(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		msg := fmt.Sprintf("Failed to parse url: %s", err)
 		Logger.Error(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
 		return
 	}
 	peers, err := GetUsersPeers(user)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to get user peers: %s", err)
 		Logger.Error(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
 		return
 	}
 	var data struct {
@@ -157,7 +320,7 @@ func serveAuthPage(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			msg := fmt.Sprintf("Got an error creating temp url: %s", err)
 			Logger.Warnf(msg)
-			http.Error(w, msg, http.StatusInternalServerError)
+			http.Error(w, internalErrorText, http.StatusInternalServerError)
 			return
 		}
 		http.Redirect(w, r, a, http.StatusSeeOther)
@@ -168,7 +331,7 @@ func serveAuthPage(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			msg := fmt.Sprintf("Got an error parsing form: %s", err)
 			Logger.Warnf(msg)
-			http.Error(w, msg, http.StatusBadRequest)
+			http.Error(w, msg, bodyErrorStatus(err))
 			return
 		}
 		otp := r.Form.Get("otp")
@@ -190,20 +353,39 @@ func serveAuthPage(w http.ResponseWriter, r *http.Request) {
 			_, rmrf := r.Form["rmrf"]
 			if rmrf {
 				Logger.Infof("Removing user %s and his peers", user)
-				conn := db.pool.Get()
-				defer conn.Close()
 				for _, p := range *peers {
-					conn.Do("DEL", p.Key())
+					db.DeletePeer(p.FP)
+					closeDeleted(p.FP)
 				}
-				key := fmt.Sprintf("user:%s", user)
-				conn.Do("DEL", key)
+				db.DeleteUser(user)
 				w.Write([]byte(HTMLPostrmrf))
 				return
 			}
 			verified := make(map[string]bool)
 			for k, _ := range r.Form {
 				verified[k] = true
+				if strings.HasPrefix(k, "restore-") {
+					fp := strings.TrimPrefix(k, "restore-")
+					if err := RestorePeer(fp, user); err != nil {
+						Logger.Warnf("Failed to restore peer %q: %s", fp, err)
+					}
+				}
+			}
+			var kept PeerList
+			for _, p := range *peers {
+				if !verified["del-"+p.FP] {
+					kept = append(kept, p)
+					continue
+				}
+				Logger.Infof("Deleting peer %q of user %s", p.FP, user)
+				if err := DeletePeer(p); err != nil {
+					msg := fmt.Sprintf("Failed to delete peer: %s", err)
+					Logger.Errorf(msg)
+					http.Error(w, internalErrorText, http.StatusInternalServerError)
+					return
+				}
 			}
+			*peers = kept
 			for _, p := range *peers {
 				var err error
 				_, toBeV := verified[p.FP]
@@ -218,7 +400,7 @@ func serveAuthPage(w http.ResponseWriter, r *http.Request) {
 				if err != nil {
 					msg := fmt.Sprintf("Failed to verify peer: %s", err)
 					Logger.Errorf(msg)
-					http.Error(w, msg, http.StatusInternalServerError)
+					http.Error(w, internalErrorText, http.StatusInternalServerError)
 					return
 				}
 			}
@@ -230,18 +412,19 @@ func serveAuthPage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	main := fmt.Sprintf("%s/pb.tmpl", os.Getenv("PB_STATIC_ROOT"))
-	tmpl, err := template.ParseFiles(main, baseTemplate)
+	main := staticPath("pb.tmpl")
+	tmpl, err := template.ParseFiles(main, staticPath("base.tmpl"))
 	if err != nil {
 		msg := fmt.Sprintf("Failed to parse the template: %s", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
 		return
 	}
 	err = tmpl.Execute(w, data)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to execute the main template: %s", err)
 		Logger.Error(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
 	}
 }
 func serveHitMe(w http.ResponseWriter, r *http.Request) {
@@ -250,102 +433,282 @@ func serveHitMe(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			msg := fmt.Sprintf("Got an error parsing form: %s", err)
 			Logger.Warnf(msg)
-			http.Error(w, `{"msg": "`+msg+`"}`, http.StatusBadRequest)
+			http.Error(w, `{"msg": "`+msg+`"}`, bodyErrorStatus(err))
 			return
 		}
-		email := r.Form.Get("email")
+		email := normalizeUser(r.Form.Get("email"))
 		if email == "" {
 			msg := "Got a hitme request with no email"
 			Logger.Warnf(msg)
 			http.Error(w, `{"msg": "`+msg+`"}`, http.StatusBadRequest)
 			return
 		}
-		sendAuthEmail(email)
+		if err = ValidateUser(email); err != nil {
+			http.Error(w, `{"msg": "`+err.Error()+`"}`, http.StatusBadRequest)
+			return
+		}
+		sendAuthEmail(email, "")
 		var data struct {
 			Message string
 			User    string
 		}
 		data.User = email
 		data.Message = "You've been hit with the email stick"
-		index := fmt.Sprintf("%s/index.tmpl", os.Getenv("PB_STATIC_ROOT"))
-		tmpl, err := template.ParseFiles(index, baseTemplate)
+		index := staticPath("index.tmpl")
+		tmpl, err := template.ParseFiles(index, staticPath("base.tmpl"))
 		if err != nil {
 			msg := fmt.Sprintf("Failed to parse the template: %s", err)
-			http.Error(w, msg, http.StatusInternalServerError)
+			Logger.Error(msg)
+			http.Error(w, internalErrorText, http.StatusInternalServerError)
 			return
 		}
 		err = tmpl.Execute(w, data)
 		if err != nil {
 			msg := fmt.Sprintf("Failed to execute the main template: %s", err)
 			Logger.Error(msg)
-			http.Error(w, msg, http.StatusInternalServerError)
+			http.Error(w, internalErrorText, http.StatusInternalServerError)
+		}
+	}
+}
+
+// internalErrorText is the body of the responses to requests that failed
+// on the server's side, the error itself is logged rather than disclosed
+const internalErrorText = "Internal server error"
+
+// addPeerError replies to a request that failed to add a peer, with a 409
+// when the user has too many peers and a 429 when too many are pending
+// verification
+func addPeerError(w http.ResponseWriter, err error) {
+	msg := fmt.Sprintf("Failed to add peer: %s", err)
+	Logger.Warn(msg)
+	var tooMany *TooManyPeers
+	if errors.As(err, &tooMany) {
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+	var taken *NameTaken
+	if errors.As(err, &taken) {
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+	var pending *TooManyPending
+	if errors.As(err, &pending) {
+		http.Error(w, msg, http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, internalErrorText, http.StatusInternalServerError)
+}
+
+// writeValidationErrors answers a request with invalid fields with a 422
+// and the error of each field
+func writeValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	m, err := json.Marshal(map[string]ValidationErrors{"errors": errs})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal the validation errors: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	w.Write(m)
+}
+
+// requireParams returns a MissingParam error for the first of the names
+// that's missing or blank in the request
+func requireParams(req map[string]string, names ...string) error {
+	for _, name := range names {
+		if strings.TrimSpace(req[name]) == "" {
+			return &MissingParam{name}
 		}
 	}
+	return nil
 }
+
+// applyPeerDefaults sets the configured defaults of a new peer's missing
+// name & kind. Known peers must send both, as a missing name or kind would
+// rename the peer and send an email.
+func applyPeerDefaults(req map[string]string) error {
+	c := conf()
+	defaults := map[string]string{"name": c.DefaultName, "kind": c.DefaultKind}
+	var missing []string
+	for _, name := range []string{"name", "kind"} {
+		if strings.TrimSpace(req[name]) != "" {
+			continue
+		}
+		if defaults[name] == "" {
+			return &MissingParam{name}
+		}
+		missing = append(missing, name)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	exists, err := db.PeerExists(req["fp"])
+	if err != nil {
+		return fmt.Errorf("Failed to check the peer exists: %w", err)
+	}
+	if exists {
+		return &MissingParam{missing[0]}
+	}
+	for _, name := range missing {
+		Logger.Infow("Applying a default to a new peer", "fp", req["fp"],
+			name, defaults[name])
+		req[name] = defaults[name]
+	}
+	return nil
+}
+
+// newVerifyingPeer returns a new peer of the verify request's identity,
+// verified when the identity provider vouches for its user
+func newVerifyingPeer(fp string, req map[string]string, id *Identity) *Peer {
+	peer := NewPeer(fp, req["name"], id.User, req["kind"])
+	peer.Verified = id.Verified
+	return peer
+}
+
 func serveVerify(w http.ResponseWriter, r *http.Request) {
 	var req map[string]string
 	dec := json.NewDecoder(r.Body)
 	err := dec.Decode(&req)
 	fp := req["fp"]
-	email := req["email"]
 	if err != nil {
-		http.Error(w, "Bad JSON", http.StatusBadRequest)
+		writeBadJSON(w, err)
+		return
+	}
+	var id *Identity
+	if err = requireParams(req, "fp"); err == nil {
+		id, err = conf().auth.Authenticate(r, req["email"])
+	}
+	if err == nil {
+		err = applyPeerDefaults(req)
+	}
+	var authFailed *AuthFailed
+	if errors.As(err, &authFailed) {
+		Logger.Warnf("Refusing a verify request: %s", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		if _, ok := err.(*MissingParam); !ok {
+			http.Error(w, "DB read failure", http.StatusInternalServerError)
+			return
+		}
+		Logger.Warnf("Refusing a verify request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if fp == "" {
-		http.Error(w, "Missing fingerprint", http.StatusBadRequest)
+	email := id.User
+	invalid := ValidationErrors{}
+	invalid.add("email", ValidateUser(email))
+	invalid.add("fp", ValidatePeer(fp, req["name"], req["kind"]))
+	if len(invalid) > 0 {
+		Logger.Warnf("Refusing a verify request: %s", invalid)
+		writeValidationErrors(w, invalid)
 		return
 	}
-	if email == "" {
-		http.Error(w, "Missing email", http.StatusBadRequest)
+	if !conf().kindAllowed(req["kind"]) {
+		err = &UnknownKind{req["kind"]}
+		Logger.Warnf("Refusing a verify request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !conf().userAllowed(email) {
+		err = &UserNotAllowed{email}
+		Logger.Warnf("Refusing a verify request: %s", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 	if r.Method == "POST" {
-		var peer *Peer
-		pexists, err := db.PeerExists(fp)
-		if err != nil {
+		peer, err := db.FindPeer(fp)
+		var notFound *PeerNotFound
+		pexists := !errors.As(err, &notFound)
+		if pexists && err != nil {
 			http.Error(w, "DB read failure", http.StatusInternalServerError)
 			return
 		}
 		if !pexists {
-			peer = NewPeer(fp, req["name"], email, req["kind"])
-			err = db.AddPeer(peer)
+			if err = checkPending(email); err == nil {
+				err = checkName(email, fp, req["name"])
+			}
 			if err != nil {
-				msg := fmt.Sprintf("Failed to add peer: %s", err)
-				Logger.Warn(msg)
-				http.Error(w, msg, http.StatusInternalServerError)
+				addPeerError(w, err)
 				return
 			}
-			sendAuthEmail(email)
-		} else {
-			peer, err = GetPeer(fp)
+			peer = newVerifyingPeer(fp, req, id)
+			err = db.AddPeer(peer)
 			if err != nil {
-				msg := fmt.Sprintf("Failed to get peer: %s", err)
-				Logger.Errorf(msg)
-				m, _ := json.Marshal(map[string]string{"m": msg})
-				http.Error(w, string(m), http.StatusInternalServerError)
+				addPeerError(w, err)
 				return
 			}
+			if !peer.Verified {
+				sendAuthEmail(email, peer.Name)
+			}
+		} else {
 			if peer.User == "" {
-				peer = NewPeer(fp, req["name"], email, req["kind"])
+				if err = checkPending(email); err == nil {
+					err = checkName(email, fp, req["name"])
+				}
+				if err != nil {
+					addPeerError(w, err)
+					return
+				}
+				peer = newVerifyingPeer(fp, req, id)
 				err = db.AddPeer(peer)
 				if err != nil {
-					msg := fmt.Sprintf("Failed to add peer: %s", err)
-					Logger.Warn(msg)
-					http.Error(w, msg, http.StatusInternalServerError)
+					addPeerError(w, err)
 					return
 				}
-			} else if peer.User != email {
+			} else if normalizeUser(peer.User) != email {
 				msg := fmt.Sprintf(
 					"Fingerprint is associated to another email: %s", peer.User)
 				http.Error(w, msg, http.StatusConflict)
 				return
 			}
+			if peer.staleName(req["name"], time.Now(), conf().renameGrace()) {
+				// the peer hasn't caught up with its rename yet
+				Logger.Infof("Keeping %q's new name %q", fp, peer.Name)
+				req["name"] = peer.Name
+			}
+			changed := peer.identityChange(req["name"], req["kind"],
+				conf().IdentityFields)
 			if peer.Name != req["name"] {
+				if err = checkName(email, fp, req["name"]); err != nil {
+					var taken *NameTaken
+					if !errors.As(err, &taken) {
+						http.Error(w, "DB read failure",
+							http.StatusInternalServerError)
+						return
+					}
+					Logger.Warnf("Refusing to rename %q: %s", fp, err)
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
 				peer.setName(req["name"])
 			}
-			if !peer.Verified {
-				sendAuthEmail(email)
+			if peer.Kind != req["kind"] {
+				peer.setKind(req["kind"])
+			}
+			if changed != nil && peer.Verified {
+				Logger.Infof("Unverifying %q: %s", fp, changed)
+				if err = VerifyPeer(fp, false); err != nil {
+					msg := fmt.Sprintf("Failed to unverify peer: %s", err)
+					Logger.Errorf(msg)
+					http.Error(w, internalErrorText, http.StatusInternalServerError)
+					return
+				}
+				peer.Verified = false
+			}
+			if !peer.Verified && id.Verified {
+				if err = VerifyPeer(fp, true); err != nil {
+					msg := fmt.Sprintf("Failed to verify peer: %s", err)
+					Logger.Errorf(msg)
+					http.Error(w, internalErrorText, http.StatusInternalServerError)
+					return
+				}
+				peer.Verified = true
+			} else if !peer.Verified {
+				sendAuthEmail(email, peer.Name)
 			}
 		}
 		var m []byte
@@ -354,14 +717,14 @@ func serveVerify(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				msg := fmt.Sprintf("Failed to get user peers: %s", err)
 				Logger.Errorf(msg)
-				http.Error(w, msg, http.StatusInternalServerError)
+				http.Error(w, internalErrorText, http.StatusInternalServerError)
 				return
 			}
 			m, err = json.Marshal(map[string]interface{}{"peers": ps})
 			if err != nil {
 				msg := fmt.Sprintf("Failed marshel peers: %s", err)
 				Logger.Errorf(msg)
-				http.Error(w, msg, http.StatusInternalServerError)
+				http.Error(w, internalErrorText, http.StatusInternalServerError)
 				return
 			}
 		} else {
@@ -369,13 +732,62 @@ func serveVerify(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				msg := fmt.Sprintf("Failed to marshal user's list: %s", err)
 				Logger.Errorf(msg)
-				http.Error(w, msg, http.StatusInternalServerError)
+				http.Error(w, internalErrorText, http.StatusInternalServerError)
 				return
 			}
 		}
 		w.Write(m)
 	}
 }
+
+// defaultHTML holds the built-in home page, served when the static root
+// lacks one
+//
+//go:embed html/base.tmpl html/index.tmpl
+var defaultHTML embed.FS
+
+// homeFS holds the built-in home page's templates, nil for none
+var homeFS fs.FS = defaultHTML
+
+// statusPage is served as the home page when there's neither a static nor a
+// built-in one, so a fresh deployment can be checked in a browser
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>peerbook</title></head>
+<body>
+<h1>peerbook is up</h1>
+<p>Instance {{.Instance}}, up for {{.Uptime}}.</p>
+</body>
+</html>
+`))
+
+// staticPath returns the path of a file in the static root
+func staticPath(name string) string {
+	return filepath.Join(conf().StaticRoot, name)
+}
+
+// homeTemplate returns the home page's template from the static root or, if
+// it's missing there, the built-in one. With neither, it returns the status
+// page.
+func homeTemplate(log *zap.SugaredLogger) (*template.Template, error) {
+	tmpl, err := template.ParseFiles(staticPath("index.tmpl"),
+		staticPath("base.tmpl"))
+	if err == nil {
+		return tmpl, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if homeFS == nil {
+		log.Warnf("Serving the status page, there's no home page in %q: %s",
+			conf().StaticRoot, err)
+		return statusPage, nil
+	}
+	log.Warnf("Serving the built-in home page, it's missing from %q: %s",
+		conf().StaticRoot, err)
+	return template.ParseFS(homeFS, "html/index.tmpl", "html/base.tmpl")
+}
+
 func serveHome(w http.ResponseWriter, r *http.Request) {
 
 	if r.URL.Path != "/" {
@@ -386,19 +798,281 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	index := fmt.Sprintf("%s/index.tmpl", os.Getenv("PB_STATIC_ROOT"))
-	tmpl, err := template.ParseFiles(index, baseTemplate)
+	tmpl, err := homeTemplate(reqLogger(r))
 	if err != nil {
 		msg := fmt.Sprintf("Failed to parse the template: %s", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
 		return
 	}
-	err = tmpl.Execute(w, nil)
+	err = tmpl.Execute(w, map[string]interface{}{
+		"Instance": instanceID,
+		"Uptime":   time.Since(startTime).Truncate(time.Second),
+	})
 	if err != nil {
 		msg := fmt.Sprintf("Failed to execute template: %s", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+}
+
+// isAdmin tests the request has the admin's bearer token. When no admin
+// token is configured no one is an admin.
+func isAdmin(r *http.Request) bool {
+	token := conf().AdminToken
+	if token == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// withAdmin refuses the request with a 401 unless it's from an admin
+func withAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			Logger.Warnf("Refusing an unauthorized admin request to %s",
+				r.URL.Path)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// newInstanceID returns PB_INSTANCE_ID or, if it's not set, an ID made of
+// the host name & the process ID
+func newInstanceID() string {
+	if id := os.Getenv("PB_INSTANCE_ID"); id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "peerbook"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// serveRouteTest serves the admins' dry run of routing a message - a POST
+// with the sender's & target's fingerprints returns the outcome of routing
+// a message between them, without sending anything
+func serveRouteTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBadJSON(w, err)
+		return
+	}
+	if req.From == "" || req.To == "" {
+		http.Error(w, "Missing from or to", http.StatusBadRequest)
+		return
+	}
+	sender, err := db.GetPeer(req.From)
+	var target *Peer
+	if err == nil {
+		target, err = db.GetPeer(req.To)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get peer: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
 		return
 	}
+	if sender.User == "" {
+		http.Error(w, (&PeerNotFound{req.From}).Error(), http.StatusNotFound)
+		return
+	}
+	if target.User == "" {
+		target = nil
+	}
+	outcome, err := routeCheck(sender, req.To, target)
+	if outcome == "" {
+		var instance string
+		if instance, err = hub.Locate(req.To); err != nil {
+			msg := fmt.Sprintf("Failed to locate peer: %s", err)
+			Logger.Error(msg)
+			http.Error(w, internalErrorText, http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case instance == "" && conf().OfflineQueue > 0:
+			outcome = RouteQueued
+		case instance == "":
+			outcome = RouteOffline
+		case instance != hub.instance:
+			outcome = RouteRemote
+		default:
+			outcome = RouteDelivered
+		}
+	}
+	res := map[string]string{"from": req.From, "to": req.To,
+		"outcome": outcome}
+	if err != nil {
+		res["reason"] = err.Error()
+	}
+	m, err := json.Marshal(res)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal the outcome: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
+
+// serveAdminUsers serves the admins' user endpoints - a POST to
+// /admin/users/<user>/revoke-tokens deletes all the user's tokens
+func serveAdminUsers(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/admin/users/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || parts[1] != "revoke-tokens" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := url.PathUnescape(parts[0])
+	if user = normalizeUser(user); err != nil || user == "" {
+		http.Error(w, "Bad user", http.StatusBadRequest)
+		return
+	}
+	n, err := db.RevokeTokens(user)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to revoke tokens: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	reqLogger(r).Warnf("Revoked %d tokens of %q", n, user)
+	m, err := json.Marshal(map[string]interface{}{"user": user, "revoked": n})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal the revocation: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
+
+// serveInstance returns the server instance a peer is connected to
+func serveInstance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fp, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/instance/"))
+	if err != nil || fp == "" {
+		http.Error(w, "Bad fingerprint", http.StatusBadRequest)
+		return
+	}
+	instance, err := hub.Locate(fp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to locate peer: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	if instance == "" {
+		http.Error(w, fmt.Sprintf("Peer %q is not connected", fp),
+			http.StatusNotFound)
+		return
+	}
+	m, err := json.Marshal(map[string]interface{}{
+		"fp":       fp,
+		"instance": instance,
+		"local":    instance == hub.instance,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal instance: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
+
+// serveConnections returns the live connections of this instance
+func serveConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m, err := json.Marshal(map[string]interface{}{
+		"instance":    hub.instance,
+		"connections": hub.Connections(),
+	})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal connections: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
+
+// serveLivez answers the liveness probe, even during maintenance
+func serveLivez(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// serveStats returns the number of connected & registered peers, the users
+// with most connected peers and the uptime
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	top := DefaultStatsTop
+	if s := r.URL.Query().Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "Bad top parameter", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	count, err := registered.get()
+	if err != nil {
+		msg := fmt.Sprintf("Failed to count registered peers: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	m, err := json.Marshal(map[string]interface{}{
+		"hub":              hub.Stats(top),
+		"registered":       count,
+		"uptime":           int64(time.Since(startTime).Seconds()),
+		"throttled":        atomic.LoadUint64(&throttledMessages),
+		"hub_busy":         atomic.LoadUint64(&busyRequests),
+		"write_timeouts":   atomic.LoadUint64(&writeTimeouts),
+		"dropped_emails":   atomic.LoadUint64(&droppedEmails),
+		"dropped_webhooks": atomic.LoadUint64(&droppedWebhooks),
+	})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal stats: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
 }
 
 func initLogger() {
@@ -426,25 +1100,222 @@ func initLogger() {
 	defer Logger.Sync()
 }
 
+// sampledLogger returns a logger writing 1 in n of l's identical entries
+// each second, all of them when n is below 2
+func sampledLogger(l *zap.SugaredLogger, n int) *zap.SugaredLogger {
+	if n < 2 {
+		return l
+	}
+	return l.Desugar().WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return zapcore.NewSamplerWithOptions(c, time.Second, 1, n)
+	})).Sugar()
+}
+
+// newCORS returns the CORS handler for the REST endpoints. When no origins
+// are given all origins are allowed to GET & POST.
+func newCORS(origins []string) *cors.Cors {
+	if len(origins) == 0 {
+		return cors.Default()
+	}
+	return cors.New(cors.Options{
+		AllowedOrigins: origins,
+		AllowedMethods: []string{
+			http.MethodGet, http.MethodPost, http.MethodDelete,
+			http.MethodPatch, http.MethodHead},
+		AllowedHeaders: []string{"Origin", "Accept", "Content-Type",
+			"Authorization", "X-Requested-With"},
+	})
+}
+
+// withCORS adds CORS headers & preflight handling to a REST endpoint
+func withCORS(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conf().cors.ServeHTTP(w, r, h)
+	}
+}
+
+// withRecovery recovers from a handler's panic, logging it with its stack,
+// and answers with a 500 json error
+func withRecovery(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			reqLogger(r).Errorw("Recovered from a panic", "panic", fmt.Sprint(v),
+				"method", r.Method, "path", r.URL.Path,
+				"stack", string(debug.Stack()))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error": "Internal server error"}`))
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestIDKey is the context key of a request's ID
+type requestIDKey struct{}
+
+// MaxRequestIDLen is the maximum length of an incoming X-Request-ID, longer
+// ones are replaced
+const MaxRequestIDLen = 128
+
+// withRequestID passes the request's X-Request-ID, or a fresh one if it has
+// none, in its context and the response's header, so reqLogger includes it
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > MaxRequestIDLen {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(
+			context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the request's ID, empty if it has none
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// reqLogger returns the logger of a request, with its ID
+func reqLogger(r *http.Request) *zap.SugaredLogger {
+	if id := requestID(r); id != "" {
+		return Logger.With("request_id", id)
+	}
+	return Logger
+}
+
+// limitedBody is a request body that fails with a *BodyTooLarge error once
+// more than its limit is read
+type limitedBody struct {
+	io.ReadCloser
+	limit int64
+	left  int64
+	err   error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	// read a byte more than what's left to find out if there's more
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.left {
+		b.left -= int64(n)
+		return n, err
+	}
+	n, b.left = int(b.left), 0
+	b.err = &BodyTooLarge{b.limit}
+	return n, b.err
+}
+
+// withBodyLimit limits the size of the requests' bodies to MaxBodySize
+func withBodyLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if max := int64(conf().MaxBodySize); max > 0 && r.Body != nil {
+			r.Body = &limitedBody{ReadCloser: r.Body, limit: max, left: max}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// bodyErrorStatus returns the status of a request whose body failed to
+// parse - 413 when it's too large and 400 otherwise
+func bodyErrorStatus(err error) int {
+	var tooLarge *BodyTooLarge
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// writeBadJSON answers a request whose json body failed to decode
+func writeBadJSON(w http.ResponseWriter, err error) {
+	status := bodyErrorStatus(err)
+	if status == http.StatusRequestEntityTooLarge {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	http.Error(w, "Bad JSON", status)
+}
+
+// withServerHeader sets the configured Server header of all responses
+func withServerHeader(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := conf().ServerHeader; s != "" {
+			w.Header().Set("Server", s)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newHTTPServer returns a server of the handler with the configured timeouts
+func newHTTPServer(addr string, h http.Handler) *http.Server {
+	cfg := conf()
+	seconds := func(n int) time.Duration { return time.Duration(n) * time.Second }
+	return &http.Server{Addr: addr,
+		Handler:           withServerHeader(withRequestID(withRecovery(withMaintenance(withBodyLimit(h))))),
+		ReadHeaderTimeout: seconds(cfg.ReadHeaderTimeout),
+		ReadTimeout:       seconds(cfg.ReadTimeout),
+		WriteTimeout:      seconds(cfg.WriteTimeout),
+		IdleTimeout:       seconds(cfg.IdleTimeout),
+	}
+}
+
 func startHTTPServer(addr string, wg *sync.WaitGroup) *http.Server {
-	srv := &http.Server{
-		Addr: addr, Handler: cors.Default().Handler(http.DefaultServeMux)}
+	srv := newHTTPServer(addr, http.DefaultServeMux)
 
-	http.HandleFunc("/", serveHome)
-	http.HandleFunc("/pb/", serveAuthPage)
-	http.HandleFunc("/verify", serveVerify)
-	http.HandleFunc("/hitme", serveHitMe)
+	http.HandleFunc("/", withCORS(serveHome))
+	http.HandleFunc("/pb/", withCORS(serveAuthPage))
+	http.HandleFunc("/verify", withCORS(serveVerify))
+	http.HandleFunc("/hitme", withCORS(serveHitMe))
 	http.HandleFunc("/ws", serveWs)
-	http.HandleFunc("/qr/", serveQR)
+	http.HandleFunc("/qr/", withCORS(serveQR))
+	http.HandleFunc("/list/", withCORS(serveList))
+	http.HandleFunc("/peer/", withCORS(servePeer))
+	http.HandleFunc("/resend", withCORS(serveResend))
+	http.HandleFunc("/import", withCORS(serveImport))
+	http.HandleFunc("/stats", withAdmin(serveStats))
+	http.HandleFunc("/metrics", withAdmin(serveMetrics))
+	http.HandleFunc("/instance/", withAdmin(serveInstance))
+	http.HandleFunc("/admin/connections", withAdmin(serveConnections))
+	http.HandleFunc("/admin/connections/", withAdmin(serveConnectionHistory))
+	http.HandleFunc("/admin/maintenance", withAdmin(serveMaintenance))
+	http.HandleFunc("/admin/users/", withAdmin(serveAdminUsers))
+	http.HandleFunc("/admin/route-test", withAdmin(serveRouteTest))
+	http.HandleFunc("/admin/audit", withAdmin(serveAudit))
+	http.HandleFunc("/livez", serveLivez)
 
+	ln, stopListening, err := listen(addr, conf().SocketMode)
+	if err != nil {
+		Logger.Errorf("Failed to listen at %s: %s", addr, err)
+		wg.Done()
+		return srv
+	}
 	go func() {
 		defer wg.Done() // let main know we are done cleaning up
+		defer stopListening()
+		Logger.Infof("Listening for HTTP connection at %s", addr)
 		// always returns error. ErrServerClosed on graceful close
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			// unexpected error. port in use?
-			Logger.Errorf("ListenAndServe failed: %v", err)
-		} else {
-			Logger.Infof("Listening for HTTP connection at %s", addr)
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			Logger.Errorf("Serve failed: %v", err)
 		}
 	}()
 
@@ -468,24 +1339,27 @@ func createTempURL(email string, prefix string) (string, error) {
 
 // sendAuthEmail creates a short lived token and emails a message with a link
 // to `/auth/<token>` so the javascript at /auth can read the list of peers and
-// use checkboxes to enable/disable
-func sendAuthEmail(email string) {
+// use checkboxes to enable/disable. peerName is the name of the peer waiting
+// for verification, if any. It returns an *EmailThrottled error when the
+// user got an email too recently. The email is sent in the background, a
+// full queue & delivery failures are only logged.
+func sendAuthEmail(email string, peerName string) error {
 	if !db.canSendEmail(email) {
 		Logger.Warnf("Throttling prevented sending email to %q", email)
-		return
+		return &EmailThrottled{email}
 	}
 	m := gomail.NewMessage()
 	clickL, err := createTempURL(email, "pb")
 	if err != nil {
 		Logger.Errorf("Failed to sendte temp URL: %s", err)
-		return
+		return err
 	}
-	m.SetBody("text/html", `<html lang=en> <head><meta charset=utf-8>
-<title>Peerbook updates for your approval</title>
-</head>
-Please click <a href="`+clickL+`">here to review</a>.`)
-
-	text := fmt.Sprintf("Please click to review:\n%s", clickL)
+	body, text, err := renderAuthEmail(AuthEmail{clickL, peerName, email})
+	if err != nil {
+		Logger.Errorf("Failed to render the auth email: %s", err)
+		return err
+	}
+	m.SetBody("text/html", body)
 	m.AddAlternative("text/plain", text)
 
 	m.SetHeaders(map[string][]string{
@@ -497,19 +1371,9 @@ Please click <a href="`+clickL+`">here to review</a>.`)
 		// "X-SES-CONFIGURATION-SET": {ConfigSet},
 	})
 
-	host := os.Getenv("PB_SMTP_HOST")
-	user := os.Getenv("PB_SMTP_USER")
-	pass := os.Getenv("PB_SMTP_PASS")
-	d := gomail.NewPlainDialer(host, 587, user, pass)
-
 	Logger.Infof("Sending email %q", text)
-	// Display an error message if something goes wrong; otherwise,
-	// display a message confirming that the message was sent.
-	if err := d.DialAndSend(m); err != nil {
-		Logger.Errorf("Failed to send email: %s", err)
-	} else {
-		Logger.Infof("Send email to %q", email)
-	}
+	emails.Send(m)
+	return nil
 }
 
 func getUserKey(user string) (*otp.Key, error) {
@@ -522,12 +1386,11 @@ func getUserKey(user string) (*otp.Key, error) {
 
 }
 func getUserSecret(user string) (string, error) {
-	var secret string
-	conn := db.pool.Get()
-	defer conn.Close()
-	key := fmt.Sprintf("secret:%s", user)
-	secret, err := redis.String(conn.Do("Get", key))
-	if err == redis.ErrNil {
+	secret, err := db.GetSecret(user)
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
 		ok, err := totp.Generate(totp.GenerateOpts{
 			Issuer:      "PeerBook",
 			AccountName: user,
@@ -537,12 +1400,10 @@ func getUserSecret(user string) (string, error) {
 		}
 		// all is well, save the secret
 		secret = ok.Secret()
-		_, err = conn.Do("SET", key, secret)
+		err = db.SetSecret(user, secret)
 		if err != nil {
 			return "", fmt.Errorf("Failed to save the user's secret")
 		}
-	} else if err != nil {
-		return "", err
 	}
 	return secret, nil
 }
@@ -555,7 +1416,7 @@ func serveQR(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		msg := fmt.Sprintf("Failed to parse url: %s", err)
 		Logger.Error(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
 		return
 	}
 	if db.IsQRVerified(user) {
@@ -603,23 +1464,26 @@ render:
 	ok, err := getUserKey(user)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to get users secret key QR iomage: %S", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
 		return
 	}
 	img, err := ok.Image(200, 200)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to get the QR image: %S", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
 		return
 	}
 	encoder := base64.NewEncoder(base64.StdEncoding, &qr)
 	png.Encode(encoder, img)
 	encoder.Close()
-	p := fmt.Sprintf("%s/qr.tmpl", os.Getenv("PB_STATIC_ROOT"))
-	tmpl, err := template.ParseFiles(p, baseTemplate)
+	p := staticPath("qr.tmpl")
+	tmpl, err := template.ParseFiles(p, staticPath("base.tmpl"))
 	if err != nil {
 		msg := fmt.Sprintf("Failed to parse the template: %s", err)
-		http.Error(w, msg, http.StatusInternalServerError)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
 		return
 	}
 	// and return the html
@@ -643,13 +1507,40 @@ render:
 	if err != nil {
 		msg := fmt.Sprintf("Failed to execute the QR template: %s", err)
 		Logger.Error(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+	}
+}
+
+// newStore returns the store to use - "memory" for an in-memory store, good
+// for a single server, or redis by default
+func newStore(kind string) Store {
+	if kind == "memory" {
+		Logger.Infof("Using an in-memory store")
+		return NewMemStore()
+	}
+	return &DBType{}
+}
+
+// reloadOnHUP reloads the configuration whenever the process gets a SIGHUP
+func reloadOnHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloadConfig(); err != nil {
+			Logger.Errorf("Failed to reload the configuration: %s", err)
+		}
 	}
 }
 
 func main() {
-	baseTemplate = fmt.Sprintf("%s/base.tmpl", os.Getenv("PB_STATIC_ROOT"))
-	addr := flag.String("addr", "0.0.0.0:17777", "address to listen for http requests")
+	startTime = time.Now()
+	addr := flag.String("addr", "0.0.0.0:17777",
+		"address to listen for http requests, unix:<path> for a unix socket")
+	repair := flag.Bool("repair-owners", false,
+		"rebuild the peers' owners index and exit")
+	orphans := flag.Bool("orphans", false,
+		"log the peers missing from their user's set and exit")
+	clean := flag.Bool("clean", false, "with -orphans, delete the orphan peers")
 	redisH := os.Getenv("REDIS_HOST")
 	if redisH == "" {
 		redisH = "127.0.0.1:6379"
@@ -658,17 +1549,63 @@ func main() {
 	if Logger == nil {
 		initLogger()
 	}
+	if err := reloadConfig(); err != nil {
+		Logger.Errorf("Failed to load the configuration: %s", err)
+		os.Exit(1)
+	}
+	go reloadOnHUP()
+	if db == nil {
+		db = newStore(os.Getenv("PB_STORE"))
+	}
 	err := db.Connect(redisH)
 	if err != nil {
 		Logger.Errorf("Failed to connect to redis: %s", err)
 		os.Exit(1)
 	}
+	if replica := conf().RedisReplica; replica != "" {
+		if d, ok := db.(*DBType); ok {
+			if err = d.ConnectReplica(replica); err != nil {
+				Logger.Errorf("Failed to connect to the redis replica: %s", err)
+				os.Exit(1)
+			}
+		} else {
+			Logger.Warnf("Ignoring redis_replica, the store isn't redis")
+		}
+	}
+	if *repair {
+		n, err := db.RepairOwners()
+		if err != nil {
+			Logger.Errorf("Failed to repair the owners index: %s", err)
+			os.Exit(1)
+		}
+		Logger.Infof("Repaired %d entries of the owners index", n)
+		os.Exit(0)
+	}
+	if *orphans {
+		fps, err := db.FindOrphans(*clean)
+		for _, fp := range fps {
+			Logger.Infof("Peer %q is an orphan", fp)
+		}
+		if err != nil {
+			Logger.Errorf("Failed to find the orphan peers: %s", err)
+			os.Exit(1)
+		}
+		if *clean {
+			Logger.Infof("Deleted %d orphan peers", len(fps))
+		} else {
+			Logger.Infof("Found %d orphan peers", len(fps))
+		}
+		os.Exit(0)
+	}
 
-	hub = Hub{
-		register:   make(chan *Conn),
-		unregister: make(chan *Conn),
-		requests:   make(chan map[string]interface{}, 16),
+	cfg := conf()
+	emails = NewEmailPool(cfg.EmailConcurrency, cfg.EmailQueue)
+	webhooks = NewWebhookPool(cfg.WebhookConcurrency, cfg.WebhookQueue)
+	if cfg.AuditSize > 0 {
+		auditLog = NewAuditLog(cfg.AuditSize)
 	}
+	instanceID = newInstanceID()
+	hub = NewHub(db)
 	Logger.Infof("Starting peerbook")
 	go hub.run()
 
@@ -684,4 +1621,7 @@ func main() {
 	}
 	// wait for goroutine started in startHTTPServer() to stop
 	httpServerExitDone.Wait()
+	hub.Stop()
+	emails.Stop()
+	webhooks.Stop()
 }
@@ -2,11 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -14,8 +22,9 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/pquerna/otp/totp"
 	"github.com/stretchr/testify/require"
-	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap"
 	"golang.org/x/net/html"
+	"gopkg.in/gomail.v2"
 )
 
 const ReadTimeout = time.Second * 3
@@ -31,18 +40,111 @@ var mainRunning bool
 
 func startTest(t *testing.T) {
 	if !mainRunning {
+		// the logger outlives the test that starts main, so it can't be
+		// bound to it
+		initTestLogger()
 		var err error
-		Logger = zaptest.NewLogger(t).Sugar()
 		redisDouble, err = miniredis.Run()
 		require.Nil(t, err)
 		go main()
 		mainRunning = true
 		// let the server open
 	} else {
+		// let the connections of the last test close, so their presence
+		// updates don't leak into this one
+		for i := 0; i < 100 && hub.Stats(0).Connected > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
 		redisDouble.FlushAll()
 	}
 	time.Sleep(time.Millisecond * 10)
 }
+
+// setConfig changes the configuration for the duration of the test
+func setConfig(t *testing.T, change func(c *Config)) {
+	orig := conf()
+	c := *orig
+	change(&c)
+	c.init()
+	config.Store(&c)
+	t.Cleanup(func() { config.Store(orig) })
+}
+
+// requireStatus reads a status message and requires its code
+func requireStatus(t *testing.T, ws *websocket.Conn, code int) {
+	var s StatusMessage
+	err := ws.ReadJSON(&s)
+	require.Nil(t, err)
+	require.Equal(t, code, s.Code, "got status: %v", s)
+}
+
+// newTestServer starts an http server with peerbook's websocket handler,
+// using the hub & store started by startTest
+func newTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", serveWs)
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// seedPeer adds a peer to the store & its user's set
+func seedPeer(fp string, name string, user string, verified bool) {
+	v := "0"
+	if verified {
+		v = "1"
+	}
+	redisDouble.SetAdd("user:"+user, fp)
+	redisDouble.HSet("peer:"+fp, "fp", fp, "name", name, "kind", "lay",
+		"user", user, "verified", v, "online", "0")
+}
+
+// connectPeer opens a websocket to the server as a verified peer and reads
+// the status & peer list sent on connect
+func connectPeer(t *testing.T, s *httptest.Server, fp string) *websocket.Conn {
+	u := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?fp=" + url.QueryEscape(fp)
+	ws, _, err := cstDialer.Dial(u, nil)
+	require.Nil(t, err)
+	t.Cleanup(func() { ws.Close() })
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws, 200)
+	var l map[string]interface{}
+	require.Nil(t, ws.ReadJSON(&l))
+	_, found := l["peers"]
+	require.True(t, found, "expected a peer list, got: %v", l)
+	return ws
+}
+
+// subscribeConn subscribes the connection to its channels until the test
+// ends or the returned function is called
+func subscribeConn(t *testing.T, c *Conn) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go c.subscribe(ctx)
+	out := "out:" + c.FP
+	require.Eventually(t, func() bool {
+		return redisDouble.PubSubNumSub(out)[out] > 0
+	}, time.Second, 10*time.Millisecond)
+	return cancel
+}
+
+// readUntil reads messages from the websocket until one has the key
+func readUntil(t *testing.T, ws *websocket.Conn, key string) map[string]interface{} {
+	for {
+		var m map[string]interface{}
+		require.Nil(t, ws.ReadJSON(&m))
+		if _, found := m[key]; found {
+			return m
+		}
+	}
+}
+
+// requireStatusWith reads messages until a status message and requires its
+// code
+func requireStatusWith(t *testing.T, ws *websocket.Conn, code int) {
+	m := readUntil(t, ws, "code")
+	require.Equal(t, float64(code), m["code"], "got status: %v", m)
+}
 func openWS(url string) (*websocket.Conn, error) {
 	time.Sleep(time.Millisecond)
 	ws, _, err := cstDialer.Dial(url, nil)
@@ -90,12 +192,14 @@ func TestSignalingAcrossUsers(t *testing.T) {
 	// clean the pipe by reading the first three peers messages
 	var pl map[string]interface{}
 	time.Sleep(time.Second / 5)
+	requireStatus(t, wsA, 200)
 	err = wsA.ReadJSON(&pl)
 	require.Nil(t, err)
 	require.Contains(t, pl, "peers")
 	err = wsA.ReadJSON(&pl)
 	require.Nil(t, err)
 	require.Contains(t, pl, "peer_update")
+	requireStatus(t, wsB, 200)
 	err = wsB.ReadJSON(&pl)
 	require.Nil(t, err)
 	require.Contains(t, pl, "peers")
@@ -146,12 +250,14 @@ func TestValidSignaling(t *testing.T) {
 	}
 	// read all the peers messages
 	var m map[string]interface{}
+	requireStatus(t, wsA, 200)
 	err = wsA.ReadJSON(&m)
 	require.Nil(t, err)
 	require.Contains(t, m, "peers")
 	err = wsA.ReadJSON(&m)
 	require.Nil(t, err)
 	require.Contains(t, m, "peer_update")
+	requireStatus(t, wsB, 200)
 	err = wsB.ReadJSON(&m)
 	require.Nil(t, err)
 	require.Contains(t, m, "peers")
@@ -392,7 +498,8 @@ func TestVerifyUnverified(t *testing.T) {
 		"user", "j", "verified", "0")
 	redisDouble.HSet("peer:B", "fp", "B", "name", "bar", "kind", "lay",
 		"user", "j", "verified", "1")
-	msg := map[string]string{"fp": "A", "email": "j"}
+	msg := map[string]string{"fp": "A", "email": "j", "name": "foo",
+		"kind": "lay"}
 	m, err := json.Marshal(msg)
 	require.Nil(t, err)
 	resp, err := http.Post("http://127.0.0.1:17777/verify", "application/json",
@@ -432,7 +539,8 @@ func TestVerifyVerified(t *testing.T) {
 		"user", "j", "verified", "0")
 	redisDouble.HSet("peer:B", "fp", "B", "name", "bar", "kind", "lay",
 		"user", "j", "verified", "1")
-	msg := map[string]string{"fp": "B", "email": "j"}
+	msg := map[string]string{"fp": "B", "email": "j", "name": "bar",
+		"kind": "lay"}
 	m, err := json.Marshal(msg)
 	require.Nil(t, err)
 	resp, err := http.Post("http://127.0.0.1:17777/verify", "application/json",
@@ -456,7 +564,8 @@ func TestVerifyWrongUser(t *testing.T) {
 	redisDouble.HSet("peer:B", "fp", "B", "name", "bar", "kind", "lay",
 		"user", "j", "verified", "1")
 
-	msg := map[string]string{"fp": "B", "email": "i"}
+	msg := map[string]string{"fp": "B", "email": "i", "name": "bar",
+		"kind": "lay"}
 	m, err := json.Marshal(msg)
 	require.Nil(t, err)
 	resp, err := http.Post("http://127.0.0.1:17777/verify", "application/json",
@@ -464,6 +573,168 @@ func TestVerifyWrongUser(t *testing.T) {
 	require.Nil(t, err, err)
 	require.Equal(t, 409, resp.StatusCode)
 }
+func TestVerifyMissingParams(t *testing.T) {
+	startTest(t)
+	redisDouble.SetAdd("user:j", "A")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "0")
+	for _, missing := range []string{"name", "email", "kind"} {
+		msg := map[string]string{"fp": "A", "email": "j", "name": "foo",
+			"kind": "lay"}
+		delete(msg, missing)
+		m, err := json.Marshal(msg)
+		require.Nil(t, err)
+		resp, err := http.Post("http://127.0.0.1:17777/verify",
+			"application/json", bytes.NewBuffer(m))
+		require.Nil(t, err)
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, missing)
+		require.Equal(t, "Missing required parameter: "+missing,
+			strings.TrimSpace(string(b)))
+	}
+	require.Equal(t, "foo", redisDouble.HGet("peer:A", "name"))
+	require.False(t, redisDouble.Exists("dontsend:j"),
+		"a verification email was sent")
+}
+
+func TestMaxPending(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.MaxPending = 2 })
+	verify := func(fp string) int {
+		m, err := json.Marshal(map[string]string{"fp": fp, "email": "j",
+			"name": "foo", "kind": "lay"})
+		require.Nil(t, err)
+		resp, err := http.Post("http://127.0.0.1:17777/verify",
+			"application/json", bytes.NewBuffer(m))
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, verify("P1"))
+	require.Equal(t, http.StatusOK, verify("P2"))
+	require.Equal(t, http.StatusTooManyRequests, verify("P3"))
+	require.False(t, redisDouble.Exists("peer:P3"))
+	// a peer that's already pending can ask again
+	require.Equal(t, http.StatusOK, verify("P2"))
+	// completing a verification frees a place
+	redisDouble.HSet("peer:P1", "verified", "1")
+	require.Equal(t, http.StatusOK, verify("P3"))
+	require.Equal(t, http.StatusTooManyRequests, verify("P4"))
+	// and so does one whose token expired
+	redisDouble.HSet("peer:P2", "created_on",
+		fmt.Sprint(time.Now().Add(-TokenTTL*time.Second-time.Minute).Unix()))
+	require.Equal(t, http.StatusOK, verify("P4"))
+}
+
+func TestNormalizedUser(t *testing.T) {
+	startTest(t)
+	verify := func(fp string, email string) int {
+		m, err := json.Marshal(map[string]string{"fp": fp, "email": email,
+			"name": "foo", "kind": "lay"})
+		require.Nil(t, err)
+		resp, err := http.Post("http://127.0.0.1:17777/verify",
+			"application/json", bytes.NewBuffer(m))
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, verify("A", " User@Example.com"))
+	require.Equal(t, http.StatusOK, verify("B", "user@example.com\n"))
+	// the same peer from another variant isn't foreign
+	require.Equal(t, http.StatusOK, verify("A", "USER@example.COM"))
+	members, err := redisDouble.Members("user:user@example.com")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"A", "B"}, members)
+	require.Equal(t, "user@example.com", redisDouble.HGet("peer:A", "user"))
+	// tokens of variants list the same peers
+	redisDouble.Set("token:avarianttoken", "User@Example.com")
+	resp, err := http.Get("http://127.0.0.1:17777/list/avarianttoken")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	var l struct {
+		Peers []Peer `json:"peers"`
+	}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+	require.Len(t, l.Peers, 2)
+	// users can be required to be email addresses
+	require.Equal(t, http.StatusOK, verify("C", "not an email"))
+	setConfig(t, func(c *Config) { c.EmailUsers = true })
+	require.Equal(t, http.StatusUnprocessableEntity, verify("D", "not an email"))
+	require.Equal(t, http.StatusUnprocessableEntity, verify("D", "Ann <ann@example.com>"))
+	require.Equal(t, http.StatusOK, verify("D", "Ann@example.com"))
+}
+
+// TestRejoinWithStaleName checks a verified peer that reconnects with a
+// different name isn't sent for re-verification
+func TestRejoinWithStaleName(t *testing.T) {
+	startTest(t)
+	redisDouble.SetAdd("user:j", "A")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "renamed", "kind", "lay",
+		"user", "j", "verified", "1")
+	m, err := json.Marshal(map[string]string{"fp": "A", "email": "j",
+		"name": "foo", "kind": "lay"})
+	require.Nil(t, err)
+	resp, err := http.Post("http://127.0.0.1:17777/verify", "application/json",
+		bytes.NewBuffer(m))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var l map[string]interface{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&l))
+	_, found := l["peers"]
+	require.True(t, found, "verified peer didn't get the list: %v", l)
+	require.Equal(t, "1", redisDouble.HGet("peer:A", "verified"))
+	require.False(t, redisDouble.Exists("dontsend:j"),
+		"a verification email was sent")
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=A&name=foo&kind=lay&email=j")
+	require.Nil(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws, 200)
+}
+
+// TestRenameGrace checks a peer verifying with its previous name in the
+// rename grace keeps the new name & its verification
+func TestRenameGrace(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) {
+		c.RenameGrace = 60
+		c.IdentityFields = []string{"name"}
+	})
+	redisDouble.SetAdd("user:j", "A")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1")
+	verify := func(name string) int {
+		m, err := json.Marshal(map[string]string{"fp": "A", "email": "j",
+			"name": name, "kind": "lay"})
+		require.Nil(t, err)
+		resp, err := http.Post("http://127.0.0.1:17777/verify",
+			"application/json", bytes.NewBuffer(m))
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// the rename itself is an identity change
+	require.Equal(t, http.StatusOK, verify("bar"))
+	require.Equal(t, "bar", redisDouble.HGet("peer:A", "name"))
+	require.Equal(t, "foo", redisDouble.HGet("peer:A", "prev_name"))
+	redisDouble.HSet("peer:A", "verified", "1")
+	redisDouble.Del("dontsend:j")
+	// the stale name is taken as the new one
+	require.Equal(t, http.StatusOK, verify("foo"))
+	require.Equal(t, "bar", redisDouble.HGet("peer:A", "name"))
+	require.Equal(t, "1", redisDouble.HGet("peer:A", "verified"))
+	require.False(t, redisDouble.Exists("dontsend:j"),
+		"a verification email was sent")
+	// past the grace, the previous name is a change again
+	redisDouble.HSet("peer:A", "renamed_on",
+		fmt.Sprint(time.Now().Add(-time.Minute-time.Second).Unix()))
+	require.Equal(t, http.StatusOK, verify("foo"))
+	require.Equal(t, "foo", redisDouble.HGet("peer:A", "name"))
+	require.Equal(t, "0", redisDouble.HGet("peer:A", "verified"))
+}
 
 // TestValidatePeerNPublish runs the following scenarion
 func TestValidatePeerNPublish(t *testing.T) {
@@ -502,7 +773,8 @@ func TestValidatePeerNPublish(t *testing.T) {
 	err = wsA.ReadJSON(&s)
 	require.Nil(t, err)
 	require.Equal(t, 401, s.Code)
-	// get the peers list on B
+	// get the verified status & peers list on B
+	requireStatus(t, wsB, 200)
 	var pl map[string]*PeerList
 	err = wsB.ReadJSON(&pl)
 	require.Nil(t, err)
@@ -554,7 +826,7 @@ func TestGoodOTP2(t *testing.T) {
 }
 func TestMiniRedis(t *testing.T) {
 	startTest(t)
-	conn := db.pool.Get()
+	conn := db.(*DBType).pool.Get()
 	defer conn.Close()
 	_, err := conn.Do("SET", "peer:A", "1")
 	require.Nil(t, err)
@@ -662,3 +934,496 @@ func TestUserSecret(t *testing.T) {
 	v := totp.Validate(otp, s)
 	require.True(t, v)
 }
+func TestCORS(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) {
+		c.AllowedOrigins = []string{"https://allowed.example.com"}
+	})
+	// preflight
+	req, err := http.NewRequest("OPTIONS", "http://127.0.0.1:17777/verify", nil)
+	require.Nil(t, err)
+	req.Header.Set("Origin", "https://allowed.example.com")
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, "https://allowed.example.com",
+		resp.Header.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "DELETE", resp.Header.Get("Access-Control-Allow-Methods"))
+	// cross origin GET from an allowed and a disallowed origin
+	for origin, expected := range map[string]string{
+		"https://allowed.example.com": "https://allowed.example.com",
+		"https://evil.example.com":    "",
+	} {
+		req, err = http.NewRequest("GET", "http://127.0.0.1:17777/", nil)
+		require.Nil(t, err)
+		req.Header.Set("Origin", origin)
+		resp, err = http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, expected, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+}
+func TestReloadConfig(t *testing.T) {
+	startTest(t)
+	orig := conf()
+	defer config.Store(orig)
+	f, err := os.CreateTemp("", "peerbook-conf")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"allowed_origins": ["https://new.example.com"]}`)
+	require.Nil(t, err)
+	f.Close()
+	os.Setenv("PB_CONF", f.Name())
+	defer os.Unsetenv("PB_CONF")
+	origin := func() string {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:17777/", nil)
+		require.Nil(t, err)
+		req.Header.Set("Origin", "https://new.example.com")
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.Header.Get("Access-Control-Allow-Origin")
+	}
+	// before the reload all origins are allowed
+	require.Equal(t, "*", origin())
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	require.Eventually(t, func() bool {
+		return origin() == "https://new.example.com"
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"https://new.example.com"}, conf().AllowedOrigins)
+	// a broken file keeps the current configuration
+	err = os.WriteFile(f.Name(), []byte("{broken"), 0600)
+	require.Nil(t, err)
+	require.NotNil(t, reloadConfig())
+	require.Equal(t, []string{"https://new.example.com"}, conf().AllowedOrigins)
+}
+func TestConnectStatus(t *testing.T) {
+	startTest(t)
+	redisDouble.SetAdd("user:j", "A")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=A&name=foo&kind=lay&email=j")
+	require.Nil(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws, 200)
+	var m map[string]interface{}
+	err = ws.ReadJSON(&m)
+	require.Nil(t, err)
+	require.Contains(t, m, "peers")
+	// an unknown peer gets a 401
+	ws2, err := openWS("ws://127.0.0.1:17777/ws?fp=UNKNOWN")
+	require.Nil(t, err)
+	defer ws2.Close()
+	ws2.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws2, 401)
+}
+func TestOfferRelay(t *testing.T) {
+	startTest(t)
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	wsA := connectPeer(t, s, "A")
+	wsB := connectPeer(t, s, "B")
+	require.Nil(t, wsA.WriteJSON(map[string]string{"offer": "an offer", "target": "B"}))
+	m := readUntil(t, wsB, "offer")
+	require.Equal(t, "an offer", m["offer"])
+	require.Equal(t, "A", m["source_fp"])
+	require.Equal(t, "foo", m["source_name"])
+	_, found := m["target"]
+	require.False(t, found, "target wasn't removed: %v", m)
+	require.Nil(t, wsB.WriteJSON(map[string]string{"answer": "an answer", "target": "A"}))
+	m = readUntil(t, wsA, "answer")
+	require.Equal(t, "an answer", m["answer"])
+	require.Equal(t, "B", m["source_fp"])
+	require.Equal(t, "bar", m["source_name"])
+}
+func TestServerHeader(t *testing.T) {
+	startTest(t)
+	get := func() *http.Response {
+		resp, err := http.Get("http://127.0.0.1:17777/stats")
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	require.Equal(t, DefaultServerHeader, get().Header.Get("Server"))
+	setConfig(t, func(c *Config) { c.ServerHeader = "pb" })
+	require.Equal(t, "pb", get().Header.Get("Server"))
+	setConfig(t, func(c *Config) { c.ServerHeader = "" })
+	_, found := get().Header["Server"]
+	require.False(t, found)
+}
+func TestAddPeerErrorBody(t *testing.T) {
+	initTestLogger()
+	w := httptest.NewRecorder()
+	addPeerError(w, fmt.Errorf("dial tcp 10.0.0.1:6379: connection refused"))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Equal(t, internalErrorText+"\n", w.Body.String())
+	w = httptest.NewRecorder()
+	addPeerError(w, &TooManyPeers{"j"})
+	require.Equal(t, http.StatusConflict, w.Code)
+	require.Contains(t, w.Body.String(), (&TooManyPeers{"j"}).Error())
+}
+func TestRecovery(t *testing.T) {
+	logs, restore := observeLogs(zap.ErrorLevel)
+	defer restore()
+	h := withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var c *Conn
+		c.FP = "nil conn"
+	}))
+	w := httptest.NewRecorder()
+	require.NotPanics(t, func() {
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/boom", nil))
+	})
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var body map[string]string
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Contains(t, body, "error")
+	entries := logs.FilterMessage("Recovered from a panic").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(t, "/boom", fields["path"])
+	require.Contains(t, fields["stack"], "TestRecovery")
+	// a peer goroutine's panic is logged too
+	c := &Conn{FP: "A", ID: newConnID()}
+	require.NotPanics(t, func() {
+		defer c.recoverPanic("test")
+		panic("bug")
+	})
+	entries = logs.FilterMessage("Recovered from a panic").All()
+	require.Len(t, entries, 2)
+	require.Equal(t, "A", entries[1].ContextMap()["fp"])
+}
+func TestHTTPTimeouts(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) {
+		c.ReadHeaderTimeout = 1
+		c.ReadTimeout = 1
+		c.WriteTimeout = 1
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", serveWs)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	srv := newHTTPServer(l.Addr().String(), mux)
+	go srv.Serve(l)
+	defer srv.Close()
+	// a slow header sender is cut off
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("GET /ws HTTP/1.1\r\nHost: pb\r\n"))
+	require.Nil(t, err)
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = c.Read(make([]byte, 1024))
+	require.Equal(t, io.EOF, err)
+	require.Less(t, int64(time.Since(start)), int64(2*time.Second))
+	// websockets outlive the timeouts
+	seedPeer("A", "foo", "j", true)
+	ws, _, err := cstDialer.Dial("ws://"+l.Addr().String()+"/ws?fp=A", nil)
+	require.Nil(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws, 200)
+	readUntil(t, ws, "peers")
+	time.Sleep(1500 * time.Millisecond)
+	require.Nil(t, ws.WriteJSON(map[string]interface{}{
+		"type": "kick", "target": "Z"}))
+	requireStatusWith(t, ws, http.StatusNotFound)
+}
+func TestHomeBuiltIn(t *testing.T) {
+	startTest(t)
+	get := func() string {
+		resp, err := http.Get("http://127.0.0.1:17777/")
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		b, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(b)
+	}
+	logs, restore := observeLogs(zap.WarnLevel)
+	defer restore()
+	for _, root := range []string{"", t.TempDir()} {
+		setConfig(t, func(c *Config) { c.StaticRoot = root })
+		require.Contains(t, get(), "Greetings & Salutations!")
+	}
+	require.Equal(t, 2, logs.FilterMessageSnippet("built-in home page").Len())
+}
+func TestHomeStatusPage(t *testing.T) {
+	startTest(t)
+	orig := homeFS
+	homeFS = nil
+	defer func() { homeFS = orig }()
+	setConfig(t, func(c *Config) { c.StaticRoot = t.TempDir() })
+	resp, err := http.Get("http://127.0.0.1:17777/")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Contains(t, string(b), "peerbook is up")
+	require.Contains(t, string(b), instanceID)
+}
+func TestHomeStaticRoot(t *testing.T) {
+	startTest(t)
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"base.tmpl":  `{{define "base"}}<title>{{template "title" .}}</title>{{template "main" .}}{{end}}`,
+		"index.tmpl": `{{template "base" .}}{{define "title"}}Home{{end}}{{define "main"}}Our own home{{end}}`,
+	} {
+		require.Nil(t, os.WriteFile(filepath.Join(root, name), []byte(content), 0600))
+	}
+	setConfig(t, func(c *Config) { c.StaticRoot = root })
+	resp, err := http.Get("http://127.0.0.1:17777/")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "<title>Home</title>Our own home", string(b))
+	// other paths aren't home
+	resp, err = http.Get("http://127.0.0.1:17777/nothere")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+func TestRequestID(t *testing.T) {
+	startTest(t)
+	logs, restore := observeLogs(zap.InfoLevel)
+	defer restore()
+	list := func(id string) string {
+		req, err := http.NewRequest("GET",
+			"http://127.0.0.1:17777/list/notatoken", nil)
+		require.Nil(t, err)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		return resp.Header.Get("X-Request-ID")
+	}
+	refusals := func(id string) int {
+		return logs.FilterField(zap.String("request_id", id)).
+			FilterMessageSnippet("unauthorized list request").Len()
+	}
+	require.Equal(t, "req-42", list("req-42"))
+	require.Equal(t, 1, refusals("req-42"))
+	// a missing id is generated
+	id := list("")
+	require.NotEmpty(t, id)
+	require.NotEqual(t, "req-42", id)
+	require.Equal(t, 1, refusals(id))
+	// and upgraded requests' connections log with it
+	seedPeer("A", "foo", "j", true)
+	ws, _, err := cstDialer.Dial("ws://127.0.0.1:17777/ws?fp=A",
+		http.Header{"X-Request-ID": {"ws-7"}})
+	require.Nil(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws, 200)
+	require.Nil(t, ws.WriteJSON(map[string]string{"foo": "bar"}))
+	require.Eventually(t, func() bool {
+		return logs.FilterField(zap.String("request_id", "ws-7")).
+			FilterMessageSnippet("Ignoring a message from").Len() == 1
+	}, time.Second, 10*time.Millisecond)
+}
+func TestVerifyDefaults(t *testing.T) {
+	startTest(t)
+	redisDouble.SetAdd("user:j", "A")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "0")
+	verify := func(msg map[string]string) int {
+		m, err := json.Marshal(msg)
+		require.Nil(t, err)
+		resp, err := http.Post("http://127.0.0.1:17777/verify",
+			"application/json", bytes.NewBuffer(m))
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// strict by default
+	require.Equal(t, http.StatusBadRequest,
+		verify(map[string]string{"fp": "B", "email": "j", "name": "bar"}))
+	require.False(t, redisDouble.Exists("peer:B"))
+	setConfig(t, func(c *Config) {
+		c.DefaultName = "terminal"
+		c.DefaultKind = "webexec"
+	})
+	logs, restore := observeLogs(zap.InfoLevel)
+	defer restore()
+	require.Equal(t, http.StatusOK,
+		verify(map[string]string{"fp": "B", "email": "j"}))
+	require.Equal(t, "terminal", redisDouble.HGet("peer:B", "name"))
+	require.Equal(t, "webexec", redisDouble.HGet("peer:B", "kind"))
+	require.Equal(t, 2, logs.FilterMessage("Applying a default to a new peer").Len())
+	require.Equal(t, http.StatusOK,
+		verify(map[string]string{"fp": "C", "email": "j", "name": "bar"}))
+	require.Equal(t, "bar", redisDouble.HGet("peer:C", "name"))
+	require.Equal(t, "webexec", redisDouble.HGet("peer:C", "kind"))
+	// known peers aren't renamed
+	require.Equal(t, http.StatusBadRequest,
+		verify(map[string]string{"fp": "A", "email": "j", "kind": "lay"}))
+	require.Equal(t, "foo", redisDouble.HGet("peer:A", "name"))
+}
+func TestMaintenance(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.AdminToken = "anadmintoken" })
+	t.Cleanup(func() { atomic.StoreInt32(&maintenanceOn, 0) })
+	redisDouble.Set("token:avalidtoken", "j")
+	seedPeer("A", "foo", "j", true)
+	get := func(path string, token string) *http.Response {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:17777"+path, nil)
+		require.Nil(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	setMaintenance := func(on bool) {
+		m, err := json.Marshal(map[string]bool{"maintenance": on})
+		require.Nil(t, err)
+		req, err := http.NewRequest("POST",
+			"http://127.0.0.1:17777/admin/maintenance", bytes.NewBuffer(m))
+		require.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer anadmintoken")
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var state map[string]bool
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&state))
+		require.Equal(t, on, state["maintenance"])
+	}
+	requireRefused := func() {
+		for _, path := range []string{"/list/avalidtoken", "/peer/A"} {
+			resp := get(path, "avalidtoken")
+			require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, path)
+			require.Equal(t, "300", resp.Header.Get("Retry-After"), path)
+		}
+		_, resp, err := websocket.DefaultDialer.Dial(
+			"ws://127.0.0.1:17777/ws?fp=A", nil)
+		require.NotNil(t, err)
+		require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		require.Equal(t, http.StatusOK, get("/livez", "").StatusCode)
+		// admins can still get in, to turn it off
+		require.Equal(t, http.StatusOK,
+			get("/admin/connections", "anadmintoken").StatusCode)
+	}
+	setMaintenance(true)
+	requireRefused()
+	setMaintenance(false)
+	require.Equal(t, http.StatusOK, get("/list/avalidtoken", "").StatusCode)
+	require.Equal(t, http.StatusOK, get("/peer/A", "avalidtoken").StatusCode)
+	// or by the configuration
+	setConfig(t, func(c *Config) { c.Maintenance = true })
+	requireRefused()
+}
+func TestUserLists(t *testing.T) {
+	startTest(t)
+	orig := conf()
+	defer config.Store(orig)
+	dir := t.TempDir()
+	allowed := filepath.Join(dir, "allowed")
+	denied := filepath.Join(dir, "denied")
+	require.Nil(t, os.WriteFile(allowed, []byte("# invited\nj\nH\n"), 0600))
+	require.Nil(t, os.WriteFile(denied, []byte("h\n"), 0600))
+	os.Setenv("PB_ALLOWED_USERS_FILE", allowed)
+	defer os.Unsetenv("PB_ALLOWED_USERS_FILE")
+	os.Setenv("PB_DENIED_USERS_FILE", denied)
+	defer os.Unsetenv("PB_DENIED_USERS_FILE")
+	require.Nil(t, reloadConfig())
+	verify := func(fp string, email string) int {
+		m, err := json.Marshal(map[string]string{"fp": fp, "email": email,
+			"name": "foo", "kind": "lay"})
+		require.Nil(t, err)
+		resp, err := http.Post("http://127.0.0.1:17777/verify",
+			"application/json", bytes.NewBuffer(m))
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, verify("A", "j"))
+	require.Equal(t, http.StatusForbidden, verify("B", "k"))
+	// the deny list beats the allow list
+	require.Equal(t, http.StatusForbidden, verify("C", "h"))
+	require.False(t, redisDouble.Exists("peer:B"))
+	require.False(t, redisDouble.Exists("peer:C"))
+	// peers of users off the list can't connect
+	seedPeer("D", "bar", "k", true)
+	_, resp, err := websocket.DefaultDialer.Dial(
+		"ws://127.0.0.1:17777/ws?fp=D", nil)
+	require.NotNil(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	// a reload picks up new users
+	f, err := os.OpenFile(allowed, os.O_APPEND|os.O_WRONLY, 0600)
+	require.Nil(t, err)
+	_, err = f.WriteString("k\n")
+	require.Nil(t, err)
+	f.Close()
+	require.Nil(t, reloadConfig())
+	require.Equal(t, http.StatusOK, verify("B", "k"))
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=D")
+	require.Nil(t, err)
+	ws.Close()
+	// a missing list fails the reload
+	require.Nil(t, os.Remove(denied))
+	require.NotNil(t, reloadConfig())
+	require.True(t, conf().deniedUsers["h"])
+}
+func TestIdentityFields(t *testing.T) {
+	startTest(t)
+	var sent int32
+	swapEmails(t, 1, 10, func(m *gomail.Message) error {
+		atomic.AddInt32(&sent, 1)
+		return nil
+	})
+	// verify re-verifies peer A, verified as "foo" of kind "lay", as name
+	// & kind and returns whether it's still verified
+	verify := func(name string, kind string) bool {
+		redisDouble.Del("dontsend:j")
+		resp := apiRequest(t, "POST", "/verify", "", map[string]string{
+			"fp": "A", "email": "j", "name": name, "kind": kind})
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, name, redisDouble.HGet("peer:A", "name"))
+		require.Equal(t, kind, redisDouble.HGet("peer:A", "kind"))
+		return redisDouble.HGet("peer:A", "verified") == "1"
+	}
+	for _, tc := range []struct {
+		fields   []string
+		name     string
+		kind     string
+		verified bool
+	}{
+		{nil, "bar", "server", true},
+		{[]string{"user"}, "bar", "lay", true},
+		{[]string{"kind"}, "bar", "lay", true},
+		{[]string{"kind"}, "foo", "server", false},
+		{[]string{"name", "kind"}, "bar", "lay", false},
+		{[]string{"name", "kind"}, "foo", "lay", true},
+	} {
+		setConfig(t, func(c *Config) { c.IdentityFields = tc.fields })
+		seedPeer("A", "foo", "j", true)
+		before := atomic.LoadInt32(&sent)
+		require.Equal(t, tc.verified, verify(tc.name, tc.kind),
+			"identity fields %v changed to %s/%s", tc.fields, tc.name, tc.kind)
+		// unverified peers get an email
+		if !tc.verified {
+			require.Eventually(t, func() bool {
+				return atomic.LoadInt32(&sent) == before+1
+			}, time.Second, 10*time.Millisecond)
+		} else {
+			time.Sleep(20 * time.Millisecond)
+			require.Equal(t, before, atomic.LoadInt32(&sent))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// DefaultMaintenanceRetry is the seconds clients are asked to wait before
+// retrying during maintenance
+const DefaultMaintenanceRetry = 300
+
+// maintenanceOn is set when an admin turned maintenance mode on, use atomic
+// to access
+var maintenanceOn int32
+
+// inMaintenance returns whether the server is in maintenance mode, by the
+// configuration or by an admin
+func inMaintenance() bool {
+	return conf().Maintenance || atomic.LoadInt32(&maintenanceOn) == 1
+}
+
+// withMaintenance refuses all requests with a 503 during maintenance, except
+// for the liveness probe's and the admins'
+func withMaintenance(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !inMaintenance() || r.URL.Path == "/livez" || isAdmin(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(conf().MaintenanceRetry))
+		http.Error(w, "Down for maintenance", http.StatusServiceUnavailable)
+	})
+}
+
+// serveMaintenance returns whether the server is in maintenance mode and,
+// on POST, turns it on or off
+func serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req struct {
+			Maintenance *bool `json:"maintenance"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err == nil && req.Maintenance == nil {
+			err = fmt.Errorf("Missing maintenance")
+		}
+		if err != nil {
+			writeBadJSON(w, err)
+			return
+		}
+		var on int32
+		if *req.Maintenance {
+			on = 1
+		}
+		atomic.StoreInt32(&maintenanceOn, on)
+		reqLogger(r).Warnf("Maintenance mode turned %s", onOff(*req.Maintenance))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m, err := json.Marshal(map[string]bool{"maintenance": inMaintenance()})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal maintenance mode: %s", err)
+		Logger.Error(msg)
+		http.Error(w, internalErrorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,550 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// memSubBufSize is the number of messages buffered for each subscriber
+const memSubBufSize = 64
+
+type memToken struct {
+	email   string
+	expires time.Time
+}
+
+type memMessage struct {
+	channel string
+	data    []byte
+}
+
+// MemStore is an in-memory Store, good for tests and small deployments
+// running a single server
+type MemStore struct {
+	sync.Mutex
+	tokens     map[string]memToken
+	users      map[string]map[string]bool
+	peers      map[string]map[string]string
+	expires    map[string]time.Time
+	online     map[string]time.Time
+	instances  map[string]string
+	queues     map[string][][]byte
+	secrets    map[string]string
+	qrVerified map[string]bool
+	dontSend   map[string]time.Time
+	subs       map[string][]chan memMessage
+}
+
+// NewMemStore returns an empty in-memory store
+func NewMemStore() *MemStore {
+	return &MemStore{
+		tokens:     make(map[string]memToken),
+		users:      make(map[string]map[string]bool),
+		peers:      make(map[string]map[string]string),
+		expires:    make(map[string]time.Time),
+		online:     make(map[string]time.Time),
+		instances:  make(map[string]string),
+		queues:     make(map[string][][]byte),
+		secrets:    make(map[string]string),
+		qrVerified: make(map[string]bool),
+		dontSend:   make(map[string]time.Time),
+		subs:       make(map[string][]chan memMessage),
+	}
+}
+
+// Connect does nothing, the store is always connected
+func (m *MemStore) Connect(host string) error {
+	return nil
+}
+
+// Close does nothing
+func (m *MemStore) Close() error {
+	return nil
+}
+
+// CreateToken creates a short-live token to be emailed to the user
+func (m *MemStore) CreateToken(email string) (string, error) {
+	if email == "" {
+		return "", fmt.Errorf("Failied to create a token for an empty email")
+	}
+	b := make([]byte, TokenLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.URLEncoding.EncodeToString(b)
+	m.Lock()
+	defer m.Unlock()
+	m.tokens[token] = memToken{email,
+		time.Now().Add(TokenTTL * time.Second)}
+	return token, nil
+}
+
+// GetToken reads the value of a token, usually an email address
+func (m *MemStore) GetToken(token string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	t, found := m.tokens[token]
+	if !found || time.Now().After(t.expires) {
+		delete(m.tokens, token)
+		return "", fmt.Errorf("Failed to read token: %w:", redis.ErrNil)
+	}
+	return t.email, nil
+}
+
+// RevokeTokens deletes the user's live tokens
+func (m *MemStore) RevokeTokens(email string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	n := 0
+	now := time.Now()
+	for token, t := range m.tokens {
+		if t.email != email {
+			continue
+		}
+		if now.Before(t.expires) {
+			n++
+		}
+		delete(m.tokens, token)
+	}
+	return n, nil
+}
+
+// GetUser returns the user's list of peers' fingerprints
+func (m *MemStore) GetUser(email string) (*DBUser, error) {
+	var r DBUser
+	m.Lock()
+	defer m.Unlock()
+	for fp := range m.users[email] {
+		r = append(r, fp)
+	}
+	return &r, nil
+}
+
+// ScanUser returns the user's peers whose name matches the pattern
+func (m *MemStore) ScanUser(email string, pattern string) (*DBUser, error) {
+	r := DBUser{}
+	m.Lock()
+	defer m.Unlock()
+	for fp := range m.users[email] {
+		h, stored := m.peers[fp]
+		if !stored {
+			continue
+		}
+		found, err := path.Match(pattern, h["name"])
+		if err != nil {
+			return nil, fmt.Errorf("Bad pattern %q: %w", pattern, err)
+		}
+		if found {
+			r = append(r, fp)
+		}
+	}
+	return &r, nil
+}
+
+// ScanUserPage returns a page of the user's peers whose name matches the
+// pattern, sorted by fingerprint
+func (m *MemStore) ScanUserPage(email string, pattern string, cursor string,
+	count int) (*DBUser, string, error) {
+	_, skip, err := parseListCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	all, err := m.ScanUser(email, pattern)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(*all)
+	if skip > len(*all) {
+		skip = len(*all)
+	}
+	r := (*all)[skip:]
+	if len(r) <= count {
+		return &r, "", nil
+	}
+	r = r[:count]
+	return &r, listCursor(0, skip+count), nil
+}
+
+// DeleteUser removes a user's list of peers
+func (m *MemStore) DeleteUser(email string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.users, email)
+	return nil
+}
+
+// GetPeer returns a copy of the peer. If the peer is not found an empty
+// peer is returned.
+func (m *MemStore) GetPeer(fp string) (*Peer, error) {
+	pd, _, err := m.readPeer(fp)
+	return pd, err
+}
+
+// FindPeer returns a copy of the peer, or a PeerNotFound error
+func (m *MemStore) FindPeer(fp string) (*Peer, error) {
+	pd, found, err := m.readPeer(fp)
+	if err == nil && !found {
+		return nil, &PeerNotFound{fp}
+	}
+	return pd, err
+}
+
+// readPeer returns a copy of the peer and whether it was found
+func (m *MemStore) readPeer(fp string) (*Peer, bool, error) {
+	var pd Peer
+	m.Lock()
+	m.prune(fp)
+	h := m.peers[fp]
+	values := make([]interface{}, 0, 2*len(h))
+	for k, v := range h {
+		values = append(values, []byte(k), []byte(v))
+	}
+	online := time.Now().Before(m.online[fp])
+	m.Unlock()
+	if err := redis.ScanStruct(values, &pd); err != nil {
+		return nil, false, fmt.Errorf("Failed to scan peer %q: %w", fp, err)
+	}
+	pd.Online = online
+	return &pd, len(h) > 0, nil
+}
+
+// SetPeerOnline marks the peer as online at the instance until the ttl
+// passes
+func (m *MemStore) SetPeerOnline(fp string, instance string, ttl time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	if ttl == 0 {
+		delete(m.online, fp)
+		delete(m.instances, fp)
+	} else {
+		m.online[fp] = time.Now().Add(ttl)
+		m.instances[fp] = instance
+	}
+	if h, found := m.peers[fp]; found {
+		h["online"] = formatArg(ttl != 0)
+	}
+	return nil
+}
+
+// GetPeerInstance returns the instance an online peer is connected to
+func (m *MemStore) GetPeerInstance(fp string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	if !time.Now().Before(m.online[fp]) {
+		return "", nil
+	}
+	return m.instances[fp], nil
+}
+
+// PeerExists tests if a peer is stored
+func (m *MemStore) PeerExists(fp string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.prune(fp)
+	_, found := m.peers[fp]
+	return found, nil
+}
+
+// prune removes the peer if it has expired, must be called with the lock
+// held
+func (m *MemStore) prune(fp string) {
+	if e, found := m.expires[fp]; found && time.Now().After(e) {
+		delete(m.peers, fp)
+		delete(m.expires, fp)
+	}
+}
+
+// AddPeer adds or updates a peer
+func (m *MemStore) AddPeer(peer *Peer) error {
+	return m.AddPeers(peer.User, []*Peer{peer})
+}
+
+// AddPeers adds or updates the peers of a user all at once, or none of them
+// when the new ones would take the user past max_peers
+func (m *MemStore) AddPeers(user string, peers []*Peer) error {
+	m.Lock()
+	defer m.Unlock()
+	u, found := m.users[user]
+	if !found {
+		u = make(map[string]bool)
+		m.users[user] = u
+	}
+	if max := conf().MaxPeers; max > 0 {
+		total := len(u)
+		for _, peer := range peers {
+			if !u[peer.FP] {
+				total++
+			}
+		}
+		if total > max {
+			return &TooManyPeers{user}
+		}
+	}
+	for _, peer := range peers {
+		m.prune(peer.FP)
+		h, found := m.peers[peer.FP]
+		if !found {
+			h = make(map[string]string)
+			m.peers[peer.FP] = h
+		}
+		args := redis.Args{}.AddFlat(peer)
+		for i := 0; i < len(args); i += 2 {
+			h[args[i].(string)] = formatArg(args[i+1])
+		}
+		u[peer.FP] = true
+	}
+	return nil
+}
+
+// SetPeerField sets a single field of the peer
+func (m *MemStore) SetPeerField(fp string, field string, value interface{}) error {
+	m.Lock()
+	defer m.Unlock()
+	m.prune(fp)
+	h, found := m.peers[fp]
+	if !found {
+		h = make(map[string]string)
+		m.peers[fp] = h
+	}
+	h[field] = formatArg(value)
+	return nil
+}
+
+// formatArg formats a value the same way redigo does when writing it
+func formatArg(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case []byte:
+		return string(v)
+	case redis.Argument:
+		return formatArg(v.RedisArg())
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// DeletePeer removes a peer
+func (m *MemStore) DeletePeer(fp string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.peers, fp)
+	delete(m.expires, fp)
+	return nil
+}
+
+// GetPeerOwner returns the peer's user. The in-memory store needs no index,
+// its peers are already mapped by fingerprint.
+func (m *MemStore) GetPeerOwner(fp string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.prune(fp)
+	return m.peers[fp]["user"], nil
+}
+
+// RepairOwners has nothing to repair, the owners are read from the peers
+func (m *MemStore) RepairOwners() (int, error) {
+	return 0, nil
+}
+
+// FindOrphans returns the peers missing from their user's set, except the
+// deleted ones in their grace period, and deletes them when clean is set
+func (m *MemStore) FindOrphans(clean bool) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	orphans := []string{}
+	for fp, h := range m.peers {
+		m.prune(fp)
+		if _, found := m.peers[fp]; !found || m.users[h["user"]][fp] {
+			continue
+		}
+		if d := h["deleted_on"]; d != "" && d != "0" {
+			continue
+		}
+		orphans = append(orphans, fp)
+		if clean {
+			delete(m.peers, fp)
+			delete(m.expires, fp)
+		}
+	}
+	return orphans, nil
+}
+
+// SetPeerTTL sets the time to live of a peer, a zero ttl persists it
+func (m *MemStore) SetPeerTTL(fp string, ttl time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	if ttl == 0 {
+		delete(m.expires, fp)
+	} else if _, found := m.peers[fp]; found {
+		m.expires[fp] = time.Now().Add(ttl)
+	}
+	return nil
+}
+
+// AddUserPeer adds a peer to the user's list
+func (m *MemStore) AddUserPeer(user string, fp string) error {
+	m.Lock()
+	defer m.Unlock()
+	u, found := m.users[user]
+	if !found {
+		u = make(map[string]bool)
+		m.users[user] = u
+	}
+	u[fp] = true
+	return nil
+}
+
+// RemoveUserPeer removes a peer from the user's list
+func (m *MemStore) RemoveUserPeer(user string, fp string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.users[user], fp)
+	return nil
+}
+
+// CountPeers returns the number of stored peers
+func (m *MemStore) CountPeers() (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	for fp := range m.expires {
+		m.prune(fp)
+	}
+	return len(m.peers), nil
+}
+
+// GetSecret returns the user's OTP secret or an empty string if the user has
+// none
+func (m *MemStore) GetSecret(user string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.secrets[user], nil
+}
+
+// SetSecret saves the user's OTP secret
+func (m *MemStore) SetSecret(user string, secret string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.secrets[user] = secret
+	return nil
+}
+
+// SetQRVerified marks the user as one that scanned the OTP QR
+func (m *MemStore) SetQRVerified(email string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.qrVerified[email] = true
+	return nil
+}
+
+// IsQRVerified tests if the user scanned the OTP QR
+func (m *MemStore) IsQRVerified(email string) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.qrVerified[email]
+}
+
+func (m *MemStore) canSendEmail(email string) bool {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	if until, found := m.dontSend[email]; found && now.Before(until) {
+		return false
+	}
+	m.dontSend[email] = now.Add(EmailInterval * time.Second)
+	return true
+}
+
+// Publish sends a message to all the channel's subscribers, dropping it for
+// the subscribers that fall behind
+func (m *MemStore) Publish(channel string, msg []byte) (int, error) {
+	m.Lock()
+	subs := append([]chan memMessage{}, m.subs[channel]...)
+	m.Unlock()
+	for _, c := range subs {
+		select {
+		case c <- memMessage{channel, msg}:
+		default:
+			Logger.Warnf("Dropping a message on %q for a slow subscriber", channel)
+		}
+	}
+	return len(subs), nil
+}
+
+// QueueMessage appends the message to the peer's queue, keeping the last
+// max messages
+func (m *MemStore) QueueMessage(fp string, msg []byte, max int,
+	ttl time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	q := append(m.queues[fp], newQueueEntry(msg, ttl))
+	if len(q) > max {
+		q = q[len(q)-max:]
+	}
+	m.queues[fp] = q
+	return nil
+}
+
+// DrainQueue returns the fresh messages in the peer's queue and clears it
+func (m *MemStore) DrainQueue(fp string) ([][]byte, error) {
+	m.Lock()
+	q := m.queues[fp]
+	delete(m.queues, fp)
+	m.Unlock()
+	return freshEntries(q), nil
+}
+
+// Subscribe calls handler for each message published on channels until ctx
+// is done
+func (m *MemStore) Subscribe(ctx context.Context,
+	handler func(channel string, data []byte), ready func(),
+	channels ...string) error {
+	c := make(chan memMessage, memSubBufSize)
+	m.Lock()
+	for _, ch := range channels {
+		m.subs[ch] = append(m.subs[ch], c)
+	}
+	m.Unlock()
+	if ready != nil {
+		ready()
+	}
+	defer func() {
+		m.Lock()
+		defer m.Unlock()
+		for _, ch := range channels {
+			subs := m.subs[ch]
+			for i, s := range subs {
+				if s == c {
+					m.subs[ch] = append(subs[:i], subs[i+1:]...)
+					break
+				}
+			}
+			if len(m.subs[ch]) == 0 {
+				delete(m.subs, ch)
+			}
+		}
+	}()
+	for {
+		select {
+		case msg := <-c:
+			handler(msg.channel, msg.data)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// The types of the messages peers send & get
+const (
+	TypeOffer      = "offer"
+	TypeAnswer     = "answer"
+	TypeCandidate  = "candidate"
+	TypeSubscribe  = "subscribe"
+	TypeKick       = "kick"
+	TypeStatus     = "status"
+	TypePeerUpdate = "peer_update"
+	TypePeers      = "peers"
+	TypeNotice     = "notice"
+	TypeGetList    = "get_list"
+	TypeBroadcast  = "broadcast"
+	// TypePing & TypePong are the application level heartbeat, for
+	// connections whose ping & pong frames are stripped
+	TypePing = "ping"
+	TypePong = "pong"
+	// TypePresenceBatch holds the peer updates coalesced in the presence
+	// window
+	TypePresenceBatch = "presence-batch"
+	// TypeSetStatus sets the labels of the sender's connection, included in
+	// its presence updates
+	TypeSetStatus = "set-status"
+)
+
+// legacyKinds are the types of legacy messages named by their content's key,
+// in the order they're looked for
+var legacyKinds = []string{TypeOffer, TypeAnswer, TypeCandidate,
+	TypePeerUpdate, TypePeers}
+
+// legacyHeader are the keys of a legacy message that go in the envelope's
+// header
+var legacyHeader = map[string]bool{"command": true, "type": true,
+	"target": true, "source_fp": true, "source_name": true, "id": true,
+	"hops": true}
+
+// typedCommands are the commands a legacy message names by its type, e.g.
+// {"type": "subscribe", "fingerprints": [...]}, rather than its command
+var typedCommands = map[string]bool{TypeSubscribe: true, TypeKick: true}
+
+// MessageEnvelope is the common header of the messages peers send & get. The
+// type's content - an offer's SDP, a status' code & text - is in
+// RawPayload.
+type MessageEnvelope struct {
+	Type string `json:"type"`
+	// From & FromName are the sender's fingerprint & name, set by the server
+	From     string `json:"from,omitempty"`
+	FromName string `json:"from_name,omitempty"`
+	To       string `json:"to,omitempty"`
+	// ID is the sender's message ID, relayed as is - a string, a number or
+	// any other JSON value
+	ID json.RawMessage `json:"id,omitempty"`
+	// Hops is the number of times the message was relayed, set by the
+	// server. A message bounced back as is keeps counting them.
+	Hops       int             `json:"hops,omitempty"`
+	RawPayload json.RawMessage `json:"payload,omitempty"`
+	// legacy is the legacy message the envelope was decoded from. It's
+	// relayed as is to legacy peers, with the fields the envelope has no
+	// place for.
+	legacy map[string]interface{}
+}
+
+// envelopeFromLegacy returns the envelope of a message in the legacy format,
+// where the type is the one key of the content, e.g. {"offer": "<sdp>"}, or
+// the command, e.g. {"command": "get_list"}
+func envelopeFromLegacy(m map[string]interface{}) (*MessageEnvelope, error) {
+	e := &MessageEnvelope{}
+	e.To, _ = m["target"].(string)
+	e.From, _ = m["source_fp"].(string)
+	e.FromName, _ = m["source_name"].(string)
+	if id, found := m["id"]; found && id != nil {
+		var err error
+		if e.ID, err = json.Marshal(id); err != nil {
+			return nil, fmt.Errorf("Bad message id: %w", err)
+		}
+	}
+	switch hops := m["hops"].(type) {
+	case float64:
+		e.Hops = int(hops)
+	case json.Number:
+		if n, err := hops.Int64(); err == nil {
+			e.Hops = int(n)
+		}
+	}
+	var payload interface{}
+	if m["type"] == TypeNotice {
+		// notices are a legacy message with a type
+		e.Type = TypeNotice
+		payload = map[string]interface{}{"message": m["message"]}
+	} else if m["type"] == TypeSetStatus {
+		e.Type = TypeSetStatus
+		payload = map[string]interface{}{"labels": m["labels"]}
+	} else if m["type"] == TypePresenceBatch {
+		// the batch's changes are enveloped too
+		e.Type = TypePresenceBatch
+		changes, _ := m["changes"].([]interface{})
+		envelopes := make([]*MessageEnvelope, 0, len(changes))
+		for _, c := range changes {
+			change, ok := c.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Bad presence change")
+			}
+			ce, err := envelopeFromLegacy(change)
+			if err != nil {
+				return nil, err
+			}
+			envelopes = append(envelopes, ce)
+		}
+		payload = map[string]interface{}{"changes": envelopes}
+	} else if command, ok := legacyCommand(m); ok {
+		e.Type = command
+		p := map[string]interface{}{}
+		for k, v := range m {
+			if !legacyHeader[k] {
+				p[k] = v
+			}
+		}
+		if len(p) > 0 {
+			payload = p
+		}
+	} else if _, found := m["code"]; found {
+		e.Type = TypeStatus
+		p := map[string]interface{}{"code": m["code"], "text": m["text"]}
+		if retry, found := m["retry_after"]; found {
+			p["retry_after"] = retry
+		}
+		payload = p
+	} else {
+		for _, kind := range legacyKinds {
+			if v, found := m[kind]; found {
+				e.Type = kind
+				payload = v
+				break
+			}
+		}
+	}
+	if e.Type == "" {
+		return nil, fmt.Errorf("Unknown message type")
+	}
+	if payload != nil {
+		var err error
+		if e.RawPayload, err = json.Marshal(payload); err != nil {
+			return nil, fmt.Errorf("Failed to encode the payload: %w", err)
+		}
+	}
+	return e, nil
+}
+
+// legacyCommand returns the command of a legacy message, named by its type
+// for the typed commands or else by its command
+func legacyCommand(m map[string]interface{}) (string, bool) {
+	if t, ok := m["type"].(string); ok && typedCommands[t] {
+		return t, true
+	}
+	command, ok := m["command"].(string)
+	return command, ok
+}
+
+// Legacy returns the message in the legacy format
+func (e *MessageEnvelope) Legacy() (map[string]interface{}, error) {
+	var payload interface{}
+	if len(e.RawPayload) > 0 {
+		if err := decodeJSON(e.RawPayload, &payload); err != nil {
+			return nil, fmt.Errorf("Failed to decode the payload: %w", err)
+		}
+	}
+	m := map[string]interface{}{}
+	switch e.Type {
+	case TypeStatus:
+		// statuses have no header
+		if p, ok := payload.(map[string]interface{}); ok {
+			return p, nil
+		}
+		return m, nil
+	case TypeNotice:
+		m["type"] = TypeNotice
+		if p, ok := payload.(map[string]interface{}); ok {
+			m["message"] = p["message"]
+		}
+	case TypeSetStatus:
+		m["type"] = TypeSetStatus
+		if p, ok := payload.(map[string]interface{}); ok {
+			m["labels"] = p["labels"]
+		}
+	case TypePresenceBatch:
+		m["type"] = TypePresenceBatch
+		var p struct {
+			Changes []MessageEnvelope `json:"changes"`
+		}
+		if err := json.Unmarshal(e.RawPayload, &p); err != nil {
+			return nil, fmt.Errorf("Failed to decode the changes: %w", err)
+		}
+		changes := make([]interface{}, 0, len(p.Changes))
+		for _, c := range p.Changes {
+			change, err := c.Legacy()
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, change)
+		}
+		m["changes"] = changes
+	case TypeSubscribe, TypeKick, TypeGetList, TypeBroadcast:
+		if typedCommands[e.Type] {
+			m["type"] = e.Type
+		} else {
+			m["command"] = e.Type
+		}
+		if p, ok := payload.(map[string]interface{}); ok {
+			for k, v := range p {
+				m[k] = v
+			}
+		}
+	default:
+		m[e.Type] = payload
+	}
+	for k, v := range map[string]string{"target": e.To, "source_fp": e.From,
+		"source_name": e.FromName} {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	if len(e.ID) > 0 {
+		var id interface{}
+		if err := decodeJSON(e.ID, &id); err != nil {
+			return nil, fmt.Errorf("Failed to decode the id: %w", err)
+		}
+		m["id"] = id
+	}
+	if e.Hops > 0 {
+		m["hops"] = json.Number(strconv.Itoa(e.Hops))
+	}
+	return m, nil
+}
+
+// encodeRelayed returns the message relayed to a peer, in the legacy format.
+// A message from a legacy peer is relayed as it was sent, with the envelope's
+// header replacing the target.
+func (e *MessageEnvelope) encodeRelayed() ([]byte, error) {
+	if e.legacy == nil {
+		m, err := e.Legacy()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(m)
+	}
+	m := make(map[string]interface{}, len(e.legacy)+3)
+	for k, v := range e.legacy {
+		m[k] = v
+	}
+	delete(m, "target")
+	m["source_fp"], m["source_name"] = e.From, e.FromName
+	delete(m, "hops")
+	if e.Hops > 0 {
+		m["hops"] = json.Number(strconv.Itoa(e.Hops))
+	}
+	return json.Marshal(m)
+}
+
+// idText returns a message ID as text, a string's without its quotes
+func idText(id json.RawMessage) string {
+	var s string
+	if json.Unmarshal(id, &s) == nil {
+		return s
+	}
+	return string(id)
+}
+
+// encodeEnvelope returns a message in the legacy format as an envelope. It's
+// used on the way out to peers getting envelopes, as the server's messages
+// are in the legacy format.
+func encodeEnvelope(m []byte) ([]byte, error) {
+	var legacy map[string]interface{}
+	if err := decodeJSON(m, &legacy); err != nil {
+		return nil, err
+	}
+	e, err := envelopeFromLegacy(legacy)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(e)
+}
+
+// decodeJSON is json.Unmarshal keeping the numbers as json.Number, so the
+// numbers in relayed messages, e.g. 64 bit IDs, aren't rounded to a float64
+func decodeJSON(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		legacy   string
+		envelope MessageEnvelope
+	}{
+		{`{"offer": "an offer", "target": "B", "id": "1"}`,
+			MessageEnvelope{Type: TypeOffer, To: "B", ID: json.RawMessage(`"1"`),
+				RawPayload: json.RawMessage(`"an offer"`)}},
+		{`{"offer": "an offer", "target": "B", "id": 12345678901234567891}`,
+			MessageEnvelope{Type: TypeOffer, To: "B",
+				ID:         json.RawMessage(`12345678901234567891`),
+				RawPayload: json.RawMessage(`"an offer"`)}},
+		{`{"answer": "an answer", "source_fp": "B", "source_name": "bar"}`,
+			MessageEnvelope{Type: TypeAnswer, From: "B", FromName: "bar",
+				RawPayload: json.RawMessage(`"an answer"`)}},
+		{`{"candidate": {"candidate": "a candidate", "sdpMid": "0"}, "target": "A"}`,
+			MessageEnvelope{Type: TypeCandidate, To: "A",
+				RawPayload: json.RawMessage(`{"candidate":"a candidate","sdpMid":"0"}`)}},
+		{`{"type": "subscribe", "fingerprints": ["A", "B"]}`,
+			MessageEnvelope{Type: TypeSubscribe,
+				RawPayload: json.RawMessage(`{"fingerprints":["A","B"]}`)}},
+		{`{"offer": "an offer", "source_fp": "A", "hops": 2}`,
+			MessageEnvelope{Type: TypeOffer, From: "A", Hops: 2,
+				RawPayload: json.RawMessage(`"an offer"`)}},
+		{`{"type": "kick", "target": "B"}`,
+			MessageEnvelope{Type: TypeKick, To: "B"}},
+		{`{"code": 200, "text": "peer is verified"}`,
+			MessageEnvelope{Type: TypeStatus,
+				RawPayload: json.RawMessage(`{"code":200,"text":"peer is verified"}`)}},
+		{`{"code": 401, "text": "Unverified peer", "retry_after": 60}`,
+			MessageEnvelope{Type: TypeStatus,
+				RawPayload: json.RawMessage(`{"code":401,"retry_after":60,"text":"Unverified peer"}`)}},
+		{`{"peer_update": {"online": true, "verified": true}, "source_fp": "B"}`,
+			MessageEnvelope{Type: TypePeerUpdate, From: "B",
+				RawPayload: json.RawMessage(`{"online":true,"verified":true}`)}},
+		{`{"type": "notice", "message": "Down for maintenance at 10:00"}`,
+			MessageEnvelope{Type: TypeNotice,
+				RawPayload: json.RawMessage(`{"message":"Down for maintenance at 10:00"}`)}},
+		{`{"command": "broadcast", "group": "home", "message": {"hello": "home"}, "source_fp": "A"}`,
+			MessageEnvelope{Type: TypeBroadcast, From: "A",
+				RawPayload: json.RawMessage(`{"group":"home","message":{"hello":"home"}}`)}},
+		{`{"type": "presence-batch", "changes": [{"peer_update": {"online": true}, "source_fp": "B"}, {"peer_update": {"online": false}, "source_fp": "C"}]}`,
+			MessageEnvelope{Type: TypePresenceBatch,
+				RawPayload: json.RawMessage(`{"changes":[{"type":"peer_update","from":"B","payload":{"online":true}},{"type":"peer_update","from":"C","payload":{"online":false}}]}`)}},
+		{`{"type": "set-status", "labels": {"power": "battery"}, "source_fp": "A"}`,
+			MessageEnvelope{Type: TypeSetStatus, From: "A",
+				RawPayload: json.RawMessage(`{"labels":{"power":"battery"}}`)}},
+		{`{"peers": [{"fp": "A", "name": "foo"}]}`,
+			MessageEnvelope{Type: TypePeers,
+				RawPayload: json.RawMessage(`[{"fp":"A","name":"foo"}]`)}},
+	} {
+		var legacy map[string]interface{}
+		require.Nil(t, decodeJSON([]byte(tc.legacy), &legacy))
+		e, err := envelopeFromLegacy(legacy)
+		require.Nil(t, err, tc.legacy)
+		require.Equal(t, tc.envelope, *e, tc.legacy)
+		// the envelope's json & back
+		b, err := json.Marshal(e)
+		require.Nil(t, err)
+		var decoded MessageEnvelope
+		require.Nil(t, json.Unmarshal(b, &decoded))
+		require.Equal(t, *e, decoded)
+		// and back to the legacy format
+		m, err := decoded.Legacy()
+		require.Nil(t, err)
+		require.Equal(t, legacy, m)
+	}
+	// a subscribe named by its command is still taken
+	e, err := envelopeFromLegacy(map[string]interface{}{"command": "subscribe",
+		"fingerprints": []interface{}{"A"}})
+	require.Nil(t, err)
+	require.Equal(t, TypeSubscribe, e.Type)
+	require.JSONEq(t, `{"fingerprints":["A"]}`, string(e.RawPayload))
+	_, err = envelopeFromLegacy(map[string]interface{}{"foo": "bar"})
+	require.NotNil(t, err)
+}
+
+// readEnvelope reads the websocket's messages till one of the type
+func readEnvelope(t *testing.T, ws *websocket.Conn, typ string) MessageEnvelope {
+	for {
+		var e MessageEnvelope
+		require.Nil(t, ws.ReadJSON(&e))
+		if e.Type == typ {
+			return e
+		}
+	}
+}
+func TestEnvelopedSignaling(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.Envelopes = true })
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	s := newTestServer(t)
+	open := func(fp string) *websocket.Conn {
+		u := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?fp=" +
+			url.QueryEscape(fp)
+		ws, _, err := cstDialer.Dial(u, nil)
+		require.Nil(t, err)
+		t.Cleanup(func() { ws.Close() })
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var sm StatusMessage
+		e := readEnvelope(t, ws, TypeStatus)
+		require.Nil(t, json.Unmarshal(e.RawPayload, &sm))
+		require.Equal(t, http.StatusOK, sm.Code)
+		readEnvelope(t, ws, TypePeers)
+		return ws
+	}
+	a := open("A")
+	b := open("B")
+	require.Nil(t, a.WriteJSON(MessageEnvelope{Type: TypeOffer, To: "B",
+		ID: json.RawMessage(`"42"`), RawPayload: json.RawMessage(`"an offer"`)}))
+	offer := readEnvelope(t, b, TypeOffer)
+	require.Equal(t, "A", offer.From)
+	require.Equal(t, "foo", offer.FromName)
+	require.Equal(t, `"42"`, string(offer.ID))
+	require.Empty(t, offer.To)
+	require.Equal(t, `"an offer"`, string(offer.RawPayload))
+	// commands are enveloped too
+	require.Nil(t, b.WriteJSON(MessageEnvelope{Type: TypeKick, To: "Z"}))
+	var sm StatusMessage
+	status := readEnvelope(t, b, TypeStatus)
+	require.Nil(t, json.Unmarshal(status.RawPayload, &sm))
+	require.Equal(t, http.StatusNotFound, sm.Code)
+}
+func TestRelayLargeNumbers(t *testing.T) {
+	startTest(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	s := newTestServer(t)
+	a := connectPeer(t, s, "A")
+	b := connectPeer(t, s, "B")
+	// keys are sorted, as the relayed maps are
+	payload := `{"ratio":1.10,"sdp":"an offer","session_id":12345678901234567891}`
+	require.Nil(t, a.WriteMessage(websocket.TextMessage,
+		[]byte(`{"offer":`+payload+`,"target":"B"}`)))
+	for {
+		_, data, err := b.ReadMessage()
+		require.Nil(t, err)
+		var m map[string]json.RawMessage
+		require.Nil(t, json.Unmarshal(data, &m))
+		if offer, found := m["offer"]; found {
+			require.Equal(t, payload, string(offer))
+			break
+		}
+	}
+	// and when it's enveloped on the way out
+	out, err := encodeEnvelope([]byte(`{"offer":` + payload + `,"source_fp":"A"}`))
+	require.Nil(t, err)
+	var e MessageEnvelope
+	require.Nil(t, json.Unmarshal(out, &e))
+	require.Equal(t, payload, string(e.RawPayload))
+	// trailing data is still refused
+	var m map[string]interface{}
+	require.NotNil(t, decodeJSON([]byte(`{"offer":"an offer"} {}`), &m))
+}
+func TestLegacyRelayAsIs(t *testing.T) {
+	startTest(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	seedPeer("C", "baz", "j", true)
+	s := newTestServer(t)
+	a := connectPeer(t, s, "A")
+	b := connectPeer(t, s, "B")
+	// C gets envelopes
+	setConfig(t, func(c *Config) { c.Envelopes = true })
+	u := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?fp=C"
+	c, _, err := cstDialer.Dial(u, nil)
+	require.Nil(t, err)
+	t.Cleanup(func() { c.Close() })
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	readEnvelope(t, c, TypePeers)
+	send := func(target string) {
+		require.Nil(t, a.WriteMessage(websocket.TextMessage, []byte(`{"offer": "an offer", "target": "`+
+			target+`", "id": 12345678901234567891, "session": {"restart": true}, "seq": 7}`)))
+	}
+	send("B")
+	for {
+		_, data, err := b.ReadMessage()
+		require.Nil(t, err)
+		var m map[string]json.RawMessage
+		require.Nil(t, json.Unmarshal(data, &m))
+		if _, found := m["offer"]; !found {
+			continue
+		}
+		// the extra fields & the numeric id are relayed as sent
+		require.Equal(t, map[string]json.RawMessage{
+			"offer":       json.RawMessage(`"an offer"`),
+			"id":          json.RawMessage(`12345678901234567891`),
+			"session":     json.RawMessage(`{"restart":true}`),
+			"seq":         json.RawMessage(`7`),
+			"source_fp":   json.RawMessage(`"A"`),
+			"source_name": json.RawMessage(`"foo"`),
+			"hops":        json.RawMessage(`1`),
+		}, m)
+		break
+	}
+	send("C")
+	offer := readEnvelope(t, c, TypeOffer)
+	require.Equal(t, "A", offer.From)
+	require.Equal(t, `12345678901234567891`, string(offer.ID))
+	require.Equal(t, `"an offer"`, string(offer.RawPayload))
+}
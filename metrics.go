@@ -0,0 +1,115 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// DefaultSlowRedisOp is the milliseconds a redis operation takes to be
+// logged as slow
+const DefaultSlowRedisOp = 100
+
+// redisOpBuckets are the upper bounds of the redis latency histogram's
+// buckets
+var redisOpBuckets = []time.Duration{time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+	500 * time.Millisecond, time.Second}
+
+// redisLatency is the histogram of redis operations' latency
+var redisLatency = NewHistogram(redisOpBuckets)
+
+// Histogram counts durations in buckets, in the prometheus way. It's lock
+// free so observing is cheap.
+type Histogram struct {
+	bounds []time.Duration
+	// counts has a counter per bound and one for the longer durations
+	counts []uint64
+	// sum is in nanoseconds
+	sum   uint64
+	count uint64
+}
+
+// NewHistogram returns an empty histogram with the buckets' upper bounds,
+// in ascending order
+func NewHistogram(bounds []time.Duration) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe counts a duration
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Write writes the histogram in the prometheus text format
+func (h *Histogram) Write(b *strings.Builder, name string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(b, "%s_bucket{le=%q} %d\n", name,
+			strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, atomic.LoadUint64(&h.count))
+	fmt.Fprintf(b, "%s_sum %g\n", name,
+		time.Duration(atomic.LoadUint64(&h.sum)).Seconds())
+	fmt.Fprintf(b, "%s_count %d\n", name, atomic.LoadUint64(&h.count))
+}
+
+// serveMetrics serves the metrics in the prometheus text format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var b strings.Builder
+	redisLatency.Write(&b, "peerbook_redis_op_seconds",
+		"Latency of redis operations.")
+	b.WriteString("# HELP peerbook_peer_rtt_seconds Round trip time of the peer's last ping.\n" +
+		"# TYPE peerbook_peer_rtt_seconds gauge\n")
+	for _, c := range hub.Connections() {
+		if c.RTT > 0 {
+			fmt.Fprintf(&b, "peerbook_peer_rtt_seconds{fp=%q,conn=%q} %g\n",
+				c.FP, c.ID, c.RTT/1000)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// timedConn is a redis connection timing its commands. Commands slower than
+// the configured threshold are logged.
+type timedConn struct {
+	redis.Conn
+}
+
+func (c *timedConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		// just flushing
+		return c.Conn.Do(cmd, args...)
+	}
+	start := time.Now()
+	reply, err := c.Conn.Do(cmd, args...)
+	d := time.Since(start)
+	redisLatency.Observe(d)
+	if slow := conf().slowRedisOp(); slow > 0 && d >= slow {
+		Logger.Warnw("Slow redis operation", "command", cmd,
+			"duration", d.String())
+	}
+	return reply, err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// delayingConn is a redis connection stub replying OK after a delay
+type delayingConn struct {
+	redis.Conn
+	delay time.Duration
+}
+
+func (c *delayingConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	time.Sleep(c.delay)
+	return "OK", nil
+}
+
+func TestSlowRedisOp(t *testing.T) {
+	setConfig(t, func(c *Config) { c.SlowRedisOp = 20 })
+	logs, restore := observeLogs(zap.WarnLevel)
+	defer restore()
+	// the stub's commands are apart from the running server's
+	slowOps := func(cmd string) int {
+		return logs.FilterMessage("Slow redis operation").
+			FilterField(zap.String("command", cmd)).Len()
+	}
+	before := atomic.LoadUint64(&redisLatency.count)
+	fast := &timedConn{&delayingConn{}}
+	_, err := fast.Do("FASTSTUB")
+	require.Nil(t, err)
+	require.Zero(t, slowOps("FASTSTUB"))
+	slow := &timedConn{&delayingConn{delay: 30 * time.Millisecond}}
+	reply, err := slow.Do("SLOWSTUB")
+	require.Nil(t, err)
+	require.Equal(t, "OK", reply)
+	require.Equal(t, 1, slowOps("SLOWSTUB"))
+	require.GreaterOrEqual(t, atomic.LoadUint64(&redisLatency.count), before+2)
+	// a zero threshold turns the logging off
+	setConfig(t, func(c *Config) { c.SlowRedisOp = 0 })
+	_, err = slow.Do("SLOWSTUB")
+	require.Nil(t, err)
+	require.Equal(t, 1, slowOps("SLOWSTUB"))
+}
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]time.Duration{time.Millisecond, time.Second})
+	h.Observe(500 * time.Microsecond)
+	h.Observe(time.Millisecond)
+	h.Observe(20 * time.Millisecond)
+	h.Observe(2 * time.Second)
+	var b strings.Builder
+	h.Write(&b, "op_seconds", "Latency.")
+	require.Equal(t, `# HELP op_seconds Latency.
+# TYPE op_seconds histogram
+op_seconds_bucket{le="0.001"} 2
+op_seconds_bucket{le="1"} 3
+op_seconds_bucket{le="+Inf"} 4
+op_seconds_sum 2.0215
+op_seconds_count 4
+`, b.String())
+}
+func TestMetrics(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.AdminToken = "anadmintoken" })
+	_, err := db.GetPeer("A")
+	require.Nil(t, err)
+	req, err := http.NewRequest("GET", "http://127.0.0.1:17777/metrics", nil)
+	require.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	req.Header.Set("Authorization", "Bearer anadmintoken")
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Contains(t, string(b), "# TYPE peerbook_redis_op_seconds histogram")
+	require.Contains(t, string(b), `peerbook_redis_op_seconds_bucket{le="+Inf"} `)
+	require.NotContains(t, string(b), "peerbook_redis_op_seconds_count 0\n")
+}
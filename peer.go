@@ -7,6 +7,9 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,6 +19,7 @@ var upgrader = websocket.Upgrader{
 	ReadBufferSize:  maxMessageSize,
 	WriteBufferSize: maxMessageSize,
 	CheckOrigin:     func(r *http.Request) bool { return true },
+	Subprotocols:    []string{BinarySubprotocol},
 }
 
 // Peer is a middleman between the websocket connection and the hub.
@@ -28,13 +32,249 @@ type Peer struct {
 	CreatedOn   int64  `redis:"created_on" json:"created_on,omitempty"`
 	VerifiedOn  int64  `redis:"verified_on" json:"verified_on,omitempty"`
 	LastConnect int64  `redis:"last_connect" json:"last_connect,omitempty"`
-	Online      bool   `redis:"online" json:"online"`
+	// LastIP is the IP the peer last connected from, for the admins' eyes
+	// only
+	LastIP    string `redis:"last_ip" json:"-"`
+	Online    bool   `redis:"online" json:"online"`
+	DeletedOn int64  `redis:"deleted_on" json:"deleted_on,omitempty"`
+	// PrevName is the peer's name before it was last renamed, on RenamedOn
+	PrevName  string `redis:"prev_name" json:"-"`
+	RenamedOn int64  `redis:"renamed_on" json:"-"`
+	// DisplayName & Color are cosmetic, they're not part of the identity
+	DisplayName string `redis:"display_name" json:"display_name,omitempty"`
+	Color       string `redis:"color" json:"color,omitempty"`
+	// Group is a label the user gives the peer, e.g. "home", to broadcast &
+	// list within
+	Group string `redis:"group" json:"group,omitempty"`
+	// Pinned peers are listed first
+	Pinned bool `redis:"pinned" json:"pinned,omitempty"`
+	// Capabilities are the features the peer advertised when connecting
+	Capabilities Capabilities `redis:"capabilities" json:"capabilities,omitempty"`
 }
 type PeerList []*Peer
 
+// Sort orders the list for display - pinned peers first, then the most
+// recently connected
+func (l PeerList) Sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		if l[i].Pinned != l[j].Pinned {
+			return l[i].Pinned
+		}
+		return l[i].LastConnect > l[j].LastConnect
+	})
+}
+
+// InGroup returns the peers in the group, all of them for an empty group
+func (l PeerList) InGroup(group string) PeerList {
+	if group == "" {
+		return l
+	}
+	var ret PeerList
+	for _, p := range l {
+		if p.Group == group {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// FPs returns the fingerprints of the peers
+func (l PeerList) FPs() []string {
+	fps := make([]string, len(l))
+	for i, p := range l {
+		fps[i] = p.FP
+	}
+	return fps
+}
+
+// Connected returns the peers whose connected state, by the fingerprints of
+// the connected ones, is the one given
+func (l PeerList) Connected(connected map[string]bool, want bool) PeerList {
+	var ret PeerList
+	for _, p := range l {
+		if connected[p.FP] == want {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+const (
+	// MaxFingerprintLen is the maximum length of a fingerprint
+	MaxFingerprintLen = 255
+	// MaxNameLen is the maximum length of a peer's name & kind
+	MaxNameLen = 64
+)
+
+// ValidateFingerprint checks a fingerprint is made of 1-255 printable, non
+// space, ascii characters
+func ValidateFingerprint(fp string) error {
+	if fp == "" || len(fp) > MaxFingerprintLen {
+		return fmt.Errorf("Fingerprint length must be 1-%d", MaxFingerprintLen)
+	}
+	for _, r := range fp {
+		if r <= ' ' || r > '~' {
+			return fmt.Errorf("Fingerprint has a bad character: %q", r)
+		}
+	}
+	return nil
+}
+
+// ValidationErrors is an error returned when fields of a request are
+// invalid. It holds the error of each invalid field, by the field's name.
+type ValidationErrors map[string]string
+
+func (e ValidationErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for f := range e {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	msgs := make([]string, len(fields))
+	for i, f := range fields {
+		msgs[i] = fmt.Sprintf("%s: %s", f, e[f])
+	}
+	return fmt.Sprintf("Invalid fields - %s", strings.Join(msgs, ", "))
+}
+
+// add adds the field errors of err, or err itself as the field's error
+func (e ValidationErrors) add(field string, err error) {
+	if err == nil {
+		return
+	}
+	if fields, ok := err.(ValidationErrors); ok {
+		for f, msg := range fields {
+			e[f] = msg
+		}
+		return
+	}
+	e[field] = err.Error()
+}
+
+// ValidatePeer checks the fields of a new peer and returns a
+// ValidationErrors with all the invalid ones
+func ValidatePeer(fp string, name string, kind string) error {
+	errs := ValidationErrors{}
+	errs.add("fp", ValidateFingerprint(fp))
+	if len(name) > MaxNameLen {
+		errs["name"] = fmt.Sprintf("Name is longer than %d", MaxNameLen)
+	}
+	if len(kind) > MaxNameLen {
+		errs["kind"] = fmt.Sprintf("Kind is longer than %d", MaxNameLen)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// KnownCapabilities are the capabilities peers can advertise
+var KnownCapabilities = map[string]bool{
+	"webrtc-datachannel": true,
+	"file-transfer":      true,
+	"audio":              true,
+	"video":              true,
+}
+
+// Capabilities is a set of known capabilities, stored in redis as a comma
+// separated list
+type Capabilities []string
+
+// ParseCapabilities returns the known capabilities in a comma separated
+// list, ignoring unknown & repeated ones
+func ParseCapabilities(s string) Capabilities {
+	r := Capabilities{}
+	seen := make(map[string]bool)
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" || seen[c] {
+			continue
+		}
+		if !KnownCapabilities[c] {
+			Logger.Warnf("Ignoring an unknown capability: %q", c)
+			continue
+		}
+		seen[c] = true
+		r = append(r, c)
+	}
+	return r
+}
+
+// RedisArg implements redis.Argument
+func (c Capabilities) RedisArg() interface{} {
+	return strings.Join(c, ",")
+}
+
+// RedisScan implements redis.Scanner
+func (c *Capabilities) RedisScan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		*c = ParseCapabilities(string(v))
+	case string:
+		*c = ParseCapabilities(v)
+	default:
+		return fmt.Errorf("Can't scan capabilities from %T", src)
+	}
+	return nil
+}
+
 type PeerUpdate struct {
-	Verified bool `redis:"verified" json:"verified"`
-	Online   bool `redis:"online" json:"online"`
+	Verified    bool   `redis:"verified" json:"verified"`
+	Online      bool   `redis:"online" json:"online"`
+	DisplayName string `redis:"display_name" json:"display_name,omitempty"`
+	Color       string `redis:"color" json:"color,omitempty"`
+	Group       string `redis:"group" json:"group,omitempty"`
+	// Capabilities are included so clients can pick a compatible target
+	Capabilities Capabilities `redis:"capabilities" json:"capabilities,omitempty"`
+	// Labels are the connection's labels, set by the peer
+	Labels map[string]string `redis:"-" json:"labels,omitempty"`
+}
+
+// NewPeerUpdate returns the update with the peer's current state
+func NewPeerUpdate(p *Peer) PeerUpdate {
+	return PeerUpdate{Verified: p.Verified, Online: p.Online,
+		DisplayName: p.DisplayName, Color: p.Color, Group: p.Group,
+		Capabilities: p.Capabilities}
+}
+
+// PeerListItem is a peer in the list served to REST clients. It's the
+// list's schema, decoupled from the stored peer so fields added to it aren't
+// exposed by accident.
+type PeerListItem struct {
+	FP           string       `json:"fp"`
+	Name         string       `json:"name,omitempty"`
+	User         string       `json:"user,omitempty"`
+	Kind         string       `json:"kind,omitempty"`
+	Verified     bool         `json:"verified"`
+	Online       bool         `json:"online"`
+	CreatedOn    int64        `json:"created_on,omitempty"`
+	VerifiedOn   int64        `json:"verified_on,omitempty"`
+	LastConnect  int64        `json:"last_connect,omitempty"`
+	DisplayName  string       `json:"display_name,omitempty"`
+	Color        string       `json:"color,omitempty"`
+	Group        string       `json:"group,omitempty"`
+	Pinned       bool         `json:"pinned,omitempty"`
+	Capabilities Capabilities `json:"capabilities,omitempty"`
+	// LastIP is only listed for admins
+	LastIP string `json:"last_ip,omitempty"`
+}
+
+// NewPeerListItem returns the list item of the peer
+func NewPeerListItem(p *Peer) PeerListItem {
+	return PeerListItem{FP: p.FP, Name: p.Name, User: p.User, Kind: p.Kind,
+		Verified: p.Verified, Online: p.Online, CreatedOn: p.CreatedOn,
+		VerifiedOn: p.VerifiedOn, LastConnect: p.LastConnect,
+		DisplayName: p.DisplayName, Color: p.Color, Group: p.Group,
+		Pinned: p.Pinned, Capabilities: p.Capabilities}
+}
+
+// Items returns the list items of the peers, in order
+func (l PeerList) Items() []PeerListItem {
+	items := make([]PeerListItem, len(l))
+	for i, p := range l {
+		items[i] = NewPeerListItem(p)
+	}
+	return items
 }
 
 // StatusMessage is used to update the peer to a change of state,
@@ -42,6 +282,9 @@ type PeerUpdate struct {
 type StatusMessage struct {
 	Code int    `json:"code"`
 	Text string `json:"text"`
+	// RetryAfter is the seconds a client is asked to wait before
+	// reconnecting, zero for no hint
+	RetryAfter int `json:"retry_after,omitempty"`
 }
 
 // OfferMessage is the format of the offer message after processing -
@@ -62,39 +305,184 @@ type AnswerMessage struct {
 
 // Getting the list of users peers
 func GetUsersPeers(email string) (*PeerList, error) {
-	var l PeerList
-	u, err := db.GetUser(email)
+	return FindUsersPeers(email, "")
+}
+
+// FindUsersPeers returns the user's peers whose name matches q. q is
+// either a glob pattern or, if it has no special characters, a prefix. An
+// empty q matches all peers.
+func FindUsersPeers(email string, q string) (*PeerList, error) {
+	var (
+		u   *DBUser
+		err error
+	)
+	if q == "" {
+		u, err = db.GetUser(email)
+	} else {
+		u, err = db.ScanUser(email, searchPattern(q))
+	}
 	if err != nil {
 		return nil, err
 	}
+	return readPeers(*u), nil
+}
+
+// FindUsersPeersPage returns a page of up to limit of the user's peers
+// whose name matches q, starting at the cursor, and the cursor of the
+// next page. The cursor is empty after the last page.
+func FindUsersPeersPage(email string, q string, cursor string,
+	limit int) (*PeerList, string, error) {
+	pattern := "*"
+	if q != "" {
+		pattern = searchPattern(q)
+	}
+	u, next, err := db.ScanUserPage(email, pattern, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return readPeers(*u), next, nil
+}
+
+// searchPattern returns the glob pattern of a search, q itself if it's a
+// pattern or a prefix pattern when it has no special characters
+func searchPattern(q string) string {
+	if !strings.ContainsAny(q, "*?[") {
+		q += "*"
+	}
+	return q
+}
+
+// readPeers reads the peers with the fingerprints, skipping the deleted ones
+func readPeers(fps DBUser) *PeerList {
+	var l PeerList
 	// TODO: use redis transaction to read them all at once
-	for _, fp := range *u {
+	for _, fp := range fps {
 		p, err := GetPeer(fp)
 		if err != nil {
 			Logger.Warnf("Failed to read peer: %w", err)
 			if err != nil {
 				Logger.Errorf("Failed to send status message: %s", err)
 			}
-		} else {
+		} else if p.DeletedOn == 0 {
 			l = append(l, p)
 		}
 	}
-	return &l, nil
+	return &l
 }
 
 func (p *Peer) setName(name string) {
+	if p.Name != "" {
+		p.PrevName = p.Name
+		p.RenamedOn = time.Now().Unix()
+		db.SetPeerField(p.FP, "prev_name", p.PrevName)
+		db.SetPeerField(p.FP, "renamed_on", p.RenamedOn)
+	}
 	p.Name = name
-	conn := db.pool.Get()
-	defer conn.Close()
-	conn.Do("HSET", p.Key(), "name", name)
+	db.SetPeerField(p.FP, "name", name)
+}
+
+// staleName returns whether the name is the one the peer had before it was
+// renamed in the last grace period
+func (p *Peer) staleName(name string, now time.Time, grace time.Duration) bool {
+	return grace > 0 && p.PrevName != "" && name == p.PrevName &&
+		name != p.Name && p.RenamedOn >= now.Add(-grace).Unix()
+}
+
+func (p *Peer) setKind(kind string) {
+	p.Kind = kind
+	db.SetPeerField(p.FP, "kind", kind)
+}
+
+// identityChange returns a *PeerChanged when the name or the kind differ
+// from the peer's and are among the identity fields, nil otherwise
+func (p *Peer) identityChange(name string, kind string, fields []string) error {
+	var changed []string
+	for _, f := range fields {
+		if (f == "name" && name != p.Name) || (f == "kind" && kind != p.Kind) {
+			changed = append(changed, f)
+		}
+	}
+	if changed == nil {
+		return nil
+	}
+	return &PeerChanged{changed}
+}
+
+// pending returns whether the peer is pending verification - unverified and
+// created in the last TokenTTL seconds, while its verification token lives
+func (p *Peer) pending(now time.Time) bool {
+	return !p.Verified && p.CreatedOn >= now.Add(-TokenTTL*time.Second).Unix()
 }
 
 func (p *Peer) Key() string {
 	return fmt.Sprintf("peer:%s", p.FP)
 }
+
+// checkPending returns a *TooManyPending error if the user has MaxPending
+// peers pending verification. A peer is pending till it's verified or its
+// verification token expires.
+func checkPending(user string) error {
+	max := conf().MaxPending
+	if max <= 0 {
+		return nil
+	}
+	ps, err := GetUsersPeers(user)
+	if err != nil {
+		return fmt.Errorf("Failed to get user peers: %w", err)
+	}
+	now := time.Now()
+	n := 0
+	for _, p := range *ps {
+		if p.pending(now) {
+			n++
+		}
+	}
+	if n >= max {
+		return &TooManyPending{user}
+	}
+	return nil
+}
+
+// checkName returns a *NameTaken error if names are unique and another of
+// the user's peers than fp has the name
+func checkName(user string, fp string, name string) error {
+	if !conf().UniqueNames {
+		return nil
+	}
+	ps, err := GetUsersPeers(user)
+	if err != nil {
+		return fmt.Errorf("Failed to get user peers: %w", err)
+	}
+	for _, p := range *ps {
+		if p.FP != fp && p.Name == name {
+			return &NameTaken{name}
+		}
+	}
+	return nil
+}
+
+// normalizeUser returns the user in its stored form - trimmed & lowercased -
+// so variants of an email address are the same user
+func normalizeUser(user string) string {
+	return strings.ToLower(strings.TrimSpace(user))
+}
+
+// ValidateUser returns an error if EmailUsers is set and the normalized user
+// isn't an email address
+func ValidateUser(user string) error {
+	if !conf().EmailUsers {
+		return nil
+	}
+	a, err := mail.ParseAddress(user)
+	if err != nil || a.Address != user {
+		return fmt.Errorf("User %q is not an email address", user)
+	}
+	return nil
+}
+
 func NewPeer(fp string, name string, user string, kind string) *Peer {
 	return &Peer{FP: fp, Name: name, Kind: kind, CreatedOn: time.Now().Unix(),
-		User: user, Verified: false, Online: false}
+		User: normalizeUser(user), Verified: false, Online: false}
 }
 func (p *Peer) SinceBoot() string {
 	return time.Now().Sub(time.Unix(p.CreatedOn, 0)).Truncate(time.Second).String()
@@ -105,3 +493,77 @@ func (p *Peer) SinceConnect() string {
 	}
 	return time.Now().Sub(time.Unix(p.LastConnect, 0)).Truncate(time.Second).String()
 }
+
+// DeletePeer removes the peer from its user's list. If there's a delete grace
+// period the peer is kept as a tombstone until it expires and can be restored
+// till then.
+func DeletePeer(p *Peer) error {
+	uncachePeer(p.FP)
+	if err := db.RemoveUserPeer(p.User, p.FP); err != nil {
+		return fmt.Errorf("Failed to remove peer from user list: %w", err)
+	}
+	closeDeleted(p.FP)
+	grace := conf().deleteGrace()
+	if grace == 0 {
+		return db.DeletePeer(p.FP)
+	}
+	p.DeletedOn = time.Now().Unix()
+	if err := db.SetPeerField(p.FP, "deleted_on", p.DeletedOn); err != nil {
+		return err
+	}
+	return db.SetPeerTTL(p.FP, grace)
+}
+
+// closeDeleted closes the connections of a deleted peer, a failure is only
+// logged as the peer is gone anyway
+func closeDeleted(fp string) {
+	_, err := ClosePeer(fp, http.StatusGone, fmt.Errorf("Peer was deleted"),
+		&CloseReason{CloseRevoked, "peer deleted"})
+	if err != nil {
+		Logger.Warnf("Failed to close the connections of deleted peer %q: %s",
+			fp, err)
+	}
+}
+
+// RestorePeer restores a deleted peer that's still in its grace period
+func RestorePeer(fp string, user string) error {
+	exists, err := db.PeerExists(fp)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return &PeerNotFound{fp}
+	}
+	p, err := db.GetPeer(fp)
+	if err != nil {
+		return err
+	}
+	if p.User != user {
+		return &PeerIsForeign{p}
+	}
+	if p.DeletedOn == 0 {
+		return nil
+	}
+	if err = db.SetPeerTTL(fp, 0); err != nil {
+		return err
+	}
+	if err = db.SetPeerField(fp, "deleted_on", 0); err != nil {
+		return err
+	}
+	return db.AddUserPeer(user, fp)
+}
+
+// PeerOwner returns the user of the peer, or an empty string for an unknown
+// peer. It reads the owners index and falls back to the peer's hash for peers
+// added before the index, until it's repaired.
+func PeerOwner(fp string) (string, error) {
+	owner, err := db.GetPeerOwner(fp)
+	if err != nil || owner != "" {
+		return owner, err
+	}
+	p, err := db.GetPeer(fp)
+	if err != nil {
+		return "", err
+	}
+	return p.User, nil
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -25,3 +31,310 @@ func TestTooManyPeers(t *testing.T) {
 	err := db.AddPeer(&p)
 	require.NotNil(t, err)
 }
+func TestConcurrentAddPeer(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.MaxPeers = 3 })
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- db.AddPeer(NewPeer(fmt.Sprintf("P%d", i), "foo", "j", "lay"))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	added := 0
+	for err := range errs {
+		if err == nil {
+			added++
+		} else {
+			require.IsType(t, &TooManyPeers{}, err)
+		}
+	}
+	require.Equal(t, 3, added)
+	members, err := redisDouble.Members("user:j")
+	require.Nil(t, err)
+	require.Len(t, members, 3)
+	// a peer in the set is updated, not refused
+	p := NewPeer(members[0], "bar", "j", "lay")
+	require.Nil(t, db.AddPeer(p))
+	require.Equal(t, "bar", redisDouble.HGet("peer:"+members[0], "name"))
+}
+func TestImportPeerCap(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.MaxPeers = 3 })
+	redisDouble.Set("token:avalidtoken", "j")
+	redisDouble.Set("token:htoken", "h")
+	seedPeer("A", "foo", "j", true)
+	// up to the cap
+	resp := apiRequest(t, "POST", "/import", "avalidtoken", []ImportedPeer{
+		{FP: "B", Name: "bar", Kind: "lay"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "1", redisDouble.HGet("peer:B", "verified"))
+	owner, err := redisDouble.Get("owner:B")
+	require.Nil(t, err)
+	require.Equal(t, "j", owner)
+	// a batch crossing the cap is refused as a whole
+	before := redisDouble.Dump()
+	resp = apiRequest(t, "POST", "/import", "avalidtoken", []ImportedPeer{
+		{FP: "C", Name: "baz", Kind: "lay"},
+		{FP: "D", Name: "qux", Kind: "lay"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	require.Equal(t, before, redisDouble.Dump())
+	members, err := redisDouble.Members("user:j")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"A", "B"}, members)
+	// a batch filling the cap is added
+	resp = apiRequest(t, "POST", "/import", "avalidtoken", []ImportedPeer{
+		{FP: "C", Name: "baz", Kind: "lay"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	members, err = redisDouble.Members("user:j")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"A", "B", "C"}, members)
+	resp = apiRequest(t, "POST", "/import", "avalidtoken", []ImportedPeer{
+		{FP: "E", Name: "quux", Kind: "lay"}, {FP: "E", Name: "quux", Kind: "lay"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	// other users' peers aren't taken
+	resp = apiRequest(t, "POST", "/import", "htoken", []ImportedPeer{
+		{FP: "A", Name: "foo", Kind: "lay"}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	require.Equal(t, "j", redisDouble.HGet("peer:A", "user"))
+	resp = apiRequest(t, "POST", "/import", "", []ImportedPeer{})
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+func TestAddPeersAllOrNothing(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.MaxPeers = 3 })
+	for name, s := range map[string]Store{"redis": db, "memory": NewMemStore()} {
+		require.Nil(t, s.AddPeer(NewPeer("A", "foo", "j", "lay")), name)
+		err := s.AddPeers("j", []*Peer{NewPeer("B", "bar", "j", "lay"),
+			NewPeer("C", "baz", "j", "lay"), NewPeer("D", "qux", "j", "lay")})
+		require.IsType(t, &TooManyPeers{}, err, name)
+		for _, fp := range []string{"B", "C", "D"} {
+			exists, err := s.PeerExists(fp)
+			require.Nil(t, err, name)
+			require.False(t, exists, "%s %s", name, fp)
+		}
+		// updating a peer in the set doesn't count
+		require.Nil(t, s.AddPeers("j", []*Peer{NewPeer("A", "foo", "j", "lay"),
+			NewPeer("B", "bar", "j", "lay"), NewPeer("C", "baz", "j", "lay")}),
+			name)
+		u, err := s.GetUser("j")
+		require.Nil(t, err, name)
+		require.Len(t, *u, 3, name)
+	}
+}
+func TestSoftDeletePeer(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.DeleteGrace = 60 })
+	redisDouble.SAdd("user:j", "A", "B")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1")
+	redisDouble.HSet("peer:B", "fp", "B", "name", "bar", "kind", "lay",
+		"user", "j", "verified", "1")
+	p, err := GetPeer("A")
+	require.Nil(t, err)
+	err = DeletePeer(p)
+	require.Nil(t, err)
+	// the tombstone is kept but not listed
+	require.True(t, redisDouble.Exists("peer:A"))
+	require.NotEqual(t, "0", redisDouble.HGet("peer:A", "deleted_on"))
+	list, err := GetUsersPeers("j")
+	require.Nil(t, err)
+	require.Len(t, *list, 1)
+	require.Equal(t, "B", (*list)[0].FP)
+	// restore within the grace period
+	require.IsType(t, &PeerIsForeign{}, RestorePeer("A", "h"))
+	err = RestorePeer("A", "j")
+	require.Nil(t, err)
+	list, err = GetUsersPeers("j")
+	require.Nil(t, err)
+	require.Len(t, *list, 2)
+	require.Equal(t, time.Duration(0), redisDouble.TTL("peer:A"))
+	// pruned after the grace period
+	p, err = GetPeer("A")
+	require.Nil(t, err)
+	err = DeletePeer(p)
+	require.Nil(t, err)
+	redisDouble.FastForward(61 * time.Second)
+	require.False(t, redisDouble.Exists("peer:A"))
+	require.IsType(t, &PeerNotFound{}, RestorePeer("A", "j"))
+}
+func TestDeletedPeerIsGone(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) {
+		c.DeleteGrace = 60
+		c.PeerCacheSize = 10
+		c.OfflineQueue = 10
+	})
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	a := connectPeer(t, s, "A")
+	p, err := GetPeer("B")
+	require.Nil(t, err)
+	require.Nil(t, DeletePeer(p))
+	// it can't reconnect while it's a tombstone
+	u := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?fp=B"
+	_, resp, err := cstDialer.Dial(u, nil)
+	require.NotNil(t, err)
+	require.NotNil(t, resp)
+	require.NotEqual(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	require.Nil(t, conf().peerCache.Get("B"))
+	// nor is it a relay target, the message isn't queued
+	require.Nil(t, a.WriteJSON(map[string]string{"offer": "an offer",
+		"target": "B"}))
+	require.Nil(t, a.WriteJSON(map[string]string{"command": "get_list"}))
+	readUntil(t, a, "peers")
+	require.False(t, redisDouble.Exists("queue:B"))
+	p, err = GetPeer("B")
+	require.Nil(t, err)
+	outcome, err := routeCheck(&Peer{FP: "A", User: "j", Verified: true}, "B", p)
+	require.Equal(t, RouteDropped, outcome)
+	require.NotNil(t, err)
+}
+func TestHardDeletePeer(t *testing.T) {
+	startTest(t)
+	redisDouble.SAdd("user:j", "A", "B")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1")
+	p, err := GetPeer("A")
+	require.Nil(t, err)
+	err = DeletePeer(p)
+	require.Nil(t, err)
+	require.False(t, redisDouble.Exists("peer:A"))
+	members, err := redisDouble.Members("user:j")
+	require.Nil(t, err)
+	require.Equal(t, []string{"B"}, members)
+}
+func TestParseCapabilities(t *testing.T) {
+	require.Equal(t, Capabilities{"webrtc-datachannel", "file-transfer"},
+		ParseCapabilities("webrtc-datachannel, file-transfer,teleport,webrtc-datachannel"))
+	require.Equal(t, Capabilities{}, ParseCapabilities(""))
+}
+func TestUnverifiedCapabilities(t *testing.T) {
+	startTest(t)
+	seedPeer("A", "foo", "j", false)
+	redisDouble.HSet("peer:A", "capabilities", "webrtc-datachannel")
+	ws, err := openWS("ws://127.0.0.1:17777/ws?fp=A&caps=file-transfer")
+	require.Nil(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, ws, http.StatusUnauthorized)
+	require.Equal(t, "webrtc-datachannel", redisDouble.HGet("peer:A", "capabilities"))
+}
+func TestCapabilitiesPresence(t *testing.T) {
+	startTest(t)
+	redisDouble.SAdd("user:j", "A", "B")
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	redisDouble.HSet("peer:B", "fp", "B", "name", "bar", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	wsA, err := openWS("ws://127.0.0.1:17777/ws?fp=A&caps=webrtc-datachannel,teleport")
+	require.Nil(t, err)
+	defer wsA.Close()
+	wsA.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, wsA, 200)
+	require.Equal(t, "webrtc-datachannel", redisDouble.HGet("peer:A", "capabilities"))
+	wsB, err := openWS("ws://127.0.0.1:17777/ws?fp=B&caps=file-transfer&caps=webrtc-datachannel")
+	require.Nil(t, err)
+	defer wsB.Close()
+	wsB.SetReadDeadline(time.Now().Add(ReadTimeout))
+	requireStatus(t, wsB, 200)
+	// B's snapshot has A's capabilities
+	var l struct {
+		Peers PeerList `json:"peers"`
+	}
+	require.Nil(t, wsB.ReadJSON(&l))
+	caps := make(map[string]Capabilities)
+	for _, p := range l.Peers {
+		caps[p.FP] = p.Capabilities
+	}
+	require.Equal(t, Capabilities{"webrtc-datachannel"}, caps["A"])
+	require.Equal(t, Capabilities{"file-transfer", "webrtc-datachannel"}, caps["B"])
+	// A gets B's capabilities in B's presence update
+	for {
+		var m struct {
+			SourceFP   string     `json:"source_fp"`
+			PeerUpdate PeerUpdate `json:"peer_update"`
+		}
+		require.Nil(t, wsA.ReadJSON(&m))
+		if m.SourceFP == "B" {
+			require.True(t, m.PeerUpdate.Online)
+			require.Equal(t, Capabilities{"file-transfer", "webrtc-datachannel"},
+				m.PeerUpdate.Capabilities)
+			break
+		}
+	}
+}
+func TestMaxPeersConfig(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.MaxPeers = 2 })
+	verify := func(fp string) int {
+		m, err := json.Marshal(map[string]string{"fp": fp, "email": "j",
+			"name": fp, "kind": "lay"})
+		require.Nil(t, err)
+		resp, err := http.Post("http://127.0.0.1:17777/verify",
+			"application/json", bytes.NewBuffer(m))
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, verify("A"))
+	require.Equal(t, http.StatusOK, verify("B"))
+	require.Equal(t, http.StatusConflict, verify("C"))
+	require.False(t, redisDouble.Exists("peer:C"))
+	members, err := redisDouble.SMembers("user:j")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"A", "B"}, members)
+	// known peers are still served
+	require.Equal(t, http.StatusOK, verify("A"))
+	// zero is unlimited
+	setConfig(t, func(c *Config) { c.MaxPeers = 0 })
+	for i := 0; i < MaxPeersPerUser+1; i++ {
+		require.Equal(t, http.StatusOK, verify(fmt.Sprintf("P%d", i)))
+	}
+}
+func TestUniqueNames(t *testing.T) {
+	startTest(t)
+	verify := func(fp string, name string) int {
+		m, err := json.Marshal(map[string]string{"fp": fp, "email": "j",
+			"name": name, "kind": "lay"})
+		require.Nil(t, err)
+		resp, err := http.Post("http://127.0.0.1:17777/verify",
+			"application/json", bytes.NewBuffer(m))
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// names can collide by default
+	require.Equal(t, http.StatusOK, verify("A", "laptop"))
+	require.Equal(t, http.StatusOK, verify("B", "laptop"))
+	setConfig(t, func(c *Config) { c.UniqueNames = true })
+	require.Equal(t, http.StatusConflict, verify("C", "laptop"))
+	require.False(t, redisDouble.Exists("peer:C"))
+	require.Equal(t, http.StatusOK, verify("C", "desktop"))
+	// a peer keeps its own name, but can't be renamed into a conflict
+	require.Equal(t, http.StatusOK, verify("C", "desktop"))
+	require.Equal(t, http.StatusConflict, verify("C", "laptop"))
+	require.Equal(t, "desktop", redisDouble.HGet("peer:C", "name"))
+	require.Equal(t, http.StatusOK, verify("C", "phone"))
+	require.Equal(t, "phone", redisDouble.HGet("peer:C", "name"))
+	// names are unique per user
+	m, err := json.Marshal(map[string]string{"fp": "D", "email": "h",
+		"name": "laptop", "kind": "lay"})
+	require.Nil(t, err)
+	resp, err := http.Post("http://127.0.0.1:17777/verify",
+		"application/json", bytes.NewBuffer(m))
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
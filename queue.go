@@ -0,0 +1,86 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DefaultOfflineTTL is the number of seconds a message is queued for an
+// offline peer, when offline queuing is on
+const DefaultOfflineTTL = 60
+
+// newQueueEntry returns a queued message prefixed by its expiry time in
+// unix milliseconds and a space
+func newQueueEntry(msg []byte, ttl time.Duration) []byte {
+	e := strconv.AppendInt(nil, time.Now().Add(ttl).UnixNano()/1e6, 10)
+	e = append(e, ' ')
+	return append(e, msg...)
+}
+
+// parseQueueEntry returns the message of a queue entry and whether it's
+// still fresh
+func parseQueueEntry(e []byte) ([]byte, bool, error) {
+	i := bytes.IndexByte(e, ' ')
+	if i < 0 {
+		return nil, false, fmt.Errorf("Bad queue entry")
+	}
+	expiry, err := strconv.ParseInt(string(e[:i]), 10, 64)
+	if err != nil {
+		return nil, false, fmt.Errorf("Bad queue entry expiry: %w", err)
+	}
+	return e[i+1:], time.Now().UnixNano()/1e6 < expiry, nil
+}
+
+// freshEntries returns the messages of the entries that haven't expired
+func freshEntries(entries [][]byte) [][]byte {
+	msgs := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		m, fresh, err := parseQueueEntry(e)
+		if err != nil {
+			Logger.Warnf("Dropping a queued message: %s", err)
+			continue
+		}
+		if fresh {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+// queueOffline queues a message for an offline target and returns whether
+// it's queued. It's a no-op unless offline_queue is set.
+func (c *Conn) queueOffline(tfp string, kind string, m []byte) bool {
+	cfg := conf()
+	if cfg.OfflineQueue == 0 {
+		return false
+	}
+	err := db.QueueMessage(tfp, m, cfg.OfflineQueue, cfg.offlineTTL())
+	if err != nil {
+		c.logger().Errorf("Failed to queue a %s for %q: %s", kind, tfp, err)
+		return false
+	}
+	c.logger().Infof("Queued a %s from %q to offline %q", kind, c.FP, tfp)
+	return true
+}
+
+// drainQueue forwards the messages queued while the peer was offline, in
+// order, and clears its queue
+func (c *Conn) drainQueue(s Store) {
+	msgs, err := s.DrainQueue(c.FP)
+	if err != nil {
+		c.logger().Errorf("Failed to drain %q queue: %s", c.FP, err)
+		return
+	}
+	if len(msgs) > 0 {
+		c.logger().Infof("Forwarding %d queued messages to %q", len(msgs), c.FP)
+	}
+	for _, m := range msgs {
+		c.forward(fmt.Sprintf("out:%s", c.FP), m)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestParseQueueEntry(t *testing.T) {
+	m, fresh, err := parseQueueEntry(newQueueEntry([]byte("a b"), time.Minute))
+	require.Nil(t, err)
+	require.True(t, fresh)
+	require.Equal(t, []byte("a b"), m)
+	_, fresh, err = parseQueueEntry(newQueueEntry([]byte("a"), -time.Second))
+	require.Nil(t, err)
+	require.False(t, fresh)
+	_, _, err = parseQueueEntry([]byte("nospace"))
+	require.NotNil(t, err)
+}
+func TestOfflineQueue(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) {
+		c.OfflineQueue = 2
+		c.AuditRouting = true
+	})
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	logs, restore := observeLogs(zapcore.DebugLevel)
+	defer restore()
+	wsA := connectPeer(t, s, "A")
+	for _, o := range []string{"first", "second", "third"} {
+		require.Nil(t, wsA.WriteJSON(map[string]interface{}{
+			"offer": o, "target": "B"}))
+	}
+	require.Eventually(t, func() bool {
+		return len(logs.FilterMessage("routed message").All()) == 3
+	}, time.Second, 10*time.Millisecond)
+	for _, e := range logs.FilterMessage("routed message").All() {
+		require.Equal(t, RouteQueued, e.ContextMap()["outcome"])
+	}
+	// B gets the last two offers, in order, when it connects
+	wsB := connectPeer(t, s, "B")
+	m := readUntil(t, wsB, "offer")
+	require.Equal(t, "second", m["offer"])
+	require.Equal(t, "A", m["source_fp"])
+	m = readUntil(t, wsB, "offer")
+	require.Equal(t, "third", m["offer"])
+	require.False(t, redisDouble.Exists("queue:B"))
+}
+func TestOfflineQueueTTL(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) {
+		c.OfflineQueue = 2
+		c.OfflineTTL = 1
+	})
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	a := &Conn{User: "j", FP: "A", Verified: true, ID: newConnID(),
+		send: make(chan outbound, SendBufSize)}
+	a.handleMessage(map[string]interface{}{"offer": "stale", "target": "B"})
+	require.True(t, redisDouble.Exists("queue:B"))
+	time.Sleep(1100 * time.Millisecond)
+	a.handleMessage(map[string]interface{}{"offer": "fresh", "target": "B"})
+	wsB := connectPeer(t, s, "B")
+	m := readUntil(t, wsB, "offer")
+	require.Equal(t, "fresh", m["offer"])
+}
+func TestDeliveredNotQueued(t *testing.T) {
+	startTest(t)
+	setConfig(t, func(c *Config) { c.OfflineQueue = 2 })
+	s := newTestServer(t)
+	seedPeer("A", "foo", "j", true)
+	seedPeer("B", "bar", "j", true)
+	wsA := connectPeer(t, s, "A")
+	wsB := connectPeer(t, s, "B")
+	// a stale presence, as its TTL lapsed, doesn't queue a delivered message
+	redisDouble.Del("online:B")
+	require.Nil(t, wsA.WriteJSON(map[string]interface{}{
+		"offer": "an offer", "target": "B"}))
+	m := readUntil(t, wsB, "offer")
+	require.Equal(t, "an offer", m["offer"])
+	require.False(t, redisDouble.Exists("queue:B"))
+}
@@ -0,0 +1,228 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets is the number of buckets that triggers a sweep of full
+// buckets, keeping the limiter's memory bounded
+const maxIdleBuckets = 4096
+
+// TokenBucket is a classic token bucket - it holds up to burst tokens and
+// refills at rate tokens per second
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: float64(burst),
+		tokens: float64(burst), last: time.Now()}
+}
+
+// Allow takes a token from the bucket, returning false if it's empty
+func (b *TokenBucket) Allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// IPLimiter keeps a token bucket per remote IP
+type IPLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*TokenBucket
+}
+
+// NewIPLimiter returns a limiter allowing each IP rate requests per second
+// with bursts of up to burst requests. A zero rate disables the limiter.
+func NewIPLimiter(rate float64, burst int) *IPLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &IPLimiter{rate: rate, burst: burst,
+		buckets: make(map[string]*TokenBucket)}
+}
+
+// Allow returns true if a request from ip is allowed
+func (l *IPLimiter) Allow(ip string) bool {
+	if l == nil || l.rate <= 0 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	b, found := l.buckets[ip]
+	if !found {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.sweep(now)
+		}
+		b = NewTokenBucket(l.rate, l.burst)
+		l.buckets[ip] = b
+	}
+	return b.Allow(now)
+}
+
+// sweep removes the buckets that have refilled, they hold no state
+func (l *IPLimiter) sweep(now time.Time) {
+	full := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// getClientIP returns the IP of the client sending the request. The
+// X-Forwarded-For & X-Real-IP headers are only read when the immediate peer
+// is a trusted proxy, otherwise they could be spoofed. X-Forwarded-For is
+// read from the right, skipping the trusted proxies, so the address is the
+// one the outermost trusted proxy saw.
+func getClientIP(r *http.Request, c *Config) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !c.trustsProxy(host) {
+		return host
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		ip := host
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !c.trustsProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return host
+}
+
+// parseCIDRs parses a list of CIDRs, a plain IP is a single address CIDR
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Bad IP %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Bad CIDR %q: %w", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// FlapGuard refuses the connections of a fingerprint that connected more than
+// max times in a window, until a cooldown passes. It protects the server
+// from a flapping device opening a socket on every network change.
+type FlapGuard struct {
+	sync.Mutex
+	max      int
+	window   time.Duration
+	cooldown time.Duration
+	fps      map[string]*flapState
+}
+
+type flapState struct {
+	// connects are the times of the connections in the window
+	connects []time.Time
+	// until is the end of the cooldown
+	until time.Time
+}
+
+// NewFlapGuard returns a guard allowing max connections of a fingerprint in
+// the window. A zero max disables the guard.
+func NewFlapGuard(max int, window time.Duration, cooldown time.Duration) *FlapGuard {
+	return &FlapGuard{max: max, window: window, cooldown: cooldown,
+		fps: make(map[string]*flapState)}
+}
+
+// Allow records a connection of the fingerprint. It returns zero when
+// allowed, or the time left until the fingerprint's cooldown ends.
+func (g *FlapGuard) Allow(fp string, now time.Time) time.Duration {
+	if g == nil || g.max <= 0 {
+		return 0
+	}
+	g.Lock()
+	defer g.Unlock()
+	s, found := g.fps[fp]
+	if !found {
+		if len(g.fps) >= maxIdleBuckets {
+			g.sweep(now)
+		}
+		s = &flapState{}
+		g.fps[fp] = s
+	}
+	if now.Before(s.until) {
+		return s.until.Sub(now)
+	}
+	kept := s.connects[:0]
+	for _, t := range s.connects {
+		if now.Sub(t) < g.window {
+			kept = append(kept, t)
+		}
+	}
+	s.connects = kept
+	if len(s.connects) >= g.max {
+		s.connects = nil
+		s.until = now.Add(g.cooldown)
+		return g.cooldown
+	}
+	s.connects = append(s.connects, now)
+	return 0
+}
+
+// sweep removes the fingerprints with no connections in the window and no
+// cooldown
+func (g *FlapGuard) sweep(now time.Time) {
+	for fp, s := range g.fps {
+		last := s.until
+		if n := len(s.connects); n > 0 && s.connects[n-1].Add(g.window).After(last) {
+			last = s.connects[n-1].Add(g.window)
+		}
+		if now.After(last) {
+			delete(g.fps, fp)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPLimiter(t *testing.T) {
+	l := NewIPLimiter(0.001, 3)
+	for i := 0; i < 3; i++ {
+		require.True(t, l.Allow("10.0.0.1"))
+	}
+	require.False(t, l.Allow("10.0.0.1"))
+	require.True(t, l.Allow("10.0.0.2"))
+	// a zero rate means no limits
+	l = NewIPLimiter(0, 1)
+	for i := 0; i < 10; i++ {
+		require.True(t, l.Allow("10.0.0.1"))
+	}
+}
+func TestGetClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.RemoteAddr = "192.168.1.1:4321"
+	r.Header.Set("X-Forwarded-For", "10.1.1.1, 172.16.0.1")
+	require.Equal(t, "192.168.1.1", getClientIP(r, &Config{}))
+	require.Equal(t, "10.1.1.1", getClientIP(r, &Config{TrustProxy: true}))
+	r.Header.Del("X-Forwarded-For")
+	require.Equal(t, "192.168.1.1", getClientIP(r, &Config{TrustProxy: true}))
+}
+func TestTrustedProxies(t *testing.T) {
+	nets, err := parseCIDRs([]string{"192.168.0.0/16", " 172.16.0.1", "::1"})
+	require.Nil(t, err)
+	c := &Config{trustedProxies: nets}
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.RemoteAddr = "192.168.1.1:4321"
+	// the trusted proxies are skipped, the spoofed left most hop is ignored
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 10.1.1.1, 172.16.0.1")
+	require.Equal(t, "10.1.1.1", getClientIP(r, c))
+	r.Header.Set("X-Forwarded-For", "172.16.0.1")
+	require.Equal(t, "172.16.0.1", getClientIP(r, c))
+	r.Header.Set("X-Forwarded-For", "not-an-ip, 10.1.1.1")
+	require.Equal(t, "10.1.1.1", getClientIP(r, c))
+	r.Header.Del("X-Forwarded-For")
+	r.Header.Set("X-Real-IP", "10.2.2.2")
+	require.Equal(t, "10.2.2.2", getClientIP(r, c))
+	r.Header.Set("X-Real-IP", "garbage")
+	require.Equal(t, "192.168.1.1", getClientIP(r, c))
+	// an untrusted source's headers are ignored
+	r.RemoteAddr = "10.9.9.9:4321"
+	r.Header.Set("X-Forwarded-For", "10.1.1.1")
+	r.Header.Set("X-Real-IP", "10.2.2.2")
+	require.Equal(t, "10.9.9.9", getClientIP(r, c))
+	r.RemoteAddr = "[::1]:4321"
+	require.Equal(t, "10.1.1.1", getClientIP(r, c))
+	_, err = parseCIDRs([]string{"10.0.0.0/33"})
+	require.NotNil(t, err)
+	_, err = parseCIDRs([]string{"proxy"})
+	require.NotNil(t, err)
+}
+func TestWSThrottling(t *testing.T) {
+	startTest(t)
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	setConfig(t, func(c *Config) {
+		c.WSRate = 0.001
+		c.WSBurst = 2
+		c.TrustProxy = true
+	})
+	u := "ws://127.0.0.1:17777/ws?fp=A&name=foo&kind=lay&email=j"
+	h := http.Header{"X-Forwarded-For": {"10.0.0.1"}}
+	for i := 0; i < 2; i++ {
+		ws, _, err := cstDialer.Dial(u, h)
+		require.Nil(t, err)
+		ws.Close()
+	}
+	_, resp, err := cstDialer.Dial(u, h)
+	require.NotNil(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	// a different IP is unaffected
+	ws, _, err := cstDialer.Dial(u, http.Header{"X-Forwarded-For": {"10.0.0.2"}})
+	require.Nil(t, err)
+	ws.Close()
+}
+func TestThrottlingSurvivesReload(t *testing.T) {
+	startTest(t)
+	orig := conf()
+	defer config.Store(orig)
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	f, err := os.CreateTemp("", "peerbook-conf")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.Close()
+	os.Setenv("PB_CONF", f.Name())
+	defer os.Unsetenv("PB_CONF")
+	load := func(conf string) {
+		require.Nil(t, os.WriteFile(f.Name(), []byte(conf), 0600))
+		require.Nil(t, reloadConfig())
+	}
+	load(`{"ws_rate": 0.001, "ws_burst": 2, "trust_proxy": true}`)
+	u := "ws://127.0.0.1:17777/ws?fp=A&name=foo&kind=lay&email=j"
+	h := http.Header{"X-Forwarded-For": {"10.0.0.3"}}
+	dial := func() int {
+		ws, resp, err := cstDialer.Dial(u, h)
+		if err != nil {
+			return resp.StatusCode
+		}
+		ws.Close()
+		return http.StatusSwitchingProtocols
+	}
+	for i := 0; i < 2; i++ {
+		require.Equal(t, http.StatusSwitchingProtocols, dial())
+	}
+	require.Equal(t, http.StatusTooManyRequests, dial())
+	// a reload keeps the throttling & the flaps, unless their settings change
+	flaps := conf().flaps
+	load(`{"ws_rate": 0.001, "ws_burst": 2, "trust_proxy": true, "banner": "hi"}`)
+	require.Equal(t, http.StatusTooManyRequests, dial())
+	require.Same(t, flaps, conf().flaps)
+	load(`{"ws_rate": 0.001, "ws_burst": 3, "trust_proxy": true}`)
+	require.Equal(t, http.StatusSwitchingProtocols, dial())
+}
+func TestWSThrottlingUntrustedSource(t *testing.T) {
+	startTest(t)
+	redisDouble.HSet("peer:A", "fp", "A", "name", "foo", "kind", "lay",
+		"user", "j", "verified", "1", "online", "0")
+	nets, err := parseCIDRs([]string{"10.0.0.0/8"})
+	require.Nil(t, err)
+	setConfig(t, func(c *Config) {
+		c.WSRate = 0.001
+		c.WSBurst = 2
+		c.trustedProxies = nets
+	})
+	// the test client isn't a trusted proxy, so a spoofed X-Forwarded-For
+	// doesn't escape the limit
+	u := "ws://127.0.0.1:17777/ws?fp=A&name=foo&kind=lay&email=j"
+	for i := 0; i < 2; i++ {
+		ws, _, err := cstDialer.Dial(u, http.Header{
+			"X-Forwarded-For": {fmt.Sprintf("10.0.0.%d", i)}})
+		require.Nil(t, err)
+		ws.Close()
+	}
+	_, resp, err := cstDialer.Dial(u, http.Header{"X-Forwarded-For": {"10.0.0.9"}})
+	require.NotNil(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+func TestFlapGuard(t *testing.T) {
+	g := NewFlapGuard(3, time.Minute, 30*time.Second)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		require.Zero(t, g.Allow("A", now.Add(time.Duration(i)*time.Second)))
+	}
+	require.Equal(t, 30*time.Second, g.Allow("A", now.Add(3*time.Second)))
+	require.Zero(t, g.Allow("B", now.Add(3*time.Second)))
+	require.Equal(t, 20*time.Second, g.Allow("A", now.Add(13*time.Second)))
+	// after the cooldown the count starts over
+	for i := 0; i < 3; i++ {
+		require.Zero(t, g.Allow("A", now.Add(33*time.Second)))
+	}
+	require.NotZero(t, g.Allow("A", now.Add(34*time.Second)))
+	// connections out of the window aren't counted
+	g = NewFlapGuard(2, time.Minute, time.Minute)
+	require.Zero(t, g.Allow("A", now))
+	require.Zero(t, g.Allow("A", now.Add(40*time.Second)))
+	require.Zero(t, g.Allow("A", now.Add(70*time.Second)))
+	require.NotZero(t, g.Allow("A", now.Add(80*time.Second)))
+	// a zero max means no limit
+	g = NewFlapGuard(0, time.Minute, time.Minute)
+	for i := 0; i < 10; i++ {
+		require.Zero(t, g.Allow("A", now))
+	}
+}
+func TestReconnectCooldown(t *testing.T) {
+	startTest(t)
+	seedPeer("A", "foo", "j", true)
+	setConfig(t, func(c *Config) {
+		c.ReconnectMax = 3
+		c.ReconnectCooldown = 1
+	})
+	s := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		connectPeer(t, s, "A").Close()
+	}
+	u := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?fp=A"
+	_, resp, err := cstDialer.Dial(u, nil)
+	require.NotNil(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+	// other peers aren't affected
+	seedPeer("B", "bar", "j", true)
+	connectPeer(t, s, "B").Close()
+	time.Sleep(1100 * time.Millisecond)
+	connectPeer(t, s, "A").Close()
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// DefaultReadPrimaryAfterWrite is the default milliseconds after a write in
+// which reads are from the primary
+const DefaultReadPrimaryAfterWrite = 1000
+
+// readCommands are the commands that don't write, all others mark the
+// primary as written to
+var readCommands = map[string]bool{
+	"": true, "PING": true, "GET": true, "EXISTS": true, "HGET": true,
+	"HMGET": true, "HGETALL": true, "SMEMBERS": true, "SISMEMBER": true,
+	"SCARD": true, "SSCAN": true, "SCAN": true, "TTL": true, "PTTL": true,
+	"LRANGE": true, "LLEN": true, "PUBLISH": true, "SUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "PSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+}
+
+// replicatedPrefixes are the prefixes of the keys read from the replica,
+// the writes of other keys aren't tracked
+var replicatedPrefixes = []string{"token:", "user:", "peer:"}
+
+// primaryConn is a connection to the primary that notes the keys written, so
+// reads that follow a write aren't served by a lagging replica
+type primaryConn struct {
+	redis.Conn
+	d *DBType
+}
+
+func (c *primaryConn) Send(cmd string, args ...interface{}) error {
+	c.d.noteWrite(cmd, args)
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *primaryConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.d.noteWrite(cmd, args)
+	return c.Conn.Do(cmd, args...)
+}
+
+// noteWrite stamps the time the replicated keys of a command were written
+func (d *DBType) noteWrite(cmd string, args []interface{}) {
+	if readCommands[cmd] || len(args) == 0 {
+		return
+	}
+	keys := args[:1]
+	if cmd == "DEL" || cmd == "UNLINK" {
+		keys = args
+	}
+	now := time.Now()
+	d.replicaM.Lock()
+	defer d.replicaM.Unlock()
+	if d.replica == nil {
+		return
+	}
+	for _, k := range keys {
+		if key, ok := k.(string); ok && isReplicated(key) {
+			if d.writes == nil {
+				d.writes = make(map[string]time.Time)
+			}
+			d.writes[key] = now
+		}
+	}
+	// forget the writes the replica caught up with
+	window := conf().readPrimaryAfterWrite()
+	if now.Sub(d.swept) > window {
+		for key, t := range d.writes {
+			if now.Sub(t) >= window {
+				delete(d.writes, key)
+			}
+		}
+		d.swept = now
+	}
+}
+
+// isReplicated returns whether a key is read from the replica
+func isReplicated(key string) bool {
+	for _, prefix := range replicatedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectReplica connects to a replica serving the reads of tokens, user
+// lists & peers, the rest are from the primary
+func (d *DBType) ConnectReplica(host string) error {
+	replica := newPool((&backoffDialer{host: host}).dial)
+	d.replicaM.Lock()
+	d.replica = replica
+	d.replicaM.Unlock()
+	return nil
+}
+
+// readConn returns a connection for reading a key that can lag behind the
+// primary, and whether it's to the replica. It's to the primary when
+// there's no replica or the key was written within
+// read_primary_after_write.
+func (d *DBType) readConn(key string) (redis.Conn, bool) {
+	d.replicaM.Lock()
+	replica := d.replica
+	written, found := d.writes[key]
+	d.replicaM.Unlock()
+	if replica == nil ||
+		(found && time.Since(written) < conf().readPrimaryAfterWrite()) {
+		return d.pool.Get(), false
+	}
+	return replica.Get(), true
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ClientOutdated is an error for a client older than min_client_version, or
+// with no version when one is required
+type ClientOutdated struct {
+	version string
+	min     string
+}
+
+func (e *ClientOutdated) Error() string {
+	if e.version == "" {
+		return fmt.Sprintf("Client version is missing, please upgrade to %s or later",
+			e.min)
+	}
+	return fmt.Sprintf("Client version %q is older than %s, please upgrade",
+		e.version, e.min)
+}
+
+// parseVersion parses a dotted version, e.g. "1.2.3" or "v1.2"
+func parseVersion(s string) ([]int, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	ret := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Bad version %q", s)
+		}
+		ret[i] = n
+	}
+	return ret, nil
+}
+
+// compareVersions returns -1, 0 or 1 as version a is older, the same or
+// newer than b. Missing parts are zeros, so "1.2" is "1.2.0".
+func compareVersions(a []int, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkClientVersion returns a *ClientOutdated when the client's version is
+// older than min_client_version. A missing version is refused only with
+// require_client_version set and a bad one is refused as outdated.
+func (c *Config) checkClientVersion(version string) error {
+	if c.MinClientVersion == "" {
+		return nil
+	}
+	if version == "" {
+		if c.RequireClientVersion {
+			return &ClientOutdated{"", c.MinClientVersion}
+		}
+		return nil
+	}
+	min, err := parseVersion(c.MinClientVersion)
+	if err != nil {
+		// it's checked when the configuration's loaded
+		return nil
+	}
+	v, err := parseVersion(version)
+	if err != nil || compareVersions(v, min) < 0 {
+		return &ClientOutdated{version, c.MinClientVersion}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 TUZIG LTD and peerbook Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultWebhookConcurrency is the number of webhooks posted at once
+	DefaultWebhookConcurrency = 4
+	// DefaultWebhookQueue is the number of webhooks waiting to be posted
+	DefaultWebhookQueue = 100
+	// WebhookSignatureHeader holds the hex HMAC-SHA256 of the webhook's
+	// body, keyed by the webhook secret
+	WebhookSignatureHeader = "X-Peerbook-Signature"
+	// webhookTimeout limits the time a webhook post takes
+	webhookTimeout = 10 * time.Second
+)
+
+// The types of the lifecycle events
+const (
+	EventPeerConnected    = "peer.connected"
+	EventPeerDisconnected = "peer.disconnected"
+)
+
+// droppedWebhooks counts the webhooks dropped as the queue was full, use
+// atomic to access
+var droppedWebhooks uint64
+
+// webhooks posts the lifecycle events, it's started by main
+var webhooks *WebhookPool
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// deliverWebhook posts a webhook's body, tests replace it
+var deliverWebhook = func(url string, body []byte, signature string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+signature)
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// LifecycleEvent is the body of the webhooks posted when a peer connects
+// or disconnects. Times are in unix milliseconds.
+type LifecycleEvent struct {
+	Type           string `json:"type"`
+	FP             string `json:"fp"`
+	User           string `json:"user,omitempty"`
+	Kind           string `json:"kind,omitempty"`
+	ConnID         string `json:"conn_id"`
+	ConnectedAt    int64  `json:"connected_at"`
+	DisconnectedAt int64  `json:"disconnected_at,omitempty"`
+	Time           int64  `json:"time"`
+}
+
+// webhook is a lifecycle event waiting to be posted
+type webhook struct {
+	url    string
+	secret string
+	event  *LifecycleEvent
+}
+
+// WebhookPool posts webhooks with a bounded number of workers, so a slow
+// receiver never holds the hub. Webhooks waiting for a worker are queued
+// and once the queue is full, new ones are dropped.
+type WebhookPool struct {
+	queue chan *webhook
+	wg    sync.WaitGroup
+}
+
+// NewWebhookPool returns a pool of workers posting webhooks and a queue of
+// the webhooks waiting for them. Use Stop() to stop it.
+func NewWebhookPool(workers int, queue int) *WebhookPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &WebhookPool{queue: make(chan *webhook, queue)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Send queues a webhook without blocking, it returns false when the queue
+// is full and the webhook is dropped
+func (p *WebhookPool) Send(w *webhook) bool {
+	select {
+	case p.queue <- w:
+		return true
+	default:
+		n := atomic.AddUint64(&droppedWebhooks, 1)
+		Logger.Warnf("Dropped a %s webhook of %q as the queue is full, %d dropped so far",
+			w.event.Type, w.event.FP, n)
+		return false
+	}
+}
+
+// Stop posts the queued webhooks and stops the workers
+func (p *WebhookPool) Stop() {
+	close(p.queue)
+	p.wg.Wait()
+}
+
+func (p *WebhookPool) work() {
+	defer p.wg.Done()
+	for w := range p.queue {
+		body, err := json.Marshal(w.event)
+		if err != nil {
+			Logger.Errorf("Failed to marshal a webhook: %s", err)
+			continue
+		}
+		if err = deliverWebhook(w.url, body, signWebhook(w.secret, body)); err != nil {
+			Logger.Warnf("Failed to post a %s webhook: %s", w.event.Type, err)
+		}
+	}
+}
+
+// signWebhook returns the hex HMAC-SHA256 of the body, empty when there's
+// no secret
+func signWebhook(secret string, body []byte) string {
+	if secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// fireLifecycle queues a connection's lifecycle event, a no-op when
+// there's no webhook. disconnected is zero for the connected event.
+func fireLifecycle(event string, c *Conn, disconnected time.Time) {
+	cfg := conf()
+	if cfg.WebhookURL == "" || webhooks == nil {
+		return
+	}
+	now := time.Now()
+	e := &LifecycleEvent{Type: event, FP: c.FP, User: c.User, Kind: c.Kind,
+		ConnID: c.ID, ConnectedAt: unixMilli(c.connectedAt), Time: unixMilli(now)}
+	if !disconnected.IsZero() {
+		e.DisconnectedAt = unixMilli(disconnected)
+	}
+	webhooks.Send(&webhook{cfg.WebhookURL, cfg.WebhookSecret, e})
+}
+
+// unixMilli returns t in unix milliseconds, zero for the zero time
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver starts a server receiving the webhooks, checks their
+// signature and returns the events it got
+func webhookReceiver(t *testing.T, secret string) (*httptest.Server, chan LifecycleEvent) {
+	events := make(chan LifecycleEvent, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)),
+			r.Header.Get(WebhookSignatureHeader))
+		var e LifecycleEvent
+		require.Nil(t, json.Unmarshal(body, &e))
+		events <- e
+	}))
+	t.Cleanup(s.Close)
+	return s, events
+}
+func TestLifecycleWebhooks(t *testing.T) {
+	startTest(t)
+	receiver, events := webhookReceiver(t, "s3cret")
+	setConfig(t, func(c *Config) {
+		c.WebhookURL = receiver.URL
+		c.WebhookSecret = "s3cret"
+	})
+	orig := webhooks
+	webhooks = NewWebhookPool(2, 10)
+	t.Cleanup(func() {
+		webhooks.Stop()
+		webhooks = orig
+	})
+	seedPeer("A", "foo", "j", true)
+	s := newTestServer(t)
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	ws := connectPeer(t, s, "A")
+	var connected LifecycleEvent
+	select {
+	case connected = <-events:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the connected webhook")
+	}
+	require.Equal(t, EventPeerConnected, connected.Type)
+	require.Equal(t, "A", connected.FP)
+	require.Equal(t, "j", connected.User)
+	require.Equal(t, "lay", connected.Kind)
+	require.NotEmpty(t, connected.ConnID)
+	require.True(t, connected.ConnectedAt >= before)
+	require.Zero(t, connected.DisconnectedAt)
+	ws.Close()
+	var disconnected LifecycleEvent
+	select {
+	case disconnected = <-events:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the disconnected webhook")
+	}
+	require.Equal(t, EventPeerDisconnected, disconnected.Type)
+	require.Equal(t, "A", disconnected.FP)
+	require.Equal(t, connected.ConnID, disconnected.ConnID)
+	require.Equal(t, connected.ConnectedAt, disconnected.ConnectedAt)
+	require.True(t, disconnected.DisconnectedAt >= connected.ConnectedAt)
+}
+func TestWebhookQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	origDeliver := deliverWebhook
+	deliverWebhook = func(url string, body []byte, signature string) error {
+		<-release
+		return nil
+	}
+	defer func() { deliverWebhook = origDeliver }()
+	p := NewWebhookPool(1, 1)
+	dropped := atomic.LoadUint64(&droppedWebhooks)
+	w := &webhook{"http://example.com", "", &LifecycleEvent{
+		Type: EventPeerConnected, FP: "A"}}
+	require.True(t, p.Send(w))
+	// wait for the worker to take the first webhook
+	require.Eventually(t, func() bool { return len(p.queue) == 0 },
+		time.Second, time.Millisecond)
+	require.True(t, p.Send(w))
+	require.False(t, p.Send(w))
+	require.Equal(t, dropped+1, atomic.LoadUint64(&droppedWebhooks))
+	close(release)
+	p.Stop()
+}